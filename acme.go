@@ -0,0 +1,778 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// Minimal ACME (RFC 8555) server issuing certificates from the regenerated
+// CA. Only what ACME clients need for issuance with HTTP-01 challenges is
+// implemented: no revocation, key rollover, pre-authorization or
+// external account binding. State is kept in memory.
+func runACMEServe(args []string) {
+	fs := flag.NewFlagSet("acme-serve", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	addr := fs.String("addr", "localhost:14000", "Address for the ACME server to listen on")
+	var hostnames stringList
+	fs.Var(&hostnames, "hostname", "DNS name or IP address clients use to reach the ACME server, can be repeated (default localhost)")
+	http01Port := fs.Int("http01-port", 80, "Port to connect to for HTTP-01 validation")
+	validity := fs.Duration("cert-validity", 90*24*time.Hour, "Validity of issued certificates")
+	registerShutdown(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() {
+		usageError("go run *.go acme-serve (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-addr host:port] [-hostname name]... [-http01-port 80] [-cert-validity 2160h]")
+	}
+	if len(hostnames) == 0 {
+		hostnames = stringList{"localhost"}
+	}
+
+	setup := regenerateCAs(caOpts)
+	serverCert, serverKey, err := issueServerCert(setup.newCA, setup.caKey, hostnames, caOpts.leaf)
+	if err != nil {
+		exitWith(exitRegenerationFailed, "Failed to generate server certificate", "error", err)
+	}
+	setup.serverCert, setup.serverKey = serverCert, serverKey
+
+	_, port, err := net.SplitHostPort(*addr)
+	if err != nil {
+		usageError("invalid -addr: " + err.Error())
+	}
+	acme := &acmeServer{
+		baseURL:    "https://" + net.JoinHostPort(hostnames[0], port),
+		ca:         setup.newCA,
+		caKey:      setup.caKey,
+		http01Port: *http01Port,
+		validity:   *validity,
+		nonces:     map[string]time.Time{},
+		accounts:   map[string]*acmeAccount{},
+		orders:     map[string]*acmeOrder{},
+		authzs:     map[string]*acmeAuthz{},
+		certs:      map[string][]byte{},
+	}
+
+	server := &http.Server{
+		Addr:      *addr,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{setup.serverTLSCertificate()}},
+		Handler:   acme.handler(),
+		ErrorLog:  serverErrorLog(),
+	}
+	slog.Info("ACME server started", "directory", acme.baseURL+"/directory", "ca_file", "new-ca.pem")
+	if err := serveUntilSignal(server); err != nil {
+		fatal("ACME server failed", "error", err)
+	}
+}
+
+// acmeNonceTTL is how long a nonce is accepted. Like other timeouts it
+// follows the system time, not -now.
+const acmeNonceTTL = 10 * time.Minute
+
+type acmeServer struct {
+	baseURL    string
+	ca         *x509.Certificate
+	caKey      crypto.Signer
+	http01Port int
+	validity   time.Duration
+
+	mu       sync.Mutex
+	nonces   map[string]time.Time
+	accounts map[string]*acmeAccount
+	orders   map[string]*acmeOrder
+	authzs   map[string]*acmeAuthz
+	certs    map[string][]byte
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status,omitempty"`
+}
+
+func (p *acmeProblem) Error() string {
+	return p.Detail
+}
+
+// acmeError returns a problem document of the given ACME error type.
+func acmeError(status int, errType, format string, args ...any) *acmeProblem {
+	return &acmeProblem{Type: "urn:ietf:params:acme:error:" + errType, Detail: fmt.Sprintf(format, args...), Status: status}
+}
+
+type acmeAccount struct {
+	ID         string
+	Key        crypto.PublicKey
+	Thumbprint string
+	Contact    []string
+}
+
+type acmeOrder struct {
+	ID          string
+	AccountID   string
+	Status      string
+	Expires     time.Time
+	Identifiers []acmeIdentifier
+	AuthzIDs    []string
+	CertID      string
+	Error       *acmeProblem
+}
+
+type acmeAuthz struct {
+	ID         string
+	AccountID  string
+	Identifier acmeIdentifier
+	Status     string
+	Expires    time.Time
+	Token      string
+	// Challenge state of the single http-01 challenge
+	ChallengeStatus string
+	Validated       time.Time
+	Error           *acmeProblem
+}
+
+func (s *acmeServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /directory", s.handleDirectory)
+	mux.HandleFunc("HEAD /new-nonce", s.handleNewNonce)
+	mux.HandleFunc("GET /new-nonce", s.handleNewNonce)
+	mux.HandleFunc("POST /new-account", s.post(s.handleNewAccount))
+	mux.HandleFunc("POST /account/{id}", s.post(s.handleAccount))
+	mux.HandleFunc("POST /new-order", s.post(s.handleNewOrder))
+	mux.HandleFunc("POST /order/{id}", s.post(s.handleOrder))
+	mux.HandleFunc("POST /order/{id}/finalize", s.post(s.handleFinalize))
+	mux.HandleFunc("POST /authz/{id}", s.post(s.handleAuthz))
+	mux.HandleFunc("POST /authz/{id}/http-01", s.post(s.handleChallenge))
+	mux.HandleFunc("POST /cert/{id}", s.post(s.handleCertificate))
+	return mux
+}
+
+func (s *acmeServer) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, map[string]any{
+		"newNonce":   s.baseURL + "/new-nonce",
+		"newAccount": s.baseURL + "/new-account",
+		"newOrder":   s.baseURL + "/new-order",
+		"meta": map[string]any{
+			"website": "https://github.com/databus23/ca-regen",
+		},
+	})
+}
+
+func (s *acmeServer) handleNewNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// acmeRequest is a verified JWS request. account is nil for requests
+// signed with an embedded JWK (newAccount).
+type acmeRequest struct {
+	payload []byte
+	jwk     crypto.PublicKey
+	account *acmeAccount
+}
+
+// post wraps the handler of a POST endpoint with the JWS verification and
+// the error reporting. The handler runs with s.mu held.
+func (s *acmeServer) post(handler func(w http.ResponseWriter, r *http.Request, req *acmeRequest) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// Every response carries a fresh nonce, including errors
+		w.Header().Set("Replay-Nonce", s.newNonceLocked())
+		req, err := s.verifyJWS(r)
+		if err == nil {
+			err = handler(w, r, req)
+		}
+		if err == nil {
+			return
+		}
+		problem, ok := err.(*acmeProblem)
+		if !ok {
+			problem = acmeError(http.StatusInternalServerError, "serverInternal", "%v", err)
+		}
+		slog.Debug("ACME request failed", "path", r.URL.Path, "error", problem.Detail)
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(problem.Status)
+		json.NewEncoder(w).Encode(problem)
+	}
+}
+
+// verifyJWS checks the flattened JWS of a request (RFC 8555, section 6.2).
+func (s *acmeServer) verifyJWS(r *http.Request) (*acmeRequest, error) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&jws); err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "invalid JWS: %v", err)
+	}
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "invalid protected header encoding")
+	}
+	var protected struct {
+		Alg   string          `json:"alg"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+		JWK   json.RawMessage `json:"jwk"`
+		KID   string          `json:"kid"`
+	}
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "invalid protected header: %v", err)
+	}
+
+	issued, ok := s.nonces[protected.Nonce]
+	delete(s.nonces, protected.Nonce)
+	if !ok || time.Since(issued) > acmeNonceTTL {
+		return nil, acmeError(http.StatusBadRequest, "badNonce", "invalid, reused or expired nonce")
+	}
+	if protected.URL != s.baseURL+r.URL.Path {
+		return nil, acmeError(http.StatusUnauthorized, "unauthorized", "JWS url %q does not match request URL", protected.URL)
+	}
+
+	req := &acmeRequest{}
+	var key crypto.PublicKey
+	switch {
+	case len(protected.JWK) > 0 && protected.KID == "":
+		key, err = parseJWK(protected.JWK)
+		if err != nil {
+			return nil, acmeError(http.StatusBadRequest, "malformed", "invalid JWK: %v", err)
+		}
+		req.jwk = key
+	case len(protected.JWK) == 0 && strings.HasPrefix(protected.KID, s.baseURL+"/account/"):
+		account := s.accounts[strings.TrimPrefix(protected.KID, s.baseURL+"/account/")]
+		if account == nil {
+			return nil, acmeError(http.StatusBadRequest, "accountDoesNotExist", "unknown account %s", protected.KID)
+		}
+		key = account.Key
+		req.account = account
+	default:
+		return nil, acmeError(http.StatusBadRequest, "malformed", "exactly one of jwk and kid is required")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "invalid signature encoding")
+	}
+	if err := verifyJWSSignature(protected.Alg, key, []byte(jws.Protected+"."+jws.Payload), signature); err != nil {
+		return nil, acmeError(http.StatusBadRequest, "badSignatureAlgorithm", "%v", err)
+	}
+	req.payload, err = base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, acmeError(http.StatusBadRequest, "malformed", "invalid payload encoding")
+	}
+	return req, nil
+}
+
+// parseJWK parses an RSA or EC public JSON Web Key.
+func parseJWK(data []byte) (crypto.PublicKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, err
+	}
+	decode := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	switch jwk.Kty {
+	case "RSA":
+		e := decode(jwk.E)
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: decode(jwk.N), E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		// Encode as uncompressed point so the coordinates get validated
+		size := (curve.Params().BitSize + 7) / 8
+		point := append([]byte{4}, append(decode(jwk.X).FillBytes(make([]byte, size)), decode(jwk.Y).FillBytes(make([]byte, size))...)...)
+		return ecdsa.ParseUncompressedPublicKey(curve, point)
+	}
+	return nil, fmt.Errorf("%w %q", caregen.ErrUnsupportedKeyType, jwk.Kty)
+}
+
+// jwkThumbprint returns the RFC 7638 thumbprint of a public key, used in
+// the key authorization of challenges.
+func jwkThumbprint(key crypto.PublicKey) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	var canonical string
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, b64(big.NewInt(int64(k.E)).Bytes()), b64(k.N.Bytes()))
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, k.Curve.Params().Name, b64(k.X.FillBytes(make([]byte, size))), b64(k.Y.FillBytes(make([]byte, size))))
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return b64(sum[:])
+}
+
+// verifyJWSSignature checks a JWS signature with one of the algorithms
+// used by common ACME clients.
+func verifyJWSSignature(alg string, key crypto.PublicKey, input, signature []byte) error {
+	var hash crypto.Hash
+	var digest []byte
+	switch alg {
+	case "RS256", "ES256":
+		sum := sha256.Sum256(input)
+		hash, digest = crypto.SHA256, sum[:]
+	case "ES384":
+		sum := sha512.Sum384(input)
+		hash, digest = crypto.SHA384, sum[:]
+	default:
+		return fmt.Errorf("unsupported JWS algorithm %s", alg)
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("algorithm %s does not match RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, signature); err != nil {
+			return fmt.Errorf("invalid JWS signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg == "RS256" || len(signature) != 2*size {
+			return fmt.Errorf("algorithm %s does not match EC key", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		sig := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, sig) {
+			return fmt.Errorf("invalid JWS signature")
+		}
+	default:
+		return fmt.Errorf("%w %T", caregen.ErrUnsupportedKeyType, key)
+	}
+	return nil
+}
+
+func (s *acmeServer) handleNewAccount(w http.ResponseWriter, r *http.Request, req *acmeRequest) error {
+	if req.jwk == nil {
+		return acmeError(http.StatusBadRequest, "malformed", "newAccount requests must use jwk")
+	}
+	var payload struct {
+		Contact            []string `json:"contact"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "invalid newAccount payload: %v", err)
+	}
+
+	thumbprint := jwkThumbprint(req.jwk)
+	for _, account := range s.accounts {
+		if account.Thumbprint == thumbprint {
+			w.Header().Set("Location", s.baseURL+"/account/"+account.ID)
+			s.writeJSON(w, http.StatusOK, s.accountJSON(account))
+			return nil
+		}
+	}
+	if payload.OnlyReturnExisting {
+		return acmeError(http.StatusBadRequest, "accountDoesNotExist", "no account for this key")
+	}
+
+	account := &acmeAccount{ID: randomID(), Key: req.jwk, Thumbprint: thumbprint, Contact: payload.Contact}
+	s.accounts[account.ID] = account
+	slog.Info("ACME account created", "account", account.ID, "contact", strings.Join(account.Contact, ","))
+	w.Header().Set("Location", s.baseURL+"/account/"+account.ID)
+	s.writeJSON(w, http.StatusCreated, s.accountJSON(account))
+	return nil
+}
+
+func (s *acmeServer) handleAccount(w http.ResponseWriter, r *http.Request, req *acmeRequest) error {
+	if req.account == nil || req.account.ID != r.PathValue("id") {
+		return acmeError(http.StatusUnauthorized, "unauthorized", "account mismatch")
+	}
+	s.writeJSON(w, http.StatusOK, s.accountJSON(req.account))
+	return nil
+}
+
+func (s *acmeServer) accountJSON(account *acmeAccount) map[string]any {
+	return map[string]any{
+		"status":  "valid",
+		"contact": account.Contact,
+		"orders":  s.baseURL + "/account/" + account.ID + "/orders",
+	}
+}
+
+func (s *acmeServer) handleNewOrder(w http.ResponseWriter, r *http.Request, req *acmeRequest) error {
+	if req.account == nil {
+		return acmeError(http.StatusBadRequest, "malformed", "newOrder requests must use kid")
+	}
+	var payload struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil || len(payload.Identifiers) == 0 {
+		return acmeError(http.StatusBadRequest, "malformed", "invalid newOrder payload")
+	}
+
+	order := &acmeOrder{
+		ID:        randomID(),
+		AccountID: req.account.ID,
+		Status:    "pending",
+		Expires:   now.Now().Add(24 * time.Hour),
+	}
+	for _, id := range payload.Identifiers {
+		id.Value = strings.ToLower(id.Value)
+		if id.Type != "dns" {
+			return acmeError(http.StatusBadRequest, "unsupportedIdentifier", "identifier type %q is not supported", id.Type)
+		}
+		if strings.HasPrefix(id.Value, "*.") {
+			return acmeError(http.StatusBadRequest, "rejectedIdentifier", "wildcard names need DNS-01 validation, which is not supported")
+		}
+		authz := &acmeAuthz{
+			ID:              randomID(),
+			AccountID:       req.account.ID,
+			Identifier:      id,
+			Status:          "pending",
+			Expires:         order.Expires,
+			Token:           randomID() + randomID(),
+			ChallengeStatus: "pending",
+		}
+		s.authzs[authz.ID] = authz
+		order.Identifiers = append(order.Identifiers, id)
+		order.AuthzIDs = append(order.AuthzIDs, authz.ID)
+	}
+	s.orders[order.ID] = order
+
+	slog.Info("ACME order created", "order", order.ID, "names", strings.Join(orderNames(order), ","))
+	w.Header().Set("Location", s.baseURL+"/order/"+order.ID)
+	s.writeJSON(w, http.StatusCreated, s.orderJSON(order))
+	return nil
+}
+
+func (s *acmeServer) handleOrder(w http.ResponseWriter, r *http.Request, req *acmeRequest) error {
+	order, err := s.lookupOrder(r, req)
+	if err != nil {
+		return err
+	}
+	s.writeJSON(w, http.StatusOK, s.orderJSON(order))
+	return nil
+}
+
+func (s *acmeServer) lookupOrder(r *http.Request, req *acmeRequest) (*acmeOrder, error) {
+	order := s.orders[r.PathValue("id")]
+	if order == nil || req.account == nil || order.AccountID != req.account.ID {
+		return nil, acmeError(http.StatusNotFound, "malformed", "unknown order")
+	}
+	s.updateOrderStatus(order)
+	return order, nil
+}
+
+// updateOrderStatus moves a pending order to ready or invalid once all of
+// its authorizations are final.
+func (s *acmeServer) updateOrderStatus(order *acmeOrder) {
+	if order.Status != "pending" {
+		return
+	}
+	ready := true
+	for _, id := range order.AuthzIDs {
+		switch s.authzs[id].Status {
+		case "invalid":
+			order.Status = "invalid"
+			return
+		case "valid":
+		default:
+			ready = false
+		}
+	}
+	if ready {
+		order.Status = "ready"
+	}
+}
+
+func (s *acmeServer) orderJSON(order *acmeOrder) map[string]any {
+	var authzURLs []string
+	for _, id := range order.AuthzIDs {
+		authzURLs = append(authzURLs, s.baseURL+"/authz/"+id)
+	}
+	result := map[string]any{
+		"status":         order.Status,
+		"expires":        order.Expires.UTC().Format(time.RFC3339),
+		"identifiers":    order.Identifiers,
+		"authorizations": authzURLs,
+		"finalize":       s.baseURL + "/order/" + order.ID + "/finalize",
+	}
+	if order.CertID != "" {
+		result["certificate"] = s.baseURL + "/cert/" + order.CertID
+	}
+	if order.Error != nil {
+		result["error"] = order.Error
+	}
+	return result
+}
+
+func (s *acmeServer) handleAuthz(w http.ResponseWriter, r *http.Request, req *acmeRequest) error {
+	authz := s.authzs[r.PathValue("id")]
+	if authz == nil || req.account == nil || authz.AccountID != req.account.ID {
+		return acmeError(http.StatusNotFound, "malformed", "unknown authorization")
+	}
+	s.writeJSON(w, http.StatusOK, map[string]any{
+		"status":     authz.Status,
+		"expires":    authz.Expires.UTC().Format(time.RFC3339),
+		"identifier": authz.Identifier,
+		"challenges": []any{s.challengeJSON(authz)},
+	})
+	return nil
+}
+
+func (s *acmeServer) challengeJSON(authz *acmeAuthz) map[string]any {
+	result := map[string]any{
+		"type":   "http-01",
+		"url":    s.baseURL + "/authz/" + authz.ID + "/http-01",
+		"token":  authz.Token,
+		"status": authz.ChallengeStatus,
+	}
+	if !authz.Validated.IsZero() {
+		result["validated"] = authz.Validated.UTC().Format(time.RFC3339)
+	}
+	if authz.Error != nil {
+		result["error"] = authz.Error
+	}
+	return result
+}
+
+// handleChallenge starts the HTTP-01 validation of an authorization. The
+// validation runs in the background; clients poll the authorization.
+func (s *acmeServer) handleChallenge(w http.ResponseWriter, r *http.Request, req *acmeRequest) error {
+	authz := s.authzs[r.PathValue("id")]
+	if authz == nil || req.account == nil || authz.AccountID != req.account.ID {
+		return acmeError(http.StatusNotFound, "malformed", "unknown challenge")
+	}
+	// An empty payload polls, "{}" responds to the challenge
+	if len(bytes.TrimSpace(req.payload)) > 0 && authz.ChallengeStatus == "pending" {
+		authz.ChallengeStatus = "processing"
+		keyAuthorization := authz.Token + "." + req.account.Thumbprint
+		go s.validateHTTP01(authz, keyAuthorization)
+	}
+	w.Header().Add("Link", "<"+s.baseURL+"/authz/"+authz.ID+`>;rel="up"`)
+	s.writeJSON(w, http.StatusOK, s.challengeJSON(authz))
+	return nil
+}
+
+func (s *acmeServer) validateHTTP01(authz *acmeAuthz, keyAuthorization string) {
+	url := "http://" + net.JoinHostPort(authz.Identifier.Value, strconv.Itoa(s.http01Port)) + "/.well-known/acme-challenge/" + authz.Token
+	err := fetchHTTP01(url, keyAuthorization)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		authz.Status, authz.ChallengeStatus = "invalid", "invalid"
+		authz.Error = acmeError(http.StatusForbidden, "incorrectResponse", "%v", err)
+		slog.Warn("HTTP-01 validation failed", "name", authz.Identifier.Value, "error", err)
+		return
+	}
+	authz.Status, authz.ChallengeStatus = "valid", "valid"
+	authz.Validated = now.Now()
+	slog.Info("HTTP-01 validation succeeded", "name", authz.Identifier.Value)
+}
+
+func fetchHTTP01(url, keyAuthorization string) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", url, err)
+	}
+	if got := strings.TrimSpace(string(body)); got != keyAuthorization {
+		return fmt.Errorf("%s returned %q, expected the key authorization %q", url, got, keyAuthorization)
+	}
+	return nil
+}
+
+func (s *acmeServer) handleFinalize(w http.ResponseWriter, r *http.Request, req *acmeRequest) error {
+	order, err := s.lookupOrder(r, req)
+	if err != nil {
+		return err
+	}
+	if order.Status != "ready" {
+		return acmeError(http.StatusForbidden, "orderNotReady", "order is %s", order.Status)
+	}
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "invalid finalize payload: %v", err)
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "badCSR", "invalid CSR encoding")
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "badCSR", "invalid CSR: %v", err)
+	}
+
+	// The CSR must request exactly the names of the order
+	names := append([]string{}, csr.DNSNames...)
+	if csr.Subject.CommonName != "" && !containsString(names, strings.ToLower(csr.Subject.CommonName)) {
+		names = append(names, csr.Subject.CommonName)
+	}
+	for i := range names {
+		names[i] = strings.ToLower(names[i])
+	}
+	sort.Strings(names)
+	want := orderNames(order)
+	sort.Strings(want)
+	if strings.Join(names, ",") != strings.Join(want, ",") || len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return acmeError(http.StatusBadRequest, "badCSR", "CSR names %v do not match the order identifiers %v", names, want)
+	}
+
+	cert, err := s.issue(csr, want)
+	if err != nil {
+		order.Status = "invalid"
+		order.Error = acmeError(http.StatusInternalServerError, "serverInternal", "issuance failed: %v", err)
+		return order.Error
+	}
+	order.CertID = randomID()
+	order.Status = "valid"
+	s.certs[order.CertID] = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Raw})...)
+	slog.Info("Issued certificate", "order", order.ID, "names", strings.Join(want, ","), "serial", x509util.FormatHex(cert.SerialNumber.Bytes()))
+
+	w.Header().Set("Location", s.baseURL+"/order/"+order.ID)
+	s.writeJSON(w, http.StatusOK, s.orderJSON(order))
+	return nil
+}
+
+// issue signs a certificate for the CSR's key with the regenerated CA.
+func (s *acmeServer) issue(csr *x509.CertificateRequest, names []string) (*x509.Certificate, error) {
+	serialNumber, err := newSerialNumber(s.ca)
+	if err != nil {
+		return nil, err
+	}
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template := &x509.Certificate{
+		SerialNumber:       serialNumber,
+		Subject:            pkix.Name{CommonName: names[0]},
+		DNSNames:           names,
+		NotBefore:          now.Now().Add(-time.Minute),
+		NotAfter:           now.Now().Add(s.validity),
+		KeyUsage:           keyUsage,
+		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		SignatureAlgorithm: x509util.SignatureAlgorithmFor(s.caKey, x509.UnknownSignatureAlgorithm),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return recordCertificate("issue", der)
+}
+
+func (s *acmeServer) handleCertificate(w http.ResponseWriter, r *http.Request, req *acmeRequest) error {
+	chain, ok := s.certs[r.PathValue("id")]
+	if !ok || req.account == nil {
+		return acmeError(http.StatusNotFound, "malformed", "unknown certificate")
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(chain)
+	return nil
+}
+
+func orderNames(order *acmeOrder) []string {
+	var names []string
+	for _, id := range order.Identifiers {
+		names = append(names, id.Value)
+	}
+	return names
+}
+
+func (s *acmeServer) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Link", "<"+s.baseURL+`/directory>;rel="index"`)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *acmeServer) newNonce() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newNonceLocked()
+}
+
+// newNonceLocked returns a fresh nonce and drops the expired ones, which
+// clients fetched but never used.
+func (s *acmeServer) newNonceLocked() string {
+	for nonce, issued := range s.nonces {
+		if time.Since(issued) > acmeNonceTTL {
+			delete(s.nonces, nonce)
+		}
+	}
+	nonce := randomID()
+	s.nonces[nonce] = time.Now()
+	return nonce
+}
+
+// randomID returns a random URL-safe identifier.
+func randomID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
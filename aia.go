@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// aiaFetch makes the verifying clients fetch intermediates missing from a
+// chain via the CA Issuers URL of the authority information access
+// extension, like browsers do, if -aia-fetch is given.
+var aiaFetch bool
+
+// maxAIAFetches limits how many certificates are fetched for one chain.
+const maxAIAFetches = 5
+
+// registerAIAFetch registers the -aia-fetch flag.
+func registerAIAFetch(fs *flag.FlagSet) {
+	fs.BoolVar(&aiaFetch, "aia-fetch", false, "Fetch intermediates missing from a chain via their CA Issuers URL like browsers, and warn when a chain only verifies with them")
+}
+
+// verifyWithAIA verifies the presented chain, leaf first, with opts. If
+// it only fails for an unknown authority, the missing intermediates are
+// fetched via AIA and the chain is verified again with them. The fetched
+// certificates are returned, so callers can tell that Go's client, which
+// does not fetch them, would reject the chain.
+func verifyWithAIA(presented []*x509.Certificate, opts x509.VerifyOptions) ([][]*x509.Certificate, []*x509.Certificate, error) {
+	if opts.Intermediates == nil {
+		opts.Intermediates = x509.NewCertPool()
+	}
+	for _, cert := range presented[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := presented[0].Verify(opts)
+	var unknownAuthority x509.UnknownAuthorityError
+	if err == nil || !errors.As(err, &unknownAuthority) {
+		return chains, nil, err
+	}
+	fetched, fetchErr := fetchAIAIntermediates(presented)
+	if len(fetched) == 0 {
+		if fetchErr != nil {
+			err = fmt.Errorf("%w (fetching intermediates via AIA failed: %v)", err, fetchErr)
+		}
+		return nil, nil, err
+	}
+	for _, cert := range fetched {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err = presented[0].Verify(opts)
+	if err != nil {
+		return nil, fetched, err
+	}
+	return chains, fetched, nil
+}
+
+// fetchAIAIntermediates follows the issuers from the leaf through the
+// presented certificates and fetches the first missing one, and its
+// issuers, from their CA Issuers URLs until a self-signed certificate or
+// one without URL is reached.
+func fetchAIAIntermediates(presented []*x509.Certificate) ([]*x509.Certificate, error) {
+	var fetched []*x509.Certificate
+	cert := presented[0]
+	for range maxAIAFetches + len(presented) {
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+			return fetched, nil
+		}
+		if issuer, _ := x509util.FindIssuer(cert, slices.Concat(presented, fetched)); issuer != nil && issuer != cert {
+			cert = issuer
+			continue
+		}
+		if len(fetched) == maxAIAFetches || len(cert.IssuingCertificateURL) == 0 {
+			return fetched, nil
+		}
+		issuer, err := fetchIssuer(cert)
+		if err != nil {
+			return fetched, err
+		}
+		slog.Debug("Fetched intermediate via AIA", "subject", issuer.Subject.String(), "for", cert.Subject.String())
+		fetched = append(fetched, issuer)
+		cert = issuer
+	}
+	return fetched, nil
+}
+
+// fetchIssuer fetches the issuer of cert from the first of its CA Issuers
+// URLs which returns a certificate having signed it. Like browsers only
+// HTTP URLs are used.
+func fetchIssuer(cert *x509.Certificate) (*x509.Certificate, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	var errs []error
+	for _, url := range cert.IssuingCertificateURL {
+		if !strings.HasPrefix(url, "http://") {
+			errs = append(errs, fmt.Errorf("%s: only http CA Issuers URLs are fetched", url))
+			continue
+		}
+		certs, err := fetchCertificates(client, url)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", url, err))
+			continue
+		}
+		for _, issuer := range certs {
+			if issuedBy(cert, issuer) {
+				return issuer, nil
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s: no certificate which issued %s", url, x509util.DescribeCert(cert)))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// fetchCertificates fetches the certificates at a CA Issuers URL, which is
+// a DER encoded certificate or a certs-only PKCS#7 message, or in
+// practice sometimes PEM.
+func fetchCertificates(client *http.Client, url string) ([]*x509.Certificate, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if certs, err := parseCertsOnlyPKCS7(data); err == nil {
+		return certs, nil
+	}
+	return parseCertificates(data)
+}
+
+// aiaVerifyConnection returns a VerifyConnection callback for clients
+// with InsecureSkipVerify, which verifies the chain against roots and
+// hostname like the default verification but fetches missing
+// intermediates via AIA, logging a warning when it has to.
+func aiaVerifyConnection(roots *x509.CertPool, hostname, caName string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("the server presented no certificate")
+		}
+		_, fetched, err := verifyWithAIA(state.PeerCertificates, x509.VerifyOptions{
+			Roots:       roots,
+			DNSName:     hostname,
+			CurrentTime: now.Now(),
+		})
+		if err != nil {
+			return &tls.CertificateVerificationError{UnverifiedCertificates: state.PeerCertificates, Err: err}
+		}
+		if len(fetched) > 0 {
+			warnAIAOnly(fetched, "ca", caName)
+		}
+		return nil
+	}
+}
+
+// warnAIAOnly warns that a chain only verified with intermediates fetched
+// via AIA.
+func warnAIAOnly(fetched []*x509.Certificate, args ...any) {
+	var subjects []string
+	for _, cert := range fetched {
+		subjects = append(subjects, cert.Subject.String())
+	}
+	slog.Warn("The chain only verifies with intermediates fetched via AIA: browsers accept it, but Go, OpenSSL and curl clients reject it; send the intermediates along", append(args, "fetched", strings.Join(subjects, "; "))...)
+}
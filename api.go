@@ -0,0 +1,518 @@
+package main
+
+import (
+	"crypto"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// REST and gRPC management API, so internal portals can regenerate CAs and issue
+// certificates from them without running the tool. CAs are uploaded along
+// with their key and only kept in memory, identified by a random ID.
+func runAPI(args []string) {
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:8080", "Address for the API server to listen on")
+	token := fs.String("token", "", "Bearer token required for every request")
+	insecureNoAuth := fs.Bool("insecure-no-auth", false, "Accept every request without -token, to anyone who can reach -addr")
+	tlsCert := fs.String("tls-cert", "", "PEM encoded certificate to serve the API via TLS with")
+	tlsKey := fs.String("tls-key", "", "PEM encoded private key of -tls-cert")
+	registerAudit(fs)
+	registerWebhook(fs)
+	registerCertDB(fs)
+	registerSerials(fs)
+	registerShutdown(fs)
+	registerPublicSuffixList(fs, nil)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	const usage = "go run *.go api [-addr host:port] (-token <token> | -insecure-no-auth) [-tls-cert cert.pem -tls-key key.pem] [-v|-q] [-log-format text|json]"
+	if (*tlsCert == "") != (*tlsKey == "") {
+		usageError(usage)
+	}
+	switch {
+	case *token == "" && !*insecureNoAuth:
+		// The API signs with the uploaded CA keys for anyone it accepts
+		usageError("-token is required to authenticate requests, or -insecure-no-auth to accept every request")
+	case *token != "" && *insecureNoAuth:
+		usageError("-insecure-no-auth cannot be combined with -token")
+	case *insecureNoAuth:
+		slog.Warn("No -token given, every request will be accepted")
+	}
+	if *tlsCert == "" {
+		slog.Warn("No -tls-cert given, CA keys are uploaded unencrypted")
+	}
+
+	api := &apiServer{token: *token, cas: map[string]*apiCA{}}
+	server := &http.Server{Addr: *addr, Handler: api.handler(), ErrorLog: serverErrorLog(), Protocols: new(http.Protocols)}
+	// gRPC clients use HTTP/2, without TLS in its cleartext form (h2c)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			fatal("Failed to load TLS certificate", "error", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		slog.Info("API server started", "url", "https://"+*addr+"/v1/cas")
+	} else {
+		slog.Info("API server started", "url", "http://"+*addr+"/v1/cas")
+	}
+	if err := serveUntilSignal(server); err != nil {
+		fatal("API server failed", "error", err)
+	}
+}
+
+// apiServer implements the operations of the management API independent
+// of the transport.
+type apiServer struct {
+	token string
+	mu    sync.Mutex
+	cas   map[string]*apiCA
+}
+
+type apiCA struct {
+	id          string
+	original    *x509.Certificate
+	key         crypto.Signer
+	regenerated *x509.Certificate
+	issued      []*x509.Certificate
+}
+
+type apiUploadRequest struct {
+	// Certificate is the PEM encoded CA certificate, Key its PEM encoded
+	// private key. Certificate may hold a bundle of both.
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+}
+
+type apiRegenerateRequest struct {
+	// Subject renames the regenerated CA, like -ca-subject.
+	Subject       string `json:"subject"`
+	Deterministic bool   `json:"deterministic"`
+}
+
+type apiIssueRequest struct {
+	// CSR is a PEM encoded request to sign. Without one a key is
+	// generated for a server certificate for Hostnames.
+	CSR       string   `json:"csr"`
+	Hostnames []string `json:"hostnames"`
+	// Profile is a built-in profile for CSRs, server by default.
+	Profile  string `json:"profile"`
+	Validity string `json:"validity"`
+}
+
+type apiVerifyRequest struct {
+	// Certificate is the PEM encoded certificate to verify, followed by
+	// its intermediates.
+	Certificate string `json:"certificate"`
+	Hostname    string `json:"hostname"`
+}
+
+type apiCAResponse struct {
+	ID          string                    `json:"id"`
+	Subject     string                    `json:"subject"`
+	Original    string                    `json:"original"`
+	Regenerated string                    `json:"regenerated,omitempty"`
+	Issued      []*apiCertificateResponse `json:"issued"`
+}
+
+type apiCertificateResponse struct {
+	Serial      string    `json:"serial"`
+	Subject     string    `json:"subject"`
+	NotAfter    time.Time `json:"not_after"`
+	Certificate string    `json:"certificate"`
+	// Key is only returned once, when it is generated.
+	Key string `json:"key,omitempty"`
+}
+
+// apiVerifyResult is the outcome of verifying a certificate with the
+// original or the regenerated CA as trust root.
+type apiVerifyResult struct {
+	CA    string `json:"ca"`
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+	// Causes are the problems the chain analysis found.
+	Causes []string `json:"causes,omitempty"`
+}
+
+// apiError is an error of an API operation with its HTTP status.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// grpcCode maps the HTTP status to the gRPC status code.
+func (e *apiError) grpcCode() int {
+	switch e.status {
+	case http.StatusBadRequest:
+		return 3 // INVALID_ARGUMENT
+	case http.StatusUnauthorized:
+		return 16 // UNAUTHENTICATED
+	case http.StatusNotFound:
+		return 5 // NOT_FOUND
+	case http.StatusConflict:
+		return 9 // FAILED_PRECONDITION
+	default:
+		return 13 // INTERNAL
+	}
+}
+
+func apiErrorf(status int, format string, args ...any) error {
+	return &apiError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/cas", s.endpoint(func(r *http.Request) (int, any, error) {
+		var req apiUploadRequest
+		if err := decodeAPIRequest(r, &req); err != nil {
+			return 0, nil, err
+		}
+		ca, err := s.uploadCA(req)
+		return http.StatusCreated, ca, err
+	}))
+	mux.HandleFunc("GET /v1/cas", s.endpoint(func(r *http.Request) (int, any, error) {
+		return http.StatusOK, s.listCAs(), nil
+	}))
+	mux.HandleFunc("GET /v1/cas/{id}", s.endpoint(func(r *http.Request) (int, any, error) {
+		ca, err := s.getCA(r.PathValue("id"))
+		return http.StatusOK, ca, err
+	}))
+	mux.HandleFunc("DELETE /v1/cas/{id}", s.endpoint(func(r *http.Request) (int, any, error) {
+		return http.StatusNoContent, nil, s.deleteCA(r.PathValue("id"))
+	}))
+	mux.HandleFunc("POST /v1/cas/{id}/regenerate", s.endpoint(func(r *http.Request) (int, any, error) {
+		var req apiRegenerateRequest
+		if err := decodeAPIRequest(r, &req); err != nil {
+			return 0, nil, err
+		}
+		ca, err := s.regenerate(r.PathValue("id"), req)
+		return http.StatusOK, ca, err
+	}))
+	mux.HandleFunc("POST /v1/cas/{id}/certificates", s.endpoint(func(r *http.Request) (int, any, error) {
+		var req apiIssueRequest
+		if err := decodeAPIRequest(r, &req); err != nil {
+			return 0, nil, err
+		}
+		cert, err := s.issue(r.PathValue("id"), req)
+		return http.StatusCreated, cert, err
+	}))
+	mux.HandleFunc("POST /v1/cas/{id}/verify", s.endpoint(func(r *http.Request) (int, any, error) {
+		var req apiVerifyRequest
+		if err := decodeAPIRequest(r, &req); err != nil {
+			return 0, nil, err
+		}
+		results, err := s.verify(r.PathValue("id"), req)
+		return http.StatusOK, results, err
+	}))
+	s.registerGRPC(mux)
+	return mux
+}
+
+// endpoint wraps an operation with the authentication and the JSON
+// encoding of its result or error.
+func (s *apiServer) endpoint(operation func(r *http.Request) (int, any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, result, err := http.StatusUnauthorized, any(nil), s.authenticate(r.Header.Get("Authorization"))
+		if err == nil {
+			status, result, err = operation(r)
+		}
+		if err != nil {
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) {
+				apiErr = &apiError{status: http.StatusInternalServerError, message: err.Error()}
+			}
+			slog.Debug("API request failed", "method", r.Method, "path", r.URL.Path, "error", apiErr.message)
+			status, result = apiErr.status, map[string]string{"error": apiErr.message}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if result != nil {
+			json.NewEncoder(w).Encode(result)
+		}
+	}
+}
+
+// authenticate checks the Authorization header value of a request.
+func (s *apiServer) authenticate(authorization string) error {
+	if s.token == "" {
+		return nil
+	}
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		return apiErrorf(http.StatusUnauthorized, "a valid bearer token is required")
+	}
+	return nil
+}
+
+// decodeAPIRequest decodes the JSON body of r into v. An empty body leaves
+// v unchanged.
+func decodeAPIRequest(r *http.Request, v any) error {
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(v)
+	if err != nil && err != io.EOF {
+		return apiErrorf(http.StatusBadRequest, "invalid request: %v", err)
+	}
+	return nil
+}
+
+func (s *apiServer) uploadCA(req apiUploadRequest) (*apiCAResponse, error) {
+	keyPEM := req.Key
+	if keyPEM == "" {
+		keyPEM = req.Certificate
+	}
+	cert, key, _, err := parseCA([]byte(req.Certificate), []byte(keyPEM))
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "invalid CA: %v", err)
+	}
+	if err := checkOriginalCABasicConstraints(cert); err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ca := &apiCA{id: randomID(), original: cert, key: key}
+	s.cas[ca.id] = ca
+	slog.Info("Uploaded CA", "id", ca.id, "subject", cert.Subject.String())
+	return ca.response(), nil
+}
+
+func (s *apiServer) listCAs() []*apiCAResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cas := []*apiCAResponse{}
+	for _, ca := range s.cas {
+		cas = append(cas, ca.response())
+	}
+	sort.Slice(cas, func(i, j int) bool { return cas[i].ID < cas[j].ID })
+	return cas
+}
+
+func (s *apiServer) getCA(id string) (*apiCAResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ca, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	return ca.response(), nil
+}
+
+func (s *apiServer) deleteCA(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.lookup(id); err != nil {
+		return err
+	}
+	delete(s.cas, id)
+	slog.Info("Deleted CA", "id", id)
+	return nil
+}
+
+// regenerate regenerates the CA with critical basic constraints, like the
+// default mode. Regenerating again replaces the regenerated CA.
+func (s *apiServer) regenerate(id string, req apiRegenerateRequest) (*apiCAResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ca, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := caOptions{deterministic: req.Deterministic}
+	if req.Subject != "" {
+		if err := opts.caSubject.Set(req.Subject); err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "invalid subject: %v", err)
+		}
+	}
+	regenerated, err := opts.regenerate(ca.original, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	ca.regenerated = regenerated
+	slog.Info("Regenerated CA", "id", id, "subject", regenerated.Subject.String())
+	return ca.response(), nil
+}
+
+// issue issues a certificate from the regenerated CA, for a CSR or with a
+// new key for the hostnames.
+func (s *apiServer) issue(id string, req apiIssueRequest) (*apiCertificateResponse, error) {
+	var validity time.Duration
+	if req.Validity != "" {
+		var err error
+		if validity, err = time.ParseDuration(req.Validity); err != nil || validity <= 0 {
+			return nil, apiErrorf(http.StatusBadRequest, "invalid validity %q", req.Validity)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ca, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	if ca.regenerated == nil {
+		return nil, apiErrorf(http.StatusConflict, "CA %s has not been regenerated yet", id)
+	}
+
+	var cert *x509.Certificate
+	var keyPEM []byte
+	switch {
+	case req.CSR != "" && len(req.Hostnames) > 0:
+		return nil, apiErrorf(http.StatusBadRequest, "csr and hostnames are mutually exclusive")
+	case req.CSR != "":
+		block := findPEMBlock([]byte(req.CSR), "CERTIFICATE REQUEST")
+		if block == nil {
+			return nil, apiErrorf(http.StatusBadRequest, "csr is not PEM encoded")
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err == nil {
+			err = csr.CheckSignature()
+		}
+		if err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "invalid csr: %v", err)
+		}
+		name := req.Profile
+		if name == "" {
+			name = "server"
+		}
+		profile, ok := builtinProfiles[name]
+		if !ok {
+			return nil, apiErrorf(http.StatusBadRequest, "unknown profile %q, available: %s", name, strings.Join(builtinProfileNames(), ", "))
+		}
+		if validity > 0 {
+			profile.expiry = validity
+		}
+		if cert, err = issueFromCSR(ca.regenerated, ca.key, csr, profile); err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "failed to issue certificate: %v", err)
+		}
+	case len(req.Hostnames) > 0:
+		if req.Profile != "" {
+			return nil, apiErrorf(http.StatusBadRequest, "profile is only supported with a csr")
+		}
+		for _, name := range req.Hostnames {
+			if err := checkWildcard(name); err != nil {
+				return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+			}
+		}
+		var key crypto.Signer
+		if cert, key, err = issueServerCert(ca.regenerated, ca.key, req.Hostnames, leafOptions{validity: validity}); err != nil {
+			return nil, err
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	default:
+		return nil, apiErrorf(http.StatusBadRequest, "either csr or hostnames is required")
+	}
+	ca.issued = append(ca.issued, cert)
+	slog.Info("Issued certificate", "id", id, "subject", cert.Subject.String(), "serial", x509util.FormatHex(cert.SerialNumber.Bytes()))
+	response := certificateResponse(cert)
+	response.Key = string(keyPEM)
+	return response, nil
+}
+
+// verify verifies a certificate with the original and, once regenerated,
+// the regenerated CA as trust root, like clients of either would.
+func (s *apiServer) verify(id string, req apiVerifyRequest) ([]*apiVerifyResult, error) {
+	certs, err := parseCertificates([]byte(req.Certificate))
+	if err != nil {
+		return nil, apiErrorf(http.StatusBadRequest, "invalid certificate: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ca, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	roots := []struct {
+		name string
+		cert *x509.Certificate
+	}{{"original", ca.original}}
+	if ca.regenerated != nil {
+		roots = append(roots, struct {
+			name string
+			cert *x509.Certificate
+		}{"regenerated", ca.regenerated})
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	results := []*apiVerifyResult{}
+	for _, root := range roots {
+		pool := x509.NewCertPool()
+		pool.AddCert(root.cert)
+		result := &apiVerifyResult{CA: root.name, Valid: true}
+		_, err := certs[0].Verify(x509.VerifyOptions{Roots: pool, Intermediates: intermediates, DNSName: req.Hostname})
+		if err != nil {
+			verifyErr := caregen.NewVerificationError(err, certs, []*x509.Certificate{root.cert}, req.Hostname, now.Now())
+			result.Valid, result.Error, result.Causes = false, verifyErr.Error(), verifyErr.Causes
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *apiServer) lookup(id string) (*apiCA, error) {
+	ca, ok := s.cas[id]
+	if !ok {
+		return nil, apiErrorf(http.StatusNotFound, "unknown CA %q", id)
+	}
+	return ca, nil
+}
+
+func (ca *apiCA) response() *apiCAResponse {
+	response := &apiCAResponse{
+		ID:       ca.id,
+		Subject:  ca.original.Subject.String(),
+		Original: encodeCertificatePEM(ca.original),
+		Issued:   []*apiCertificateResponse{},
+	}
+	if ca.regenerated != nil {
+		response.Regenerated = encodeCertificatePEM(ca.regenerated)
+	}
+	for _, cert := range ca.issued {
+		response.Issued = append(response.Issued, certificateResponse(cert))
+	}
+	return response
+}
+
+func certificateResponse(cert *x509.Certificate) *apiCertificateResponse {
+	return &apiCertificateResponse{
+		Serial:      x509util.FormatHex(cert.SerialNumber.Bytes()),
+		Subject:     cert.Subject.String(),
+		NotAfter:    cert.NotAfter.UTC(),
+		Certificate: encodeCertificatePEM(cert),
+	}
+}
+
+func encodeCertificatePEM(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
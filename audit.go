@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// auditEntry is a line of the audit log. Hash is the SHA-256 of the entry
+// encoded without it, which includes the hash of the previous entry, so
+// every entry vouches for all entries before it.
+type auditEntry struct {
+	Seq      int      `json:"seq"`
+	Time     string   `json:"time"`
+	Event    string   `json:"event"`
+	Serial   string   `json:"serial"`
+	Subject  string   `json:"subject"`
+	Issuer   string   `json:"issuer"`
+	SANs     []string `json:"sans,omitempty"`
+	NotAfter string   `json:"not_after"`
+	SHA256   string   `json:"sha256"`
+	Operator string   `json:"operator"`
+	Prev     string   `json:"prev"`
+	Hash     string   `json:"hash,omitempty"`
+}
+
+// auditLog appends an entry for every certificate signed, if -audit-log
+// is given. It is shared by all goroutines of the servers.
+var auditLog struct {
+	sync.Mutex
+	file     string
+	operator string
+	// loaded is set once seq and prev have been read from the file.
+	loaded bool
+	seq    int
+	prev   string
+}
+
+// registerAudit registers the -audit-log and -audit-operator flags.
+func registerAudit(fs *flag.FlagSet) {
+	fs.StringVar(&auditLog.file, "audit-log", "", "Append every regenerated, issued and re-signed certificate to this hash-chained audit log")
+	fs.StringVar(&auditLog.operator, "audit-operator", "", "Operator recorded in the audit log (default the user running the tool)")
+}
+
+// auditCertificate records cert in the audit log. Signing fails if the
+// certificate cannot be recorded.
+func auditCertificate(event string, cert *x509.Certificate) error {
+	if auditLog.file == "" {
+		return nil
+	}
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	if !auditLog.loaded {
+		last, err := lastAuditEntry(auditLog.file)
+		if err != nil {
+			return fmt.Errorf("failed to read audit log: %w", err)
+		}
+		if last != nil {
+			auditLog.seq, auditLog.prev = last.Seq, last.Hash
+		}
+		if auditLog.operator == "" {
+			auditLog.operator = currentOperator()
+		}
+		auditLog.loaded = true
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+	entry := auditEntry{
+		Seq:      auditLog.seq + 1,
+		Time:     now.Now().UTC().Format(time.RFC3339Nano),
+		Event:    event,
+		Serial:   x509util.FormatHex(cert.SerialNumber.Bytes()),
+		Subject:  cert.Subject.String(),
+		Issuer:   cert.Issuer.String(),
+		SANs:     certificateSANs(cert),
+		NotAfter: cert.NotAfter.UTC().Format(time.RFC3339),
+		SHA256:   hex.EncodeToString(sum[:]),
+		Operator: auditLog.operator,
+		Prev:     auditLog.prev,
+	}
+	line, err := entry.seal()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditLog.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	auditLog.seq, auditLog.prev = entry.Seq, entry.Hash
+	slog.Debug("Recorded certificate in audit log", "event", event, "serial", entry.Serial, "seq", entry.Seq)
+	return nil
+}
+
+// recordCertificate parses the DER of a certificate just signed and
+// records it in the audit log and the database.
+func recordCertificate(event string, der []byte) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordSigned(event, cert); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// recordSigned records a certificate just signed in the audit log and the
+// database and notifies the webhook.
+func recordSigned(event string, cert *x509.Certificate) error {
+	markSerialUsed(cert)
+	if err := auditCertificate(event, cert); err != nil {
+		return err
+	}
+	if err := recordInCertDB(event, cert); err != nil {
+		return err
+	}
+	notifyCertificate(event, cert)
+	return nil
+}
+
+// seal sets the hash of the entry and returns its encoding.
+func (e *auditEntry) seal() ([]byte, error) {
+	e.Hash = ""
+	unsealed, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(unsealed)
+	e.Hash = hex.EncodeToString(sum[:])
+	return json.Marshal(e)
+}
+
+// certificateSANs returns all SANs of cert as strings.
+func certificateSANs(cert *x509.Certificate) []string {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return append(sans, cert.EmailAddresses...)
+}
+
+func currentOperator() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "unknown"
+}
+
+// lastAuditEntry returns the last entry of the log, or nil if it does not
+// exist yet.
+func lastAuditEntry(file string) (*auditEntry, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		return nil, nil
+	}
+	var entry auditEntry
+	if err := json.Unmarshal(lines[len(lines)-1], &entry); err != nil || entry.Hash == "" {
+		return nil, fmt.Errorf("the last line of %s is not an audit entry", file)
+	}
+	return &entry, nil
+}
+
+// Verifies the hash chain of an audit log: every line must be an entry in
+// the exact encoding written, numbered without gaps, with the hash of the
+// previous entry and a valid hash of its own. Truncation at the end is
+// only detected by comparing the hash of the last entry with -head.
+func runAudit(args []string) {
+	const usage = "go run *.go audit verify [-head <hash of the last entry>] [audit.log]"
+	if len(args) == 0 || args[0] != "verify" {
+		usageError(usage)
+	}
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	head := fs.String("head", "", "Expected hash of the last entry, as recorded elsewhere")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args[1:])
+	logOpts.setup()
+
+	if fs.NArg() > 1 {
+		usageError(usage)
+	}
+	file := "audit.log"
+	if fs.NArg() == 1 {
+		file = fs.Arg(0)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		fatal("Failed to open audit log", "error", err)
+	}
+	defer f.Close()
+
+	count, last, err := verifyAuditLog(bufio.NewScanner(f))
+	if err != nil {
+		exitWith(exitVerifyFailed, "Audit log verification failed", "file", file, "error", err)
+	}
+	if *head != "" && last != *head {
+		exitWith(exitVerifyFailed, "Audit log verification failed", "file", file, "error", fmt.Errorf("the last entry has the hash %s, expected %s", last, *head))
+	}
+	slog.Info("Audit log verified", "file", file, "entries", count, "head", last)
+}
+
+// verifyAuditLog checks the chain of the lines and returns the number of
+// entries and the hash of the last one.
+func verifyAuditLog(scanner *bufio.Scanner) (int, string, error) {
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	prev := ""
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Bytes()
+		var entry auditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return 0, "", fmt.Errorf("line %d: invalid entry: %w", n, err)
+		}
+		if entry.Seq != n {
+			return 0, "", fmt.Errorf("line %d: entry %d is out of sequence", n, entry.Seq)
+		}
+		if entry.Prev != prev {
+			return 0, "", fmt.Errorf("line %d: the previous entry was changed or removed", n)
+		}
+		hash := entry.Hash
+		sealed, err := entry.seal()
+		if err != nil {
+			return 0, "", err
+		}
+		if entry.Hash != hash || !bytes.Equal(sealed, line) {
+			return 0, "", fmt.Errorf("line %d: the entry was changed", n)
+		}
+		prev = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, "", err
+	}
+	return n, prev, nil
+}
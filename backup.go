@@ -0,0 +1,484 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+const (
+	backupPEMType = "CA-REGEN BACKUP"
+	// backupIterations is the PBKDF2-HMAC-SHA256 work factor recommended
+	// by OWASP.
+	backupIterations = 600000
+	// maxBackupIterations bounds the work factor read from a backup, which
+	// could otherwise keep restore busy for hours.
+	maxBackupIterations = 10 * backupIterations
+	backupManifest      = "manifest.json"
+)
+
+// manifest lists the files of a backup archive with their fingerprints.
+type manifest struct {
+	Created time.Time      `json:"created"`
+	Files   []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Name string `json:"name"`
+	// Type is certificate or key.
+	Type   string `json:"type"`
+	SHA256 string `json:"sha256"`
+	// Subject, Serial and CertificateSHA256 are set for certificates,
+	// PublicKeySHA256 for certificates and keys.
+	Subject           string `json:"subject,omitempty"`
+	Serial            string `json:"serial,omitempty"`
+	CertificateSHA256 string `json:"certificate_sha256,omitempty"`
+	PublicKeySHA256   string `json:"public_key_sha256,omitempty"`
+}
+
+// Writes the original CA, the regenerated CA and the CA key with a
+// manifest into a single encrypted archive, to be kept offline after the
+// regeneration. The archive is encrypted to age recipients with the age
+// tool, or with a passphrase.
+func runBackup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.registerInput(fs)
+	newCAFile := fs.String("new-ca", "new-ca.pem", "Regenerated CA to include")
+	out := fs.String("out", "ca-backup.enc", "Encrypted archive to write")
+	var encryption backupEncryption
+	encryption.register(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() || fs.NArg() > 0 || !encryption.valid() {
+		usageError("go run *.go backup (-ca <ca-bundle.pem> | -ca-cert <ca-cert.pem> -ca-key <ca-key.pem>) [-new-ca new-ca.pem] (-age-recipient age1... | -passphrase-file <file>) [-out ca-backup.enc]")
+	}
+	originalCA, caKey, chain, err := caOpts.load()
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA", "error", err)
+	}
+	newCAs, err := loadCertificates(*newCAFile)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load regenerated CA", "file", *newCAFile, "error", err)
+	}
+	if !x509util.IsPublicKey(newCAs[0].PublicKey, caKey.Public()) {
+		exitWith(exitInvalidCA, "Regenerated CA does not belong to the CA key", "file", *newCAFile)
+	}
+
+	var archive backupArchive
+	archive.addCertificates("original-ca.pem", originalCA)
+	archive.addCertificates("new-ca.pem", newCAs[0])
+	if len(chain) > 0 {
+		archive.addCertificates("chain.pem", chain...)
+	}
+	if caOpts.externalKeys() > 0 {
+		slog.Warn("The CA key is held by a KMS or hardware, it is not part of the backup")
+	} else {
+		_, keyFile := caOpts.files()
+		keyPEM, err := readInput(keyFile)
+		if err != nil {
+			exitWith(exitInvalidCA, "Failed to read CA private key", "error", err)
+		}
+		block := findPEMBlock(keyPEM, "PRIVATE KEY")
+		block.Headers = nil
+		if err := archive.addKey("ca-key.pem", pem.EncodeToMemory(block), caKey.Public()); err != nil {
+			fatal("Failed to add CA key", "error", err)
+		}
+	}
+
+	data, err := archive.bytes()
+	if err != nil {
+		fatal("Failed to create archive", "error", err)
+	}
+	encrypted, err := encryption.encrypt(data)
+	if err != nil {
+		fatal("Failed to encrypt archive", "error", err)
+	}
+	if err := os.WriteFile(*out, encrypted, 0600); err != nil {
+		fatal("Failed to write backup", "error", err)
+	}
+	for _, file := range archive.manifest.Files {
+		slog.Info("Backed up file", "name", file.Name, "sha256", file.SHA256)
+	}
+	slog.Info("Wrote encrypted backup", "file", *out, "encryption", encryption.name())
+}
+
+// Decrypts a backup archive, checks the files against the manifest and
+// writes them to a directory. Existing files are never overwritten.
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	outDir := fs.String("out-dir", ".", "Directory to restore the files into")
+	var encryption backupEncryption
+	encryption.register(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if fs.NArg() > 1 {
+		usageError("go run *.go restore (-age-identity <key.txt> | -passphrase-file <file>) [-out-dir .] [ca-backup.enc]")
+	}
+	file := "ca-backup.enc"
+	if fs.NArg() == 1 {
+		file = fs.Arg(0)
+	}
+	encrypted, err := os.ReadFile(file)
+	if err != nil {
+		fatal("Failed to read backup", "error", err)
+	}
+	data, err := encryption.decrypt(encrypted)
+	if err != nil {
+		fatal("Failed to decrypt backup", "file", file, "error", err)
+	}
+	m, files, err := readBackupArchive(data)
+	if err != nil {
+		fatal("Invalid backup", "file", file, "error", err)
+	}
+	slog.Info("Verified backup against its manifest", "created", m.Created.Format(time.RFC3339), "files", len(files))
+
+	if err := os.MkdirAll(*outDir, 0700); err != nil {
+		fatal("Failed to create directory", "error", err)
+	}
+	for _, entry := range m.Files {
+		path := filepath.Join(*outDir, entry.Name)
+		mode := os.FileMode(0644)
+		if entry.Type == "key" {
+			mode = 0600
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err != nil {
+			fatal("Failed to restore file", "error", err)
+		}
+		_, err = f.Write(files[entry.Name])
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fatal("Failed to restore file", "error", err)
+		}
+		slog.Info("Restored file", "file", path, "type", entry.Type)
+	}
+}
+
+// backupArchive collects the files of a backup along with the manifest.
+type backupArchive struct {
+	manifest manifest
+	files    [][]byte
+}
+
+func (a *backupArchive) add(entry manifestFile, data []byte) {
+	sum := sha256.Sum256(data)
+	entry.SHA256 = hex.EncodeToString(sum[:])
+	a.manifest.Files = append(a.manifest.Files, entry)
+	a.files = append(a.files, data)
+}
+
+// addCertificates adds certs as PEM file, described by the first one.
+func (a *backupArchive) addCertificates(name string, certs ...*x509.Certificate) {
+	var data []byte
+	for _, cert := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	certSum := sha256.Sum256(certs[0].Raw)
+	keySum := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	a.add(manifestFile{
+		Name:              name,
+		Type:              "certificate",
+		Subject:           certs[0].Subject.String(),
+		Serial:            x509util.FormatHex(certs[0].SerialNumber.Bytes()),
+		CertificateSHA256: hex.EncodeToString(certSum[:]),
+		PublicKeySHA256:   hex.EncodeToString(keySum[:]),
+	}, data)
+}
+
+func (a *backupArchive) addKey(name string, keyPEM []byte, pub any) error {
+	fingerprint, err := keyFingerprint(pub)
+	if err != nil {
+		return err
+	}
+	a.add(manifestFile{Name: name, Type: "key", PublicKeySHA256: hex.EncodeToString(fingerprint)}, keyPEM)
+	return nil
+}
+
+// bytes returns the archive as gzip compressed tar file with the manifest
+// as first file.
+func (a *backupArchive) bytes() ([]byte, error) {
+	a.manifest.Created = now.Now().UTC()
+	manifestJSON, err := json.MarshalIndent(a.manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	write := func(name string, data []byte, mode int64) error {
+		header := &tar.Header{Name: name, Mode: mode, Size: int64(len(data)), ModTime: a.manifest.Created}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := write(backupManifest, manifestJSON, 0644); err != nil {
+		return nil, err
+	}
+	for i, entry := range a.manifest.Files {
+		mode := int64(0644)
+		if entry.Type == "key" {
+			mode = 0600
+		}
+		if err := write(entry.Name, a.files[i], mode); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readBackupArchive extracts the files of an archive and checks them
+// against the manifest: every file must be listed with its hash, and keys
+// must match the public key fingerprint.
+func readBackupArchive(data []byte) (*manifest, map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(gz)
+	files := map[string][]byte{}
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		files[header.Name] = content
+	}
+
+	var m manifest
+	if err := json.Unmarshal(files[backupManifest], &m); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	delete(files, backupManifest)
+	if len(m.Files) != len(files) {
+		return nil, nil, fmt.Errorf("the manifest lists %d files, the archive has %d", len(m.Files), len(files))
+	}
+	for _, entry := range m.Files {
+		if entry.Name != filepath.Base(entry.Name) || entry.Name == backupManifest {
+			return nil, nil, fmt.Errorf("invalid file name %q in the manifest", entry.Name)
+		}
+		content, ok := files[entry.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("file %s of the manifest is missing", entry.Name)
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != entry.SHA256 {
+			return nil, nil, fmt.Errorf("file %s does not match its SHA-256 in the manifest", entry.Name)
+		}
+		if entry.Type != "key" {
+			continue
+		}
+		key, err := parsePrivateKey(content)
+		if err != nil {
+			return nil, nil, fmt.Errorf("file %s: %w", entry.Name, err)
+		}
+		fingerprint, err := keyFingerprint(key.Public())
+		if err != nil || hex.EncodeToString(fingerprint) != entry.PublicKeySHA256 {
+			return nil, nil, fmt.Errorf("key %s does not match its public key fingerprint in the manifest", entry.Name)
+		}
+	}
+	return &m, files, nil
+}
+
+// backupEncryption encrypts to age recipients with the age tool or with a
+// passphrase read from a file.
+type backupEncryption struct {
+	ageRecipients  []string
+	ageIdentity    string
+	passphraseFile string
+}
+
+func (e *backupEncryption) register(fs *flag.FlagSet) {
+	fs.Func("age-recipient", "Encrypt to the age recipient (age1... or an SSH public key), can be repeated", func(value string) error {
+		e.ageRecipients = append(e.ageRecipients, value)
+		return nil
+	})
+	fs.StringVar(&e.ageIdentity, "age-identity", "", "age identity file to decrypt with")
+	fs.StringVar(&e.passphraseFile, "passphrase-file", "", "File containing the passphrase to encrypt or decrypt with (PBKDF2-HMAC-SHA256 and AES-256-GCM)")
+}
+
+// valid reports whether either age recipients or a passphrase were given
+// for encryption.
+func (e *backupEncryption) valid() bool {
+	return (len(e.ageRecipients) > 0) != (e.passphraseFile != "")
+}
+
+func (e *backupEncryption) name() string {
+	if len(e.ageRecipients) > 0 {
+		return "age"
+	}
+	return "passphrase"
+}
+
+func (e *backupEncryption) encrypt(data []byte) ([]byte, error) {
+	if len(e.ageRecipients) > 0 {
+		return ageEncrypt(e.ageRecipients, data)
+	}
+	passphrase, err := e.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := passphraseAEAD(passphrase, salt, backupIterations)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: backupPEMType,
+		Headers: map[string]string{
+			"Encryption": "PBKDF2-HMAC-SHA256,AES-256-GCM",
+			"Iterations": strconv.Itoa(backupIterations),
+			"Salt":       hex.EncodeToString(salt),
+			"Nonce":      hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, data, nil),
+	}), nil
+}
+
+// decrypt decrypts archives of both kinds, recognized by their content.
+func (e *backupEncryption) decrypt(encrypted []byte) ([]byte, error) {
+	block, _ := pem.Decode(encrypted)
+	if block == nil || block.Type != backupPEMType {
+		if e.ageIdentity == "" {
+			return nil, fmt.Errorf("the backup is encrypted with age, -age-identity is required")
+		}
+		return ageDecrypt(e.ageIdentity, encrypted)
+	}
+	if e.passphraseFile == "" {
+		return nil, fmt.Errorf("the backup is encrypted with a passphrase, -passphrase-file is required")
+	}
+	passphrase, err := e.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	iterations, err := strconv.Atoi(block.Headers["Iterations"])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("invalid iteration count %q", block.Headers["Iterations"])
+	}
+	if iterations > maxBackupIterations {
+		return nil, fmt.Errorf("iteration count %d exceeds the maximum of %d", iterations, maxBackupIterations)
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce: %w", err)
+	}
+	aead, err := passphraseAEAD(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce length %d", len(nonce))
+	}
+	data, err := aead.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupted backup")
+	}
+	return data, nil
+}
+
+// passphrase reads the passphrase file without the trailing newline.
+func (e *backupEncryption) passphrase() (string, error) {
+	data, err := readInput(e.passphraseFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("the passphrase file %s is empty", e.passphraseFile)
+	}
+	return passphrase, nil
+}
+
+func passphraseAEAD(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ageEncrypt encrypts data to the recipients with the age tool, ASCII
+// armored.
+func ageEncrypt(recipients []string, data []byte) ([]byte, error) {
+	args := []string{"-e", "-a"}
+	for _, recipient := range recipients {
+		args = append(args, "-r", recipient)
+	}
+	return runAge(data, args...)
+}
+
+func ageDecrypt(identity string, data []byte) ([]byte, error) {
+	return runAge(data, "-d", "-i", identity)
+}
+
+func runAge(stdin []byte, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("age", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("age failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
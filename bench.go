@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchScenario is a certificate served by the test server together with
+// the CA the client trusts.
+type benchScenario struct {
+	name string
+	root *x509.Certificate
+	cert tls.Certificate
+}
+
+// handshakeStats summarizes the handshakes of a benchmark or load test.
+type handshakeStats struct {
+	latencies []time.Duration
+	errors    int
+	elapsed   time.Duration
+}
+
+// Measures the latency and throughput of full TLS handshakes with the
+// test server for the original and the regenerated chain. Since the
+// regenerated CA keeps the key, the cost of the handshake is dominated
+// by the leaf key, so ECDSA leaves and a hypothetical re-keyed ECDSA CA
+// (or with the key selected by -leaf-key-type) are measured as well for
+// comparison.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	handshakes := fs.Int("handshakes", 1000, "Number of handshakes per scenario")
+	concurrency := fs.Int("concurrency", runtime.NumCPU(), "Number of concurrent clients")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() || *handshakes < 1 || *concurrency < 1 {
+		usageError("go run *.go bench (-ca <ca-bundle.pem> | -ca-cert <ca-cert.pem> -ca-key <ca-key.pem>) [-handshakes 1000] [-concurrency n]")
+	}
+
+	setup := loadCAs(caOpts)
+	scenarios, err := benchScenarios(setup)
+	if err != nil {
+		exitWith(exitRegenerationFailed, "Failed to issue benchmark certificates", "error", err)
+	}
+
+	var current atomic.Pointer[tls.Certificate]
+	server := startWebServer(&tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return current.Load(), nil
+		},
+	})
+	defer server.Close()
+
+	fmt.Printf("%-44s %12s %9s %9s %9s %7s\n", "Scenario", "Handshakes/s", "p50", "p95", "p99", "Errors")
+	failed := false
+	for _, scenario := range scenarios {
+		current.Store(&scenario.cert)
+		slog.Info("Benchmarking handshakes", "scenario", scenario.name, "handshakes", *handshakes, "concurrency", *concurrency)
+		stats := benchHandshakes(handshakeConfig(scenario.root), *handshakes, *concurrency)
+		failed = failed || stats.errors > 0
+		fmt.Printf("%-44s %12.1f %9s %9s %9s %7d\n", scenario.name, stats.rate(),
+			stats.percentile(50), stats.percentile(95), stats.percentile(99), stats.errors)
+	}
+	if failed {
+		os.Exit(exitVerifyFailed)
+	}
+}
+
+// benchScenarios issues the server certificates of the benchmark.
+func benchScenarios(setup *caSetup) ([]benchScenario, error) {
+	// The selected leaf key replaces RSA 2048 for the original and the
+	// regenerated CA and ECDSA P-256 for the re-keyed CA
+	leafKey := setup.leafKey.or(keyTypes["rsa2048"])
+	rekey := setup.leafKey.or(keyTypes["p256"])
+	rekeyedCAKey, err := rekey.generate()
+	if err != nil {
+		return nil, err
+	}
+	rekeyedCA, err := rekeyedCA(setup.originalCA, rekeyedCAKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var scenarios []benchScenario
+	for _, s := range []struct {
+		name      string
+		ca        *x509.Certificate
+		caKey     crypto.Signer
+		key       keySpec
+		withChain bool
+	}{
+		{fmt.Sprintf("Original CA, %s leaf", leafKey), setup.originalCA, setup.caKey, leafKey, true},
+		{fmt.Sprintf("Regenerated CA, %s leaf", leafKey), setup.newCA, setup.caKey, leafKey, true},
+		{"Regenerated CA, ECDSA P-256 leaf", setup.newCA, setup.caKey, keyTypes["p256"], true},
+		{fmt.Sprintf("Re-keyed %s CA, %s leaf", rekey, rekey), rekeyedCA, rekeyedCAKey, rekey, false},
+	} {
+		key, err := s.key.generate()
+		if err != nil {
+			return nil, err
+		}
+		template := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "localhost"},
+			DNSNames:    []string{"localhost"},
+			NotBefore:   now.Now(),
+			NotAfter:    now.Now().Add(24 * time.Hour),
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+		}
+		cert, err := signCertificate(s.ca, s.caKey, template, key.Public(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.name, err)
+		}
+		tlsCert := tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+		if s.withChain {
+			for _, c := range setup.chain {
+				tlsCert.Certificate = append(tlsCert.Certificate, c.Raw)
+			}
+		}
+		scenarios = append(scenarios, benchScenario{name: s.name, root: s.ca, cert: tlsCert})
+	}
+	return scenarios, nil
+}
+
+// rekeyedCA returns a self-signed copy of ca with key, as re-keying the CA
+// would create it. It is only used for comparison, as it does not verify
+// anything issued by ca.
+func rekeyedCA(ca *x509.Certificate, key crypto.Signer) (*x509.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber:          ca.SerialNumber,
+		Subject:               ca.Subject,
+		NotBefore:             ca.NotBefore,
+		NotAfter:              ca.NotAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create re-keyed CA: %w", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+// handshakeConfig returns the client configuration trusting only root.
+// Without a session cache every handshake is a full one.
+func handshakeConfig(root *x509.Certificate) *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return &tls.Config{RootCAs: roots, ServerName: "localhost", Time: now.Now}
+}
+
+// handshake connects to the test server and returns the time of the TCP
+// connect and the TLS handshake, including the verification of the chain.
+func handshake(config *tls.Config) (time.Duration, error) {
+	start := time.Now()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", "localhost:8443", config)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	conn.Close()
+	return elapsed, nil
+}
+
+// benchHandshakes runs n handshakes with concurrent clients.
+func benchHandshakes(config *tls.Config, n, concurrency int) *handshakeStats {
+	stats := &handshakeStats{}
+	var mu sync.Mutex
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range min(concurrency, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for next.Add(1) <= int64(n) {
+				latency, err := handshake(config)
+				mu.Lock()
+				stats.add(latency, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	stats.elapsed = time.Since(start)
+	return stats
+}
+
+func (s *handshakeStats) add(latency time.Duration, err error) {
+	if err != nil {
+		if s.errors == 0 {
+			slog.Error("Handshake failed", "error", err)
+		}
+		s.errors++
+		return
+	}
+	s.latencies = append(s.latencies, latency)
+}
+
+// rate returns the successful handshakes per second.
+func (s *handshakeStats) rate() float64 {
+	if s.elapsed <= 0 {
+		return 0
+	}
+	return float64(len(s.latencies)) / s.elapsed.Seconds()
+}
+
+// percentile returns the latency below which p percent of the successful
+// handshakes completed, by the nearest-rank method.
+func (s *handshakeStats) percentile(p int) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	rank := (p*len(s.latencies) + 99) / 100
+	return s.latencies[max(rank, 1)-1].Round(time.Microsecond)
+}
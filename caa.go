@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// dnsTypeCAA is the DNS resource record type of CAA records, which the
+// resolver of the net package cannot look up.
+const dnsTypeCAA = 257
+
+// caaRecord is a CAA resource record, see RFC 8659.
+type caaRecord struct {
+	flags byte
+	tag   string
+	value string
+}
+
+// critical reports whether the issuer critical flag is set, which forbids
+// issuance by CAs not understanding the tag.
+func (r caaRecord) critical() bool {
+	return r.flags&0x80 != 0
+}
+
+// knownCAATags are the property tags whose meaning is known, a critical
+// property with another tag forbids issuance.
+var knownCAATags = map[string]bool{
+	"issue": true, "issuewild": true, "iodef": true, "issuemail": true,
+	"issuevmc": true, "contactemail": true, "contactphone": true,
+}
+
+// caaOptions are the flags of the CAA check of the issue and sign modes.
+type caaOptions struct {
+	check    bool
+	issuer   string
+	resolver string
+}
+
+func (o *caaOptions) register(fs *flag.FlagSet) {
+	fs.BoolVar(&o.check, "check-caa", false, "Warn if the CAA records of a DNS name of the certificate do not permit issuance by this CA")
+	fs.StringVar(&o.issuer, "caa-issuer", "", "Issuer domain name identifying this CA in CAA issue properties, if it has one")
+	fs.StringVar(&o.resolver, "caa-resolver", "", "DNS resolver to query CAA records from as host:port (default the first nameserver of /etc/resolv.conf)")
+}
+
+// checkNames warns about every DNS name whose CAA records do not permit
+// issuance by the CA identified by -caa-issuer, or by any CA not listed
+// without one. It only warns: a private CA is not bound to CAA, but public
+// CAs are, and clients or auditors may expect the names to follow it.
+func (o *caaOptions) checkNames(dnsNames []string) {
+	if !o.check {
+		return
+	}
+	resolver := o.resolver
+	if resolver == "" {
+		resolver = systemResolver()
+	}
+	for _, name := range dnsNames {
+		domain, records, err := lookupRelevantCAA(resolver, strings.TrimPrefix(name, "*."))
+		if err != nil {
+			slog.Warn("Failed to look up CAA records, issuance might conflict with the CAA policy", "name", name, "resolver", resolver, "error", err)
+			continue
+		}
+		if len(records) == 0 {
+			slog.Debug("No CAA records restrict issuance", "name", name)
+			continue
+		}
+		if reason := caaConflict(records, o.issuer, strings.HasPrefix(name, "*.")); reason != "" {
+			slog.Warn("CAA records do not permit issuance by this CA", "name", name, "caa_domain", domain, "reason", reason)
+			continue
+		}
+		slog.Info("CAA records permit issuance", "name", name, "caa_domain", domain, "issuer", o.issuer)
+	}
+}
+
+// caaConflict returns why the relevant CAA records do not permit issuance
+// for a name by the CA with the issuer domain name, empty if they do. The
+// issue properties apply to wildcard names unless there are issuewild
+// properties.
+func caaConflict(records []caaRecord, issuer string, wildcard bool) string {
+	var issue, issuewild []string
+	for _, r := range records {
+		switch {
+		case r.critical() && !knownCAATags[r.tag]:
+			return fmt.Sprintf("unknown critical property %q", r.tag)
+		case r.tag == "issue":
+			issue = append(issue, r.value)
+		case r.tag == "issuewild":
+			issuewild = append(issuewild, r.value)
+		}
+	}
+	values, tag := issue, "issue"
+	if wildcard && len(issuewild) > 0 {
+		values, tag = issuewild, "issuewild"
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	var permitted []string
+	for _, value := range values {
+		domain, _, _ := strings.Cut(value, ";")
+		domain = strings.TrimSpace(domain)
+		if domain == "" {
+			continue
+		}
+		if strings.EqualFold(domain, issuer) {
+			return ""
+		}
+		permitted = append(permitted, domain)
+	}
+	if len(permitted) == 0 {
+		return tag + " properties forbid issuance by any CA"
+	}
+	return fmt.Sprintf("%s properties only permit %s", tag, strings.Join(permitted, ", "))
+}
+
+// lookupRelevantCAA returns the relevant CAA records of name and the
+// domain they were found at: those of the closest of name and its parent
+// domains which has any.
+func lookupRelevantCAA(resolver, name string) (string, []caaRecord, error) {
+	domain := strings.TrimSuffix(name, ".")
+	for domain != "" {
+		records, err := lookupCAA(resolver, domain)
+		if err != nil {
+			return domain, nil, err
+		}
+		if len(records) > 0 {
+			return domain, records, nil
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return "", nil, nil
+}
+
+// lookupCAA queries resolver for the CAA records of domain, via UDP and
+// via TCP if the answer is truncated. Records of CNAME targets in the
+// answer are included.
+func lookupCAA(resolver, domain string) ([]caaRecord, error) {
+	query, id, err := caaQuery(domain)
+	if err != nil {
+		return nil, err
+	}
+	response, err := exchangeDNS("udp", resolver, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) > 2 && response[2]&0x02 != 0 {
+		response, err = exchangeDNS("tcp", resolver, query)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parseCAAResponse(response, id)
+}
+
+// caaQuery returns a recursive DNS query for the CAA records of domain and
+// its random ID.
+func caaQuery(domain string) ([]byte, uint16, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	// Header: ID, recursion desired, one question
+	query := binary.BigEndian.AppendUint16(nil, id)
+	query = append(query, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+	for label := range strings.SplitSeq(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid domain name %q", domain)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = binary.BigEndian.AppendUint16(query, dnsTypeCAA)
+	query = binary.BigEndian.AppendUint16(query, 1) // IN
+	return query, id, nil
+}
+
+// exchangeDNS sends query to resolver and returns the response. Via TCP
+// messages are prefixed with their length.
+func exchangeDNS(network, resolver string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, resolver, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if network == "tcp" {
+		query = append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	if network == "tcp" {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		response := make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err := io.ReadFull(conn, response)
+		return response, err
+	}
+	response := make([]byte, 65535)
+	n, err := conn.Read(response)
+	return response[:n], err
+}
+
+// errMalformedDNS is returned for DNS responses which cannot be parsed.
+var errMalformedDNS = errors.New("malformed DNS response")
+
+// parseCAAResponse returns the CAA records in the answer section of a DNS
+// response to the query with id. A non-existent domain has none.
+func parseCAAResponse(msg []byte, id uint16) ([]caaRecord, error) {
+	if len(msg) < 12 {
+		return nil, errMalformedDNS
+	}
+	if binary.BigEndian.Uint16(msg) != id {
+		return nil, fmt.Errorf("DNS response ID does not match the query")
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case 3: // NXDOMAIN
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("DNS query failed with response code %d", rcode)
+	}
+	questions := binary.BigEndian.Uint16(msg[4:])
+	answers := binary.BigEndian.Uint16(msg[6:])
+	offset := 12
+	for range questions {
+		var err error
+		if offset, err = skipDNSName(msg, offset); err != nil {
+			return nil, err
+		}
+		offset += 4
+	}
+	var records []caaRecord
+	for range answers {
+		var err error
+		if offset, err = skipDNSName(msg, offset); err != nil {
+			return nil, err
+		}
+		if offset+10 > len(msg) {
+			return nil, errMalformedDNS
+		}
+		rrType := binary.BigEndian.Uint16(msg[offset:])
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return nil, errMalformedDNS
+		}
+		data := msg[offset : offset+length]
+		offset += length
+		if rrType != dnsTypeCAA {
+			continue
+		}
+		if len(data) < 2 || 2+int(data[1]) > len(data) {
+			return nil, errMalformedDNS
+		}
+		tagEnd := 2 + int(data[1])
+		records = append(records, caaRecord{
+			flags: data[0],
+			tag:   strings.ToLower(string(data[2:tagEnd])),
+			value: string(data[tagEnd:]),
+		})
+	}
+	return records, nil
+}
+
+// skipDNSName returns the offset after the possibly compressed name at
+// offset in msg.
+func skipDNSName(msg []byte, offset int) (int, error) {
+	for offset < len(msg) {
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xc0 == 0xc0:
+			return offset + 2, nil
+		}
+		offset += 1 + length
+	}
+	return 0, errMalformedDNS
+}
+
+// systemResolver returns the first nameserver of /etc/resolv.conf, or the
+// local resolver if there is none, like the net package.
+func systemResolver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
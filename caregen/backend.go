@@ -0,0 +1,50 @@
+package caregen
+
+import (
+	"crypto"
+	"flag"
+	"sync"
+)
+
+// SignerBackend is a source of CA keys other than PEM files, e.g. a KMS or
+// an HSM. Every registered backend adds its flags to all modes of the
+// command loading a CA, and is used if its flags select a key.
+type SignerBackend interface {
+	// Register registers the flags of the backend.
+	Register(fs *flag.FlagSet)
+	// Selected reports whether the flags select a key of this backend.
+	Selected() bool
+	// Signer returns the selected key. Signing operations use the
+	// signature algorithm reported by an optional
+	// SignatureAlgorithm() x509.SignatureAlgorithm method.
+	Signer() (crypto.Signer, error)
+}
+
+// signerBackends holds the constructors of the registered backends.
+var signerBackends struct {
+	sync.Mutex
+	constructors []func() SignerBackend
+}
+
+// RegisterSignerBackend makes a signer backend available. Custom backends
+// call it from an init function of their package, which the command or the
+// program using SignerBackends has to import. See the built-in backends of
+// the command, e.g. gcpkms.go, for examples.
+func RegisterSignerBackend(newBackend func() SignerBackend) {
+	signerBackends.Lock()
+	defer signerBackends.Unlock()
+	signerBackends.constructors = append(signerBackends.constructors, newBackend)
+}
+
+// SignerBackends returns a new instance of every registered backend, in
+// the order they were registered, e.g. to register their flags on a
+// FlagSet.
+func SignerBackends() []SignerBackend {
+	signerBackends.Lock()
+	defer signerBackends.Unlock()
+	var backends []SignerBackend
+	for _, newBackend := range signerBackends.constructors {
+		backends = append(backends, newBackend())
+	}
+	return backends
+}
@@ -0,0 +1,175 @@
+// Package caregen regenerates CA certificates with critical basic
+// constraints and issues certificates from them, for Go programs embedding
+// what the ca-regen command does. The command itself is built on it.
+//
+// The regenerated CA keeps the subject, serial number, validity and key of
+// the original, so certificates issued by either verify with both. Every
+// behavior the command controls with flags or globals is an Option here,
+// and all functions accept a context to cancel slow signers such as cloud
+// KMS or HSM keys.
+package caregen
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"math/big"
+	"time"
+)
+
+// An Option changes how Regenerate, Sign, Issue and GenerateKey create
+// certificates and keys.
+type Option func(*options)
+
+type options struct {
+	rand               io.Reader
+	now                func() time.Time
+	logger             *slog.Logger
+	subject            *pkix.Name
+	signatureAlgorithm x509.SignatureAlgorithm
+	keyUsage           *x509.KeyUsage
+	extKeyUsage        []x509.ExtKeyUsage
+	validity           time.Duration
+	backdate           time.Duration
+	serialInUse        func(issuer *x509.Certificate, serial *big.Int) (bool, error)
+	fips               bool
+	pss                bool
+	deterministic      bool
+	minimalDiff        bool
+	// invariants are the names of the checked invariants, nil for all.
+	invariants []string
+	ct         func(ctx context.Context, precert []byte, issuer *x509.Certificate) ([][]byte, error)
+	keyType    KeyType
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		rand:     rand.Reader,
+		now:      time.Now,
+		logger:   slog.New(slog.DiscardHandler),
+		validity: 365 * 24 * time.Hour,
+		backdate: time.Minute,
+		keyType:  KeyType{Algorithm: "rsa", Size: 2048},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithRand sets the source of randomness for signatures, serial numbers
+// and keys, crypto/rand by default.
+func WithRand(r io.Reader) Option {
+	return func(o *options) { o.rand = r }
+}
+
+// WithClock sets the clock issued certificates are valid from, the system
+// time by default, like the -now flag.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) { o.now = now }
+}
+
+// WithLogger sets the logger for what the command reports while
+// regenerating, e.g. violated invariants. Nothing is logged by default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithSubject replaces the subject: the one of the CA for Regenerate, the
+// one of the request for Issue. Certificates issued by the original CA do
+// not chain to a renamed CA.
+func WithSubject(subject pkix.Name) Option {
+	return func(o *options) { o.subject = &subject }
+}
+
+// WithSignatureAlgorithm sets the signature algorithm. By default
+// Regenerate keeps the one of the original CA and Sign and Issue use the
+// one the CA key is restricted to or let crypto/x509 choose one.
+func WithSignatureAlgorithm(algorithm x509.SignatureAlgorithm) Option {
+	return func(o *options) { o.signatureAlgorithm = algorithm }
+}
+
+// WithKeyUsage sets the key usage. Regenerate adds it to the usage of the
+// original CA, by default certificate signing, digital signature and data
+// encipherment. Issue uses it for the certificate, by default digital
+// signature and key encipherment.
+func WithKeyUsage(usage x509.KeyUsage) Option {
+	return func(o *options) { o.keyUsage = &usage }
+}
+
+// WithExtKeyUsage sets the extended key usage of issued certificates,
+// server and client authentication by default.
+func WithExtKeyUsage(usage ...x509.ExtKeyUsage) Option {
+	return func(o *options) { o.extKeyUsage = usage }
+}
+
+// WithValidity sets how long issued certificates are valid, a year by
+// default.
+func WithValidity(validity time.Duration) Option {
+	return func(o *options) { o.validity = validity }
+}
+
+// WithBackdate sets how long before the current time issued certificates
+// become valid, to allow for clock skew. The default is a minute.
+func WithBackdate(backdate time.Duration) Option {
+	return func(o *options) { o.backdate = backdate }
+}
+
+// WithSerialInUse sets a check for serial numbers already used by the
+// issuer, which are then not reused for issued certificates, like the
+// -serial-list flag and the certificate database of the command.
+func WithSerialInUse(inUse func(issuer *x509.Certificate, serial *big.Int) (bool, error)) Option {
+	return func(o *options) { o.serialInUse = inUse }
+}
+
+// WithFIPS only accepts and creates certificates with FIPS 140-3 approved
+// keys and signature algorithms, like the -fips flag. It fails unless the
+// Go Cryptographic Module is in FIPS 140-3 mode, see CheckFIPSModule.
+func WithFIPS() Option {
+	return func(o *options) { o.fips = true }
+}
+
+// WithPSS signs with RSA-PSS instead of the algorithm of the CA, keeping
+// the hash of the CA if it is SHA-384 or SHA-512, like the -pss flag.
+func WithPSS() Option {
+	return func(o *options) { o.pss = true }
+}
+
+// WithDeterministic makes Regenerate reproducible, byte-identical for the
+// same inputs, like the -deterministic flag. Keys with randomized
+// signatures fail instead.
+func WithDeterministic() Option {
+	return func(o *options) { o.deterministic = true }
+}
+
+// WithMinimalDiff makes Regenerate only mark the basic constraints of the
+// self-signed CA critical in its DER and sign it again, keeping every
+// other byte, like the -minimal-diff flag. It cannot be combined with
+// WithSubject.
+func WithMinimalDiff() Option {
+	return func(o *options) { o.minimalDiff = true }
+}
+
+// WithInvariants selects the invariants the regenerated CA must satisfy,
+// like the -invariants flag, see InvariantNames. All are checked by
+// default, except same-subject for renamed CAs.
+func WithInvariants(names ...string) Option {
+	return func(o *options) { o.invariants = append([]string{}, names...) }
+}
+
+// WithCT issues certificates as precertificate first, which submit hands
+// to Certificate Transparency logs, like the -ct-log flag. The SCTs it
+// returns are embedded into the certificate. submit gets the encoded
+// precertificate and its issuer and should verify the SCTs.
+func WithCT(submit func(ctx context.Context, precert []byte, issuer *x509.Certificate) ([][]byte, error)) Option {
+	return func(o *options) { o.ct = submit }
+}
+
+// WithKeyType sets the type of the keys GenerateKey generates, RSA with
+// 2048 bits by default, like the -leaf-key-type flag.
+func WithKeyType(keyType KeyType) Option {
+	return func(o *options) { o.keyType = keyType }
+}
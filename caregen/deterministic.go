@@ -0,0 +1,60 @@
+package caregen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// deterministicSigner makes the signatures of the regenerated CA
+// reproducible. ECDSA software keys sign according to RFC 6979, RSA
+// PKCS#1 v1.5 and Ed25519 signatures are deterministic anyway. Every other
+// signature fails instead of silently differing between runs.
+type deterministicSigner struct {
+	crypto.Signer
+}
+
+func (s *deterministicSigner) Sign(random io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if key, ok := s.Signer.(*ecdsa.PrivateKey); ok {
+		return key.Sign(nil, digest, opts)
+	}
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, fmt.Errorf("RSA-PSS signatures use a random salt and are not reproducible")
+	}
+	switch pub := s.Public().(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		return s.Signer.Sign(random, digest, opts)
+	default:
+		return nil, fmt.Errorf("signatures of %s keys outside of the CA key file are not reproducible", x509util.DescribePublicKey(pub))
+	}
+}
+
+// SignatureAlgorithm forwards the algorithm of KMS and hardware keys.
+func (s *deterministicSigner) SignatureAlgorithm() x509.SignatureAlgorithm {
+	return x509util.SignatureAlgorithmFor(s.Signer, x509.UnknownSignatureAlgorithm)
+}
+
+// pinSubjectKeyID returns ca with a subject key identifier derived by
+// RFC 5280 method 1, the SHA-1 hash of the public key, if it has none.
+// Otherwise the derivation of the Go version in use would be inherited.
+func pinSubjectKeyID(ca *x509.Certificate) (*x509.Certificate, error) {
+	if len(ca.SubjectKeyId) > 0 {
+		return ca, nil
+	}
+	var spki x509util.SubjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(ca.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	keyID := sha1.Sum(spki.PublicKey.Bytes)
+	pinned := *ca
+	pinned.SubjectKeyId = keyID[:]
+	return &pinned, nil
+}
@@ -0,0 +1,52 @@
+package caregen
+
+import (
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// ErrKeyMismatch is returned when a private key does not belong to the
+// certificate it is used with.
+var ErrKeyMismatch = errors.New("the key does not match the certificate")
+
+// ErrUnsupportedKeyType is returned for keys of a type a format or
+// protocol cannot use. The type is appended to the message.
+var ErrUnsupportedKeyType = errors.New("unsupported key type")
+
+// ErrCriticalBasicConstraints is returned by Regenerate for a CA whose
+// basic constraints are already critical.
+var ErrCriticalBasicConstraints = errors.New("the CA already has critical basic constraints")
+
+// VerificationError is returned when a certificate does not verify. It
+// explains the error of x509.Certificate.Verify, which it wraps, and lists
+// the problems found in the chain.
+type VerificationError struct {
+	Err         error
+	Explanation string
+	// Causes are the problems found in the chain, in plain language.
+	Causes []string
+	// Chain is the verified chain, leaf first, and Roots are the trusted
+	// CAs it was verified against.
+	Chain []*x509.Certificate
+	Roots []*x509.Certificate
+}
+
+// NewVerificationError returns the VerificationError for err, the error
+// of verifying chain (leaf first) against roots at the time now. hostname
+// may be empty.
+func NewVerificationError(err error, chain, roots []*x509.Certificate, hostname string, now time.Time) *VerificationError {
+	return &VerificationError{
+		Err:         err,
+		Explanation: x509util.ExplainVerifyError(err),
+		Causes:      x509util.AnalyzeChain(chain, roots, hostname, now),
+		Chain:       chain,
+		Roots:       roots,
+	}
+}
+
+func (e *VerificationError) Error() string { return e.Explanation }
+
+func (e *VerificationError) Unwrap() error { return e.Err }
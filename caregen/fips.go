@@ -0,0 +1,75 @@
+package caregen
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/fips140"
+	"crypto/mldsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// fipsSignatureAlgorithms are the approved signature algorithms (FIPS
+// 186-5 and FIPS 204), none of them with SHA-1.
+var fipsSignatureAlgorithms = map[x509.SignatureAlgorithm]bool{
+	x509.SHA256WithRSA:    true,
+	x509.SHA384WithRSA:    true,
+	x509.SHA512WithRSA:    true,
+	x509.SHA256WithRSAPSS: true,
+	x509.SHA384WithRSAPSS: true,
+	x509.SHA512WithRSAPSS: true,
+	x509.ECDSAWithSHA256:  true,
+	x509.ECDSAWithSHA384:  true,
+	x509.ECDSAWithSHA512:  true,
+	x509.PureEd25519:      true,
+	x509.MLDSA44:          true,
+	x509.MLDSA65:          true,
+	x509.MLDSA87:          true,
+}
+
+// CheckFIPSModule fails unless the Go Cryptographic Module is in FIPS
+// 140-3 mode: WithFIPS only restricts the algorithms, the module has to
+// provide the validated implementations of them.
+func CheckFIPSModule() error {
+	if !fips140.Enabled() {
+		return errors.New("the Go Cryptographic Module is not in FIPS 140-3 mode, build with GOFIPS140=v1.0.0 or run with GODEBUG=fips140=on")
+	}
+	return nil
+}
+
+// checkFIPSCertificate checks that the key and the signature of cert use
+// approved algorithms.
+func checkFIPSCertificate(cert *x509.Certificate) error {
+	if err := checkFIPSPublicKey(cert.PublicKey); err != nil {
+		return fmt.Errorf("%s: %w", cert.Subject, err)
+	}
+	if !fipsSignatureAlgorithms[cert.SignatureAlgorithm] {
+		return fmt.Errorf("%s: signature algorithm %s is not FIPS 140-3 approved", cert.Subject, cert.SignatureAlgorithm)
+	}
+	return nil
+}
+
+// checkFIPSPublicKey checks that pub is of an approved type and size.
+func checkFIPSPublicKey(pub any) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return fmt.Errorf("RSA keys with %d bits are not FIPS 140-3 approved, at least 2048 bits are required", pub.N.BitLen())
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			return nil
+		}
+		return fmt.Errorf("ECDSA curve %s is not FIPS 140-3 approved", pub.Curve.Params().Name)
+	case ed25519.PublicKey, *mldsa.PublicKey:
+		return nil
+	}
+	return fmt.Errorf("%s keys are not FIPS 140-3 approved", x509util.DescribePublicKey(pub))
+}
@@ -0,0 +1,150 @@
+package caregen
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+var (
+	oidExtensionKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionSubjectAltName   = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidExtensionBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+)
+
+// caInvariant is a property the regenerated CA must have, checked after
+// every regeneration.
+type caInvariant struct {
+	name  string
+	check func(original, regenerated *x509.Certificate) error
+}
+
+// caInvariants are all invariants, in the order they are checked.
+var caInvariants = []caInvariant{
+	{"same-public-key", func(original, regenerated *x509.Certificate) error {
+		if !bytes.Equal(original.RawSubjectPublicKeyInfo, regenerated.RawSubjectPublicKeyInfo) {
+			return fmt.Errorf("public key %s differs from the original %s", x509util.DescribePublicKey(regenerated.PublicKey), x509util.DescribePublicKey(original.PublicKey))
+		}
+		return nil
+	}},
+	{"same-subject", func(original, regenerated *x509.Certificate) error {
+		if !bytes.Equal(original.RawSubject, regenerated.RawSubject) {
+			return fmt.Errorf("subject %q differs from the original %q", regenerated.Subject, original.Subject)
+		}
+		return nil
+	}},
+	{"same-sans", func(original, regenerated *x509.Certificate) error {
+		var originalSANs, regeneratedSANs []byte
+		if ext := x509util.FindExtension(original, oidExtensionSubjectAltName); ext != nil {
+			originalSANs = ext.Value
+		}
+		if ext := x509util.FindExtension(regenerated, oidExtensionSubjectAltName); ext != nil {
+			regeneratedSANs = ext.Value
+		}
+		if !bytes.Equal(originalSANs, regeneratedSANs) {
+			return fmt.Errorf("subject alternative names %v differ from the original %v", x509util.CertNames(regenerated), x509util.CertNames(original))
+		}
+		return nil
+	}},
+	{"same-serial", func(original, regenerated *x509.Certificate) error {
+		if original.SerialNumber.Cmp(regenerated.SerialNumber) != 0 {
+			return fmt.Errorf("serial %s differs from the original %s", x509util.FormatHex(regenerated.SerialNumber.Bytes()), x509util.FormatHex(original.SerialNumber.Bytes()))
+		}
+		return nil
+	}},
+	{"same-validity", func(original, regenerated *x509.Certificate) error {
+		if !original.NotBefore.Equal(regenerated.NotBefore) || !original.NotAfter.Equal(regenerated.NotAfter) {
+			return fmt.Errorf("validity %s - %s differs from the original %s - %s", regenerated.NotBefore, regenerated.NotAfter, original.NotBefore, original.NotAfter)
+		}
+		return nil
+	}},
+	{"basic-constraints-critical", func(_, regenerated *x509.Certificate) error {
+		ext := x509util.FindExtension(regenerated, oidExtensionBasicConstraints)
+		switch {
+		case ext == nil:
+			return fmt.Errorf("basicConstraints extension is missing")
+		case !ext.Critical:
+			return fmt.Errorf("basicConstraints extension is not critical")
+		case !regenerated.IsCA:
+			return fmt.Errorf("basicConstraints has CA:FALSE")
+		}
+		return nil
+	}},
+	{"key-cert-sign", func(_, regenerated *x509.Certificate) error {
+		// Without keyUsage extension the key may be used for anything
+		if x509util.FindExtension(regenerated, oidExtensionKeyUsage) != nil && regenerated.KeyUsage&x509.KeyUsageCertSign == 0 {
+			return fmt.Errorf("keyUsage does not include keyCertSign")
+		}
+		return nil
+	}},
+	{"signature-verifies", func(_, regenerated *x509.Certificate) error {
+		if err := x509util.CheckSignedBy(regenerated, regenerated); err != nil {
+			return fmt.Errorf("self-signature does not verify: %w", err)
+		}
+		return nil
+	}},
+}
+
+// InvariantNames returns the names of all invariants, in the order they
+// are checked.
+func InvariantNames() []string {
+	var names []string
+	for _, invariant := range caInvariants {
+		names = append(names, invariant.name)
+	}
+	return names
+}
+
+// selectInvariants returns the named invariants, or all if names is nil.
+// Renaming the CA changes the subject on purpose, so same-subject is only
+// selected then if it was named explicitly.
+func selectInvariants(names []string, renamed bool) ([]*caInvariant, error) {
+	if names == nil {
+		for _, name := range InvariantNames() {
+			if name != "same-subject" || !renamed {
+				names = append(names, name)
+			}
+		}
+	}
+	var invariants []*caInvariant
+	for _, name := range names {
+		invariant := findInvariant(name)
+		if invariant == nil {
+			return nil, fmt.Errorf("unknown invariant %q, use some of %s", name, strings.Join(InvariantNames(), ", "))
+		}
+		invariants = append(invariants, invariant)
+	}
+	return invariants, nil
+}
+
+// checkInvariants checks invariants and returns an error naming every
+// violated one.
+func checkInvariants(logger *slog.Logger, invariants []*caInvariant, original, regenerated *x509.Certificate) error {
+	var violations []string
+	for _, invariant := range invariants {
+		if err := invariant.check(original, regenerated); err != nil {
+			logger.Error("Invariant violated by the regenerated CA", "invariant", invariant.name, "error", err)
+			violations = append(violations, invariant.name+": "+err.Error())
+		} else {
+			logger.Debug("Invariant holds", "invariant", invariant.name)
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("regenerated CA violates %d invariant(s): %s", len(violations), strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+func findInvariant(name string) *caInvariant {
+	for i := range caInvariants {
+		if caInvariants[i].name == name {
+			return &caInvariants[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package caregen
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+var (
+	oidExtensionCTPoison = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+	oidExtensionSCTList  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+)
+
+// maxSerialAttempts is the number of random serials tried before giving
+// up, a collision of 128 bit serials is only likely with a broken RNG.
+const maxSerialAttempts = 10
+
+// Issue signs a certificate with the subject, SANs and public key of csr
+// with ca and its key, like Sign. It checks the signature of csr first.
+// A certificate which does not verify with ca, e.g. because of its name
+// constraints, is returned as VerificationError.
+func Issue(ctx context.Context, ca *x509.Certificate, caKey crypto.Signer, csr *x509.CertificateRequest, opts ...Option) (*x509.Certificate, error) {
+	o := newOptions(opts)
+	if !x509util.IsPublicKey(ca.PublicKey, caKey.Public()) {
+		return nil, ErrKeyMismatch
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid certificate request signature: %w", err)
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	if o.keyUsage != nil {
+		keyUsage = *o.keyUsage
+	}
+	extKeyUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if o.extKeyUsage != nil {
+		extKeyUsage = o.extKeyUsage
+	}
+	now := o.now()
+	template := &x509.Certificate{
+		Subject:        csr.Subject,
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+		IPAddresses:    csr.IPAddresses,
+		URIs:           csr.URIs,
+		NotBefore:      now.Add(-o.backdate),
+		NotAfter:       now.Add(o.validity),
+		KeyUsage:       keyUsage,
+		ExtKeyUsage:    extKeyUsage,
+	}
+	if o.subject != nil {
+		template.Subject = *o.subject
+	}
+	cert, err := Sign(ctx, ca, caKey, template, csr.PublicKey, opts...)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: cert.NotBefore, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return nil, NewVerificationError(err, []*x509.Certificate{cert}, []*x509.Certificate{ca}, "", cert.NotBefore)
+	}
+	return cert, nil
+}
+
+// Sign signs a certificate for pub from template with ca and its key. A
+// serial number not in use is drawn if template has none, otherwise it is
+// checked. The signature algorithm is the one of WithSignatureAlgorithm,
+// the one the CA key is restricted to or the default of crypto/x509.
+func Sign(ctx context.Context, ca *x509.Certificate, caKey crypto.Signer, template *x509.Certificate, pub crypto.PublicKey, opts ...Option) (*x509.Certificate, error) {
+	o := newOptions(opts)
+	if o.fips {
+		if err := CheckFIPSModule(); err != nil {
+			return nil, err
+		}
+		if err := checkFIPSPublicKey(pub); err != nil {
+			return nil, err
+		}
+	}
+	t := *template
+	if t.SerialNumber == nil {
+		serial, err := newSerialNumber(ctx, o, ca)
+		if err != nil {
+			return nil, err
+		}
+		t.SerialNumber = serial
+	} else if o.serialInUse != nil {
+		inUse, err := o.serialInUse(ca, t.SerialNumber)
+		if err != nil {
+			return nil, err
+		}
+		if inUse {
+			return nil, fmt.Errorf("serial %s is already in use by %s", x509util.FormatHex(t.SerialNumber.Bytes()), ca.Subject)
+		}
+	}
+	signer := caKey
+	if o.pss {
+		var err error
+		if signer, err = x509util.NewPSSSigner(caKey, ca); err != nil {
+			return nil, err
+		}
+	}
+	// Keys which can only produce one kind of signature (e.g. KMS keys)
+	// determine the algorithm
+	t.SignatureAlgorithm = x509util.SignatureAlgorithmFor(signer, o.signatureAlgorithm)
+	signer = &contextSigner{ctx: ctx, Signer: signer}
+
+	der, err := createCertificate(ctx, o, &t, ca, pub, signer)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if o.fips {
+		if err := checkFIPSCertificate(cert); err != nil {
+			return nil, err
+		}
+	}
+	return cert, nil
+}
+
+// createCertificate creates a certificate like x509.CreateCertificate. With
+// WithCT it is issued as precertificate first, which is submitted, and the
+// SCTs returned are embedded into the certificate. template must have a
+// serial number, as the precertificate and the certificate share it.
+func createCertificate(ctx context.Context, o *options, template, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) ([]byte, error) {
+	if o.ct == nil {
+		return x509.CreateCertificate(o.rand, template, parent, pub, signer)
+	}
+
+	precertTemplate := *template
+	precertTemplate.ExtraExtensions = append(template.ExtraExtensions[:len(template.ExtraExtensions):len(template.ExtraExtensions)],
+		pkix.Extension{Id: oidExtensionCTPoison, Critical: true, Value: asn1.NullBytes})
+	precert, err := x509.CreateCertificate(o.rand, &precertTemplate, parent, pub, signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create precertificate: %w", err)
+	}
+	scts, err := o.ct(ctx, precert, parent)
+	if err != nil {
+		return nil, err
+	}
+	var list []byte
+	for _, sct := range scts {
+		list = appendUint16Prefixed(list, sct)
+	}
+	value, err := asn1.Marshal(appendUint16Prefixed(nil, list))
+	if err != nil {
+		return nil, err
+	}
+
+	template = &precertTemplate
+	template.ExtraExtensions = append(template.ExtraExtensions[:len(template.ExtraExtensions)-1], pkix.Extension{Id: oidExtensionSCTList, Value: value})
+	return x509.CreateCertificate(o.rand, template, parent, pub, signer)
+}
+
+func appendUint16Prefixed(b, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+// NewSerialNumber returns a random 128 bit serial not in use under issuer
+// according to WithSerialInUse.
+func NewSerialNumber(ctx context.Context, issuer *x509.Certificate, opts ...Option) (*big.Int, error) {
+	return newSerialNumber(ctx, newOptions(opts), issuer)
+}
+
+func newSerialNumber(ctx context.Context, o *options, issuer *x509.Certificate) (*big.Int, error) {
+	for range maxSerialAttempts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		serial, err := rand.Int(o.rand, new(big.Int).Lsh(big.NewInt(1), 128))
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate serial number: %w", err)
+		}
+		if serial.Sign() == 0 {
+			continue
+		}
+		if o.serialInUse == nil {
+			return serial, nil
+		}
+		inUse, err := o.serialInUse(issuer, serial)
+		if err != nil {
+			return nil, err
+		}
+		if !inUse {
+			return serial, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to generate a unique serial number in %d attempts", maxSerialAttempts)
+}
+
+// KeyType is the algorithm and size of a generated key. The algorithms
+// are named like in cfssl: "rsa", "ecdsa" and "ed25519". A size of 0
+// selects the default size, 2048 bits for RSA and P-256 for ECDSA.
+type KeyType struct {
+	Algorithm string
+	Size      int
+}
+
+// GenerateKey generates a key of the type selected with WithKeyType.
+func GenerateKey(opts ...Option) (crypto.Signer, error) {
+	o := newOptions(opts)
+	key, err := generateKey(o.rand, o.keyType)
+	if err != nil {
+		return nil, err
+	}
+	if o.fips {
+		if err := checkFIPSPublicKey(key.Public()); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func generateKey(random io.Reader, keyType KeyType) (crypto.Signer, error) {
+	switch keyType.Algorithm {
+	case "rsa":
+		size := keyType.Size
+		if size == 0 {
+			size = 2048
+		}
+		if size < 2048 {
+			return nil, fmt.Errorf("RSA keys need at least 2048 bits")
+		}
+		return rsa.GenerateKey(random, size)
+	case "ecdsa":
+		curves := map[int]elliptic.Curve{0: elliptic.P256(), 256: elliptic.P256(), 384: elliptic.P384(), 521: elliptic.P521()}
+		curve, ok := curves[keyType.Size]
+		if !ok {
+			return nil, fmt.Errorf("unsupported ECDSA key size %d, use 256, 384 or 521", keyType.Size)
+		}
+		return ecdsa.GenerateKey(curve, random)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(random)
+		return key, err
+	}
+	return nil, fmt.Errorf("%w %q, use rsa, ecdsa or ed25519", ErrUnsupportedKeyType, keyType.Algorithm)
+}
@@ -0,0 +1,107 @@
+package caregen
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// flipBasicConstraints regenerates a self-signed CA by rewriting its DER
+// encoded tbsCertificate: only the basicConstraints extension is marked
+// critical and the result is signed again with the same algorithm. Every
+// other byte, e.g. the extension order and string encodings, is kept.
+func flipBasicConstraints(o *options, ca *x509.Certificate, signer crypto.Signer) (*x509.Certificate, error) {
+	if !bytes.Equal(ca.RawIssuer, ca.RawSubject) {
+		return nil, fmt.Errorf("only self-signed CAs can be rewritten, the CA is issued by %s", ca.Issuer)
+	}
+	// RSA-PSS is signed with the parameters of the CA, whatever the salt
+	pss, err := x509util.ParsePSSSignature(ca)
+	if err != nil {
+		return nil, fmt.Errorf("cannot keep the RSA-PSS signature algorithm of the CA: %w", err)
+	}
+	hash, ok := x509util.SignatureAlgorithmHashes[ca.SignatureAlgorithm]
+	switch {
+	case pss != nil:
+		if algorithm := x509util.SignatureAlgorithmFor(signer, x509util.PSSAlgorithms[pss.Hash]); algorithm != x509util.PSSAlgorithms[pss.Hash] {
+			return nil, fmt.Errorf("the CA key signs with %s, but the CA is signed with RSA-PSS with %s", algorithm, pss.Hash)
+		}
+	case !ok:
+		return nil, fmt.Errorf("unsupported signature algorithm %s", ca.SignatureAlgorithm)
+	default:
+		if algorithm := x509util.SignatureAlgorithmFor(signer, ca.SignatureAlgorithm); algorithm != ca.SignatureAlgorithm {
+			return nil, fmt.Errorf("the CA key signs with %s, but the CA is signed with %s", algorithm, ca.SignatureAlgorithm)
+		}
+	}
+
+	tbs, err := setBasicConstraintsCritical(ca.RawTBSCertificate)
+	if err != nil {
+		return nil, err
+	}
+	var signature []byte
+	if pss != nil {
+		signature, err = pss.Sign(o.rand, tbs, signer)
+	} else {
+		digest := tbs
+		if hash != 0 {
+			h := hash.New()
+			h.Write(tbs)
+			digest = h.Sum(nil)
+		}
+		signature, err = signer.Sign(o.rand, digest, hash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+
+	// The signature algorithm is copied from the original as is
+	var original struct {
+		TBS       asn1.RawValue
+		Algorithm asn1.RawValue
+		Signature asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(ca.Raw, &original); err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	der, err := asn1.Marshal(struct {
+		TBS       asn1.RawValue
+		Algorithm asn1.RawValue
+		Signature asn1.BitString
+	}{asn1.RawValue{FullBytes: tbs}, original.Algorithm, asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)}})
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509util.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rewritten CA certificate: %w", err)
+	}
+	if err := x509util.CheckSignedBy(cert, cert); err != nil {
+		return nil, fmt.Errorf("rewritten CA certificate has an invalid signature: %w", err)
+	}
+	return cert, nil
+}
+
+// setBasicConstraintsCritical returns tbs with the basicConstraints
+// extension marked critical.
+func setBasicConstraintsCritical(tbs []byte) ([]byte, error) {
+	found := false
+	tbs, err := x509util.RewriteExtensions(tbs, func(raw []byte, extension pkix.Extension) ([]byte, error) {
+		if !extension.Id.Equal(oidExtensionBasicConstraints) {
+			return raw, nil
+		}
+		found = true
+		extension.Critical = true
+		return asn1.Marshal(extension)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("the CA has no basicConstraints extension to mark critical")
+	}
+	return tbs, nil
+}
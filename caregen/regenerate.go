@@ -0,0 +1,151 @@
+package caregen
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// Regenerate returns a copy of the self-signed ca with critical basic
+// constraints, signed again with key. The subject, serial number, validity
+// and key identifiers are kept, so certificates issued by ca verify with
+// the regenerated CA. The invariants selected with WithInvariants are
+// checked before it is returned.
+func Regenerate(ctx context.Context, ca *x509.Certificate, key crypto.Signer, opts ...Option) (*x509.Certificate, error) {
+	o := newOptions(opts)
+	if o.fips {
+		if err := CheckFIPSModule(); err != nil {
+			return nil, err
+		}
+		if err := checkFIPSCertificate(ca); err != nil {
+			return nil, fmt.Errorf("original CA is not FIPS 140-3 compliant: %w", err)
+		}
+	}
+	if !x509util.IsPublicKey(ca.PublicKey, key.Public()) {
+		return nil, ErrKeyMismatch
+	}
+	if ext := x509util.FindExtension(ca, oidExtensionBasicConstraints); ext != nil && ext.Critical {
+		return nil, ErrCriticalBasicConstraints
+	}
+	invariants, err := selectInvariants(o.invariants, o.subject != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	template := ca
+	if o.subject != nil {
+		renamed := *ca
+		// The subject is encoded from the fields without the raw subject
+		renamed.Subject, renamed.RawSubject = *o.subject, nil
+		template = &renamed
+	}
+	signer := key
+	if o.pss {
+		if signer, err = x509util.NewPSSSigner(key, ca); err != nil {
+			return nil, err
+		}
+	}
+	if o.deterministic {
+		if template, err = pinSubjectKeyID(template); err != nil {
+			return nil, fmt.Errorf("failed to derive subject key identifier: %w", err)
+		}
+		signer = &deterministicSigner{signer}
+	}
+	signer = &contextSigner{ctx: ctx, Signer: signer}
+
+	minimalDiff := o.minimalDiff
+	if minimalDiff && o.subject != nil {
+		return nil, errors.New("minimal-diff regeneration keeps the subject, the CA cannot be renamed")
+	}
+	if !minimalDiff && x509util.HasPSSPublicKey(ca) {
+		// Go encodes every RSA key as rsaEncryption, which would lift the
+		// restriction of the key to RSA-PSS
+		if o.subject != nil {
+			return nil, errors.New("the public key of the CA is restricted to RSA-PSS, which is only kept by minimal-diff regeneration without renaming")
+		}
+		o.logger.Warn("The public key of the original CA is restricted to RSA-PSS, regenerating it as minimal diff to keep it")
+		minimalDiff = true
+	}
+	var newCA *x509.Certificate
+	if minimalDiff {
+		newCA, err = flipBasicConstraints(o, ca, signer)
+	} else {
+		newCA, err = regenerateFromTemplate(o, template, signer)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkInvariants(o.logger, invariants, ca, newCA); err != nil {
+		return nil, err
+	}
+	if o.fips {
+		if err := checkFIPSCertificate(newCA); err != nil {
+			return nil, fmt.Errorf("regenerated CA is not FIPS 140-3 compliant: %w", err)
+		}
+	}
+	return newCA, nil
+}
+
+// regenerateFromTemplate creates a CA certificate identical to ca except
+// for critical basic constraints, self-signed with signer.
+func regenerateFromTemplate(o *options, ca *x509.Certificate, signer crypto.Signer) (*x509.Certificate, error) {
+	// RSA-PSS parameters Go does not sign with are kept by signing the new
+	// CA again with them, instead of falling back to PKCS#1 v1.5
+	pss, err := x509util.ParsePSSSignature(ca)
+	if err != nil {
+		return nil, fmt.Errorf("cannot keep the RSA-PSS signature algorithm of the original CA: %w", err)
+	}
+	signatureAlgorithm := x509util.SignatureAlgorithmFor(signer, ca.SignatureAlgorithm)
+	if pss != nil {
+		signatureAlgorithm = x509util.PSSAlgorithms[pss.Hash]
+	}
+	if o.signatureAlgorithm != x509.UnknownSignatureAlgorithm {
+		signatureAlgorithm, pss = o.signatureAlgorithm, nil
+	}
+	keyUsage := x509.KeyUsageCertSign | x509.KeyUsageDataEncipherment | x509.KeyUsageDigitalSignature
+	if o.keyUsage != nil {
+		keyUsage = *o.keyUsage
+	}
+
+	// Use the same serial number as the original
+	template := &x509.Certificate{
+		SerialNumber:          ca.SerialNumber,
+		RawSubject:            ca.RawSubject,
+		Subject:               ca.Subject,
+		NotBefore:             ca.NotBefore,
+		NotAfter:              ca.NotAfter,
+		IsCA:                  true,
+		ExtKeyUsage:           ca.ExtKeyUsage,
+		KeyUsage:              ca.KeyUsage | keyUsage,
+		BasicConstraintsValid: true,
+		SignatureAlgorithm:    signatureAlgorithm,
+		AuthorityKeyId:        ca.AuthorityKeyId,
+		SubjectKeyId:          ca.SubjectKeyId,
+	}
+
+	der, err := x509.CreateCertificate(o.rand, template, template, signer.Public(), signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new CA certificate: %w", err)
+	}
+	if pss != nil {
+		if der, err = pss.SignAgain(o.rand, der, signer); err != nil {
+			return nil, err
+		}
+	}
+
+	newCA, err := x509util.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse new CA certificate: %w", err)
+	}
+	if ext := x509util.FindExtension(newCA, oidExtensionBasicConstraints); ext != nil && ext.Critical {
+		o.logger.Info("Verified: Basic constraints are critical in the new CA")
+	} else {
+		o.logger.Warn("Basic constraints are not critical in the new CA")
+	}
+	return newCA, nil
+}
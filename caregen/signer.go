@@ -0,0 +1,44 @@
+package caregen
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"io"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// contextSigner returns from Sign when ctx is done even if the signer does
+// not, e.g. a remote key which does not answer.
+type contextSigner struct {
+	ctx context.Context
+	crypto.Signer
+}
+
+func (s *contextSigner) Sign(random io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, context.Cause(s.ctx)
+	}
+	type result struct {
+		signature []byte
+		err       error
+	}
+	// Buffered so the signer does not block once it returns late
+	done := make(chan result, 1)
+	go func() {
+		signature, err := s.Signer.Sign(random, digest, opts)
+		done <- result{signature, err}
+	}()
+	select {
+	case r := <-done:
+		return r.signature, r.err
+	case <-s.ctx.Done():
+		return nil, context.Cause(s.ctx)
+	}
+}
+
+// SignatureAlgorithm forwards the algorithm of KMS and hardware keys.
+func (s *contextSigner) SignatureAlgorithm() x509.SignatureAlgorithm {
+	return x509util.SignatureAlgorithmFor(s.Signer, x509.UnknownSignatureAlgorithm)
+}
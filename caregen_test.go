@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+)
+
+func TestRegenerate(t *testing.T) {
+	original, key := newTestCA(t, "p256", nil)
+	leaf, err := caregen.Issue(context.Background(), original, key, newTestCSR(t, "leaf.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCA, err := caregen.Regenerate(context.Background(), original, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range newCA.Extensions {
+		if ext.Id.Equal(oidExtensionBasicConstraints) && !ext.Critical {
+			t.Error("the basic constraints of the regenerated CA are not critical")
+		}
+	}
+	if newCA.SerialNumber.Cmp(original.SerialNumber) != 0 || newCA.Subject.String() != original.Subject.String() {
+		t.Errorf("the regenerated CA is %s with serial %s, want %s with serial %s", newCA.Subject, newCA.SerialNumber, original.Subject, original.SerialNumber)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(newCA)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "leaf.example.com"}); err != nil {
+		t.Errorf("a certificate issued by the original CA does not verify with the regenerated CA: %v", err)
+	}
+
+	if _, err := caregen.Regenerate(context.Background(), newCA, key); !errors.Is(err, caregen.ErrCriticalBasicConstraints) {
+		t.Errorf("regenerating a CA with critical basic constraints returned %v, want %v", err, caregen.ErrCriticalBasicConstraints)
+	}
+}
+
+func TestIssueOptions(t *testing.T) {
+	ca, key := newTestCA(t, "p256", nil)
+	issuedAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	var checked []*big.Int
+	cert, err := caregen.Issue(context.Background(), ca, key, newTestCSR(t, "client.example.com"),
+		caregen.WithClock(func() time.Time { return issuedAt }),
+		caregen.WithValidity(24*time.Hour),
+		caregen.WithBackdate(0),
+		caregen.WithKeyUsage(x509.KeyUsageDigitalSignature),
+		caregen.WithExtKeyUsage(x509.ExtKeyUsageClientAuth),
+		caregen.WithSerialInUse(func(issuer *x509.Certificate, serial *big.Int) (bool, error) {
+			checked = append(checked, serial)
+			// The first serial is taken
+			return len(checked) == 1, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.NotBefore.Equal(issuedAt) || !cert.NotAfter.Equal(issuedAt.Add(24*time.Hour)) {
+		t.Errorf("the certificate is valid from %s to %s, want %s to %s", cert.NotBefore, cert.NotAfter, issuedAt, issuedAt.Add(24*time.Hour))
+	}
+	if cert.KeyUsage != x509.KeyUsageDigitalSignature || len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Errorf("the certificate has key usage %d and extended key usage %v", cert.KeyUsage, cert.ExtKeyUsage)
+	}
+	if len(checked) != 2 || cert.SerialNumber.Cmp(checked[1]) != 0 {
+		t.Errorf("the certificate has serial %s after checking %v, want the second one", cert.SerialNumber, checked)
+	}
+}
+
+// blockingSigner never returns from Sign, like an unreachable remote key.
+type blockingSigner struct {
+	crypto.Signer
+}
+
+func (s blockingSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	select {}
+}
+
+func TestRegenerateContext(t *testing.T) {
+	original, key := newTestCA(t, "p256", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := caregen.Regenerate(ctx, original, blockingSigner{key}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("regenerating with a signer that does not answer returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestIssueCT(t *testing.T) {
+	ca, key := newTestCA(t, "p256", nil)
+	sct := []byte("signed certificate timestamp")
+	var submitted *x509.Certificate
+	cert, err := caregen.Issue(context.Background(), ca, key, newTestCSR(t, "ct.example.com"),
+		caregen.WithCT(func(ctx context.Context, precert []byte, issuer *x509.Certificate) ([][]byte, error) {
+			var err error
+			submitted, err = x509.ParseCertificate(precert)
+			return [][]byte{sct}, err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if submitted == nil || submitted.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Fatal("no precertificate with the serial of the certificate was submitted")
+	}
+	poisoned := false
+	for _, ext := range submitted.Extensions {
+		poisoned = poisoned || ext.Id.Equal(oidExtensionCTPoison) && ext.Critical
+	}
+	if !poisoned {
+		t.Error("the precertificate has no critical poison extension")
+	}
+	var list []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidExtensionSCTList) {
+			if _, err := asn1.Unmarshal(ext.Value, &list); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The list and each SCT have a two byte length prefix
+	if want := appendUint16Prefixed(nil, appendUint16Prefixed(nil, sct)); !bytes.Equal(list, want) {
+		t.Errorf("the certificate has the SCT list %x, want %x", list, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ca, _ := newTestCA(t, "p256", nil)
+	otherKey, err := caregen.GenerateKey(caregen.WithKeyType(caregen.KeyType{Algorithm: "ecdsa"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := caregen.Issue(context.Background(), ca, otherKey, newTestCSR(t, "leaf.example.com")); !errors.Is(err, caregen.ErrKeyMismatch) {
+		t.Errorf("issuing with another key returned %v, want %v", err, caregen.ErrKeyMismatch)
+	}
+	if _, err := caregen.GenerateKey(caregen.WithKeyType(caregen.KeyType{Algorithm: "dsa"})); !errors.Is(err, caregen.ErrUnsupportedKeyType) {
+		t.Errorf("generating a DSA key returned %v, want %v", err, caregen.ErrUnsupportedKeyType)
+	}
+
+	constrained, constrainedKey := newTestCA(t, "p256", func(template *x509.Certificate) {
+		template.PermittedDNSDomains = []string{"example.org"}
+	})
+	_, err = caregen.Issue(context.Background(), constrained, constrainedKey, newTestCSR(t, "leaf.example.com"))
+	var verifyErr *caregen.VerificationError
+	if !errors.As(err, &verifyErr) {
+		t.Fatalf("issuing a name the CA does not permit returned %v, want a VerificationError", err)
+	}
+	if len(verifyErr.Chain) != 1 || len(verifyErr.Roots) != 1 || !verifyErr.Roots[0].Equal(constrained) {
+		t.Errorf("the VerificationError has a chain of %d and %d roots, want the certificate and the CA", len(verifyErr.Chain), len(verifyErr.Roots))
+	}
+	var invalid x509.CertificateInvalidError
+	if !errors.As(err, &invalid) || invalid.Reason != x509.CANotAuthorizedForThisName {
+		t.Errorf("the VerificationError wraps %v, want a name constraint violation", verifyErr.Err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// certDB tracks every certificate signed in a SQLite database, if -db is
+// given, as the source of truth for revocation, renewal and reporting.
+// There is no SQLite in the standard library, so the sqlite3 tool is used.
+var certDB struct {
+	sync.Mutex
+	file string
+	// created is set once the schema has been created.
+	created bool
+}
+
+const certDBSchema = `CREATE TABLE IF NOT EXISTS certificates (
+	sha256 TEXT PRIMARY KEY,
+	serial TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	issuer TEXT NOT NULL,
+	sans TEXT NOT NULL,
+	not_before TEXT NOT NULL,
+	not_after TEXT NOT NULL,
+	is_ca INTEGER NOT NULL,
+	event TEXT NOT NULL,
+	issued_at TEXT NOT NULL,
+	revoked_at TEXT,
+	revocation_reason INTEGER,
+	pem TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS certificates_serial ON certificates (issuer, serial);
+CREATE INDEX IF NOT EXISTS certificates_not_after ON certificates (not_after);
+CREATE TABLE IF NOT EXISTS crls (
+	issuer TEXT PRIMARY KEY,
+	number INTEGER NOT NULL
+);
+`
+
+// dbCertificate is a row of the certificates table.
+type dbCertificate struct {
+	SHA256           string `json:"sha256"`
+	Serial           string `json:"serial"`
+	Subject          string `json:"subject"`
+	Issuer           string `json:"issuer"`
+	SANs             string `json:"sans"`
+	NotBefore        string `json:"not_before"`
+	NotAfter         string `json:"not_after"`
+	IsCA             int    `json:"is_ca"`
+	Event            string `json:"event"`
+	IssuedAt         string `json:"issued_at"`
+	RevokedAt        string `json:"revoked_at"`
+	RevocationReason int    `json:"revocation_reason"`
+	PEM              string `json:"pem"`
+}
+
+// registerCertDB registers the -db flag.
+func registerCertDB(fs *flag.FlagSet) {
+	fs.StringVar(&certDB.file, "db", "", "Track every regenerated, issued and re-signed certificate in this SQLite database (requires the sqlite3 tool)")
+}
+
+// recordInCertDB adds cert to the database. Signing fails if the
+// certificate cannot be recorded.
+func recordInCertDB(event string, cert *x509.Certificate) error {
+	if certDB.file == "" {
+		return nil
+	}
+	certDB.Lock()
+	defer certDB.Unlock()
+	sql := ""
+	if !certDB.created {
+		sql = certDBSchema
+	}
+	sum := sha256.Sum256(cert.Raw)
+	sql += fmt.Sprintf("INSERT OR IGNORE INTO certificates (sha256, serial, subject, issuer, sans, not_before, not_after, is_ca, event, issued_at, pem) VALUES (%s, %s, %s, %s, %s, %s, %s, %d, %s, %s, %s);\n",
+		sqlQuote(hex.EncodeToString(sum[:])),
+		sqlQuote(x509util.FormatHex(cert.SerialNumber.Bytes())),
+		sqlQuote(cert.Subject.String()),
+		sqlQuote(cert.Issuer.String()),
+		sqlQuote(strings.Join(certificateSANs(cert), ",")),
+		sqlQuote(cert.NotBefore.UTC().Format(time.RFC3339)),
+		sqlQuote(cert.NotAfter.UTC().Format(time.RFC3339)),
+		sqlBool(cert.IsCA),
+		sqlQuote(event),
+		sqlQuote(now.Now().UTC().Format(time.RFC3339)),
+		sqlQuote(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))))
+	if _, err := runSQLite(certDB.file, sql); err != nil {
+		return fmt.Errorf("failed to record certificate in database: %w", err)
+	}
+	certDB.created = true
+	slog.Debug("Recorded certificate in database", "event", event, "serial", x509util.FormatHex(cert.SerialNumber.Bytes()), "db", certDB.file)
+	return nil
+}
+
+// queryCertDB returns the rows of the certificates table matching where,
+// ordered by expiry.
+func queryCertDB(file, where string) ([]dbCertificate, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+	sql := "SELECT * FROM certificates"
+	if where != "" {
+		sql += " WHERE " + where
+	}
+	out, err := runSQLite(file, sql+" ORDER BY not_after, serial;\n", "-json", "-readonly")
+	if err != nil {
+		return nil, err
+	}
+	var rows []dbCertificate
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(out, &rows); err != nil {
+		return nil, fmt.Errorf("invalid output of sqlite3: %w", err)
+	}
+	return rows, nil
+}
+
+// runSQLite runs the statements in sql on the database file with the
+// sqlite3 tool and returns its output. Concurrent writers wait for each
+// other for up to 5s.
+func runSQLite(file, sql string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sqlite3", append(append([]string{"-bail", "-batch", "-cmd", ".timeout 5000"}, args...), file)...)
+	cmd.Stdin = strings.NewReader(sql)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("sqlite3 failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// sqlQuote returns s as SQL string literal.
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func sqlBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Lists the certificates tracked in the database, optionally only the ones
+// expiring soon, e.g. to renew them.
+func runDB(args []string) {
+	const usage = "go run *.go db list [-db issued.db] [-expiring 720h] [-revoked] [-json]"
+	if len(args) == 0 || args[0] != "list" {
+		usageError(usage)
+	}
+	fs := flag.NewFlagSet("db list", flag.ContinueOnError)
+	registerCertDB(fs)
+	expiring := fs.Duration("expiring", 0, "Only list unrevoked certificates expiring within this duration")
+	revoked := fs.Bool("revoked", false, "Only list revoked certificates")
+	jsonOutput := fs.Bool("json", false, "Print the certificates as JSON")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args[1:])
+	logOpts.setup()
+
+	if fs.NArg() > 0 || (*expiring != 0 && *revoked) {
+		usageError(usage)
+	}
+	if certDB.file == "" {
+		certDB.file = "issued.db"
+	}
+	var where []string
+	if *expiring != 0 {
+		where = append(where, "revoked_at IS NULL", "not_after <= "+sqlQuote(now.Now().Add(*expiring).UTC().Format(time.RFC3339)))
+	}
+	if *revoked {
+		where = append(where, "revoked_at IS NOT NULL")
+	}
+	rows, err := queryCertDB(certDB.file, strings.Join(where, " AND "))
+	if err != nil {
+		fatal("Failed to query database", "db", certDB.file, "error", err)
+	}
+
+	if *jsonOutput {
+		if rows == nil {
+			rows = []dbCertificate{}
+		}
+		data, err := json.MarshalIndent(rows, "", "  ")
+		if err != nil {
+			fatal("Failed to encode certificates", "error", err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERIAL\tSUBJECT\tISSUER\tNOT AFTER\tSTATUS")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", row.Serial, row.Subject, row.Issuer, row.NotAfter, row.status())
+	}
+	w.Flush()
+}
+
+// status returns whether the certificate is valid, expired or revoked.
+func (c dbCertificate) status() string {
+	if c.RevokedAt != "" {
+		return "revoked"
+	}
+	if notAfter, err := time.Parse(time.RFC3339, c.NotAfter); err == nil && now.Now().After(notAfter) {
+		return "expired"
+	}
+	if c.IsCA != 0 {
+		return "valid (CA)"
+	}
+	return "valid"
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// kubectlOptions selects the kubectl binary and cluster used by the
+// Kubernetes integrations. The tool shells out to kubectl instead of
+// talking to the API server directly, so all of kubectl's authentication
+// mechanisms work unchanged.
+type kubectlOptions struct {
+	binary  string
+	context string
+}
+
+func (o *kubectlOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.binary, "kubectl", "kubectl", "Path to the kubectl binary")
+	fs.StringVar(&o.context, "context", "", "kubeconfig context to use (default: current context)")
+}
+
+// run executes kubectl with args and returns its stdout. stdin is passed
+// to kubectl if not nil.
+func (o *kubectlOptions) run(stdin []byte, args ...string) ([]byte, error) {
+	if o.context != "" {
+		args = append([]string{"--context", o.context}, args...)
+	}
+	cmd := exec.Command(o.binary, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("kubectl %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// getJSON runs kubectl get ... -o json and decodes the result into v.
+func (o *kubectlOptions) getJSON(v any, args ...string) error {
+	out, err := o.run(nil, append(append([]string{"get"}, args...), "-o", "json")...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		return fmt.Errorf("failed to decode kubectl output: %w", err)
+	}
+	return nil
+}
+
+// Subsets of the cert-manager and core API objects used below.
+type certManagerIssuer struct {
+	Spec struct {
+		CA *struct {
+			SecretName string `json:"secretName"`
+		} `json:"ca"`
+	} `json:"spec"`
+}
+
+type kubeSecret struct {
+	Data map[string]string `json:"data"`
+}
+
+type certManagerCertificate struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		IssuerRef struct {
+			Name string `json:"name"`
+			Kind string `json:"kind"`
+		} `json:"issuerRef"`
+	} `json:"spec"`
+	Status struct {
+		Conditions []map[string]any `json:"conditions"`
+	} `json:"status"`
+}
+
+func runCertManager(args []string) {
+	fs := flag.NewFlagSet("cert-manager", flag.ContinueOnError)
+	issuer := fs.String("issuer", "", "Name of the cert-manager CA issuer")
+	issuerKind := fs.String("issuer-kind", "ClusterIssuer", "Kind of the issuer: ClusterIssuer or Issuer")
+	namespace := fs.String("namespace", "cert-manager", "Namespace of the issuer secret (the cluster resource namespace for ClusterIssuers)")
+	reissue := fs.Bool("reissue", false, "Trigger re-issuance of all Certificates using the issuer")
+	dryRun := fs.Bool("dry-run", false, "Only show what would be changed")
+	var kubectl kubectlOptions
+	kubectl.register(fs)
+	registerAudit(fs)
+	registerWebhook(fs)
+	registerCertDB(fs)
+	registerSerials(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if *issuer == "" || (*issuerKind != "ClusterIssuer" && *issuerKind != "Issuer") {
+		usageError("go run *.go cert-manager -issuer <name> [-issuer-kind ClusterIssuer|Issuer] [-namespace cert-manager] [-reissue] [-dry-run] [-context ctx]")
+	}
+
+	var iss certManagerIssuer
+	getArgs := []string{strings.ToLower(*issuerKind), *issuer}
+	if *issuerKind == "Issuer" {
+		getArgs = append(getArgs, "-n", *namespace)
+	}
+	if err := kubectl.getJSON(&iss, getArgs...); err != nil {
+		exitWith(exitFailure, "Failed to get issuer", "issuer", *issuer, "error", err)
+	}
+	if iss.Spec.CA == nil || iss.Spec.CA.SecretName == "" {
+		exitWith(exitInvalidCA, "Issuer is not a CA issuer", "issuer", *issuer)
+	}
+	secretName := iss.Spec.CA.SecretName
+
+	var secret kubeSecret
+	if err := kubectl.getJSON(&secret, "secret", secretName, "-n", *namespace); err != nil {
+		exitWith(exitFailure, "Failed to get issuer secret", "secret", secretName, "error", err)
+	}
+	certPEM, err := base64.StdEncoding.DecodeString(secret.Data["tls.crt"])
+	if err != nil {
+		exitWith(exitInvalidCA, "Invalid tls.crt in issuer secret", "error", err)
+	}
+	keyPEM, err := base64.StdEncoding.DecodeString(secret.Data["tls.key"])
+	if err != nil {
+		exitWith(exitInvalidCA, "Invalid tls.key in issuer secret", "error", err)
+	}
+
+	originalCA, caKey, _, err := parseCA(certPEM, keyPEM)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA from issuer secret", "secret", secretName, "error", err)
+	}
+	slog.Info("Loaded CA from issuer secret", "secret", *namespace+"/"+secretName, "subject", originalCA.Subject.String())
+
+	if err := checkOriginalCABasicConstraints(originalCA); err != nil {
+		exitWith(exitInvalidCA, "Original CA validation failed", "error", err)
+	}
+
+	var opts caOptions
+	newCA, err := opts.regenerate(originalCA, caKey)
+	if err != nil {
+		exitWith(exitRegenerationFailed, "Failed to generate new CA", "error", err)
+	}
+	newCAPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newCA.Raw})
+
+	// Replace the CA certificate, keep any chain that followed it
+	newTLSCrt := replaceCertificatePEM(certPEM, originalCA.Raw, newCAPEM)
+	data := map[string]string{"tls.crt": base64.StdEncoding.EncodeToString(newTLSCrt)}
+	if _, ok := secret.Data["ca.crt"]; ok {
+		caCrt, err := base64.StdEncoding.DecodeString(secret.Data["ca.crt"])
+		if err == nil {
+			data["ca.crt"] = base64.StdEncoding.EncodeToString(replaceCertificatePEM(caCrt, originalCA.Raw, newCAPEM))
+		}
+	}
+	patch, err := json.Marshal(map[string]any{"data": data})
+	if err != nil {
+		fatal("Failed to encode secret patch", "error", err)
+	}
+
+	if *dryRun {
+		slog.Info("Dry run: would update issuer secret with regenerated CA", "secret", *namespace+"/"+secretName)
+	} else {
+		_, err = kubectl.run(nil, "patch", "secret", secretName, "-n", *namespace, "--type", "merge", "-p", string(patch))
+		if err != nil {
+			exitWith(exitFailure, "Failed to update issuer secret", "error", err)
+		}
+		slog.Info("Updated issuer secret with regenerated CA", "secret", *namespace+"/"+secretName)
+	}
+
+	if !*reissue {
+		return
+	}
+
+	var certificates struct {
+		Items []certManagerCertificate `json:"items"`
+	}
+	if err := kubectl.getJSON(&certificates, "certificates.cert-manager.io", "--all-namespaces"); err != nil {
+		exitWith(exitFailure, "Failed to list Certificates", "error", err)
+	}
+	for _, cert := range certificates.Items {
+		ref := cert.Spec.IssuerRef
+		kind := ref.Kind
+		if kind == "" {
+			kind = "Issuer"
+		}
+		if ref.Name != *issuer || kind != *issuerKind || (kind == "Issuer" && cert.Metadata.Namespace != *namespace) {
+			continue
+		}
+		name := cert.Metadata.Namespace + "/" + cert.Metadata.Name
+		if *dryRun {
+			slog.Info("Dry run: would trigger re-issuance", "certificate", name)
+			continue
+		}
+		if err := triggerCertificateReissue(&kubectl, cert); err != nil {
+			slog.Error("Failed to trigger re-issuance", "certificate", name, "error", err)
+			continue
+		}
+		slog.Info("Triggered re-issuance", "certificate", name)
+	}
+}
+
+// triggerCertificateReissue sets the Issuing condition on a Certificate,
+// the same mechanism `cmctl renew` uses to request re-issuance.
+func triggerCertificateReissue(kubectl *kubectlOptions, cert certManagerCertificate) error {
+	var conditions []map[string]any
+	for _, c := range cert.Status.Conditions {
+		if c["type"] != "Issuing" {
+			conditions = append(conditions, c)
+		}
+	}
+	conditions = append(conditions, map[string]any{
+		"type":               "Issuing",
+		"status":             "True",
+		"reason":             "ManuallyTriggered",
+		"message":            "Certificate re-issuance triggered by ca-regen after CA regeneration",
+		"lastTransitionTime": time.Now().UTC().Format(time.RFC3339),
+	})
+	patch, err := json.Marshal(map[string]any{"status": map[string]any{"conditions": conditions}})
+	if err != nil {
+		return err
+	}
+	_, err = kubectl.run(nil, "patch", "certificates.cert-manager.io", cert.Metadata.Name, "-n", cert.Metadata.Namespace,
+		"--subresource", "status", "--type", "merge", "-p", string(patch))
+	return err
+}
+
+// replaceCertificatePEM replaces the PEM block containing the DER
+// certificate old in data with the PEM encoded replacement. Other blocks
+// are kept unchanged.
+func replaceCertificatePEM(data, old, replacement []byte) []byte {
+	var out []byte
+	replaced := false
+	for rest := data; ; {
+		block, next := pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if !replaced && block.Type == "CERTIFICATE" && bytes.Equal(block.Bytes, old) {
+			out = append(out, replacement...)
+			replaced = true
+		} else {
+			out = append(out, pem.EncodeToMemory(block)...)
+		}
+		rest = next
+	}
+	if !replaced {
+		return replacement
+	}
+	return out
+}
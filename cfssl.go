@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cfsslKeyUsages and cfsslExtKeyUsages map the usage names of cfssl
+// signing profiles to key usages.
+var (
+	cfsslKeyUsages = map[string]x509.KeyUsage{
+		"signing":            x509.KeyUsageDigitalSignature,
+		"digital signature":  x509.KeyUsageDigitalSignature,
+		"content commitment": x509.KeyUsageContentCommitment,
+		"key encipherment":   x509.KeyUsageKeyEncipherment,
+		"key agreement":      x509.KeyUsageKeyAgreement,
+		"data encipherment":  x509.KeyUsageDataEncipherment,
+		"cert sign":          x509.KeyUsageCertSign,
+		"crl sign":           x509.KeyUsageCRLSign,
+		"encipher only":      x509.KeyUsageEncipherOnly,
+		"decipher only":      x509.KeyUsageDecipherOnly,
+	}
+	cfsslExtKeyUsages = map[string]x509.ExtKeyUsage{
+		"any":              x509.ExtKeyUsageAny,
+		"server auth":      x509.ExtKeyUsageServerAuth,
+		"client auth":      x509.ExtKeyUsageClientAuth,
+		"code signing":     x509.ExtKeyUsageCodeSigning,
+		"email protection": x509.ExtKeyUsageEmailProtection,
+		"s/mime":           x509.ExtKeyUsageEmailProtection,
+		"ipsec end system": x509.ExtKeyUsageIPSECEndSystem,
+		"ipsec tunnel":     x509.ExtKeyUsageIPSECTunnel,
+		"ipsec user":       x509.ExtKeyUsageIPSECUser,
+		"timestamping":     x509.ExtKeyUsageTimeStamping,
+		"ocsp signing":     x509.ExtKeyUsageOCSPSigning,
+		"microsoft sgc":    x509.ExtKeyUsageMicrosoftServerGatedCrypto,
+		"netscape sgc":     x509.ExtKeyUsageNetscapeServerGatedCrypto,
+	}
+)
+
+// cfsslConfig is a cfssl config.json. Only the signing profiles are used.
+type cfsslConfig struct {
+	Signing struct {
+		Default  *cfsslProfile            `json:"default"`
+		Profiles map[string]*cfsslProfile `json:"profiles"`
+	} `json:"signing"`
+}
+
+type cfsslProfile struct {
+	Usages []string `json:"usages"`
+	Expiry string   `json:"expiry"`
+}
+
+// cfsslCSR is a cfssl csr.json.
+type cfsslCSR struct {
+	CN    string   `json:"CN"`
+	Hosts []string `json:"hosts"`
+	Key   *struct {
+		Algo string `json:"algo"`
+		Size int    `json:"size"`
+	} `json:"key"`
+	Names []struct {
+		C  string `json:"C"`
+		ST string `json:"ST"`
+		L  string `json:"L"`
+		O  string `json:"O"`
+		OU string `json:"OU"`
+	} `json:"names"`
+}
+
+// loadCFSSLProfile returns a profile of a cfssl config.json, or the
+// default profile if name is empty. Like cfssl, the default profile of the
+// tool is used if the config has none.
+func loadCFSSLProfile(file, name string) (certProfile, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return certProfile{}, err
+	}
+	var config cfsslConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return certProfile{}, fmt.Errorf("failed to parse cfssl config %s: %w", file, err)
+	}
+	profile := config.Signing.Default
+	if name != "" {
+		var ok bool
+		if profile, ok = config.Signing.Profiles[name]; !ok {
+			var names []string
+			for n := range config.Signing.Profiles {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return certProfile{}, fmt.Errorf("unknown profile %q, %s has: %s", name, file, strings.Join(names, ", "))
+		}
+	}
+	if profile == nil {
+		return defaultCertProfile, nil
+	}
+	return profile.certProfile()
+}
+
+func (p *cfsslProfile) certProfile() (certProfile, error) {
+	if len(p.Usages) == 0 {
+		return certProfile{}, fmt.Errorf("profile has no usages")
+	}
+	profile := certProfile{expiry: defaultCertProfile.expiry}
+	for _, usage := range p.Usages {
+		if keyUsage, ok := cfsslKeyUsages[usage]; ok {
+			profile.keyUsage |= keyUsage
+		} else if extKeyUsage, ok := cfsslExtKeyUsages[usage]; ok {
+			profile.extKeyUsage = append(profile.extKeyUsage, extKeyUsage)
+		} else {
+			return certProfile{}, fmt.Errorf("unknown usage %q", usage)
+		}
+	}
+	if p.Expiry != "" {
+		expiry, err := time.ParseDuration(p.Expiry)
+		if err != nil {
+			return certProfile{}, fmt.Errorf("invalid expiry: %w", err)
+		}
+		profile.expiry = expiry
+	}
+	return profile, nil
+}
+
+// loadCFSSLCSR reads a cfssl csr.json and returns the requested subject and
+// names as a CSR without key, along with the key of its key stanza, or the
+// zero keySpec if it has none.
+func loadCFSSLCSR(file string) (*x509.CertificateRequest, keySpec, error) {
+	data, err := readInput(file)
+	if err != nil {
+		return nil, keySpec{}, err
+	}
+	var req cfsslCSR
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, keySpec{}, fmt.Errorf("failed to parse cfssl CSR %s: %w", file, err)
+	}
+	csr := &x509.CertificateRequest{Subject: pkix.Name{CommonName: req.CN}}
+	for _, name := range req.Names {
+		csr.Subject.Country = appendNonEmpty(csr.Subject.Country, name.C)
+		csr.Subject.Province = appendNonEmpty(csr.Subject.Province, name.ST)
+		csr.Subject.Locality = appendNonEmpty(csr.Subject.Locality, name.L)
+		csr.Subject.Organization = appendNonEmpty(csr.Subject.Organization, name.O)
+		csr.Subject.OrganizationalUnit = appendNonEmpty(csr.Subject.OrganizationalUnit, name.OU)
+	}
+	setHosts(csr, req.Hosts)
+	var key keySpec
+	if req.Key != nil {
+		key = keySpec{req.Key.Algo, req.Key.Size}
+	}
+	return csr, key, nil
+}
+
+func appendNonEmpty(values []string, value string) []string {
+	if value == "" {
+		return values
+	}
+	return append(values, value)
+}
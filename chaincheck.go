@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// Connects to a server and checks that the chain it presents is complete,
+// ordered from the leaf to the root and free of duplicate and expired
+// certificates, the common deployment errors after swapping a CA.
+func runCheckChain(args []string) {
+	fs := flag.NewFlagSet("check-chain", flag.ContinueOnError)
+	var caFiles stringList
+	fs.Var(&caFiles, "ca", "Path to PEM encoded CA certificate(s) the chain must lead to (repeatable, default the system trust store)")
+	registerTarget(fs, "Server whose presented chain is checked, as `host[:port]` (default port 443); chains in files are checked with verify")
+	registerIPFamily(fs)
+	registerProxy(fs)
+	registerClock(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if testTarget == "" || ipFamily == "dual" {
+		usageError("go run *.go check-chain -target host[:port] [-servername name] [-ca ca.pem]... [-ip-family any|ipv4|ipv6] [-proxy url]")
+	}
+
+	var roots []*x509.Certificate
+	for _, file := range caFiles {
+		certs, err := loadCertificates(file)
+		if err != nil {
+			exitWith(exitFailure, "Failed to load CA certificates", "file", file, "error", err)
+		}
+		roots = append(roots, certs...)
+	}
+	presented, err := presentedChain()
+	if err != nil {
+		exitWith(exitFailure, "Failed to fetch the presented chain", "target", testTarget, "error", err)
+	}
+	for i, cert := range presented {
+		fmt.Printf("%d: %s (issuer %s, expires %s)\n", i, cert.Subject, cert.Issuer, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	hostname := testHostname(testNetworks()[0])
+	problems, warnings := checkPresentedChain(presented, roots, hostname, now.Now())
+	for _, warning := range warnings {
+		slog.Warn(warning)
+	}
+	for _, problem := range problems {
+		slog.Error(problem)
+	}
+	if len(problems) > 0 {
+		exitWith(exitLintFailed, "The presented chain has problems", "target", testTarget, "problems", len(problems), "warnings", len(warnings))
+	}
+	slog.Info("The presented chain is complete and correctly ordered", "target", testTarget, "certificates", len(presented), "warnings", len(warnings))
+}
+
+// checkPresentedChain checks the chain a server presents, leaf first. The
+// chain must lead to one of roots, or with none to a CA in the system
+// trust store. Problems break clients; warnings are harmless but
+// unnecessary or fragile.
+func checkPresentedChain(presented, roots []*x509.Certificate, hostname string, now time.Time) (problems, warnings []string) {
+	report := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	warn := func(format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	leaf := presented[0]
+
+	// Duplicates, which also confuse the order checks below
+	var unique []*x509.Certificate
+	for i, cert := range presented {
+		if x509util.ContainsCert(unique, cert) {
+			report("certificate %d, %s, is sent more than once", i, x509util.DescribeCert(cert))
+			continue
+		}
+		unique = append(unique, cert)
+	}
+
+	// Every certificate has to be issued by the one following it
+	for i := 1; i < len(unique); i++ {
+		cert, previous := unique[i], unique[i-1]
+		if issuedBy(previous, cert) {
+			continue
+		}
+		if child := issuedCert(cert, unique); child != nil {
+			report("%s is the issuer of %s but follows %s, the chain is out of order", x509util.DescribeCert(cert), x509util.DescribeCert(child), x509util.DescribeCert(previous))
+		} else {
+			warn("%s did not issue any other presented certificate and is unnecessary", x509util.DescribeCert(cert))
+		}
+	}
+
+	// Validity of the leaf and the intermediates
+	for _, cert := range unique {
+		switch {
+		case now.Before(cert.NotBefore):
+			report("%s is not valid before %s", x509util.DescribeCert(cert), cert.NotBefore.Format(time.RFC3339))
+		case now.After(cert.NotAfter):
+			report("%s expired at %s", x509util.DescribeCert(cert), cert.NotAfter.Format(time.RFC3339))
+		case cert != leaf && cert.NotAfter.Before(leaf.NotAfter):
+			warn("%s expires at %s, before the leaf", x509util.DescribeCert(cert), cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	// Completeness: following the issuers from the leaf through the
+	// presented certificates has to end at a trusted CA
+	top := leaf
+	for range len(unique) {
+		issuer, _ := x509util.FindIssuer(top, unique)
+		if issuer == nil || issuer == top {
+			break
+		}
+		top = issuer
+	}
+	if top != leaf && isSelfSigned(top) {
+		warn("the root %s is sent along, clients ignore it and use their own copy", x509util.DescribeCert(top))
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range unique[1:] {
+		intermediates.AddCert(cert)
+	}
+	opts := x509.VerifyOptions{Intermediates: intermediates, DNSName: hostname, CurrentTime: now}
+	if len(roots) > 0 {
+		opts.Roots = x509.NewCertPool()
+		for _, root := range roots {
+			opts.Roots.AddCert(root)
+		}
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		var unknownAuthority x509.UnknownAuthorityError
+		if errors.As(err, &unknownAuthority) && !isSelfSigned(top) {
+			report("the chain is incomplete: no presented intermediate or trusted CA has the subject %q, the issuer of %s", top.Issuer, x509util.DescribeCert(top))
+		} else {
+			report("the chain does not verify: %s", x509util.ExplainVerifyError(err))
+		}
+	}
+	return problems, warnings
+}
+
+// issuedBy reports whether cert was signed by issuer.
+func issuedBy(cert, issuer *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, issuer.RawSubject) && x509util.CheckSignedBy(cert, issuer) == nil
+}
+
+// issuedCert returns the certificate of certs issued by issuer, if any.
+func issuedCert(issuer *x509.Certificate, certs []*x509.Certificate) *x509.Certificate {
+	for _, cert := range certs {
+		if cert != issuer && issuedBy(cert, issuer) {
+			return cert
+		}
+	}
+	return nil
+}
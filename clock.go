@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// clock is the source of the current time for issuing and verifying
+// certificates.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// offsetClock runs at the pace of the system clock from another point in
+// time, so timeouts and durations keep working while simulating it.
+type offsetClock struct {
+	offset time.Duration
+}
+
+func (c offsetClock) Now() time.Time {
+	return time.Now().Add(c.offset)
+}
+
+// now is the clock of issuance and verification. It is only replaced by
+// the -now flag, timeouts and measurements use the system time.
+var now clock = systemClock{}
+
+// nowFlag is the -now flag simulating another time: RFC 3339, a date or a
+// duration relative to the system time.
+type nowFlag struct{}
+
+func (nowFlag) String() string {
+	return ""
+}
+
+func (nowFlag) Set(value string) error {
+	var simulated time.Time
+	var err error
+	switch {
+	case strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-"):
+		var offset time.Duration
+		if offset, err = time.ParseDuration(value); err == nil {
+			simulated = time.Now().Add(offset)
+		}
+	case len(value) == len(time.DateOnly):
+		simulated, err = time.Parse(time.DateOnly, value)
+	default:
+		simulated, err = time.Parse(time.RFC3339, value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid time %q, use RFC 3339 (2030-01-02T15:04:05Z), a date (2030-01-02) or a duration like +8760h", value)
+	}
+	now = offsetClock{offset: time.Until(simulated)}
+	return nil
+}
+
+// registerClock registers the -now flag.
+func registerClock(fs *flag.FlagSet) {
+	fs.Var(nowFlag{}, "now", "Issue and verify certificates as if it was this time, e.g. 2030-01-02, 2030-01-02T15:04:05Z or +8760h from now")
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// CMP (RFC 4210) body types, which are the context specific tags of the
+// PKIBody choice.
+const (
+	cmpBodyIR       = 0
+	cmpBodyIP       = 1
+	cmpBodyCR       = 2
+	cmpBodyCP       = 3
+	cmpBodyP10CR    = 4
+	cmpBodyPKIConf  = 19
+	cmpBodyError    = 23
+	cmpBodyCertConf = 24
+)
+
+// PKIFailureInfo bits.
+const (
+	cmpFailBadAlg           = 0
+	cmpFailBadMessageCheck  = 1
+	cmpFailBadRequest       = 2
+	cmpFailBadDataFormat    = 5
+	cmpFailBadPOP           = 9
+	cmpFailUnacceptedPolicy = 15
+	cmpFailSystemFailure    = 25
+)
+
+var (
+	oidPasswordBasedMAC = asn1.ObjectIdentifier{1, 2, 840, 113533, 7, 66, 13}
+	oidImplicitConfirm  = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 4, 13}
+)
+
+// cmpMACAlgorithms maps the HMAC algorithms usable with password based MAC
+// protection to their hash.
+var cmpMACAlgorithms = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+}{
+	{asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 8, 1, 2}, crypto.SHA1},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}, crypto.SHA256},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}, crypto.SHA384},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}, crypto.SHA512},
+}
+
+// cmpSignatureAlgorithms are the signature algorithms accepted for
+// signature protection and proof of possession.
+var cmpSignatureAlgorithms = []struct {
+	oid       asn1.ObjectIdentifier
+	algorithm x509.SignatureAlgorithm
+}{
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, x509.SHA256WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}, x509.SHA384WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}, x509.SHA512WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}, x509.ECDSAWithSHA256},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}, x509.ECDSAWithSHA384},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}, x509.ECDSAWithSHA512},
+	{asn1.ObjectIdentifier{1, 3, 101, 112}, x509.PureEd25519},
+}
+
+type cmpMessage struct {
+	Header     asn1.RawValue
+	Body       asn1.RawValue
+	Protection asn1.BitString  `asn1:"explicit,optional,tag:0"`
+	ExtraCerts []asn1.RawValue `asn1:"explicit,optional,tag:1"`
+}
+
+type cmpHeader struct {
+	PVNO          int
+	Sender        asn1.RawValue
+	Recipient     asn1.RawValue
+	MessageTime   time.Time                `asn1:"generalized,explicit,optional,tag:0"`
+	ProtectionAlg pkix.AlgorithmIdentifier `asn1:"explicit,optional,tag:1"`
+	SenderKID     []byte                   `asn1:"explicit,optional,tag:2"`
+	RecipKID      []byte                   `asn1:"explicit,optional,tag:3"`
+	TransactionID []byte                   `asn1:"explicit,optional,tag:4"`
+	SenderNonce   []byte                   `asn1:"explicit,optional,tag:5"`
+	RecipNonce    []byte                   `asn1:"explicit,optional,tag:6"`
+	FreeText      asn1.RawValue            `asn1:"optional,tag:7"`
+	GeneralInfo   []cmpInfoTypeAndValue    `asn1:"explicit,optional,tag:8"`
+}
+
+type cmpInfoTypeAndValue struct {
+	InfoType  asn1.ObjectIdentifier
+	InfoValue asn1.RawValue `asn1:"optional"`
+}
+
+type cmpPBMParameter struct {
+	Salt           []byte
+	OWF            pkix.AlgorithmIdentifier
+	IterationCount int
+	MAC            pkix.AlgorithmIdentifier
+}
+
+type cmpStatusInfo struct {
+	Status       int
+	StatusString []asn1.RawValue `asn1:"optional"`
+	FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+type cmpCertRepMessage struct {
+	CAPubs   []asn1.RawValue `asn1:"explicit,optional,tag:1"`
+	Response []cmpCertResponse
+}
+
+type cmpCertResponse struct {
+	CertReqID        int
+	Status           cmpStatusInfo
+	CertifiedKeyPair asn1.RawValue `asn1:"optional"`
+}
+
+type crmfCertReqMsg struct {
+	CertReq asn1.RawValue
+	POPO    asn1.RawValue `asn1:"optional"`
+	RegInfo asn1.RawValue `asn1:"optional"`
+}
+
+type crmfCertRequest struct {
+	CertReqID    int
+	CertTemplate asn1.RawValue
+	Controls     asn1.RawValue `asn1:"optional"`
+}
+
+type crmfPOPOSigningKey struct {
+	Input     asn1.RawValue `asn1:"optional,tag:0"`
+	Algorithm pkix.AlgorithmIdentifier
+	Signature asn1.BitString
+}
+
+// cmpFailure is a rejected request, answered with an error message.
+type cmpFailure struct {
+	failInfo int
+	message  string
+}
+
+func (f *cmpFailure) Error() string {
+	return f.message
+}
+
+func cmpError(failInfo int, format string, args ...any) *cmpFailure {
+	return &cmpFailure{failInfo: failInfo, message: fmt.Sprintf(format, args...)}
+}
+
+// CMP server for initialization, certification and PKCS#10 requests,
+// issuing certificates from the regenerated CA. Messages are transferred
+// over HTTP (RFC 6712) and requests are answered immediately.
+func runCMPServe(args []string) {
+	fs := flag.NewFlagSet("cmp-serve", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	addr := fs.String("addr", "localhost:8090", "Address for the CMP server to listen on")
+	secret := fs.String("secret", "", "Shared secret for password based MAC protection of requests (default: accept all requests)")
+	validity := fs.Duration("cert-validity", 365*24*time.Hour, "Validity of issued certificates")
+	registerShutdown(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() {
+		usageError("go run *.go cmp-serve (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-addr host:port] [-secret <secret>] [-cert-validity 8760h]")
+	}
+
+	setup := regenerateCAs(caOpts)
+	var outer struct {
+		TBS       asn1.RawValue
+		Algorithm pkix.AlgorithmIdentifier
+		Signature asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(setup.newCA.Raw, &outer); err != nil {
+		exitWith(exitRegenerationFailed, "Failed to parse new CA", "error", err)
+	}
+	if _, ok := x509util.SignatureAlgorithmHashes[setup.newCA.SignatureAlgorithm]; !ok {
+		exitWith(exitInvalidCA, "Unsupported CA signature algorithm", "algorithm", setup.newCA.SignatureAlgorithm.String())
+	}
+	if *secret == "" {
+		slog.Warn("No -secret given, every request will be accepted")
+	}
+
+	cmp := &cmpServer{
+		ca:                 setup.newCA,
+		caKey:              setup.caKey,
+		signatureAlgorithm: outer.Algorithm,
+		secret:             *secret,
+		validity:           *validity,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /", cmp.handle)
+	server := &http.Server{
+		Addr:     *addr,
+		Handler:  mux,
+		ErrorLog: serverErrorLog(),
+	}
+	slog.Info("CMP server started", "url", "http://"+*addr+"/pkix/", "ca_file", "new-ca.pem")
+	if err := serveUntilSignal(server); err != nil {
+		fatal("CMP server failed", "error", err)
+	}
+}
+
+type cmpServer struct {
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	// signatureAlgorithm is the algorithm identifier of the CA's
+	// signatures, used for signature protected responses.
+	signatureAlgorithm pkix.AlgorithmIdentifier
+	secret             string
+	validity           time.Duration
+}
+
+// cmpRequest is a parsed request message.
+type cmpRequest struct {
+	message cmpMessage
+	header  cmpHeader
+	// macProtected is set for requests protected with the shared secret,
+	// whose responses are protected the same way.
+	macProtected bool
+}
+
+func (s *cmpServer) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := parseCMPRequest(body)
+	if err != nil {
+		slog.Warn("Invalid CMP message", "remote", r.RemoteAddr, "error", err)
+		http.Error(w, "invalid CMP message", http.StatusBadRequest)
+		return
+	}
+
+	responseType, responseBody, err := s.process(req)
+	if err != nil {
+		var failure *cmpFailure
+		if !errors.As(err, &failure) {
+			failure = cmpError(cmpFailSystemFailure, "%v", err)
+		}
+		slog.Warn("Rejected CMP request", "remote", r.RemoteAddr, "transaction", x509util.FormatHex(req.header.TransactionID), "error", failure.message)
+		responseType = cmpBodyError
+		responseBody, _ = asn1.Marshal(struct{ Status cmpStatusInfo }{cmpRejection(failure)})
+	}
+	response, err := s.response(req, responseType, responseBody)
+	if err != nil {
+		slog.Error("Failed to create CMP response", "error", err)
+		http.Error(w, "failed to create CMP response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkixcmp")
+	w.Write(response)
+}
+
+// parseCMPRequest parses a PKIMessage and its header.
+func parseCMPRequest(der []byte) (*cmpRequest, error) {
+	req := &cmpRequest{}
+	if _, err := asn1.Unmarshal(der, &req.message); err != nil {
+		return nil, err
+	}
+	if _, err := asn1.Unmarshal(req.message.Header.FullBytes, &req.header); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// process authenticates a request and returns the type and content of
+// the response body.
+func (s *cmpServer) process(req *cmpRequest) (int, []byte, error) {
+	if err := s.authenticate(req); err != nil {
+		return 0, nil, err
+	}
+	body := req.message.Body
+	if body.Class != asn1.ClassContextSpecific {
+		return 0, nil, cmpError(cmpFailBadDataFormat, "invalid PKIBody")
+	}
+	switch body.Tag {
+	case cmpBodyIR, cmpBodyCR:
+		var msgs []crmfCertReqMsg
+		if _, err := asn1.Unmarshal(body.Bytes, &msgs); err != nil || len(msgs) == 0 {
+			return 0, nil, cmpError(cmpFailBadDataFormat, "invalid certificate request messages")
+		}
+		rep := cmpCertRepMessage{}
+		if body.Tag == cmpBodyIR {
+			rep.CAPubs = []asn1.RawValue{{FullBytes: s.ca.Raw}}
+		}
+		for _, msg := range msgs {
+			id, csr, err := parseCRMFRequest(msg)
+			if err != nil {
+				return 0, nil, err
+			}
+			response, err := s.issue(req, id, csr)
+			if err != nil {
+				return 0, nil, err
+			}
+			rep.Response = append(rep.Response, response)
+		}
+		der, err := asn1.Marshal(rep)
+		return body.Tag + 1, der, err
+	case cmpBodyP10CR:
+		csr, err := x509.ParseCertificateRequest(body.Bytes)
+		if err == nil {
+			err = csr.CheckSignature()
+		}
+		if err != nil {
+			return 0, nil, cmpError(cmpFailBadPOP, "invalid CSR: %v", err)
+		}
+		// There is no certReqId for PKCS#10 requests (RFC 9483, section 4.1.4)
+		response, err := s.issue(req, -1, csr)
+		if err != nil {
+			return 0, nil, err
+		}
+		der, err := asn1.Marshal(cmpCertRepMessage{Response: []cmpCertResponse{response}})
+		return cmpBodyCP, der, err
+	case cmpBodyCertConf:
+		slog.Info("Certificate confirmed", "transaction", x509util.FormatHex(req.header.TransactionID))
+		return cmpBodyPKIConf, asn1.NullBytes, nil
+	}
+	return 0, nil, cmpError(cmpFailBadRequest, "unsupported PKIBody type %d", body.Tag)
+}
+
+// authenticate verifies the protection of a request. Requests need to be
+// protected with the shared secret or signed with a certificate of the
+// CA, unless no secret is configured.
+func (s *cmpServer) authenticate(req *cmpRequest) error {
+	algorithm := req.header.ProtectionAlg.Algorithm
+	protected, err := req.protectedPart()
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(algorithm) == 0:
+		if s.secret != "" {
+			return cmpError(cmpFailBadMessageCheck, "unprotected message")
+		}
+		return nil
+	case algorithm.Equal(oidPasswordBasedMAC):
+		if s.secret == "" {
+			return cmpError(cmpFailBadMessageCheck, "MAC protected message, but no -secret is configured")
+		}
+		mac, err := cmpPBM(s.secret, req.header.ProtectionAlg.Parameters.FullBytes, protected)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(mac, req.message.Protection.RightAlign()) != 1 {
+			return cmpError(cmpFailBadMessageCheck, "wrong MAC, is the secret correct?")
+		}
+		req.macProtected = true
+		return nil
+	}
+
+	if len(req.message.ExtraCerts) == 0 {
+		return cmpError(cmpFailBadMessageCheck, "signature protected message without certificate")
+	}
+	cert, err := x509.ParseCertificate(req.message.ExtraCerts[0].FullBytes)
+	if err != nil {
+		return cmpError(cmpFailBadDataFormat, "invalid protection certificate: %v", err)
+	}
+	if err := verifyCMPSignature(cert.PublicKey, req.header.ProtectionAlg, protected, req.message.Protection.RightAlign()); err != nil {
+		return cmpError(cmpFailBadMessageCheck, "invalid message signature: %v", err)
+	}
+	t := now.Now()
+	if cert.CheckSignatureFrom(s.ca) != nil || t.Before(cert.NotBefore) || t.After(cert.NotAfter) {
+		if s.secret != "" {
+			return cmpError(cmpFailBadMessageCheck, "message not signed with a valid certificate of the CA")
+		}
+	}
+	return nil
+}
+
+// protectedPart returns the DER encoding of the header and body, which is
+// what the protection is computed over.
+func (r *cmpRequest) protectedPart() ([]byte, error) {
+	return asn1.Marshal(struct{ Header, Body asn1.RawValue }{r.message.Header, r.message.Body})
+}
+
+// cmpPBM computes a password based MAC (RFC 4211, section 4.4).
+func cmpPBM(secret string, params, data []byte) ([]byte, error) {
+	var pbm cmpPBMParameter
+	if _, err := asn1.Unmarshal(params, &pbm); err != nil {
+		return nil, cmpError(cmpFailBadDataFormat, "invalid PBM parameters: %v", err)
+	}
+	owf, ok := pkcs7HashFor(pbm.OWF.Algorithm)
+	if !ok {
+		return nil, cmpError(cmpFailBadAlg, "unsupported PBM one-way function %s", pbm.OWF.Algorithm)
+	}
+	if pbm.IterationCount < 1 || pbm.IterationCount > 100000 {
+		return nil, cmpError(cmpFailBadRequest, "unsupported PBM iteration count %d", pbm.IterationCount)
+	}
+	var macHash crypto.Hash
+	for _, m := range cmpMACAlgorithms {
+		if m.oid.Equal(pbm.MAC.Algorithm) {
+			macHash = m.hash
+		}
+	}
+	if macHash == 0 {
+		return nil, cmpError(cmpFailBadAlg, "unsupported PBM MAC algorithm %s", pbm.MAC.Algorithm)
+	}
+
+	key := append([]byte(secret), pbm.Salt...)
+	for i := 0; i < pbm.IterationCount; i++ {
+		h := owf.New()
+		h.Write(key)
+		key = h.Sum(nil)
+	}
+	mac := hmac.New(macHash.New, key)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+func verifyCMPSignature(public crypto.PublicKey, algorithm pkix.AlgorithmIdentifier, signed, signature []byte) error {
+	for _, a := range cmpSignatureAlgorithms {
+		if a.oid.Equal(algorithm.Algorithm) {
+			return (&x509.Certificate{PublicKey: public}).CheckSignature(a.algorithm, signed, signature)
+		}
+	}
+	return cmpError(cmpFailBadAlg, "unsupported signature algorithm %s", algorithm.Algorithm)
+}
+
+// parseCRMFRequest returns the requested certificate of a CRMF (RFC 4211)
+// request as CSR, after checking the proof of possession.
+func parseCRMFRequest(msg crmfCertReqMsg) (int, *x509.CertificateRequest, error) {
+	var req crmfCertRequest
+	if _, err := asn1.Unmarshal(msg.CertReq.FullBytes, &req); err != nil {
+		return 0, nil, cmpError(cmpFailBadDataFormat, "invalid certificate request: %v", err)
+	}
+	csr := &x509.CertificateRequest{}
+	// The fields of the template are IMPLICIT, except for the names which
+	// are a CHOICE and thus EXPLICIT
+	for rest := req.CertTemplate.Bytes; len(rest) > 0; {
+		var field asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &field); err != nil {
+			return 0, nil, cmpError(cmpFailBadDataFormat, "invalid certificate template: %v", err)
+		}
+		retagged := append([]byte{0x30}, field.FullBytes[1:]...)
+		switch field.Tag {
+		case 5:
+			var rdns pkix.RDNSequence
+			if _, err = asn1.Unmarshal(field.Bytes, &rdns); err == nil {
+				csr.Subject.FillFromRDNSequence(&rdns)
+				csr.RawSubject = field.Bytes
+			}
+		case 6:
+			csr.PublicKey, err = x509.ParsePKIXPublicKey(retagged)
+		case 9:
+			var extensions []pkix.Extension
+			if _, err = asn1.Unmarshal(retagged, &extensions); err == nil {
+				err = parseSANExtension(extensions, csr)
+			}
+		}
+		if err != nil {
+			return 0, nil, cmpError(cmpFailBadDataFormat, "invalid certificate template field %d: %v", field.Tag, err)
+		}
+	}
+	if csr.PublicKey == nil {
+		return 0, nil, cmpError(cmpFailBadRequest, "certificate template without public key")
+	}
+
+	// Only signature based proof of possession (RFC 4211, section 4.1) over
+	// the certificate request is supported
+	if msg.POPO.Class != asn1.ClassContextSpecific || msg.POPO.Tag != 1 {
+		return 0, nil, cmpError(cmpFailBadPOP, "unsupported proof of possession")
+	}
+	var popo crmfPOPOSigningKey
+	if _, err := asn1.Unmarshal(append([]byte{0x30}, msg.POPO.FullBytes[1:]...), &popo); err != nil {
+		return 0, nil, cmpError(cmpFailBadDataFormat, "invalid proof of possession: %v", err)
+	}
+	if len(popo.Input.FullBytes) > 0 {
+		return 0, nil, cmpError(cmpFailBadPOP, "proof of possession with POPOSigningKeyInput is not supported")
+	}
+	if err := verifyCMPSignature(csr.PublicKey, popo.Algorithm, msg.CertReq.FullBytes, popo.Signature.RightAlign()); err != nil {
+		return 0, nil, cmpError(cmpFailBadPOP, "invalid proof of possession: %v", err)
+	}
+	return req.CertReqID, csr, nil
+}
+
+// parseSANExtension sets the SANs of csr from a subject alternative name
+// extension, if there is one among extensions.
+func parseSANExtension(extensions []pkix.Extension, csr *x509.CertificateRequest) error {
+	for _, ext := range extensions {
+		if !ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 17}) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return err
+		}
+		for _, name := range names {
+			switch name.Tag {
+			case 1:
+				csr.EmailAddresses = append(csr.EmailAddresses, string(name.Bytes))
+			case 2:
+				csr.DNSNames = append(csr.DNSNames, string(name.Bytes))
+			case 6:
+				uri, err := url.Parse(string(name.Bytes))
+				if err != nil {
+					return err
+				}
+				csr.URIs = append(csr.URIs, uri)
+			case 7:
+				csr.IPAddresses = append(csr.IPAddresses, net.IP(name.Bytes))
+			}
+		}
+	}
+	return nil
+}
+
+// issue issues a certificate for one request of a message.
+func (s *cmpServer) issue(req *cmpRequest, certReqID int, csr *x509.CertificateRequest) (cmpCertResponse, error) {
+	cert, err := issueClientCert(s.ca, s.caKey, csr, s.validity)
+	if err != nil {
+		return cmpCertResponse{}, fmt.Errorf("issuance failed: %w", err)
+	}
+	slog.Info("Issued certificate", "transaction", x509util.FormatHex(req.header.TransactionID), "subject", cert.Subject.String(), "serial", x509util.FormatHex(cert.SerialNumber.Bytes()))
+	keyPair, err := asn1.Marshal(struct{ CertOrEncCert asn1.RawValue }{asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw}})
+	if err != nil {
+		return cmpCertResponse{}, err
+	}
+	return cmpCertResponse{CertReqID: certReqID, CertifiedKeyPair: asn1.RawValue{FullBytes: keyPair}}, nil
+}
+
+// cmpRejection returns the status of a rejected request.
+func cmpRejection(failure *cmpFailure) cmpStatusInfo {
+	failInfo := make([]byte, failure.failInfo/8+1)
+	failInfo[failure.failInfo/8] = 0x80 >> (failure.failInfo % 8)
+	return cmpStatusInfo{
+		Status:       2,
+		StatusString: []asn1.RawValue{{Tag: asn1.TagUTF8String, Bytes: []byte(failure.message)}},
+		FailInfo:     asn1.BitString{Bytes: failInfo, BitLength: failure.failInfo + 1},
+	}
+}
+
+// response returns the protected response message to req.
+func (s *cmpServer) response(req *cmpRequest, bodyType int, body []byte) ([]byte, error) {
+	senderNonce := make([]byte, 16)
+	if _, err := rand.Read(senderNonce); err != nil {
+		return nil, err
+	}
+	header := cmpHeader{
+		PVNO:          req.header.PVNO,
+		Sender:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: s.ca.RawSubject},
+		Recipient:     req.header.Sender,
+		MessageTime:   time.Now().UTC().Truncate(time.Second),
+		TransactionID: req.header.TransactionID,
+		SenderNonce:   senderNonce,
+		RecipNonce:    req.header.SenderNonce,
+	}
+	for _, info := range req.header.GeneralInfo {
+		if info.InfoType.Equal(oidImplicitConfirm) {
+			header.GeneralInfo = append(header.GeneralInfo, cmpInfoTypeAndValue{InfoType: oidImplicitConfirm, InfoValue: asn1.NullRawValue})
+		}
+	}
+	if req.macProtected {
+		header.ProtectionAlg = req.header.ProtectionAlg
+	} else {
+		header.ProtectionAlg = s.signatureAlgorithm
+		header.SenderKID = s.ca.SubjectKeyId
+	}
+	headerDER, err := asn1.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	msg := cmpMessage{
+		Header: asn1.RawValue{FullBytes: headerDER},
+		Body:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: bodyType, IsCompound: true, Bytes: body},
+	}
+	protected, err := asn1.Marshal(struct{ Header, Body asn1.RawValue }{msg.Header, msg.Body})
+	if err != nil {
+		return nil, err
+	}
+
+	var protection []byte
+	if req.macProtected {
+		protection, err = cmpPBM(s.secret, header.ProtectionAlg.Parameters.FullBytes, protected)
+	} else {
+		protection, err = s.sign(protected)
+		msg.ExtraCerts = []asn1.RawValue{{FullBytes: s.ca.Raw}}
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg.Protection = asn1.BitString{Bytes: protection, BitLength: 8 * len(protection)}
+	return asn1.Marshal(msg)
+}
+
+// sign signs data with the CA key using the CA's signature algorithm.
+func (s *cmpServer) sign(data []byte) ([]byte, error) {
+	return signData(s.caKey, s.ca.SignatureAlgorithm, data)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// Checks that the constraints of a set of CAs are consistent with their
+// issuers before a hierarchy is rolled out: clients enforce the tighter
+// constraint of the issuer, so a CA claiming more than its issuer allows
+// fails only once it is used.
+func runHierarchyCheck(args []string, usage string) {
+	fs := flag.NewFlagSet("hierarchy check", flag.ContinueOnError)
+	registerClock(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if fs.NArg() == 0 {
+		usageError(usage)
+	}
+	var cas []*x509.Certificate
+	for _, file := range fs.Args() {
+		certs, err := loadCertificates(file)
+		if err != nil {
+			exitWith(exitFailure, "Failed to load certificates", "file", file, "error", err)
+		}
+		for _, cert := range certs {
+			if cert.IsCA {
+				cas = append(cas, cert)
+			}
+		}
+	}
+
+	problems := 0
+	for _, cert := range cas {
+		problems += printFindings(cert.Subject.String(), checkIssuerConstraints(cert, findIssuers(cert, cas)))
+	}
+	if problems > 0 {
+		exitWith(exitLintFailed, "Hierarchy check found violations", "errors", problems)
+	}
+}
+
+// findIssuers returns the CAs of cas which signed cert, other than other
+// versions of cert itself. There may be several for cross-signed CAs.
+func findIssuers(cert *x509.Certificate, cas []*x509.Certificate) []*x509.Certificate {
+	var issuers []*x509.Certificate
+	for _, ca := range cas {
+		if isSameCA(ca, cert) || !bytes.Equal(ca.RawSubject, cert.RawIssuer) {
+			continue
+		}
+		if cert.CheckSignatureFrom(ca) == nil {
+			issuers = append(issuers, ca)
+		}
+	}
+	return issuers
+}
+
+// checkIssuerConstraints checks the path length, name constraints,
+// extended key usages and validity of the CA cert against each of its
+// issuers. Self-signed CAs and CAs whose issuer is not known only get a
+// note.
+func checkIssuerConstraints(cert *x509.Certificate, issuers []*x509.Certificate) []lintFinding {
+	var findings []lintFinding
+	add := func(severity, check, format string, args ...any) {
+		// A cross-signed issuer is found once per certificate
+		if finding := (lintFinding{severity, check, fmt.Sprintf(format, args...)}); !slices.Contains(findings, finding) {
+			findings = append(findings, finding)
+		}
+	}
+	if len(issuers) == 0 {
+		if !bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+			add(lintWarning, "issuer-missing", "issuer %s is not in the checked set", cert.Issuer)
+		}
+		return findings
+	}
+
+	for _, issuer := range issuers {
+		// The issuer's path length counts the CAs below it
+		if issuer.MaxPathLen == 0 && issuer.MaxPathLenZero {
+			add(lintError, "path-length-exceeded", "issuer %s allows no CA below it (pathlen 0)", issuer.Subject)
+		} else if issuer.MaxPathLen > 0 && (cert.MaxPathLen < 0 || cert.MaxPathLen >= issuer.MaxPathLen) {
+			add(lintWarning, "path-length-widened", "path length %s exceeds the %d allowed by issuer %s", describePathLen(cert), issuer.MaxPathLen-1, issuer.Subject)
+		}
+
+		if widened := widenedNames(cert, issuer); len(widened) > 0 {
+			add(lintError, "name-constraints-widened", "permits %s outside the name constraints of issuer %s", strings.Join(widened, ", "), issuer.Subject)
+		}
+
+		if restricted(issuer) {
+			switch {
+			case !restricted(cert):
+				add(lintError, "eku-widened", "has no extended key usage restriction, issuer %s is restricted to %s", issuer.Subject, strings.Join(x509util.ExtKeyUsageStrings(issuer), ", "))
+			default:
+				var widened []string
+				for _, usage := range cert.ExtKeyUsage {
+					if !slices.Contains(issuer.ExtKeyUsage, usage) {
+						widened = append(widened, x509util.ExtKeyUsageNames[usage])
+					}
+				}
+				for _, oid := range cert.UnknownExtKeyUsage {
+					if !slices.ContainsFunc(issuer.UnknownExtKeyUsage, oid.Equal) {
+						widened = append(widened, oid.String())
+					}
+				}
+				if len(widened) > 0 {
+					add(lintError, "eku-widened", "extended key usage %s is not allowed by issuer %s", strings.Join(widened, ", "), issuer.Subject)
+				}
+			}
+		}
+
+		if cert.NotAfter.After(issuer.NotAfter) {
+			add(lintError, "outlives-issuer", "expires on %s, after issuer %s on %s", cert.NotAfter.UTC().Format(time.RFC3339), issuer.Subject, issuer.NotAfter.UTC().Format(time.RFC3339))
+		}
+		if cert.NotBefore.Before(issuer.NotBefore) {
+			add(lintWarning, "valid-before-issuer", "valid from %s, before issuer %s from %s", cert.NotBefore.UTC().Format(time.RFC3339), issuer.Subject, issuer.NotBefore.UTC().Format(time.RFC3339))
+		}
+	}
+	return findings
+}
+
+func describePathLen(cert *x509.Certificate) string {
+	if cert.MaxPathLen < 0 {
+		return "unlimited"
+	}
+	return fmt.Sprint(cert.MaxPathLen)
+}
+
+// restricted reports whether the extended key usages of a CA restrict the
+// certificates below it. No extension or anyExtendedKeyUsage does not.
+func restricted(cert *x509.Certificate) bool {
+	if len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0 {
+		return false
+	}
+	return !slices.Contains(cert.ExtKeyUsage, x509.ExtKeyUsageAny)
+}
+
+// widenedNames returns the permitted names of cert which are not within
+// the permitted subtrees of issuer, or which issuer excludes. A CA without
+// permitted names of a type inherits the ones of the issuer, which is not
+// a widening.
+func widenedNames(cert, issuer *x509.Certificate) []string {
+	var widened []string
+	checkDomains := func(kind string, permitted, issuerPermitted, issuerExcluded []string) {
+		for _, name := range permitted {
+			if (len(issuerPermitted) > 0 && !slices.ContainsFunc(issuerPermitted, func(parent string) bool { return domainWithin(name, parent) })) ||
+				slices.ContainsFunc(issuerExcluded, func(parent string) bool { return domainWithin(name, parent) }) {
+				widened = append(widened, kind+":"+name)
+			}
+		}
+	}
+	checkDomains("DNS", cert.PermittedDNSDomains, issuer.PermittedDNSDomains, issuer.ExcludedDNSDomains)
+	checkDomains("email", cert.PermittedEmailAddresses, issuer.PermittedEmailAddresses, issuer.ExcludedEmailAddresses)
+	checkDomains("URI", cert.PermittedURIDomains, issuer.PermittedURIDomains, issuer.ExcludedURIDomains)
+	for _, ipNet := range cert.PermittedIPRanges {
+		if (len(issuer.PermittedIPRanges) > 0 && !slices.ContainsFunc(issuer.PermittedIPRanges, func(parent *net.IPNet) bool { return ipNetWithin(ipNet, parent) })) ||
+			slices.ContainsFunc(issuer.ExcludedIPRanges, func(parent *net.IPNet) bool { return ipNetWithin(ipNet, parent) }) {
+			widened = append(widened, "IP:"+ipNet.String())
+		}
+	}
+	return widened
+}
+
+// domainWithin reports whether the name constraint domain name is within
+// parent. A leading dot only matches subdomains, as in RFC 5280 URI and
+// email constraints.
+func domainWithin(name, parent string) bool {
+	name, parent = strings.ToLower(name), strings.ToLower(parent)
+	if _, domain, ok := strings.Cut(name, "@"); ok && !strings.Contains(parent, "@") {
+		name = domain
+	}
+	if strings.HasPrefix(parent, ".") {
+		return strings.HasSuffix(name, parent)
+	}
+	return name == parent || strings.HasSuffix(name, "."+parent)
+}
+
+// ipNetWithin reports whether the range ipNet is within parent.
+func ipNetWithin(ipNet, parent *net.IPNet) bool {
+	ones, bits := ipNet.Mask.Size()
+	parentOnes, parentBits := parent.Mask.Size()
+	return bits == parentBits && ones >= parentOnes && parent.Contains(ipNet.IP)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// certificatePair is the CertificatePair of X.509 (RFC 2587 section 3),
+// the value of the crossCertificatePair directory attribute. The forward
+// certificate is issued to the CA of the directory entry by the other CA,
+// the reverse certificate by it to the other CA.
+type certificatePair struct {
+	Forward asn1.RawValue `asn1:"optional,explicit,tag:0"`
+	Reverse asn1.RawValue `asn1:"optional,explicit,tag:1"`
+}
+
+// Cross-signs the regenerated CA and another CA in both directions, so
+// clients trusting either one accept certificates of the other, and emits
+// the certificate pair for directory based PKI consumers.
+func runCrossSign(args []string) {
+	fs := flag.NewFlagSet("cross-sign", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	otherBundle := fs.String("other-ca", "", "Path to PEM file containing both the certificate and private key of the other CA")
+	otherCert := fs.String("other-ca-cert", "", "Path to PEM encoded certificate of the other CA")
+	otherKey := fs.String("other-ca-key", "", "Path to PEM encoded private key of the other CA, defaults to the -other-ca-cert file")
+	out := fs.String("out", "cross", "Base name of the written cross certificates (<out>-forward.pem, <out>-reverse.pem) and pair (<out>-pair.der)")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() || (*otherBundle == "") == (*otherCert == "") || fs.NArg() > 0 {
+		usageError("go run *.go cross-sign (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) (-other-ca <other-bundle.pem> | -other-ca-cert <other-cert.pem> -other-ca-key <other-key.pem>) [-out cross]")
+	}
+	if *otherBundle != "" {
+		*otherCert, *otherKey = *otherBundle, *otherBundle
+	} else if *otherKey == "" {
+		*otherKey = *otherCert
+	}
+	other, otherCAKey, _, err := loadCA(*otherCert, *otherKey)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load other CA", "error", err)
+	}
+	if !other.IsCA {
+		exitWith(exitInvalidCA, "Other certificate is not a CA", "subject", other.Subject.String())
+	}
+	setup := regenerateCAs(caOpts)
+	if isSameCA(setup.newCA, other) {
+		usageError("the other CA is the CA itself")
+	}
+
+	if err := crossSign(setup.newCA, setup.caKey, other, otherCAKey, *out); err != nil {
+		exitWith(exitFailure, "Failed to cross-sign", "error", err)
+	}
+}
+
+// crossSign cross-signs ca and other in both directions and writes the
+// cross certificates and the pair with the base name out.
+func crossSign(ca *x509.Certificate, caKey crypto.Signer, other *x509.Certificate, otherKey crypto.Signer, out string) error {
+	forward, err := crossCertificate(ca, other, otherKey)
+	if err != nil {
+		return fmt.Errorf("failed to cross-sign the regenerated CA: %w", err)
+	}
+	writeIssued(out+"-forward", forward)
+	reverse, err := crossCertificate(other, ca, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to cross-sign the other CA: %w", err)
+	}
+	writeIssued(out+"-reverse", reverse)
+
+	pair, err := asn1.Marshal(certificatePair{
+		Forward: asn1.RawValue{FullBytes: forward.Raw},
+		Reverse: asn1.RawValue{FullBytes: reverse.Raw},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode certificate pair: %w", err)
+	}
+	pairFile := out + "-pair.der"
+	if err := os.WriteFile(pairFile, pair, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate pair: %w", err)
+	}
+	slog.Info("Wrote cross certificate pair", "file", pairFile, "ca", ca.Subject.String(), "other", other.Subject.String())
+	return nil
+}
+
+// crossCertificate issues a certificate for the subject, key and CA
+// constraints of ca, signed by issuer. Its validity is that of ca, within
+// the one of issuer.
+func crossCertificate(ca, issuer *x509.Certificate, issuerKey crypto.Signer) (*x509.Certificate, error) {
+	template := caTemplate(ca)
+	if template.NotBefore.Before(issuer.NotBefore) {
+		template.NotBefore = issuer.NotBefore
+	}
+	if template.NotAfter.After(issuer.NotAfter) {
+		slog.Warn("Limiting the validity of the cross certificate to the one of the issuer", "subject", ca.Subject.String(), "issuer", issuer.Subject.String(), "not_after", issuer.NotAfter.Format(time.RFC3339))
+		template.NotAfter = issuer.NotAfter
+	}
+	return signCertificate(issuer, issuerKey, template, ca.PublicKey, nil)
+}
+
+// caTemplate returns the template of a certificate with the subject,
+// subject key identifier, validity, CA constraints and key usages of ca.
+func caTemplate(ca *x509.Certificate) *x509.Certificate {
+	return &x509.Certificate{
+		RawSubject:                  ca.RawSubject,
+		NotBefore:                   ca.NotBefore,
+		NotAfter:                    ca.NotAfter,
+		SubjectKeyId:                ca.SubjectKeyId,
+		IsCA:                        true,
+		BasicConstraintsValid:       true,
+		MaxPathLen:                  ca.MaxPathLen,
+		MaxPathLenZero:              ca.MaxPathLenZero,
+		KeyUsage:                    ca.KeyUsage,
+		ExtKeyUsage:                 ca.ExtKeyUsage,
+		UnknownExtKeyUsage:          ca.UnknownExtKeyUsage,
+		PermittedDNSDomainsCritical: ca.PermittedDNSDomainsCritical,
+		PermittedDNSDomains:         ca.PermittedDNSDomains,
+		ExcludedDNSDomains:          ca.ExcludedDNSDomains,
+		PermittedIPRanges:           ca.PermittedIPRanges,
+		ExcludedIPRanges:            ca.ExcludedIPRanges,
+		PermittedEmailAddresses:     ca.PermittedEmailAddresses,
+		ExcludedEmailAddresses:      ca.ExcludedEmailAddresses,
+		PermittedURIDomains:         ca.PermittedURIDomains,
+		ExcludedURIDomains:          ca.ExcludedURIDomains,
+	}
+}
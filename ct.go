@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+var (
+	oidExtensionCTPoison = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+	oidExtensionSCTList  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+)
+
+// ctLog is a Certificate Transparency log (RFC 6962) issued leaves are
+// submitted to.
+type ctLog struct {
+	url string
+	key crypto.PublicKey
+	// id is the log ID, the SHA-256 hash of the public key.
+	id [32]byte
+}
+
+// ctLogList is the repeatable -ct-log flag, <url>=<public-key-file>. The
+// key file holds the PEM encoded or, like in the published log lists,
+// base64 encoded DER public key of the log.
+type ctLogList []*ctLog
+
+func (l *ctLogList) String() string {
+	var urls []string
+	for _, log := range *l {
+		urls = append(urls, log.url)
+	}
+	return strings.Join(urls, ",")
+}
+
+func (l *ctLogList) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return fmt.Errorf("expected <url>=<public-key-file>")
+	}
+	url, keyFile := strings.TrimRight(value[:i], "/"), value[i+1:]
+	data, err := readInput(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read log key: %w", err)
+	}
+	var der []byte
+	if block := findPEMBlock(data, "PUBLIC KEY"); block != nil {
+		der = block.Bytes
+	} else if der, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err != nil {
+		return fmt.Errorf("log key %s is neither PEM nor base64 encoded", keyFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse log key %s: %w", keyFile, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return fmt.Errorf("unsupported log key %s, CT logs use ECDSA or RSA keys", x509util.DescribePublicKey(key))
+	}
+	*l = append(*l, &ctLog{url: url, key: key, id: sha256.Sum256(der)})
+	return nil
+}
+
+// submitPrecertificate submits precert, issued by issuer, to every log
+// and returns the SCTs to embed into the certificate, for caregen.WithCT.
+// The logs have to accept the issuer as root.
+func (l ctLogList) submitPrecertificate(ctx context.Context, precert []byte, issuer *x509.Certificate) ([][]byte, error) {
+	parsed, err := x509.ParseCertificate(precert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse precertificate: %w", err)
+	}
+	tbs, err := removeExtension(parsed.RawTBSCertificate, oidExtensionCTPoison)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := precertEntry(issuer, tbs)
+	if err != nil {
+		return nil, err
+	}
+	var scts [][]byte
+	for _, log := range l {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		sct, err := log.submit("add-pre-chain", precert, issuer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to submit precertificate to %s: %w", log.url, err)
+		}
+		if err := sct.verify(log, entry); err != nil {
+			return nil, fmt.Errorf("invalid SCT from %s: %w", log.url, err)
+		}
+		slog.Info("Received SCT", "log", log.url, "timestamp", sct.time().Format(time.RFC3339))
+		scts = append(scts, sct.marshal())
+	}
+	return scts, nil
+}
+
+// submitCertificate submits cert to every log and returns the SCTs for
+// delivery in the TLS extension.
+func (l ctLogList) submitCertificate(cert, issuer *x509.Certificate) ([][]byte, error) {
+	entry, err := x509Entry(cert.Raw)
+	if err != nil {
+		return nil, err
+	}
+	var scts [][]byte
+	for _, log := range l {
+		sct, err := log.submit("add-chain", cert.Raw, issuer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to submit certificate to %s: %w", log.url, err)
+		}
+		if err := sct.verify(log, entry); err != nil {
+			return nil, fmt.Errorf("invalid SCT from %s: %w", log.url, err)
+		}
+		slog.Info("Received SCT", "log", log.url, "timestamp", sct.time().Format(time.RFC3339))
+		scts = append(scts, sct.marshal())
+	}
+	return scts, nil
+}
+
+// submit submits a certificate or precertificate via the add-chain or
+// add-pre-chain endpoint.
+func (log *ctLog) submit(endpoint string, der []byte, issuer *x509.Certificate) (*signedCertificateTimestamp, error) {
+	body, err := json.Marshal(map[string][]string{
+		"chain": {base64.StdEncoding.EncodeToString(der), base64.StdEncoding.EncodeToString(issuer.Raw)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(log.url+"/ct/v1/"+endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var response struct {
+		Version    int    `json:"sct_version"`
+		ID         []byte `json:"id"`
+		Timestamp  uint64 `json:"timestamp"`
+		Extensions []byte `json:"extensions"`
+		Signature  []byte `json:"signature"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if response.Version != 0 {
+		return nil, fmt.Errorf("unsupported SCT version %d", response.Version)
+	}
+	if !bytes.Equal(response.ID, log.id[:]) {
+		return nil, fmt.Errorf("the SCT is of log %s, not of the configured key", base64.StdEncoding.EncodeToString(response.ID))
+	}
+	sct := &signedCertificateTimestamp{logID: log.id, timestamp: response.Timestamp, extensions: response.Extensions}
+	if err := sct.unmarshalSignature(response.Signature); err != nil {
+		return nil, err
+	}
+	return sct, nil
+}
+
+// signedCertificateTimestamp is a version 1 SCT.
+type signedCertificateTimestamp struct {
+	logID [32]byte
+	// timestamp is in milliseconds since the epoch.
+	timestamp          uint64
+	extensions         []byte
+	hashAlgorithm      uint8
+	signatureAlgorithm uint8
+	signature          []byte
+}
+
+func (s *signedCertificateTimestamp) time() time.Time {
+	return time.UnixMilli(int64(s.timestamp)).UTC()
+}
+
+// marshal encodes the SCT in its TLS presentation.
+func (s *signedCertificateTimestamp) marshal() []byte {
+	b := []byte{0}
+	b = append(b, s.logID[:]...)
+	b = binary.BigEndian.AppendUint64(b, s.timestamp)
+	b = appendUint16Prefixed(b, s.extensions)
+	b = append(b, s.hashAlgorithm, s.signatureAlgorithm)
+	return appendUint16Prefixed(b, s.signature)
+}
+
+// unmarshalSignature parses a TLS DigitallySigned struct.
+func (s *signedCertificateTimestamp) unmarshalSignature(b []byte) error {
+	if len(b) < 4 || int(binary.BigEndian.Uint16(b[2:])) != len(b)-4 {
+		return fmt.Errorf("malformed SCT signature")
+	}
+	s.hashAlgorithm, s.signatureAlgorithm, s.signature = b[0], b[1], b[4:]
+	return nil
+}
+
+// parseSCTList parses the value of the SCT list extension.
+func parseSCTList(value []byte) ([]*signedCertificateTimestamp, error) {
+	var list []byte
+	if rest, err := asn1.Unmarshal(value, &list); err != nil || len(rest) > 0 {
+		return nil, fmt.Errorf("malformed SCT list extension")
+	}
+	list, rest, ok := readUint16Prefixed(list)
+	if !ok || len(rest) > 0 {
+		return nil, fmt.Errorf("malformed SCT list")
+	}
+	var scts []*signedCertificateTimestamp
+	for len(list) > 0 {
+		var b []byte
+		if b, list, ok = readUint16Prefixed(list); !ok {
+			return nil, fmt.Errorf("malformed SCT list")
+		}
+		sct, err := parseSCT(b)
+		if err != nil {
+			return nil, err
+		}
+		scts = append(scts, sct)
+	}
+	return scts, nil
+}
+
+func parseSCT(b []byte) (*signedCertificateTimestamp, error) {
+	if len(b) < 1+32+8 || b[0] != 0 {
+		return nil, fmt.Errorf("malformed or unsupported SCT")
+	}
+	sct := &signedCertificateTimestamp{timestamp: binary.BigEndian.Uint64(b[33:])}
+	copy(sct.logID[:], b[1:33])
+	extensions, rest, ok := readUint16Prefixed(b[41:])
+	if !ok {
+		return nil, fmt.Errorf("malformed SCT")
+	}
+	sct.extensions = extensions
+	if err := sct.unmarshalSignature(rest); err != nil {
+		return nil, err
+	}
+	return sct, nil
+}
+
+// precertEntry returns the signed log entry of a precertificate with the
+// given tbsCertificate, which must not contain the poison or SCT list
+// extension.
+func precertEntry(issuer *x509.Certificate, tbs []byte) ([]byte, error) {
+	if len(tbs) >= 1<<24 {
+		return nil, fmt.Errorf("the certificate is too large")
+	}
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	entry := []byte{0, 1}
+	entry = append(entry, issuerKeyHash[:]...)
+	return appendUint24Prefixed(entry, tbs), nil
+}
+
+// x509Entry returns the signed log entry of a certificate.
+func x509Entry(der []byte) ([]byte, error) {
+	if len(der) >= 1<<24 {
+		return nil, fmt.Errorf("the certificate is too large")
+	}
+	return appendUint24Prefixed([]byte{0, 0}, der), nil
+}
+
+// verify checks the signature of an SCT for a log entry.
+func (s *signedCertificateTimestamp) verify(log *ctLog, entry []byte) error {
+	if s.logID != log.id {
+		return fmt.Errorf("the SCT is not of log %s", log.url)
+	}
+	if s.hashAlgorithm != 4 {
+		return fmt.Errorf("unsupported SCT hash algorithm %d", s.hashAlgorithm)
+	}
+	// version, signature type certificate_timestamp, timestamp, entry and
+	// extensions
+	signed := []byte{0, 0}
+	signed = binary.BigEndian.AppendUint64(signed, s.timestamp)
+	signed = append(signed, entry...)
+	signed = appendUint16Prefixed(signed, s.extensions)
+	digest := sha256.Sum256(signed)
+
+	switch key := log.key.(type) {
+	case *ecdsa.PublicKey:
+		if s.signatureAlgorithm != 3 || !ecdsa.VerifyASN1(key, digest[:], s.signature) {
+			return fmt.Errorf("the signature does not verify with the key of %s", log.url)
+		}
+	case *rsa.PublicKey:
+		if s.signatureAlgorithm != 1 || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], s.signature) != nil {
+			return fmt.Errorf("the signature does not verify with the key of %s", log.url)
+		}
+	}
+	return nil
+}
+
+// checkSCTs verifies the SCTs a client received for the verified chain of
+// state, embedded in the certificate or in the TLS extension, with the
+// logs. It returns a summary for the compatibility report and fails for
+// invalid SCTs, or if required and there is no valid one. SCTs of other
+// logs cannot be verified and are only counted.
+func (l ctLogList) checkSCTs(state *tls.ConnectionState, require bool) (string, error) {
+	cert, issuer := state.VerifiedChains[0][0], state.VerifiedChains[0][1]
+	var embedded []*signedCertificateTimestamp
+	var embeddedEntry []byte
+	if ext := x509util.FindExtension(cert, oidExtensionSCTList); ext != nil {
+		var err error
+		if embedded, err = parseSCTList(ext.Value); err != nil {
+			return "", err
+		}
+		tbs, err := removeExtension(cert.RawTBSCertificate, oidExtensionSCTList)
+		if err == nil {
+			embeddedEntry, err = precertEntry(issuer, tbs)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	var delivered []*signedCertificateTimestamp
+	for _, b := range state.SignedCertificateTimestamps {
+		sct, err := parseSCT(b)
+		if err != nil {
+			return "", fmt.Errorf("TLS extension: %w", err)
+		}
+		delivered = append(delivered, sct)
+	}
+	deliveredEntry, err := x509Entry(cert.Raw)
+	if err != nil {
+		return "", err
+	}
+
+	var summary []string
+	valid := 0
+	for _, source := range []struct {
+		name  string
+		scts  []*signedCertificateTimestamp
+		entry []byte
+	}{
+		{"embedded", embedded, embeddedEntry},
+		{"TLS extension", delivered, deliveredEntry},
+	} {
+		if len(source.scts) == 0 {
+			continue
+		}
+		verified, unknown := 0, 0
+		for _, sct := range source.scts {
+			log := l.find(sct.logID)
+			if log == nil {
+				unknown++
+				continue
+			}
+			if err := sct.verify(log, source.entry); err != nil {
+				return "", fmt.Errorf("invalid %s SCT: %w", source.name, err)
+			}
+			verified++
+		}
+		valid += verified
+		line := fmt.Sprintf("%d valid %s", verified, source.name)
+		if unknown > 0 {
+			line += fmt.Sprintf(" (%d of unknown logs)", unknown)
+		}
+		summary = append(summary, line)
+	}
+	if require && valid == 0 {
+		return "", fmt.Errorf("no valid SCT of the configured CT logs received")
+	}
+	if len(summary) == 0 {
+		return "no SCTs", nil
+	}
+	return strings.Join(summary, ", "), nil
+}
+
+func (l ctLogList) find(id [32]byte) *ctLog {
+	for _, log := range l {
+		if log.id == id {
+			return log
+		}
+	}
+	return nil
+}
+
+// removeExtension returns tbs without the extension with the given OID.
+func removeExtension(tbs []byte, oid asn1.ObjectIdentifier) ([]byte, error) {
+	return x509util.RewriteExtensions(tbs, func(raw []byte, extension pkix.Extension) ([]byte, error) {
+		if extension.Id.Equal(oid) {
+			return nil, nil
+		}
+		return raw, nil
+	})
+}
+
+func appendUint16Prefixed(b, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func appendUint24Prefixed(b, data []byte) []byte {
+	b = append(b, byte(len(data)>>16), byte(len(data)>>8), byte(len(data)))
+	return append(b, data...)
+}
+
+func readUint16Prefixed(b []byte) (data, rest []byte, ok bool) {
+	if len(b) < 2 || len(b)-2 < int(binary.BigEndian.Uint16(b)) {
+		return nil, nil, false
+	}
+	n := 2 + int(binary.BigEndian.Uint16(b))
+	return b[2:n], b[n:], true
+}
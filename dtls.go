@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The Go standard library has no DTLS implementation, the DTLS listener
+// and client are OpenSSL's s_server and s_client.
+
+func runServeDTLS(args []string) {
+	fs := flag.NewFlagSet("serve-dtls", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	addr := fs.String("addr", "localhost:4433", "UDP address for the DTLS 1.2 server to listen on")
+	keepRunning := fs.Bool("keep-running", false, "Keep the DTLS server running after the checks until interrupted, to test devices against it")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() {
+		usageError("go run *.go serve-dtls (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-stdout] [-addr host:port] [-keep-running] [-v|-q] [-log-format text|json]")
+	}
+
+	setup := prepareCAs(caOpts)
+
+	dir, err := os.MkdirTemp("", "ca-regen-dtls")
+	if err != nil {
+		fatal("Failed to create temporary directory", "error", err)
+	}
+
+	server, err := startDTLSServer(*addr, setup, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		fatal("Failed to start DTLS server", "error", err)
+	}
+	// exitWith skips deferred calls, stop the server and remove its key
+	// explicitly
+	cleanup := func() {
+		server.stop()
+		os.RemoveAll(dir)
+	}
+	defer cleanup()
+
+	slog.Info("DTLS server started", "addr", *addr)
+
+	slog.Debug("Testing client compatibility", "ca", "new")
+	err = testDTLSClientCompatibility(*addr, setup.newCA, dir)
+	if err != nil {
+		cleanup()
+		exitWith(exitNewCAVerificationFailed, "Unexpected failure with new CA", "error", err)
+	}
+
+	slog.Debug("Testing client compatibility", "ca", "original")
+	err = testDTLSClientCompatibility(*addr, setup.originalCA, dir)
+	if err != nil {
+		cleanup()
+		exitWith(exitOriginalCAIncompatible, "Unexpected failure with original CA", "error", err)
+	}
+
+	slog.Info("Success! DTLS clients trust the server with both the original and the regenerated CA")
+
+	if *keepRunning {
+		ctx, stop := shutdownSignal()
+		defer stop()
+		slog.Info("DTLS server keeps running until interrupted", "addr", *addr)
+		select {
+		case <-ctx.Done():
+		case <-server.done:
+			slog.Warn("DTLS server exited", "error", server.err)
+		}
+	}
+}
+
+// dtlsServer is a running openssl s_server.
+type dtlsServer struct {
+	cmd *exec.Cmd
+	// stdin is kept open, s_server stops at its end.
+	stdin io.WriteCloser
+	// done is closed once the server exited, with err describing why.
+	done chan struct{}
+	err  error
+}
+
+// startDTLSServer starts openssl s_server on the UDP address addr with the
+// server certificate of setup and its chain, which are written to dir. It
+// returns once the server accepts handshakes.
+func startDTLSServer(addr string, setup *caSetup, dir string) (*dtlsServer, error) {
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server-key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: setup.serverCert.Raw}), 0644); err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(setup.serverKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal server key: %w", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, err
+	}
+	args := []string{"s_server", "-dtls1_2", "-accept", addr, "-cert", certFile, "-key", keyFile}
+	if len(setup.chain) > 0 {
+		chainFile := filepath.Join(dir, "chain.pem")
+		var chain []byte
+		for _, cert := range setup.chain {
+			chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+		if err := os.WriteFile(chainFile, chain, 0644); err != nil {
+			return nil, err
+		}
+		args = append(args, "-cert_chain", chainFile)
+	}
+
+	slog.Debug("Running openssl", "args", strings.Join(args, " "))
+	cmd := exec.Command("openssl", args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run openssl: %w", err)
+	}
+	server := &dtlsServer{cmd: cmd, stdin: stdin, done: make(chan struct{})}
+
+	// s_server prints ACCEPT once it listens. The rest of its output is
+	// discarded, it includes the session parameters with the master key.
+	accepting := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if scanner.Text() == "ACCEPT" {
+				close(accepting)
+				break
+			}
+		}
+		io.Copy(io.Discard, stdout)
+		err := cmd.Wait()
+		if err == nil {
+			err = errors.New("openssl s_server exited")
+		}
+		server.err = fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		close(server.done)
+	}()
+
+	select {
+	case <-accepting:
+		return server, nil
+	case <-server.done:
+		return nil, server.err
+	case <-time.After(10 * time.Second):
+		server.stop()
+		return nil, errors.New("openssl s_server did not start listening within 10s")
+	}
+}
+
+// stop terminates the server and waits for it to exit.
+func (s *dtlsServer) stop() {
+	s.stdin.Close()
+	s.cmd.Process.Kill()
+	<-s.done
+}
+
+// testDTLSClientCompatibility runs a DTLS 1.2 handshake with openssl
+// s_client against addr, trusting only ca and verifying the name
+// localhost, and sends a message to the server.
+func testDTLSClientCompatibility(addr string, ca *x509.Certificate, dir string) error {
+	caFile := filepath.Join(dir, "client-ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644); err != nil {
+		return err
+	}
+
+	// s_client keeps retransmitting if the server does not answer
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	args := []string{"s_client", "-dtls1_2", "-connect", addr, "-CAfile", caFile, "-verify_return_error", "-verify_hostname", "localhost", "-servername", "localhost", "-brief"}
+	slog.Debug("Running openssl", "args", strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, "openssl", args...)
+	cmd.Stdin = strings.NewReader("Hello from the regenerated CA test client!\n")
+	// -brief prints the connection details and verification errors on
+	// stderr
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("no response within 10s: %w", ctx.Err())
+		}
+		return fmt.Errorf("DTLS handshake failed: %w: %s", err, strings.TrimSpace(out.String()))
+	}
+
+	var version, cipher string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if v, ok := strings.CutPrefix(line, "Protocol version: "); ok {
+			version = strings.TrimSpace(v)
+		} else if v, ok := strings.CutPrefix(line, "Ciphersuite: "); ok {
+			cipher = strings.TrimSpace(v)
+		}
+	}
+	if version == "" {
+		return fmt.Errorf("DTLS handshake did not complete: %s", strings.TrimSpace(out.String()))
+	}
+	slog.Info("DTLS handshake succeeded", "version", version, "cipher", cipher)
+	return nil
+}
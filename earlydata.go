@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// earlyDataALPN is the application protocol of the in-memory 0-RTT test,
+// which has to match for the server to accept early data.
+const earlyDataALPN = "caregen-early-data"
+
+// runEarlyDataTests checks with both CAs that a client resuming a session
+// of the server certificate sends 0-RTT early data, and that the server
+// accepts it. Go supports TLS 1.3 early data only for QUIC, so client and
+// server exchange their handshake in memory via the QUIC API of
+// crypto/tls, without the packet layer.
+func runEarlyDataTests(setup *caSetup) []compatResult {
+	cas := []struct {
+		name string
+		cert *x509.Certificate
+	}{
+		{"New CA", setup.newCA},
+		{"Original CA", setup.originalCA},
+	}
+	var results []compatResult
+	for _, ca := range cas {
+		start := time.Now()
+		err := testEarlyData(setup, ca.cert)
+		if err != nil {
+			slog.Error("Early data test failed", "ca", ca.name, "error", err)
+		} else {
+			slog.Info("Server accepted early data of the resumed session", "ca", ca.name)
+		}
+		results = append(results, compatResult{
+			CA:       ca.name,
+			Client:   "0-RTT early data",
+			Duration: time.Since(start).Round(time.Microsecond),
+			Err:      err,
+		})
+	}
+	return results
+}
+
+// testEarlyData runs a full handshake with a client trusting only ca, in
+// which the server issues a ticket allowing early data, and a resumed one
+// in which the client offers early data. The server must accept it and
+// derive the same early traffic secret as the client, so it could decrypt
+// the early data.
+func testEarlyData(setup *caSetup, ca *x509.Certificate) error {
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{setup.serverTLSCertificate()},
+		MinVersion:   tls.VersionTLS13,
+		NextProtos:   []string{earlyDataALPN},
+		Time:         now.Now,
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientConfig := &tls.Config{
+		RootCAs:            roots,
+		ServerName:         "localhost",
+		MinVersion:         tls.VersionTLS13,
+		NextProtos:         []string{earlyDataALPN},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		Time:               now.Now,
+	}
+
+	if _, err := quicHandshake(clientConfig, serverConfig, true); err != nil {
+		return fmt.Errorf("initial handshake failed: %w", err)
+	}
+	secrets, err := quicHandshake(clientConfig, serverConfig, false)
+	if err != nil {
+		return fmt.Errorf("resumed handshake failed: %w", err)
+	}
+	switch {
+	case !secrets.resumed:
+		return fmt.Errorf("the client did not resume the session")
+	case secrets.clientEarly == nil:
+		return fmt.Errorf("the client did not offer early data")
+	case secrets.rejected || secrets.serverEarly == nil:
+		return fmt.Errorf("the server rejected the early data")
+	case !bytes.Equal(secrets.clientEarly, secrets.serverEarly):
+		return fmt.Errorf("client and server derived different early traffic secrets")
+	}
+	return nil
+}
+
+// quicHandshakeResult is what the in-memory handshake reveals about early
+// data.
+type quicHandshakeResult struct {
+	resumed bool
+	// clientEarly and serverEarly are the early traffic secrets the client
+	// writes and the server reads with, nil without early data.
+	clientEarly []byte
+	serverEarly []byte
+	// rejected is set if the client was told that its early data was
+	// rejected.
+	rejected bool
+}
+
+// quicHandshake runs a handshake between a QUIC client and server in
+// memory, passing the data each writes to the other at the same
+// encryption level. With ticket the server sends a session ticket
+// allowing early data afterwards.
+func quicHandshake(clientConfig, serverConfig *tls.Config, ticket bool) (*quicHandshakeResult, error) {
+	client := tls.QUICClient(&tls.QUICConfig{TLSConfig: clientConfig})
+	server := tls.QUICServer(&tls.QUICConfig{TLSConfig: serverConfig})
+	defer client.Close()
+	defer server.Close()
+	// The transport parameters are opaque to TLS
+	client.SetTransportParameters([]byte{})
+	server.SetTransportParameters([]byte{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Start(ctx); err != nil {
+		return nil, err
+	}
+	if err := server.Start(ctx); err != nil {
+		return nil, err
+	}
+
+	result := &quicHandshakeResult{}
+	clientDone, serverDone, ticketSent := false, false, !ticket
+	for {
+		progress := false
+		for {
+			event := client.NextEvent()
+			if event.Kind == tls.QUICNoEvent {
+				break
+			}
+			progress = true
+			switch event.Kind {
+			case tls.QUICWriteData:
+				if err := server.HandleData(event.Level, event.Data); err != nil {
+					return nil, err
+				}
+			case tls.QUICSetWriteSecret:
+				if event.Level == tls.QUICEncryptionLevelEarly {
+					result.clientEarly = bytes.Clone(event.Data)
+				}
+			case tls.QUICRejectedEarlyData:
+				result.rejected = true
+			case tls.QUICHandshakeDone:
+				clientDone = true
+				result.resumed = client.ConnectionState().DidResume
+			case tls.QUICErrorEvent:
+				return nil, event.Err
+			}
+		}
+		for {
+			event := server.NextEvent()
+			if event.Kind == tls.QUICNoEvent {
+				break
+			}
+			progress = true
+			switch event.Kind {
+			case tls.QUICWriteData:
+				if err := client.HandleData(event.Level, event.Data); err != nil {
+					return nil, err
+				}
+			case tls.QUICSetReadSecret:
+				if event.Level == tls.QUICEncryptionLevelEarly {
+					result.serverEarly = bytes.Clone(event.Data)
+				}
+			case tls.QUICHandshakeDone:
+				serverDone = true
+			case tls.QUICErrorEvent:
+				return nil, event.Err
+			}
+		}
+		if serverDone && !ticketSent {
+			if err := server.SendSessionTicket(tls.QUICSessionTicketOptions{EarlyData: true}); err != nil {
+				return nil, err
+			}
+			ticketSent, progress = true, true
+		}
+		if !progress {
+			break
+		}
+	}
+	// Without further events the client also stored the ticket in its session
+	// cache
+	if !clientDone || !serverDone {
+		return nil, fmt.Errorf("handshake stalled")
+	}
+	return result, nil
+}
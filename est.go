@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// EST (RFC 7030) server issuing certificates from the regenerated CA, for
+// fleets of devices which enroll via EST. Implements the mandatory
+// operations: cacerts, simpleenroll and simplereenroll. Clients
+// authenticate with a certificate of the CA or with HTTP basic auth.
+func runESTServe(args []string) {
+	fs := flag.NewFlagSet("est-serve", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	addr := fs.String("addr", "localhost:8443", "Address for the EST server to listen on")
+	var hostnames stringList
+	fs.Var(&hostnames, "hostname", "DNS name or IP address clients use to reach the EST server, can be repeated (default localhost)")
+	username := fs.String("username", "", "Username for HTTP basic auth of enrollment requests without client certificate")
+	password := fs.String("password", "", "Password for HTTP basic auth of enrollment requests without client certificate")
+	validity := fs.Duration("cert-validity", 365*24*time.Hour, "Validity of issued certificates")
+	registerShutdown(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() {
+		usageError("go run *.go est-serve (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-addr host:port] [-hostname name]... [-username <user> -password <password>] [-cert-validity 8760h]")
+	}
+	if len(hostnames) == 0 {
+		hostnames = stringList{"localhost"}
+	}
+
+	setup := regenerateCAs(caOpts)
+	serverCert, serverKey, err := issueServerCert(setup.newCA, setup.caKey, hostnames, caOpts.leaf)
+	if err != nil {
+		exitWith(exitRegenerationFailed, "Failed to generate server certificate", "error", err)
+	}
+	setup.serverCert, setup.serverKey = serverCert, serverKey
+	if *username == "" && *password == "" {
+		slog.Warn("No -username/-password given, every enrollment request will be accepted")
+	}
+
+	est := &estServer{
+		ca:       setup.newCA,
+		caKey:    setup.caKey,
+		chain:    setup.chain,
+		username: *username,
+		password: *password,
+		validity: *validity,
+	}
+	// Certificates of the original CA verify against the regenerated one
+	// as well, as both share subject and key
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(setup.newCA)
+	server := &http.Server{
+		Addr: *addr,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{setup.serverTLSCertificate()},
+			ClientCAs:    clientCAs,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		},
+		Handler:  est.handler(),
+		ErrorLog: serverErrorLog(),
+	}
+	slog.Info("EST server started", "url", "https://"+*addr+"/.well-known/est", "ca_file", "new-ca.pem")
+	if err := serveUntilSignal(server); err != nil {
+		fatal("EST server failed", "error", err)
+	}
+}
+
+type estServer struct {
+	ca       *x509.Certificate
+	caKey    crypto.Signer
+	chain    []*x509.Certificate
+	username string
+	password string
+	validity time.Duration
+}
+
+func (s *estServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/est/cacerts", s.handleCACerts)
+	mux.HandleFunc("POST /.well-known/est/simpleenroll", s.handleEnroll)
+	mux.HandleFunc("POST /.well-known/est/simplereenroll", s.handleEnroll)
+	return mux
+}
+
+func (s *estServer) handleCACerts(w http.ResponseWriter, r *http.Request) {
+	s.writeCerts(w, append([]*x509.Certificate{s.ca}, s.chain...))
+}
+
+func (s *estServer) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	reenroll := r.URL.Path == "/.well-known/est/simplereenroll"
+	var clientCert *x509.Certificate
+	if len(r.TLS.VerifiedChains) > 0 {
+		clientCert = r.TLS.VerifiedChains[0][0]
+	}
+	if reenroll && clientCert == nil {
+		http.Error(w, "re-enrollment requires a client certificate issued by the CA", http.StatusForbidden)
+		return
+	}
+	if clientCert == nil && !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="est"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	csr, err := parseESTRequest(body)
+	if err != nil {
+		slog.Warn("Invalid EST request", "remote", r.RemoteAddr, "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// A re-enrollment renews the client's certificate, so the subject has
+	// to stay the same (RFC 7030, section 4.2.2). Compared by value, as the
+	// string types used for encoding may differ.
+	if reenroll && csr.Subject.String() != clientCert.Subject.String() {
+		http.Error(w, "subject of the CSR does not match the client certificate", http.StatusBadRequest)
+		return
+	}
+
+	cert, err := issueClientCert(s.ca, s.caKey, csr, s.validity)
+	if err != nil {
+		slog.Error("Failed to issue certificate", "subject", csr.Subject.String(), "error", err)
+		http.Error(w, "issuance failed", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Issued certificate", "subject", cert.Subject.String(), "serial", x509util.FormatHex(cert.SerialNumber.Bytes()), "reenroll", reenroll)
+	s.writeCerts(w, []*x509.Certificate{cert})
+}
+
+// authorized checks the basic auth credentials of an enrollment request,
+// if any are configured.
+func (s *estServer) authorized(r *http.Request) bool {
+	if s.username == "" && s.password == "" {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(s.username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) == 1
+}
+
+// parseESTRequest parses a base64 encoded PKCS#10 request. Some clients
+// send plain DER instead, which is accepted as well.
+func parseESTRequest(body []byte) (*x509.CertificateRequest, error) {
+	der, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil)))
+	if err != nil {
+		der = body
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSR: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature: %w", err)
+	}
+	return csr, nil
+}
+
+// writeCerts sends certificates as base64 encoded certs-only PKCS#7.
+func (s *estServer) writeCerts(w http.ResponseWriter, certs []*x509.Certificate) {
+	der, err := createCertsOnlyPKCS7(certs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	io.WriteString(w, base64.StdEncoding.EncodeToString(der))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Exit codes of the tool. They are part of the interface for automation
+// (e.g. CI jobs branching on the outcome) and must not be renumbered.
+const (
+	// exitSuccess: the CA was regenerated and clients trusting either the
+	// original or the new CA accepted the server certificate.
+	exitSuccess = 0
+	// exitFailure: unexpected runtime error (e.g. the test server could
+	// not be started).
+	exitFailure = 1
+	// exitOriginalCAIncompatible: clients trusting the new CA succeeded
+	// but clients trusting the original CA rejected the server.
+	exitOriginalCAIncompatible = 2
+	// exitNewCAVerificationFailed: clients trusting the regenerated CA
+	// rejected the server certificate issued by it.
+	exitNewCAVerificationFailed = 3
+	// exitInvalidCA: the input CA could not be loaded or is not suitable
+	// for regeneration (e.g. basic constraints are already critical).
+	exitInvalidCA = 4
+	// exitRegenerationFailed: creating the new CA or issuing the server
+	// certificate failed.
+	exitRegenerationFailed = 5
+	// exitLintFailed: the lint subcommand, or a check like it, found at
+	// least one error.
+	exitLintFailed = 6
+	// exitVerifyFailed: the verify subcommand could not verify the
+	// certificate.
+	exitVerifyFailed = 7
+	// exitUsage: invalid command line arguments (EX_USAGE).
+	exitUsage = 64
+)
+
+// fatal logs msg at error level and exits with exitFailure.
+func fatal(msg string, args ...any) {
+	exitWith(exitFailure, msg, args...)
+}
+
+// exitWith logs msg at error level and exits with the given code.
+func exitWith(code int, msg string, args ...any) {
+	slog.Error(msg, append(args, "exit_code", code)...)
+	os.Exit(code)
+}
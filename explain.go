@@ -0,0 +1,15 @@
+package main
+
+import (
+	"crypto/x509"
+	"log/slog"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// logChainProblems logs the problems x509util.AnalyzeChain finds.
+func logChainProblems(presented, roots []*x509.Certificate, hostname string) {
+	for _, problem := range x509util.AnalyzeChain(presented, roots, hostname, now.Now()) {
+		slog.Error("Cause: " + problem)
+	}
+}
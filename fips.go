@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/fips140"
+	"flag"
+	"log/slog"
+	"sync"
+)
+
+// fipsMode restricts the accepted and generated algorithms to the ones
+// approved for FIPS 140-3. It is only set by the -fips flag.
+var fipsMode bool
+
+// registerFIPS registers the -fips flag.
+func registerFIPS(fs *flag.FlagSet) {
+	fs.BoolVar(&fipsMode, "fips", false, "Only accept and generate FIPS 140-3 approved algorithms (RSA with at least 2048 bits, ECDSA P-256, P-384 and P-521, Ed25519, ML-DSA, SHA-2) and fail otherwise, requires the Go Cryptographic Module in FIPS 140-3 mode")
+}
+
+var fipsModuleOnce sync.Once
+
+// logFIPSModule logs the version of the Go Cryptographic Module once.
+func logFIPSModule() {
+	fipsModuleOnce.Do(func() {
+		slog.Info("Go Cryptographic Module is in FIPS 140-3 mode", "version", fips140.Version(), "enforced", fips140.Enforced())
+	})
+}
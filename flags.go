@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/databus23/ca-regen/caregen"
+)
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// usageError prints the usage line of a mode and exits with exitUsage.
+func usageError(usage string) {
+	fmt.Fprintln(os.Stderr, "Usage: "+usage)
+	os.Exit(exitUsage)
+}
+
+// parseFlags parses args into fs, which must have been created with
+// flag.ContinueOnError, and exits with exitUsage on errors. The default
+// flag.ExitOnError behavior would exit with status 2, which is reserved.
+// Flags not given on the command line are taken from the environment,
+// see envVarName. With -fips it exits with exitUsage unless the Go
+// Cryptographic Module is in FIPS 140-3 mode.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(exitSuccess)
+	}
+	if err != nil {
+		os.Exit(exitUsage)
+	}
+
+	if err := applyEnvOverrides(fs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	if fipsMode {
+		if err := caregen.CheckFIPSModule(); err != nil {
+			fmt.Fprintln(os.Stderr, "-fips:", err)
+			os.Exit(exitUsage)
+		}
+	}
+}
+
+// envVarName returns the environment variable overriding the flag name,
+// e.g. CAREGEN_CA_CERT for -ca-cert.
+func envVarName(name string) string {
+	return "CAREGEN_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvOverrides sets all flags which were not given on the command
+// line from their environment variable, if present. Command line flags
+// always take precedence.
+func applyEnvOverrides(fs *flag.FlagSet) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(envVarName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", value, envVarName(f.Name), setErr)
+		}
+	})
+	return err
+}
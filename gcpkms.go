@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+)
+
+// gcpKMSAlgorithms maps the Cloud KMS asymmetric signing algorithms to the
+// X.509 signature algorithm of the certificates they sign and the digest
+// Cloud KMS expects for them.
+var gcpKMSAlgorithms = map[string]struct {
+	signatureAlgorithm x509.SignatureAlgorithm
+	hash               crypto.Hash
+}{
+	"RSA_SIGN_PKCS1_2048_SHA256": {x509.SHA256WithRSA, crypto.SHA256},
+	"RSA_SIGN_PKCS1_3072_SHA256": {x509.SHA256WithRSA, crypto.SHA256},
+	"RSA_SIGN_PKCS1_4096_SHA256": {x509.SHA256WithRSA, crypto.SHA256},
+	"RSA_SIGN_PKCS1_4096_SHA512": {x509.SHA512WithRSA, crypto.SHA512},
+	"RSA_SIGN_PSS_2048_SHA256":   {x509.SHA256WithRSAPSS, crypto.SHA256},
+	"RSA_SIGN_PSS_3072_SHA256":   {x509.SHA256WithRSAPSS, crypto.SHA256},
+	"RSA_SIGN_PSS_4096_SHA256":   {x509.SHA256WithRSAPSS, crypto.SHA256},
+	"RSA_SIGN_PSS_4096_SHA512":   {x509.SHA512WithRSAPSS, crypto.SHA512},
+	"EC_SIGN_P256_SHA256":        {x509.ECDSAWithSHA256, crypto.SHA256},
+	"EC_SIGN_P384_SHA384":        {x509.ECDSAWithSHA384, crypto.SHA384},
+}
+
+func init() {
+	caregen.RegisterSignerBackend(func() caregen.SignerBackend { return &gcpKMSOptions{} })
+}
+
+// gcpKMSOptions selects a Google Cloud KMS key version holding the CA key.
+type gcpKMSOptions struct {
+	key         string
+	accessToken string
+	endpoint    string
+}
+
+func (o *gcpKMSOptions) Register(fs *flag.FlagSet) {
+	fs.StringVar(&o.key, "gcp-kms-key", "", "Sign with this Cloud KMS key version (projects/.../cryptoKeyVersions/N) instead of a CA key file")
+	fs.StringVar(&o.accessToken, "gcp-access-token", "", "OAuth2 access `token` for Cloud KMS (default $GOOGLE_OAUTH_ACCESS_TOKEN or the output of gcloud auth print-access-token)")
+	fs.StringVar(&o.endpoint, "gcp-kms-endpoint", "https://cloudkms.googleapis.com", "Cloud KMS API endpoint")
+}
+
+// gcpKMSSigner is a crypto.Signer backed by a Cloud KMS asymmetric signing
+// key version. It talks to the REST API directly and obtains credentials
+// like the gcloud CLI, so no client libraries are needed.
+type gcpKMSSigner struct {
+	opts      gcpKMSOptions
+	client    *http.Client
+	public    crypto.PublicKey
+	algorithm string
+	tokenOnce sync.Once
+	token     string
+	tokenErr  error
+}
+
+func (o *gcpKMSOptions) Selected() bool {
+	return o.key != ""
+}
+
+// Signer returns a signer for the configured key version after fetching
+// its public key and algorithm.
+func (o *gcpKMSOptions) Signer() (crypto.Signer, error) {
+	s := &gcpKMSSigner{
+		opts:   *o,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	var resp struct {
+		PEM       string `json:"pem"`
+		Algorithm string `json:"algorithm"`
+	}
+	if err := s.request("GET", o.key+"/publicKey", nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to get public key of %s: %w", o.key, err)
+	}
+	if _, ok := gcpKMSAlgorithms[resp.Algorithm]; !ok {
+		return nil, fmt.Errorf("unsupported Cloud KMS key algorithm %s", resp.Algorithm)
+	}
+	block, _ := pem.Decode([]byte(resp.PEM))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode Cloud KMS public key PEM")
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Cloud KMS public key: %w", err)
+	}
+	s.public = public
+	s.algorithm = resp.Algorithm
+	slog.Debug("Using Cloud KMS key", "key", o.key, "algorithm", resp.Algorithm)
+	return s, nil
+}
+
+func (s *gcpKMSSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// SignatureAlgorithm returns the only signature algorithm the key version
+// can produce. Certificates signed by it have to use this algorithm.
+func (s *gcpKMSSigner) SignatureAlgorithm() x509.SignatureAlgorithm {
+	return gcpKMSAlgorithms[s.algorithm].signatureAlgorithm
+}
+
+func (s *gcpKMSSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := gcpKMSAlgorithms[s.algorithm].hash
+	if opts.HashFunc() != hash {
+		return nil, fmt.Errorf("Cloud KMS key %s only signs %s digests, got %s", s.algorithm, hash, opts.HashFunc())
+	}
+	_, pss := opts.(*rsa.PSSOptions)
+	if pss != strings.HasPrefix(s.algorithm, "RSA_SIGN_PSS_") {
+		return nil, fmt.Errorf("signature scheme does not match Cloud KMS key algorithm %s", s.algorithm)
+	}
+
+	digestField := strings.ToLower(strings.ReplaceAll(hash.String(), "-", ""))
+	req := map[string]any{"digest": map[string]string{digestField: base64.StdEncoding.EncodeToString(digest)}}
+	var resp struct {
+		Signature string `json:"signature"`
+	}
+	if err := s.request("POST", s.opts.key+":asymmetricSign", req, &resp); err != nil {
+		return nil, fmt.Errorf("Cloud KMS signing failed: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Signature)
+}
+
+// accessToken returns the access token from the flag, the environment or
+// the gcloud CLI, in this order.
+func (s *gcpKMSSigner) accessToken() (string, error) {
+	s.tokenOnce.Do(func() {
+		s.token = s.opts.accessToken
+		if s.token == "" {
+			s.token = os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+		}
+		if s.token != "" {
+			return
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command("gcloud", "auth", "print-access-token")
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			s.tokenErr = fmt.Errorf("no access token given and gcloud auth print-access-token failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+			return
+		}
+		s.token = strings.TrimSpace(string(out))
+	})
+	return s.token, s.tokenErr
+}
+
+// request calls the Cloud KMS REST API at /v1/<path>.
+func (s *gcpKMSSigner) request(method, path string, body, v any) error {
+	token, err := s.accessToken()
+	if err != nil {
+		return err
+	}
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(s.opts.endpoint, "/")+"/v1/"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error.Message != "" {
+			return fmt.Errorf("%s: %s", resp.Status, apiErr.Error.Message)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode Cloud KMS response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+module github.com/databus23/ca-regen
+
+go 1.27
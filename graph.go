@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// graphNode is a certificate in the migration graph.
+type graphNode struct {
+	cert *x509.Certificate
+	role string
+}
+
+// graphEdge connects an issuer with a certificate which chains to it, or
+// the original CA with the regenerated CA.
+type graphEdge struct {
+	from, to int
+	label    string
+	dashed   bool
+}
+
+// Renders the relationships between the original CA, the regenerated CA
+// and further certificates (cross-signs, intermediates and leaves) as a
+// Graphviz DOT or Mermaid graph to communicate a migration plan.
+func runGraph(args []string) {
+	fs := flag.NewFlagSet("graph", flag.ContinueOnError)
+	originalFile := fs.String("original", "", "Path to the PEM encoded original CA certificate")
+	regeneratedFile := fs.String("regenerated", "", "Path to the PEM encoded regenerated CA certificate, e.g. new-ca.pem")
+	format := fs.String("format", "dot", "Output format: dot or mermaid")
+	output := fs.String("o", "-", "Write the graph to this file instead of stdout")
+	registerClock(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if *originalFile == "" || (*format != "dot" && *format != "mermaid") {
+		usageError("go run *.go graph -original <ca-cert.pem> [-regenerated <new-ca.pem>] [-format dot|mermaid] [-o graph.dot] [<cert.pem>...]")
+	}
+
+	var nodes []graphNode
+	add := func(file, role string) {
+		certs, err := loadCertificates(file)
+		if err != nil {
+			exitWith(exitFailure, "Failed to load certificates", "file", file, "error", err)
+		}
+		for i, cert := range certs {
+			if role == "" || i > 0 {
+				nodes = append(nodes, graphNode{cert: cert, role: certificateRole(cert)})
+				continue
+			}
+			nodes = append(nodes, graphNode{cert: cert, role: role})
+		}
+	}
+	add(*originalFile, "Original CA")
+	if *regeneratedFile != "" {
+		add(*regeneratedFile, "Regenerated CA")
+	}
+	for _, file := range fs.Args() {
+		add(file, "")
+	}
+
+	graph := renderDOT
+	if *format == "mermaid" {
+		graph = renderMermaid
+	}
+	var buf bytes.Buffer
+	graph(&buf, dedupNodes(nodes), now.Now())
+	if err := writeOutput(*output, buf.Bytes()); err != nil {
+		fatal("Failed to write graph", "error", err)
+	}
+}
+
+// dedupNodes drops certificates given more than once, keeping the first
+// occurrence and thereby its role.
+func dedupNodes(nodes []graphNode) []graphNode {
+	var unique []graphNode
+	for _, node := range nodes {
+		duplicate := false
+		for _, u := range unique {
+			if u.cert.Equal(node.cert) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			unique = append(unique, node)
+		}
+	}
+	return unique
+}
+
+// certificateRole classifies a certificate which is neither the original
+// nor the regenerated CA.
+func certificateRole(cert *x509.Certificate) string {
+	switch {
+	case !cert.IsCA:
+		return "Leaf"
+	case isSelfSigned(cert):
+		return "Root CA"
+	default:
+		return "Intermediate CA"
+	}
+}
+
+// graphEdges returns an edge from every certificate to each certificate
+// it chains to, i.e. whose subject is its issuer and whose key verifies
+// its signature. As the regenerated CA keeps name and key, everything
+// issued by the original CA also chains to the regenerated one, which is
+// labeled as verifying it. A CA
+// certificate with the key of another CA but a different issuer is
+// marked as cross-sign, and the original CA is linked to its
+// regenerated replacement.
+func graphEdges(nodes []graphNode) []graphEdge {
+	var edges []graphEdge
+	for i, node := range nodes {
+		// Self-signed roots, like the original and the regenerated CA,
+		// only chain to themselves
+		selfSigned := isSelfSigned(node.cert)
+		for j, issuer := range nodes {
+			if i == j || selfSigned || !bytes.Equal(node.cert.RawIssuer, issuer.cert.RawSubject) || x509util.CheckSignedBy(node.cert, issuer.cert) != nil {
+				continue
+			}
+			label := "issued"
+			if issuer.role == "Regenerated CA" {
+				// Signed with the same key, but by the original CA
+				label = "verifies"
+			} else if node.cert.IsCA && isCrossSign(node.cert, nodes) {
+				label = "cross-signed"
+			}
+			edges = append(edges, graphEdge{from: j, to: i, label: label})
+		}
+		if node.role == "Regenerated CA" {
+			for j, original := range nodes {
+				if original.role == "Original CA" && bytes.Equal(original.cert.RawSubjectPublicKeyInfo, node.cert.RawSubjectPublicKeyInfo) {
+					edges = append(edges, graphEdge{from: j, to: i, label: "regenerated as", dashed: true})
+				}
+			}
+		}
+	}
+	return edges
+}
+
+// isCrossSign reports whether another certificate has the subject and key
+// of cert but a different issuer.
+func isCrossSign(cert *x509.Certificate, nodes []graphNode) bool {
+	for _, other := range nodes {
+		if other.cert != cert && bytes.Equal(other.cert.RawSubject, cert.RawSubject) &&
+			bytes.Equal(other.cert.RawSubjectPublicKeyInfo, cert.RawSubjectPublicKeyInfo) &&
+			!bytes.Equal(other.cert.RawIssuer, cert.RawIssuer) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) && x509util.CheckSignedBy(cert, cert) == nil
+}
+
+// graphLabel returns the lines describing a node.
+func graphLabel(node graphNode, now time.Time) []string {
+	name := node.cert.Subject.CommonName
+	if name == "" {
+		name = node.cert.Subject.String()
+	}
+	if name == "" && len(x509util.CertNames(node.cert)) > 0 {
+		name = x509util.CertNames(node.cert)[0]
+	}
+	validity := "valid until " + node.cert.NotAfter.Format(time.DateOnly)
+	if now.After(node.cert.NotAfter) {
+		validity = "expired " + node.cert.NotAfter.Format(time.DateOnly)
+	}
+	return []string{node.role, name, "serial " + x509util.FormatHex(node.cert.SerialNumber.Bytes()), validity}
+}
+
+func renderDOT(w io.Writer, nodes []graphNode, now time.Time) {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	fmt.Fprintln(w, "digraph ca_migration {")
+	fmt.Fprintln(w, "  rankdir=TB;")
+	fmt.Fprintln(w, "  node [shape=box, style=rounded];")
+	for i, node := range nodes {
+		lines := graphLabel(node, now)
+		for j := range lines {
+			lines[j] = escape.Replace(lines[j])
+		}
+		attrs := ""
+		switch node.role {
+		case "Original CA":
+			attrs = ", color=gray"
+		case "Regenerated CA":
+			attrs = ", color=darkgreen, penwidth=2"
+		}
+		fmt.Fprintf(w, "  n%d [label=\"%s\"%s];\n", i, strings.Join(lines, `\n`), attrs)
+	}
+	for _, edge := range graphEdges(nodes) {
+		style := ""
+		if edge.dashed {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(w, "  n%d -> n%d [label=\"%s\"%s];\n", edge.from, edge.to, escape.Replace(edge.label), style)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func renderMermaid(w io.Writer, nodes []graphNode, now time.Time) {
+	escape := strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;")
+	fmt.Fprintln(w, "flowchart TD")
+	for i, node := range nodes {
+		lines := graphLabel(node, now)
+		for j := range lines {
+			lines[j] = escape.Replace(lines[j])
+		}
+		fmt.Fprintf(w, "  n%d[\"%s\"]\n", i, strings.Join(lines, "<br>"))
+		switch node.role {
+		case "Original CA":
+			fmt.Fprintf(w, "  style n%d stroke:gray\n", i)
+		case "Regenerated CA":
+			fmt.Fprintf(w, "  style n%d stroke:darkgreen,stroke-width:2px\n", i)
+		}
+	}
+	for _, edge := range graphEdges(nodes) {
+		arrow := "-->"
+		if edge.dashed {
+			arrow = "-.->"
+		}
+		fmt.Fprintf(w, "  n%d %s|%s| n%d\n", edge.from, arrow, escape.Replace(edge.label), edge.to)
+	}
+}
+
+// writeOutput writes data to file, or to stdout for "-".
+func writeOutput(file string, data []byte) error {
+	if file == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC health checking protocol (grpc.health.v1), implemented directly on
+// top of net/http's HTTP/2 support so no generated code or grpc-go
+// dependency is required. The wire format is the same one grpc-go uses, so
+// real gRPC clients (e.g. grpc_health_probe) can talk to the server as well.
+const (
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+
+	// HealthCheckResponse.ServingStatus values
+	grpcHealthUnknown = 0
+	grpcHealthServing = 1
+)
+
+func runServeGRPC(args []string) {
+	fs := flag.NewFlagSet("serve-grpc", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	addr := fs.String("addr", "localhost:8443", "Address for the gRPC server to listen on")
+	var creds grpcCredentials
+	creds.register(fs)
+	registerProxy(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() {
+		usageError("go run *.go serve-grpc (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-stdout] [-addr host:port] [-client-cert cert.pem -client-key key.pem] [-token <token>] [-proxy http://proxy:3128] [-v|-q] [-log-format text|json]")
+	}
+
+	if err := creds.load(); err != nil {
+		usageError(err.Error())
+	}
+
+	setup := prepareCAs(caOpts)
+
+	// The client certificate may be issued by either CA, they share the
+	// subject and key
+	var clientCAs *x509.CertPool
+	if creds.cert != nil {
+		clientCAs = x509.NewCertPool()
+		clientCAs.AddCert(setup.originalCA)
+		clientCAs.AddCert(setup.newCA)
+	}
+	server := startGRPCServer(*addr, setup.serverTLSCertificate(), clientCAs, creds.token)
+	defer server.Close()
+
+	slog.Info("gRPC health server started", "addr", *addr, "mtls", clientCAs != nil, "token", creds.token != "")
+
+	slog.Debug("Testing client compatibility", "ca", "new")
+	err := testGRPCClientCompatibility(*addr, setup.newCA, &creds)
+	if err != nil {
+		exitWith(exitNewCAVerificationFailed, "Unexpected failure with new CA", "error", err)
+	}
+
+	slog.Debug("Testing client compatibility", "ca", "original")
+	err = testGRPCClientCompatibility(*addr, setup.originalCA, &creds)
+	if err != nil {
+		exitWith(exitOriginalCAIncompatible, "Unexpected failure with original CA", "error", err)
+	}
+
+	slog.Info("Success! gRPC clients trust the server with both the original and the regenerated CA")
+}
+
+// grpcCredentials are the credentials the gRPC test client presents: a
+// client certificate for mutual TLS and a bearer token sent as the
+// authorization metadata of every call.
+type grpcCredentials struct {
+	certFile string
+	keyFile  string
+	token    string
+	cert     *tls.Certificate
+}
+
+func (c *grpcCredentials) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.certFile, "client-cert", "", "PEM file with a client certificate issued by the CA, which the gRPC client presents and the server requires")
+	fs.StringVar(&c.keyFile, "client-key", "", "PEM file with the private key of -client-cert")
+	fs.StringVar(&c.token, "token", "", "Bearer token the gRPC client sends as authorization metadata and the server requires")
+}
+
+// load loads the client certificate, if any.
+func (c *grpcCredentials) load() error {
+	if (c.certFile == "") != (c.keyFile == "") {
+		return fmt.Errorf("-client-cert and -client-key have to be given together")
+	}
+	if c.certFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	c.cert = &cert
+	return nil
+}
+
+// startGRPCServer starts the gRPC health server. With clientCAs it
+// requires a client certificate issued by one of them, with a token the
+// bearer token.
+func startGRPCServer(addr string, tlsCert tls.Certificate, clientCAs *x509.CertPool, token string) *http.Server {
+	// gRPC requires HTTP/2, negotiated via ALPN
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		NextProtos:   []string{"h2"},
+	}
+	if clientCAs != nil {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.Time = now.Now
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(grpcHealthCheckPath, requireGRPCToken(token, handleGRPCHealthCheck))
+
+	server := &http.Server{
+		Addr:      addr,
+		TLSConfig: tlsConfig,
+		Handler:   mux,
+		ErrorLog:  serverErrorLog(),
+	}
+
+	errc, err := startServer(server)
+	if err != nil {
+		fatal("Failed to start gRPC server", "addr", addr, "error", err)
+	}
+	go func() {
+		if err := <-errc; err != http.ErrServerClosed {
+			slog.Error("gRPC server error", "error", err)
+		}
+	}()
+	return server
+}
+
+// requireGRPCToken rejects calls without the bearer token with status
+// UNAUTHENTICATED, unless token is empty.
+func requireGRPCToken(token string, handler http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "16") // UNAUTHENTICATED
+			w.Header().Set("Grpc-Message", "a valid bearer token is required")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func handleGRPCHealthCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	if r.ProtoMajor != 2 {
+		w.Header().Set("Grpc-Status", "13") // INTERNAL
+		w.Header().Set("Grpc-Message", "gRPC requires HTTP/2")
+		return
+	}
+
+	// The request message is read but otherwise ignored: the overall
+	// server health ("" service) and any named service report SERVING.
+	if _, err := readGRPCMessage(r.Body); err != nil {
+		w.Header().Set("Grpc-Status", "3") // INVALID_ARGUMENT
+		w.Header().Set("Grpc-Message", err.Error())
+		return
+	}
+
+	// HealthCheckResponse{status: SERVING}: field 1, varint
+	w.Write(frameGRPCMessage([]byte{0x08, grpcHealthServing}))
+	w.Header().Set("Grpc-Status", "0")
+	w.Header().Set("Grpc-Message", "")
+}
+
+func testGRPCClientCompatibility(addr string, ca *x509.Certificate, creds *grpcCredentials) error {
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca)
+
+	tlsConfig := &tls.Config{RootCAs: caPool, Time: now.Now}
+	if creds.cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*creds.cert}
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:             testClientProxy,
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	// HealthCheckRequest{service: ""} encodes to an empty message
+	req, err := http.NewRequest(http.MethodPost, "https://"+addr+grpcHealthCheckPath, bytes.NewReader(frameGRPCMessage(nil)))
+	if err != nil {
+		return fmt.Errorf("failed to create gRPC request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if creds.token != "" {
+		req.Header.Set("Authorization", "Bearer "+creds.token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("gRPC request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		return fmt.Errorf("server did not negotiate HTTP/2 (got %s)", resp.Proto)
+	}
+
+	// Trailers are only populated after the body has been consumed. Errors
+	// may come without a message and with the status in the headers
+	msg, readErr := readGRPCMessage(resp.Body)
+	io.Copy(io.Discard, resp.Body)
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		message := resp.Trailer.Get("Grpc-Message")
+		if status == "" {
+			status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+		}
+		return fmt.Errorf("gRPC call failed with status %s: %s", status, message)
+	}
+	if readErr != nil {
+		return fmt.Errorf("failed to read gRPC response: %w", readErr)
+	}
+
+	status := grpcHealthUnknown
+	if len(msg) == 2 && msg[0] == 0x08 {
+		status = int(msg[1])
+	}
+	if status != grpcHealthServing {
+		return fmt.Errorf("unexpected health status %d", status)
+	}
+
+	slog.Info("gRPC health check returned SERVING")
+
+	return nil
+}
+
+// frameGRPCMessage prefixes an encoded protobuf message with the gRPC
+// length-prefixed message header (uncompressed).
+func frameGRPCMessage(msg []byte) []byte {
+	framed := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(framed[1:5], uint32(len(msg)))
+	copy(framed[5:], msg)
+	return framed
+}
+
+// readGRPCMessage reads a single length-prefixed gRPC message.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, fmt.Errorf("compressed gRPC messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length > 1<<20 {
+		return nil, fmt.Errorf("gRPC message too large (%d bytes)", length)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// grpcUnaryHandler adapts a unary method implementation working on encoded
+// protobuf messages to an http.HandlerFunc, taking care of the framing and
+// of reporting errors as gRPC status.
+func grpcUnaryHandler(method func(r *http.Request, req []byte) ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+		if r.ProtoMajor != 2 {
+			w.Header().Set("Grpc-Status", "13") // INTERNAL
+			w.Header().Set("Grpc-Message", "gRPC requires HTTP/2")
+			return
+		}
+		req, err := readGRPCMessage(r.Body)
+		if err != nil {
+			w.Header().Set("Grpc-Status", "3") // INVALID_ARGUMENT
+			w.Header().Set("Grpc-Message", err.Error())
+			return
+		}
+		resp, err := method(r, req)
+		if err != nil {
+			code := 2 // UNKNOWN
+			if coded, ok := err.(interface{ grpcCode() int }); ok {
+				code = coded.grpcCode()
+			}
+			w.Header().Set("Grpc-Status", strconv.Itoa(code))
+			w.Header().Set("Grpc-Message", err.Error())
+			return
+		}
+		w.Write(frameGRPCMessage(resp))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "")
+	}
+}
+
+// callGRPC performs a unary gRPC call with an encoded protobuf request and
+// returns the encoded response message.
+func callGRPC(client *http.Client, url string, req []byte) ([]byte, error) {
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(frameGRPCMessage(req)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	httpReq.Header.Set("TE", "trailers")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("gRPC request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// An error status may come without any message
+	msg, readErr := readGRPCMessage(resp.Body)
+	io.Copy(io.Discard, resp.Body)
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		if status == "" {
+			status = resp.Header.Get("Grpc-Status")
+		}
+		return nil, fmt.Errorf("gRPC call failed with status %s: %s", status, resp.Trailer.Get("Grpc-Message"))
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read gRPC response: %v", readErr)
+	}
+	return msg, nil
+}
+
+// protoMessage holds the decoded fields of a protobuf message. Only the
+// varint and length-delimited wire types are supported, which covers the
+// messages used by this tool.
+type protoMessage struct {
+	varints map[int]uint64
+	bytes   map[int][]byte
+	// repeated holds every value of the length-delimited fields.
+	repeated map[int][][]byte
+}
+
+// parseProtoMessage decodes a protobuf message. Repeated fields keep the
+// last value in varints and bytes.
+func parseProtoMessage(data []byte) (protoMessage, error) {
+	msg := protoMessage{varints: map[int]uint64{}, bytes: map[int][]byte{}, repeated: map[int][][]byte{}}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return msg, fmt.Errorf("invalid protobuf field key")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return msg, fmt.Errorf("invalid protobuf varint in field %d", field)
+			}
+			msg.varints[field] = value
+			data = data[n:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return msg, fmt.Errorf("invalid protobuf length in field %d", field)
+			}
+			msg.bytes[field] = data[n : n+int(length)]
+			msg.repeated[field] = append(msg.repeated[field], msg.bytes[field])
+			data = data[n+int(length):]
+		default:
+			return msg, fmt.Errorf("unsupported protobuf wire type %d in field %d", key&7, field)
+		}
+	}
+	return msg, nil
+}
+
+// appendProtoBytes appends a length-delimited field (bytes, string or
+// embedded message). Empty values are omitted like proto3 does.
+func appendProtoBytes(b []byte, field int, value []byte) []byte {
+	if len(value) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// appendProtoVarint appends a varint field (integers, bools and enums).
+// Zero values are omitted like proto3 does.
+func appendProtoVarint(b []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, value)
+}
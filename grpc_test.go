@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGRPCClientCredentials(t *testing.T) {
+	ca, caKey := newTestCA(t, "p256", nil)
+	key, err := keyTypes["p256"].generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	server := httptest.NewUnstartedServer(requireGRPCToken("secret", handleGRPCHealthCheck))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	tests := []struct {
+		name  string
+		creds grpcCredentials
+		// err is part of the expected error, empty for success
+		err string
+	}{
+		{"client certificate and token", grpcCredentials{cert: cert, token: "secret"}, ""},
+		{"no client certificate", grpcCredentials{token: "secret"}, "certificate required"},
+		{"no token", grpcCredentials{cert: cert}, "status 16"},
+		{"wrong token", grpcCredentials{cert: cert, token: "guess"}, "status 16"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testGRPCClientCompatibility(addr, server.Certificate(), &tt.creds)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("health check failed: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("health check returned %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+)
+
+// gRPC transport of the management API (api mode), served next to the
+// REST endpoints. The messages are encoded by hand with the helpers of
+// grpc.go; proto/management.proto documents them for clients.
+const grpcManagementService = "/caregen.management.v1.Management/"
+
+func (s *apiServer) registerGRPC(mux *http.ServeMux) {
+	mux.HandleFunc("POST "+grpcManagementService+"UploadCA", s.grpcMethod(func(req protoMessage) ([]byte, error) {
+		ca, err := s.uploadCA(apiUploadRequest{Certificate: string(req.bytes[1]), Key: string(req.bytes[2])})
+		if err != nil {
+			return nil, err
+		}
+		return ca.marshalProto(), nil
+	}))
+	mux.HandleFunc("POST "+grpcManagementService+"ListCAs", s.grpcMethod(func(req protoMessage) ([]byte, error) {
+		var resp []byte
+		for _, ca := range s.listCAs() {
+			resp = appendProtoBytes(resp, 1, ca.marshalProto())
+		}
+		return resp, nil
+	}))
+	mux.HandleFunc("POST "+grpcManagementService+"GetCA", s.grpcMethod(func(req protoMessage) ([]byte, error) {
+		ca, err := s.getCA(string(req.bytes[1]))
+		if err != nil {
+			return nil, err
+		}
+		return ca.marshalProto(), nil
+	}))
+	mux.HandleFunc("POST "+grpcManagementService+"DeleteCA", s.grpcMethod(func(req protoMessage) ([]byte, error) {
+		return nil, s.deleteCA(string(req.bytes[1]))
+	}))
+	mux.HandleFunc("POST "+grpcManagementService+"Regenerate", s.grpcMethod(func(req protoMessage) ([]byte, error) {
+		ca, err := s.regenerate(string(req.bytes[1]), apiRegenerateRequest{
+			Subject:       string(req.bytes[2]),
+			Deterministic: req.varints[3] != 0,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return ca.marshalProto(), nil
+	}))
+	mux.HandleFunc("POST "+grpcManagementService+"Issue", s.grpcMethod(func(req protoMessage) ([]byte, error) {
+		issueReq := apiIssueRequest{
+			CSR:      string(req.bytes[2]),
+			Profile:  string(req.bytes[4]),
+			Validity: string(req.bytes[5]),
+		}
+		for _, hostname := range req.repeated[3] {
+			issueReq.Hostnames = append(issueReq.Hostnames, string(hostname))
+		}
+		cert, err := s.issue(string(req.bytes[1]), issueReq)
+		if err != nil {
+			return nil, err
+		}
+		return cert.marshalProto(), nil
+	}))
+	mux.HandleFunc("POST "+grpcManagementService+"Verify", s.grpcMethod(func(req protoMessage) ([]byte, error) {
+		results, err := s.verify(string(req.bytes[1]), apiVerifyRequest{
+			Certificate: string(req.bytes[2]),
+			Hostname:    string(req.bytes[3]),
+		})
+		if err != nil {
+			return nil, err
+		}
+		var resp []byte
+		for _, result := range results {
+			resp = appendProtoBytes(resp, 1, result.marshalProto())
+		}
+		return resp, nil
+	}))
+}
+
+// grpcMethod adapts an operation to a gRPC handler, authenticating the
+// call with the same bearer token as the REST endpoints.
+func (s *apiServer) grpcMethod(method func(req protoMessage) ([]byte, error)) http.HandlerFunc {
+	return grpcUnaryHandler(func(r *http.Request, data []byte) ([]byte, error) {
+		if err := s.authenticate(r.Header.Get("Authorization")); err != nil {
+			return nil, err
+		}
+		req, err := parseProtoMessage(data)
+		if err != nil {
+			return nil, apiErrorf(http.StatusBadRequest, "%v", err)
+		}
+		return method(req)
+	})
+}
+
+// marshalProto encodes the CA message.
+func (ca *apiCAResponse) marshalProto() []byte {
+	b := appendProtoBytes(nil, 1, []byte(ca.ID))
+	b = appendProtoBytes(b, 2, []byte(ca.Subject))
+	b = appendProtoBytes(b, 3, []byte(ca.Original))
+	b = appendProtoBytes(b, 4, []byte(ca.Regenerated))
+	for _, cert := range ca.Issued {
+		b = appendProtoBytes(b, 5, cert.marshalProto())
+	}
+	return b
+}
+
+// marshalProto encodes the Certificate message.
+func (cert *apiCertificateResponse) marshalProto() []byte {
+	b := appendProtoBytes(nil, 1, []byte(cert.Serial))
+	b = appendProtoBytes(b, 2, []byte(cert.Subject))
+	b = appendProtoVarint(b, 3, uint64(cert.NotAfter.Unix()))
+	b = appendProtoBytes(b, 4, []byte(cert.Certificate))
+	return appendProtoBytes(b, 5, []byte(cert.Key))
+}
+
+// marshalProto encodes the VerifyResult message.
+func (result *apiVerifyResult) marshalProto() []byte {
+	b := appendProtoBytes(nil, 1, []byte(result.CA))
+	if result.Valid {
+		b = appendProtoVarint(b, 2, 1)
+	}
+	b = appendProtoBytes(b, 3, []byte(result.Error))
+	for _, cause := range result.Causes {
+		b = appendProtoBytes(b, 4, []byte(cause))
+	}
+	return b
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// hierarchyIntermediate is a value of -intermediate: the name of an
+// intermediate CA, optionally with the DNS domains it is constrained to.
+type hierarchyIntermediate struct {
+	name    string
+	domains []string
+}
+
+type hierarchyIntermediates []hierarchyIntermediate
+
+func (l *hierarchyIntermediates) String() string {
+	var values []string
+	for _, intermediate := range *l {
+		values = append(values, intermediate.name)
+	}
+	return strings.Join(values, ",")
+}
+
+func (l *hierarchyIntermediates) Set(value string) error {
+	name, domains, _ := strings.Cut(value, "=")
+	if !inventoryNamePattern.MatchString(name) || name == "root" {
+		return fmt.Errorf("invalid intermediate name %q, use letters, digits, '.', '_' and '-'", name)
+	}
+	for _, intermediate := range *l {
+		if intermediate.name == name {
+			return fmt.Errorf("duplicate intermediate %q", name)
+		}
+	}
+	intermediate := hierarchyIntermediate{name: name}
+	for _, domain := range strings.Split(domains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			intermediate.domains = append(intermediate.domains, domain)
+		}
+	}
+	*l = append(*l, intermediate)
+	return nil
+}
+
+// Bootstraps a new CA hierarchy: a root and intermediates, e.g. one per
+// environment or team, issued with the same machinery as every other
+// certificate of this tool, or checks the constraints of one.
+func runHierarchy(args []string) {
+	const usage = "go run *.go hierarchy init -subject <CN=Root CA,O=Org> -intermediate <name[=domain,...]>... [-key-type p384] [-root-validity 175200h] [-intermediate-validity 43800h] [-path-len 0] [-aia-url http://pki.example.com] [-out-dir pki] [-encrypt-to recipient] | hierarchy check <ca.pem>..."
+	if len(args) == 0 {
+		usageError(usage)
+	}
+	switch args[0] {
+	case "init":
+		runHierarchyInit(args[1:], usage)
+	case "check":
+		runHierarchyCheck(args[1:], usage)
+	default:
+		usageError(usage)
+	}
+}
+
+func runHierarchyInit(args []string, usage string) {
+	fs := flag.NewFlagSet("hierarchy init", flag.ContinueOnError)
+	var subject subjectFlag
+	fs.Var(&subject, "subject", "Subject of the root CA, e.g. CN=Example Root CA,O=Example; intermediates get its attributes with the common name <CN without Root CA> <name> Intermediate CA")
+	var intermediates hierarchyIntermediates
+	fs.Var(&intermediates, "intermediate", "Intermediate CA to issue, as name or name=domain,... to constrain it to DNS names below the domains, can be repeated")
+	keyType := fs.String("key-type", "p384", "Type of the generated CA keys: rsa2048, rsa3072, rsa4096, p256, p384 or ed25519")
+	rootValidity := fs.Duration("root-validity", 20*365*24*time.Hour, "Validity of the root CA")
+	intermediateValidity := fs.Duration("intermediate-validity", 5*365*24*time.Hour, "Validity of the intermediate CAs, at most the one of the root")
+	pathLen := fs.Int("path-len", 0, "Number of CA levels allowed below the intermediates, the root allows one more")
+	aiaURL := fs.String("aia-url", "", "Base URL the root is published at as <url>/root.crt, added to the intermediates as CA issuers location")
+	outDir := fs.String("out-dir", ".", "Directory to write the certificates and keys to")
+	var encryptTo keyRecipients
+	encryptTo.register(fs)
+	registerClock(fs)
+	registerFIPS(fs)
+	registerAudit(fs)
+	registerWebhook(fs)
+	registerCertDB(fs)
+	registerSerials(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	spec, ok := keyTypes[*keyType]
+	if fs.NArg() > 0 || subject.empty() || len(intermediates) == 0 || !ok || *rootValidity <= 0 || *intermediateValidity <= 0 || *pathLen < 0 {
+		usageError(usage)
+	}
+	rootFile := filepath.Join(*outDir, "root.pem")
+	if _, err := os.Stat(rootFile); err == nil {
+		fatal("Refusing to overwrite an existing hierarchy", "file", rootFile)
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		fatal("Failed to create output directory", "dir", *outDir, "error", err)
+	}
+
+	var rootName pkix.Name
+	subject.apply(&rootName)
+	rootKey, err := spec.generate()
+	if err != nil {
+		fatal("Failed to generate key", "error", err)
+	}
+	rootTemplate := hierarchyCATemplate(rootName, now.Now().Add(*rootValidity), *pathLen+1)
+	// Self-signed, so the template is its own issuer
+	root, err := signCertificate(rootTemplate, rootKey, rootTemplate, rootKey.Public(), nil)
+	if err != nil {
+		exitWith(exitFailure, "Failed to create root CA", "error", err)
+	}
+	writeHierarchyCA(*outDir, "root", root, rootKey, nil, &encryptTo)
+
+	for _, intermediate := range intermediates {
+		name := pkix.Name{
+			CommonName:         strings.TrimSuffix(rootName.CommonName, " Root CA") + " " + intermediate.name + " Intermediate CA",
+			Organization:       rootName.Organization,
+			OrganizationalUnit: rootName.OrganizationalUnit,
+			Country:            rootName.Country,
+			Locality:           rootName.Locality,
+			Province:           rootName.Province,
+		}
+		notAfter := now.Now().Add(*intermediateValidity)
+		if notAfter.After(root.NotAfter) {
+			slog.Warn("Limiting the validity of the intermediate CA to the one of the root", "name", intermediate.name, "not_after", root.NotAfter.Format(time.RFC3339))
+			notAfter = root.NotAfter
+		}
+		template := hierarchyCATemplate(name, notAfter, *pathLen)
+		if len(intermediate.domains) > 0 {
+			template.PermittedDNSDomainsCritical = true
+			template.PermittedDNSDomains = intermediate.domains
+		}
+		if *aiaURL != "" {
+			template.IssuingCertificateURL = []string{strings.TrimSuffix(*aiaURL, "/") + "/root.crt"}
+		}
+		key, err := spec.generate()
+		if err != nil {
+			fatal("Failed to generate key", "error", err)
+		}
+		cert, err := signCertificate(root, rootKey, template, key.Public(), nil)
+		if err != nil {
+			exitWith(exitFailure, "Failed to issue intermediate CA", "name", intermediate.name, "error", err)
+		}
+		writeHierarchyCA(*outDir, intermediate.name, cert, key, root, &encryptTo)
+	}
+
+	if *aiaURL != "" {
+		crtFile := filepath.Join(*outDir, "root.crt")
+		if err := os.WriteFile(crtFile, root.Raw, 0644); err != nil {
+			fatal("Failed to write root CA", "file", crtFile, "error", err)
+		}
+		slog.Info("Wrote DER encoded root CA to publish", "file", crtFile, "url", strings.TrimSuffix(*aiaURL, "/")+"/root.crt")
+	}
+	slog.Info("Created CA hierarchy", "root", root.Subject.String(), "intermediates", len(intermediates), "dir", *outDir)
+}
+
+// hierarchyCATemplate returns the template of a CA of the hierarchy,
+// allowing pathLen CAs below it.
+func hierarchyCATemplate(name pkix.Name, notAfter time.Time, pathLen int) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:               name,
+		NotBefore:             now.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLen:            pathLen,
+		MaxPathLenZero:        pathLen == 0,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+}
+
+// writeHierarchyCA writes a CA of the hierarchy to <name>.pem and its key
+// to <name>-key.pem, and for an intermediate the chain up to the root to
+// <name>-chain.pem.
+func writeHierarchyCA(dir, name string, cert *x509.Certificate, key crypto.Signer, root *x509.Certificate, encryptTo *keyRecipients) {
+	base := filepath.Join(dir, name)
+	writeIssued(base, cert)
+	if root != nil {
+		chainFile := base + "-chain.pem"
+		chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})...)
+		if err := os.WriteFile(chainFile, chain, 0644); err != nil {
+			fatal("Failed to write chain", "file", chainFile, "error", err)
+		}
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		fatal("Failed to encode key", "error", err)
+	}
+	keyFile, err := encryptTo.writeKey(base+"-key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		exitWith(exitFailure, "Failed to write key", "file", keyFile, "error", err)
+	}
+	slog.Info("Wrote key", "file", keyFile, "key", x509util.DescribePublicKey(key.Public()))
+}
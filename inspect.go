@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+var (
+	oidExtensionSubjectKeyId          = asn1.ObjectIdentifier{2, 5, 29, 14}
+	oidExtensionKeyUsage              = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionSubjectAltName        = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidExtensionBasicConstraints      = asn1.ObjectIdentifier{2, 5, 29, 19}
+	oidExtensionNameConstraints       = asn1.ObjectIdentifier{2, 5, 29, 30}
+	oidExtensionCRLDistributionPoints = asn1.ObjectIdentifier{2, 5, 29, 31}
+	oidExtensionCertificatePolicies   = asn1.ObjectIdentifier{2, 5, 29, 32}
+	oidExtensionAuthorityKeyId        = asn1.ObjectIdentifier{2, 5, 29, 35}
+	oidExtensionExtendedKeyUsage      = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidExtensionAuthorityInfoAccess   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 1}
+	oidExtensionTLSFeature            = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+)
+
+// extensionNames maps well-known extension OIDs to their names.
+var extensionNames = map[string]string{
+	oidExtensionSubjectKeyId.String():          "subjectKeyIdentifier",
+	oidExtensionKeyUsage.String():              "keyUsage",
+	oidExtensionSubjectAltName.String():        "subjectAltName",
+	oidExtensionBasicConstraints.String():      "basicConstraints",
+	oidExtensionNameConstraints.String():       "nameConstraints",
+	oidExtensionCRLDistributionPoints.String(): "cRLDistributionPoints",
+	oidExtensionCertificatePolicies.String():   "certificatePolicies",
+	oidExtensionAuthorityKeyId.String():        "authorityKeyIdentifier",
+	oidExtensionExtendedKeyUsage.String():      "extKeyUsage",
+	oidExtensionAuthorityInfoAccess.String():   "authorityInfoAccess",
+	"1.3.6.1.4.1.11129.2.4.2":                  "signedCertificateTimestampList",
+	"2.5.29.72":                                "subjectAltPublicKeyInfo",
+	"2.5.29.73":                                "altSignatureAlgorithm",
+	"2.5.29.74":                                "altSignatureValue",
+	"1.3.6.1.4.1.11129.2.4.3":                  "ctPrecertificatePoison",
+	oidExtensionTLSFeature.String():            "tlsFeature",
+	oidOCSPNoCheck.String():                    "ocspNoCheck",
+}
+
+func runInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if fs.NArg() == 0 {
+		usageError("go run *.go inspect <cert.pem>...")
+	}
+
+	for _, file := range fs.Args() {
+		certs, err := loadCertificates(file)
+		if err != nil {
+			exitWith(exitFailure, "Failed to load certificates", "file", file, "error", err)
+		}
+		for i, cert := range certs {
+			fmt.Printf("Certificate %d of %d (%s)\n", i+1, len(certs), file)
+			printCertificate(os.Stdout, cert)
+			fmt.Println()
+		}
+	}
+}
+
+// loadCertificates reads all certificates from a PEM file. Files without
+// any PEM block are parsed as a single DER encoded certificate.
+func loadCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := readInput(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate file: %w", err)
+	}
+	return parseCertificates(data)
+}
+
+// parseCertificates parses all PEM encoded certificates in data, or data
+// as a single DER encoded certificate.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509util.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		cert, err := x509util.ParseCertificate(data)
+		if err != nil {
+			return nil, fmt.Errorf("no certificate found (neither PEM nor DER)")
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+func printCertificate(w io.Writer, cert *x509.Certificate) {
+	field := func(name, format string, args ...any) {
+		fmt.Fprintf(w, "  %-21s %s\n", name+":", fmt.Sprintf(format, args...))
+	}
+
+	field("Subject", "%s", cert.Subject)
+	field("Issuer", "%s", cert.Issuer)
+	field("Serial Number", "%s", x509util.FormatHex(cert.SerialNumber.Bytes()))
+	field("Version", "%d", cert.Version)
+	field("Not Before", "%s", cert.NotBefore.UTC().Format(time.RFC3339))
+	field("Not After", "%s", cert.NotAfter.UTC().Format(time.RFC3339))
+	pss, pssErr := x509util.ParsePSSSignature(cert)
+	switch {
+	case cert.SignatureAlgorithm != x509.UnknownSignatureAlgorithm:
+		field("Signature Algorithm", "%s", cert.SignatureAlgorithm)
+	case pss != nil:
+		field("Signature Algorithm", "RSA-PSS with %s and a salt of %d bytes", pss.Hash, pss.SaltLength)
+	case pssErr != nil:
+		field("Signature Algorithm", "RSA-PSS with unsupported parameters")
+	default:
+		field("Signature Algorithm", "%s", cert.SignatureAlgorithm)
+	}
+	if x509util.HasPSSPublicKey(cert) {
+		field("Public Key", "%s, restricted to RSA-PSS", x509util.DescribePublicKey(cert.PublicKey))
+	} else {
+		field("Public Key", "%s", x509util.DescribePublicKey(cert.PublicKey))
+	}
+
+	if cert.BasicConstraintsValid {
+		pathLen := "unlimited"
+		if cert.MaxPathLen > 0 || cert.MaxPathLenZero {
+			pathLen = fmt.Sprint(cert.MaxPathLen)
+		}
+		if cert.IsCA {
+			field("CA", "true (max path length: %s)", pathLen)
+		} else {
+			field("CA", "false")
+		}
+	}
+	if cert.KeyUsage != 0 {
+		field("Key Usage", "%s", strings.Join(x509util.KeyUsageStrings(cert.KeyUsage), ", "))
+	}
+	if len(cert.ExtKeyUsage) > 0 || len(cert.UnknownExtKeyUsage) > 0 {
+		field("Extended Key Usage", "%s", strings.Join(x509util.ExtKeyUsageStrings(cert), ", "))
+	}
+	if len(cert.SubjectKeyId) > 0 {
+		field("Subject Key ID", "%s", x509util.FormatHex(cert.SubjectKeyId))
+	}
+	if len(cert.AuthorityKeyId) > 0 {
+		field("Authority Key ID", "%s", x509util.FormatHex(cert.AuthorityKeyId))
+	}
+
+	for _, name := range cert.DNSNames {
+		field("DNS Name", "%s", name)
+	}
+	for _, ip := range cert.IPAddresses {
+		field("IP Address", "%s", ip)
+	}
+	for _, email := range cert.EmailAddresses {
+		field("Email Address", "%s", email)
+	}
+	for _, uri := range cert.URIs {
+		field("URI", "%s", uri)
+	}
+
+	fmt.Fprintf(w, "  Extensions:\n")
+	for _, ext := range cert.Extensions {
+		name := extensionNames[ext.Id.String()]
+		if name == "" {
+			name = "unknown"
+		}
+		criticality := "non-critical"
+		if ext.Critical {
+			criticality = "critical"
+		}
+		fmt.Fprintf(w, "    %-24s %-31s %s\n", ext.Id, name, criticality)
+	}
+
+	sha256Sum := sha256.Sum256(cert.Raw)
+	sha1Sum := sha1.Sum(cert.Raw)
+	fmt.Fprintf(w, "  Fingerprints:\n")
+	fmt.Fprintf(w, "    SHA-256: %s\n", x509util.FormatHex(sha256Sum[:]))
+	fmt.Fprintf(w, "    SHA-1:   %s\n", x509util.FormatHex(sha1Sum[:]))
+}
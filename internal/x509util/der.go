@@ -0,0 +1,69 @@
+package x509util
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+)
+
+// RewriteExtensions returns tbs with every extension replaced by the
+// encoding rewrite returns for it, which is dropped if that is empty. Only
+// the changed extensions and the lengths of the enclosing elements are
+// encoded again.
+func RewriteExtensions(tbs []byte, rewrite func(raw []byte, extension pkix.Extension) ([]byte, error)) ([]byte, error) {
+	var tbsSeq asn1.RawValue
+	if _, err := asn1.Unmarshal(tbs, &tbsSeq); err != nil {
+		return nil, fmt.Errorf("failed to parse tbsCertificate: %w", err)
+	}
+	var fields []byte
+	for rest := tbsSeq.Bytes; len(rest) > 0; {
+		var field asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &field); err != nil {
+			return nil, fmt.Errorf("failed to parse tbsCertificate: %w", err)
+		}
+		if field.Class != asn1.ClassContextSpecific || field.Tag != 3 {
+			fields = append(fields, field.FullBytes...)
+			continue
+		}
+		// extensions [3] EXPLICIT SEQUENCE OF Extension
+		var extensionsSeq asn1.RawValue
+		if _, err := asn1.Unmarshal(field.Bytes, &extensionsSeq); err != nil {
+			return nil, fmt.Errorf("failed to parse extensions: %w", err)
+		}
+		var extensions []byte
+		for rest := extensionsSeq.Bytes; len(rest) > 0; {
+			var raw asn1.RawValue
+			if rest, err = asn1.Unmarshal(rest, &raw); err != nil {
+				return nil, fmt.Errorf("failed to parse extensions: %w", err)
+			}
+			var extension pkix.Extension
+			if _, err := asn1.Unmarshal(raw.FullBytes, &extension); err != nil {
+				return nil, fmt.Errorf("failed to parse extension: %w", err)
+			}
+			encoded, err := rewrite(raw.FullBytes, extension)
+			if err != nil {
+				return nil, err
+			}
+			extensions = append(extensions, encoded...)
+		}
+		if len(extensions) == 0 {
+			continue
+		}
+		encoded, err := MarshalConstructed(asn1.ClassUniversal, asn1.TagSequence, extensions)
+		if err == nil {
+			encoded, err = MarshalConstructed(asn1.ClassContextSpecific, 3, encoded)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, encoded...)
+	}
+	return MarshalConstructed(asn1.ClassUniversal, asn1.TagSequence, fields)
+}
+
+// MarshalConstructed encodes content as constructed element with the
+// given class and tag.
+func MarshalConstructed(class, tag int, content []byte) ([]byte, error) {
+	return asn1.Marshal(asn1.RawValue{Class: class, Tag: tag, IsCompound: true, Bytes: content})
+}
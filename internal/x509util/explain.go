@@ -0,0 +1,247 @@
+package x509util
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ExplainVerifyError turns the error returned by x509.Certificate.Verify
+// into an explanation of the likely cause in plain language.
+func ExplainVerifyError(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "no chain to a trusted CA could be built: the certificate (or one of the provided intermediates) " +
+			"is not signed by any of the trusted CAs. Check that the right CA file is used and that all " +
+			"intermediate certificates were provided."
+	case errors.As(err, &hostname):
+		names := hostname.Certificate.DNSNames
+		for _, ip := range hostname.Certificate.IPAddresses {
+			names = append(names, ip.String())
+		}
+		if len(names) == 0 {
+			return fmt.Sprintf("the certificate is not valid for %q, it has no DNS or IP subject alternative names", hostname.Host)
+		}
+		return fmt.Sprintf("the certificate is not valid for %q, it only covers: %s", hostname.Host, strings.Join(names, ", "))
+	case errors.As(err, &invalid):
+		switch invalid.Reason {
+		case x509.Expired:
+			return "a certificate in the chain is expired or not yet valid: " + invalid.Detail
+		case x509.NotAuthorizedToSign:
+			return "a certificate in the chain is used as an issuer, but it is not a CA: its basicConstraints " +
+				"are missing or CA:FALSE, or its keyUsage lacks keyCertSign"
+		case x509.CANotAuthorizedForThisName:
+			return "the name constraints of a CA in the chain do not permit the certificate's names: " + invalid.Detail
+		case x509.TooManyIntermediates:
+			return "the chain is longer than the path length constraint of a CA in it permits"
+		case x509.IncompatibleUsage:
+			return "the extended key usages in the chain do not permit server authentication"
+		case x509.NameMismatch:
+			return "the issuer name of a certificate does not match the subject of its issuer"
+		case x509.CANotAuthorizedForExtKeyUsage:
+			return "a CA in the chain restricts its extended key usages and does not permit the requested usage"
+		case x509.NoValidChains:
+			return "no valid chain could be built: " + invalid.Detail
+		default:
+			return invalid.Error()
+		}
+	default:
+		return err.Error()
+	}
+}
+
+// AnalyzeChain inspects the chain a server presents (leaf first) against
+// the trusted roots and explains every problem found which would make
+// verification fail, in plain language. Unlike ExplainVerifyError, which
+// only interprets the error of x509.Certificate.Verify, it looks at the
+// certificates themselves, so the actual cause is named even when Go
+// reports a generic "unknown authority". hostname may be empty.
+func AnalyzeChain(presented, roots []*x509.Certificate, hostname string, now time.Time) []string {
+	if len(presented) == 0 {
+		return nil
+	}
+	var problems []string
+	report := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	leaf := presented[0]
+	if hostname != "" {
+		if err := leaf.VerifyHostname(hostname); err != nil {
+			if names := CertNames(leaf); len(names) > 0 {
+				report("%s is not valid for %q, it only covers: %s", DescribeCert(leaf), hostname, strings.Join(names, ", "))
+			} else {
+				report("%s is not valid for %q, it has no DNS or IP subject alternative names", DescribeCert(leaf), hostname)
+			}
+		}
+	}
+	if len(leaf.ExtKeyUsage) > 0 && !containsExtKeyUsage(leaf.ExtKeyUsage, x509.ExtKeyUsageServerAuth) && !containsExtKeyUsage(leaf.ExtKeyUsage, x509.ExtKeyUsageAny) {
+		report("%s lacks the serverAuth extended key usage, it only allows: %s", DescribeCert(leaf), strings.Join(ExtKeyUsageStrings(leaf), ", "))
+	}
+
+	candidates := append(presented[1:len(presented):len(presented)], roots...)
+	cert := leaf
+	for depth := 0; depth < 10; depth++ {
+		if now.Before(cert.NotBefore) {
+			report("%s is not valid before %s", DescribeCert(cert), cert.NotBefore.Format(time.RFC3339))
+		} else if now.After(cert.NotAfter) {
+			report("%s expired at %s", DescribeCert(cert), cert.NotAfter.Format(time.RFC3339))
+		}
+		for _, oid := range cert.UnhandledCriticalExtensions {
+			report("%s has the unsupported critical extension %s", DescribeCert(cert), oid)
+		}
+		if ContainsCert(roots, cert) {
+			return problems
+		}
+
+		issuer, nameMatches := FindIssuer(cert, candidates)
+		if issuer == nil {
+			if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+				report("%s is a self-signed certificate which is not trusted", DescribeCert(cert))
+			} else {
+				report("no trusted CA or presented intermediate has the subject %q, the issuer of %s; check that the right CA file is used and the server sends all intermediates", cert.Issuer, DescribeCert(cert))
+			}
+			return problems
+		}
+
+		if !nameMatches {
+			report("the issuer name of %s does not match the subject of %s byte for byte (%q vs. %q), names are compared in their DER encoding", DescribeCert(cert), DescribeCert(issuer), cert.Issuer, issuer.Subject)
+		}
+		if len(cert.AuthorityKeyId) > 0 && len(issuer.SubjectKeyId) > 0 && !bytes.Equal(cert.AuthorityKeyId, issuer.SubjectKeyId) {
+			report("the authority key identifier of %s (%s) does not match the subject key identifier of %s (%s), some clients will not consider it the issuer", DescribeCert(cert), FormatHex(cert.AuthorityKeyId), DescribeCert(issuer), FormatHex(issuer.SubjectKeyId))
+		}
+		if !issuer.BasicConstraintsValid {
+			report("%s is used as issuer but has no basicConstraints extension, so it is not a CA", DescribeCert(issuer))
+		} else if !issuer.IsCA {
+			report("%s is used as issuer but its basicConstraints say CA:FALSE", DescribeCert(issuer))
+		} else if issuer.MaxPathLen >= 0 && (issuer.MaxPathLen > 0 || issuer.MaxPathLenZero) && depth > issuer.MaxPathLen {
+			report("%s allows %d intermediate CAs below it (pathlen), the chain has %d", DescribeCert(issuer), issuer.MaxPathLen, depth)
+		}
+		if issuer.KeyUsage != 0 && issuer.KeyUsage&x509.KeyUsageCertSign == 0 {
+			report("%s is used as issuer but its key usage lacks keyCertSign (it has: %s)", DescribeCert(issuer), strings.Join(KeyUsageStrings(issuer.KeyUsage), ", "))
+		}
+		if err := CheckSignedBy(cert, issuer); err != nil {
+			report("the signature of %s does not verify with the key of %s: %v", DescribeCert(cert), DescribeCert(issuer), err)
+		}
+		cert = issuer
+	}
+	report("the chain is longer than 10 certificates, it probably contains a loop")
+	return problems
+}
+
+// FindIssuer returns the candidate issuing cert, preferring the one whose
+// subject matches the issuer name of cert. If no name matches, a candidate
+// whose subject key identifier matches the authority key identifier is
+// returned, with nameMatches false.
+func FindIssuer(cert *x509.Certificate, candidates []*x509.Certificate) (issuer *x509.Certificate, nameMatches bool) {
+	for _, candidate := range candidates {
+		if candidate != cert && bytes.Equal(candidate.RawSubject, cert.RawIssuer) {
+			if issuer == nil || CheckSignedBy(cert, candidate) == nil {
+				issuer = candidate
+			}
+		}
+	}
+	if issuer != nil {
+		return issuer, true
+	}
+	if len(cert.AuthorityKeyId) == 0 {
+		return nil, false
+	}
+	for _, candidate := range candidates {
+		if candidate != cert && bytes.Equal(candidate.SubjectKeyId, cert.AuthorityKeyId) {
+			return candidate, false
+		}
+	}
+	return nil, false
+}
+
+// DescribeCert returns the quoted subject of cert for messages.
+func DescribeCert(cert *x509.Certificate) string {
+	return fmt.Sprintf("%q", cert.Subject.String())
+}
+
+func containsExtKeyUsage(usages []x509.ExtKeyUsage, usage x509.ExtKeyUsage) bool {
+	for _, u := range usages {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsCert reports whether certs contains cert.
+func ContainsCert(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if c.Equal(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyUsageNames are the names of the key usages, in bit order.
+var KeyUsageNames = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "Digital Signature"},
+	{x509.KeyUsageContentCommitment, "Content Commitment"},
+	{x509.KeyUsageKeyEncipherment, "Key Encipherment"},
+	{x509.KeyUsageDataEncipherment, "Data Encipherment"},
+	{x509.KeyUsageKeyAgreement, "Key Agreement"},
+	{x509.KeyUsageCertSign, "Certificate Sign"},
+	{x509.KeyUsageCRLSign, "CRL Sign"},
+	{x509.KeyUsageEncipherOnly, "Encipher Only"},
+	{x509.KeyUsageDecipherOnly, "Decipher Only"},
+}
+
+// ExtKeyUsageNames are the names of the extended key usages Go knows.
+var ExtKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:                        "Any",
+	x509.ExtKeyUsageServerAuth:                 "Server Auth",
+	x509.ExtKeyUsageClientAuth:                 "Client Auth",
+	x509.ExtKeyUsageCodeSigning:                "Code Signing",
+	x509.ExtKeyUsageEmailProtection:            "Email Protection",
+	x509.ExtKeyUsageIPSECEndSystem:             "IPSec End System",
+	x509.ExtKeyUsageIPSECTunnel:                "IPSec Tunnel",
+	x509.ExtKeyUsageIPSECUser:                  "IPSec User",
+	x509.ExtKeyUsageTimeStamping:               "Time Stamping",
+	x509.ExtKeyUsageOCSPSigning:                "OCSP Signing",
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto: "Microsoft Server Gated Crypto",
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:  "Netscape Server Gated Crypto",
+}
+
+// KeyUsageStrings returns the names of the key usages in usage.
+func KeyUsageStrings(usage x509.KeyUsage) []string {
+	var names []string
+	for _, ku := range KeyUsageNames {
+		if usage&ku.usage != 0 {
+			names = append(names, ku.name)
+		}
+	}
+	return names
+}
+
+// ExtKeyUsageStrings returns the names of the extended key usages of
+// cert, the OIDs of the ones Go does not know.
+func ExtKeyUsageStrings(cert *x509.Certificate) []string {
+	var names []string
+	for _, eku := range cert.ExtKeyUsage {
+		name, ok := ExtKeyUsageNames[eku]
+		if !ok {
+			name = fmt.Sprintf("unknown (%d)", eku)
+		}
+		names = append(names, name)
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		names = append(names, oid.String())
+	}
+	return names
+}
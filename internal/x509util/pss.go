@@ -0,0 +1,302 @@
+package x509util
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+)
+
+var (
+	OIDRSASSAPSS = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+	OIDSHA256    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	OIDSHA384    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	OIDSHA512    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	OIDMGF1      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+)
+
+// pssParameters are the RSASSA-PSS-params of RFC 4055. Only the hash is
+// of interest, Go signs with MGF1 using the same hash and a salt as long
+// as the hash.
+type pssParameters struct {
+	Hash pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:0"`
+}
+
+// PSSSignatureParameters are the complete RSASSA-PSS-params of RFC 4055,
+// as needed to sign and verify with the parameters of a signature.
+type PSSSignatureParameters struct {
+	Hash         pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:0"`
+	MaskGen      pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:1"`
+	SaltLength   int                      `asn1:"optional,explicit,tag:2,default:20"`
+	TrailerField int                      `asn1:"optional,explicit,tag:3,default:1"`
+}
+
+// PSSSignature is the RSA-PSS signature algorithm of a certificate. Go
+// only signs and verifies certificates with a salt as long as the hash,
+// other salt lengths are signed and verified with it.
+type PSSSignature struct {
+	Hash       crypto.Hash
+	SaltLength int
+	// Algorithm is the encoded AlgorithmIdentifier, which is kept as is.
+	Algorithm []byte
+}
+
+// ParsePSSSignature returns the RSA-PSS signature algorithm of cert, nil
+// if it is not signed with RSA-PSS. Parameters which cannot be signed
+// with, e.g. a mask generation hash differing from the signature hash,
+// are an error, so they are never silently replaced.
+func ParsePSSSignature(cert *x509.Certificate) (*PSSSignature, error) {
+	var signed struct {
+		TBS       asn1.RawValue
+		Algorithm asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(cert.Raw, &signed); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	var algorithm pkix.AlgorithmIdentifier
+	if _, err := asn1.Unmarshal(signed.Algorithm.FullBytes, &algorithm); err != nil {
+		return nil, fmt.Errorf("failed to parse signature algorithm: %w", err)
+	}
+	if !algorithm.Algorithm.Equal(OIDRSASSAPSS) {
+		return nil, nil
+	}
+	var params PSSSignatureParameters
+	if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("failed to parse RSA-PSS parameters: %w", err)
+	}
+	hash, err := pssHash(params.Hash.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	// The mask generation function defaults to MGF1 with SHA-1
+	var mgfHash pkix.AlgorithmIdentifier
+	if len(params.MaskGen.Algorithm) > 0 {
+		if !params.MaskGen.Algorithm.Equal(OIDMGF1) {
+			return nil, fmt.Errorf("unsupported RSA-PSS mask generation function %v, only MGF1 is supported", params.MaskGen.Algorithm)
+		}
+		if _, err := asn1.Unmarshal(params.MaskGen.Parameters.FullBytes, &mgfHash); err != nil {
+			return nil, fmt.Errorf("failed to parse RSA-PSS MGF1 hash: %w", err)
+		}
+	}
+	if h, err := pssHash(mgfHash.Algorithm); err != nil || h != hash {
+		return nil, fmt.Errorf("unsupported RSA-PSS parameters, MGF1 has to use the signature hash %s", hash)
+	}
+	if params.TrailerField != 1 {
+		return nil, fmt.Errorf("unsupported RSA-PSS trailer field %d", params.TrailerField)
+	}
+	// A salt length of 0 means the longest possible salt to Go
+	if params.SaltLength < 1 {
+		return nil, fmt.Errorf("unsupported RSA-PSS salt length %d", params.SaltLength)
+	}
+	return &PSSSignature{Hash: hash, SaltLength: params.SaltLength, Algorithm: signed.Algorithm.FullBytes}, nil
+}
+
+// pssHash returns the hash of an RSA-PSS hash algorithm, which defaults
+// to SHA-1.
+func pssHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(OIDSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(OIDSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(OIDSHA512):
+		return crypto.SHA512, nil
+	case len(oid) == 0:
+		return 0, fmt.Errorf("RSA-PSS with SHA-1 is not supported")
+	default:
+		return 0, fmt.Errorf("unsupported RSA-PSS hash %v", oid)
+	}
+}
+
+// Sign signs an encoded tbsCertificate with the parameters of p.
+func (p *PSSSignature) Sign(random io.Reader, tbs []byte, key crypto.Signer) ([]byte, error) {
+	h := p.Hash.New()
+	h.Write(tbs)
+	return key.Sign(random, h.Sum(nil), &rsa.PSSOptions{SaltLength: p.SaltLength, Hash: p.Hash})
+}
+
+// Verify verifies the signature of an encoded tbsCertificate with the
+// parameters of p.
+func (p *PSSSignature) Verify(tbs, signature []byte, pub crypto.PublicKey) error {
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("RSA-PSS signatures need an RSA key, the issuer has %s", DescribePublicKey(pub))
+	}
+	h := p.Hash.New()
+	h.Write(tbs)
+	return rsa.VerifyPSS(rsaPub, p.Hash, h.Sum(nil), signature, &rsa.PSSOptions{SaltLength: p.SaltLength, Hash: p.Hash})
+}
+
+// SignAgain replaces the signature algorithm of the encoded certificate
+// der, in the tbsCertificate and the certificate, with the one of p and
+// signs it again with key.
+func (p *PSSSignature) SignAgain(random io.Reader, der []byte, key crypto.Signer) ([]byte, error) {
+	var cert struct {
+		TBS       asn1.RawValue
+		Algorithm asn1.RawValue
+		Signature asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &cert); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	// The signature algorithm is the first SEQUENCE, after the optional
+	// version and the serial number
+	var fields []byte
+	replaced := false
+	for rest := cert.TBS.Bytes; len(rest) > 0; {
+		var field asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &field); err != nil {
+			return nil, fmt.Errorf("failed to parse tbsCertificate: %w", err)
+		}
+		if !replaced && field.Class == asn1.ClassUniversal && field.Tag == asn1.TagSequence {
+			fields = append(fields, p.Algorithm...)
+			replaced = true
+			continue
+		}
+		fields = append(fields, field.FullBytes...)
+	}
+	tbs, err := MarshalConstructed(asn1.ClassUniversal, asn1.TagSequence, fields)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := p.Sign(random, tbs, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with the RSA-PSS parameters of the original CA: %w", err)
+	}
+	return asn1.Marshal(struct {
+		TBS       asn1.RawValue
+		Algorithm asn1.RawValue
+		Signature asn1.BitString
+	}{asn1.RawValue{FullBytes: tbs}, asn1.RawValue{FullBytes: p.Algorithm}, asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)}})
+}
+
+// PSSAlgorithms are the signature algorithms Go encodes with complete
+// RSASSA-PSS-params, by hash.
+var PSSAlgorithms = map[crypto.Hash]x509.SignatureAlgorithm{
+	crypto.SHA256: x509.SHA256WithRSAPSS,
+	crypto.SHA384: x509.SHA384WithRSAPSS,
+	crypto.SHA512: x509.SHA512WithRSAPSS,
+}
+
+// pssSigner signs only with RSASSA-PSS, for keys restricted to PSS by
+// their id-RSASSA-PSS algorithm and for -pss.
+type pssSigner struct {
+	crypto.Signer
+	algorithm x509.SignatureAlgorithm
+}
+
+func (s *pssSigner) Sign(random io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); !ok {
+		return nil, fmt.Errorf("the CA key only signs with RSA-PSS")
+	}
+	return s.Signer.Sign(random, digest, opts)
+}
+
+func (s *pssSigner) SignatureAlgorithm() x509.SignatureAlgorithm {
+	return s.algorithm
+}
+
+// NewPSSSigner returns key signing with RSA-PSS. The hash is kept from
+// ca if it is signed with SHA-384 or SHA-512 and is SHA-256 otherwise.
+func NewPSSSigner(key crypto.Signer, ca *x509.Certificate) (crypto.Signer, error) {
+	if _, ok := key.Public().(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("RSA-PSS needs an RSA key, the CA key is %s", DescribePublicKey(key.Public()))
+	}
+	if signer, ok := key.(*pssSigner); ok {
+		return signer, nil
+	}
+	algorithm := x509.SHA256WithRSAPSS
+	switch hash := SignatureAlgorithmHashes[ca.SignatureAlgorithm]; hash {
+	case crypto.SHA384, crypto.SHA512:
+		algorithm = PSSAlgorithms[hash]
+	}
+	return &pssSigner{Signer: key, algorithm: algorithm}, nil
+}
+
+// ParsePSSPrivateKey parses a PKCS#8 key with the id-RSASSA-PSS algorithm,
+// which Go rejects. The key itself is a PKCS#1 RSA key, the parameters
+// restrict it to a hash.
+func ParsePSSPrivateKey(der []byte) (crypto.Signer, error) {
+	var pkcs8 struct {
+		Version    int
+		Algorithm  pkix.AlgorithmIdentifier
+		PrivateKey []byte
+	}
+	if _, err := asn1.Unmarshal(der, &pkcs8); err != nil {
+		return nil, err
+	}
+	if !pkcs8.Algorithm.Algorithm.Equal(OIDRSASSAPSS) {
+		return nil, fmt.Errorf("not an RSA-PSS key: %v", pkcs8.Algorithm.Algorithm)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(pkcs8.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RSA-PSS key: %w", err)
+	}
+	algorithm, err := pssAlgorithm(pkcs8.Algorithm.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	return &pssSigner{Signer: key, algorithm: algorithm}, nil
+}
+
+// pssAlgorithm returns the signature algorithm for the hash in the
+// parameters of an id-RSASSA-PSS key, SHA-256 for keys without them.
+func pssAlgorithm(parameters asn1.RawValue) (x509.SignatureAlgorithm, error) {
+	if len(parameters.FullBytes) == 0 {
+		return x509.SHA256WithRSAPSS, nil
+	}
+	var params pssParameters
+	if _, err := asn1.Unmarshal(parameters.FullBytes, &params); err != nil {
+		return 0, fmt.Errorf("failed to parse RSA-PSS parameters: %w", err)
+	}
+	switch hash := params.Hash.Algorithm; {
+	case hash.Equal(OIDSHA256):
+		return x509.SHA256WithRSAPSS, nil
+	case hash.Equal(OIDSHA384):
+		return x509.SHA384WithRSAPSS, nil
+	case hash.Equal(OIDSHA512):
+		return x509.SHA512WithRSAPSS, nil
+	case len(hash) == 0:
+		return 0, fmt.Errorf("RSA-PSS keys restricted to SHA-1 are not supported")
+	default:
+		return 0, fmt.Errorf("unsupported RSA-PSS hash %v", hash)
+	}
+}
+
+// SubjectPublicKeyInfo is the encoded public key of a certificate.
+type SubjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// HasPSSPublicKey reports whether the public key of cert is encoded with
+// the id-RSASSA-PSS algorithm instead of rsaEncryption.
+func HasPSSPublicKey(cert *x509.Certificate) bool {
+	var spki SubjectPublicKeyInfo
+	_, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki)
+	return err == nil && spki.Algorithm.Algorithm.Equal(OIDRSASSAPSS)
+}
+
+// ParseCertificate is x509.ParseCertificate, but fills in the public key
+// of certificates with an id-RSASSA-PSS key, which Go leaves empty.
+func ParseCertificate(der []byte) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil || cert.PublicKey != nil || !HasPSSPublicKey(cert) {
+		return cert, err
+	}
+	var spki SubjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKCS1PublicKey(spki.PublicKey.RightAlign())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RSA-PSS public key: %w", err)
+	}
+	cert.PublicKey = pub
+	cert.PublicKeyAlgorithm = x509.RSA
+	return cert, nil
+}
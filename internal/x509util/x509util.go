@@ -0,0 +1,113 @@
+// Package x509util holds the certificate helpers shared by the ca-regen
+// command and the caregen package: describing keys and certificates,
+// signature algorithms, RSA-PSS with parameters Go does not sign with and
+// rewriting DER encoded certificates.
+package x509util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/mldsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+)
+
+// DescribePublicKey returns the key type and size, e.g. "RSA 2048 bits".
+func DescribePublicKey(pub any) string {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "Ed25519"
+	case *mldsa.PublicKey:
+		return key.Parameters().String()
+	default:
+		return fmt.Sprintf("unknown (%T)", pub)
+	}
+}
+
+// FormatHex formats b as colon separated upper case hex, like openssl.
+func FormatHex(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02X", c)
+	}
+	return strings.Join(parts, ":")
+}
+
+// CertNames returns the DNS names and IP addresses of cert.
+func CertNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// FindExtension returns the extension with the given OID or nil.
+func FindExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) *pkix.Extension {
+	for i := range cert.Extensions {
+		if cert.Extensions[i].Id.Equal(oid) {
+			return &cert.Extensions[i]
+		}
+	}
+	return nil
+}
+
+// IsPublicKey reports whether the public keys a and b are equal.
+func IsPublicKey(a, b crypto.PublicKey) bool {
+	type publicKey interface {
+		Equal(x crypto.PublicKey) bool
+	}
+	pub, ok := a.(publicKey)
+	return ok && pub.Equal(b)
+}
+
+// SignatureAlgorithmFor returns the signature algorithm a signer is
+// restricted to, if it is, and fallback otherwise.
+func SignatureAlgorithmFor(signer crypto.Signer, fallback x509.SignatureAlgorithm) x509.SignatureAlgorithm {
+	if s, ok := signer.(interface {
+		SignatureAlgorithm() x509.SignatureAlgorithm
+	}); ok && s.SignatureAlgorithm() != x509.UnknownSignatureAlgorithm {
+		return s.SignatureAlgorithm()
+	}
+	return fallback
+}
+
+// SignatureAlgorithmHashes are the hashes of the algorithms a CA can sign
+// certificates and responses with.
+var SignatureAlgorithmHashes = map[x509.SignatureAlgorithm]crypto.Hash{
+	x509.SHA256WithRSA:    crypto.SHA256,
+	x509.SHA384WithRSA:    crypto.SHA384,
+	x509.SHA512WithRSA:    crypto.SHA512,
+	x509.SHA256WithRSAPSS: crypto.SHA256,
+	x509.SHA384WithRSAPSS: crypto.SHA384,
+	x509.SHA512WithRSAPSS: crypto.SHA512,
+	x509.ECDSAWithSHA256:  crypto.SHA256,
+	x509.ECDSAWithSHA384:  crypto.SHA384,
+	x509.ECDSAWithSHA512:  crypto.SHA512,
+	x509.PureEd25519:      0,
+}
+
+// CheckSignedBy checks only the signature of cert with the key of issuer,
+// unlike CheckSignatureFrom, which also checks that issuer is a CA.
+func CheckSignedBy(cert, issuer *x509.Certificate) error {
+	if cert.SignatureAlgorithm == x509.UnknownSignatureAlgorithm {
+		// Go does not know RSA-PSS with a salt not as long as the hash
+		pss, err := ParsePSSSignature(cert)
+		if err != nil {
+			return err
+		}
+		if pss != nil {
+			return pss.Verify(cert.RawTBSCertificate, cert.Signature, issuer.PublicKey)
+		}
+	}
+	return issuer.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/databus23/ca-regen/caregen"
+)
+
+// invariantList is the comma separated -invariants flag. The zero value
+// selects all invariants.
+type invariantList struct {
+	names []string
+}
+
+func (l *invariantList) String() string {
+	if l == nil || l.names == nil {
+		return "all"
+	}
+	return strings.Join(l.names, ",")
+}
+
+func (l *invariantList) Set(value string) error {
+	if value == "all" {
+		l.names = nil
+		return nil
+	}
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if !slices.Contains(caregen.InvariantNames(), name) {
+			return fmt.Errorf("unknown invariant %q, use all or some of %s", name, strings.Join(caregen.InvariantNames(), ", "))
+		}
+		names = append(names, name)
+	}
+	l.names = names
+	return nil
+}
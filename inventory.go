@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// The inventory is a directory with one subdirectory per CA, named after
+// the CA, holding its certificate, key and, once regenerated, the new CA:
+//
+//	cas/<name>/ca-cert.pem
+//	cas/<name>/ca-key.pem
+//	cas/<name>/new-ca.pem
+const (
+	inventoryCertFile  = "ca-cert.pem"
+	inventoryKeyFile   = "ca-key.pem"
+	inventoryNewCAFile = "new-ca.pem"
+)
+
+// inventoryNamePattern restricts CA names to what is safe as directory
+// name on every platform.
+var inventoryNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// inventoryEntry is a CA of the inventory.
+type inventoryEntry struct {
+	name string
+	dir  string
+	cert *x509.Certificate
+	// newCA is the regenerated CA, nil if it was not regenerated yet.
+	newCA *x509.Certificate
+}
+
+// Manages a directory of CAs, so teams with many internal CAs can
+// regenerate, lint and report on all of them in one invocation.
+func runCA(args []string) {
+	const usage = "go run *.go ca list [-dir cas] [-expiring 720h] [-json] | ca add [-dir cas] (-ca <ca-bundle.pem> | -ca-cert <ca-cert.pem> -ca-key <ca-key.pem>) <name> | ca remove [-dir cas] <name> | ca regenerate [-dir cas] [-force] [name...] | ca lint [-dir cas] [-expiry-warning 720h] [name...]"
+	if len(args) == 0 {
+		usageError(usage)
+	}
+	fs := flag.NewFlagSet("ca "+args[0], flag.ContinueOnError)
+	dir := fs.String("dir", "cas", "Directory of the CA inventory, with a subdirectory per CA")
+	var logOpts logOptions
+	logOpts.register(fs)
+	switch args[0] {
+	case "list":
+		expiring := fs.Duration("expiring", 0, "Only list CAs expiring within this duration")
+		jsonOutput := fs.Bool("json", false, "Print the CAs as JSON")
+		registerClock(fs)
+		parseFlags(fs, args[1:])
+		logOpts.setup()
+		if fs.NArg() > 0 {
+			usageError(usage)
+		}
+		listInventory(*dir, *expiring, *jsonOutput)
+	case "add":
+		bundleFile := fs.String("ca", "", "Path to PEM file containing both the CA certificate and private key")
+		certFile := fs.String("ca-cert", "", "Path to PEM encoded CA certificate file")
+		keyFile := fs.String("ca-key", "", "Path to PEM encoded CA private key file, defaults to the -ca-cert file")
+		parseFlags(fs, args[1:])
+		logOpts.setup()
+		if fs.NArg() != 1 || (*bundleFile == "") == (*certFile == "") {
+			usageError(usage)
+		}
+		if *bundleFile != "" {
+			*certFile, *keyFile = *bundleFile, *bundleFile
+		} else if *keyFile == "" {
+			*keyFile = *certFile
+		}
+		addToInventory(*dir, fs.Arg(0), *certFile, *keyFile)
+	case "remove":
+		parseFlags(fs, args[1:])
+		logOpts.setup()
+		if fs.NArg() != 1 {
+			usageError(usage)
+		}
+		removeFromInventory(*dir, fs.Arg(0))
+	case "regenerate":
+		force := fs.Bool("force", false, "Regenerate CAs again which were already regenerated")
+		registerClock(fs)
+		parseFlags(fs, args[1:])
+		logOpts.setup()
+		regenerateInventory(*dir, fs.Args(), *force)
+	case "lint":
+		expiryWarning := fs.Duration("expiry-warning", 30*24*time.Hour, "Warn about CAs expiring within this duration")
+		registerClock(fs)
+		parseFlags(fs, args[1:])
+		logOpts.setup()
+		lintInventory(*dir, fs.Args(), *expiryWarning)
+	default:
+		usageError(usage)
+	}
+}
+
+// loadInventory loads the CAs of the inventory in dir, or only the named
+// ones, sorted by name.
+func loadInventory(dir string, names []string) ([]inventoryEntry, error) {
+	if len(names) == 0 {
+		dirEntries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, dirEntry := range dirEntries {
+			if dirEntry.IsDir() && inventoryNamePattern.MatchString(dirEntry.Name()) {
+				names = append(names, dirEntry.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+	var entries []inventoryEntry
+	for _, name := range names {
+		if !inventoryNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid CA name %q", name)
+		}
+		entry := inventoryEntry{name: name, dir: filepath.Join(dir, name)}
+		certs, err := loadCertificates(filepath.Join(entry.dir, inventoryCertFile))
+		if err != nil {
+			return nil, fmt.Errorf("CA %s: %w", name, err)
+		}
+		entry.cert = certs[0]
+		newCAFile := filepath.Join(entry.dir, inventoryNewCAFile)
+		if _, err := os.Stat(newCAFile); err == nil {
+			certs, err := loadCertificates(newCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("CA %s: %w", name, err)
+			}
+			entry.newCA = certs[0]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// current returns the CA in use, the regenerated one if there is one.
+func (e inventoryEntry) current() *x509.Certificate {
+	if e.newCA != nil {
+		return e.newCA
+	}
+	return e.cert
+}
+
+type inventoryListEntry struct {
+	Name        string `json:"name"`
+	Subject     string `json:"subject"`
+	NotAfter    string `json:"not_after"`
+	Regenerated bool   `json:"regenerated"`
+	Status      string `json:"status"`
+}
+
+func listInventory(dir string, expiring time.Duration, jsonOutput bool) {
+	entries, err := loadInventory(dir, nil)
+	if err != nil {
+		fatal("Failed to load CA inventory", "dir", dir, "error", err)
+	}
+	list := []inventoryListEntry{}
+	for _, entry := range entries {
+		cert := entry.current()
+		if expiring != 0 && cert.NotAfter.After(now.Now().Add(expiring)) {
+			continue
+		}
+		status := "valid"
+		if now.Now().After(cert.NotAfter) {
+			status = "expired"
+		}
+		list = append(list, inventoryListEntry{
+			Name:        entry.name,
+			Subject:     cert.Subject.String(),
+			NotAfter:    cert.NotAfter.UTC().Format(time.RFC3339),
+			Regenerated: entry.newCA != nil,
+			Status:      status,
+		})
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].NotAfter < list[j].NotAfter })
+
+	if jsonOutput {
+		data, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			fatal("Failed to encode CAs", "error", err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSUBJECT\tNOT AFTER\tREGENERATED\tSTATUS")
+	for _, entry := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", entry.Name, entry.Subject, entry.NotAfter, entry.Regenerated, entry.Status)
+	}
+	w.Flush()
+}
+
+// addToInventory copies the CA certificate and key to the inventory after
+// checking that they match.
+func addToInventory(dir, name, certFile, keyFile string) {
+	if !inventoryNamePattern.MatchString(name) {
+		usageError("invalid CA name " + name + ", use letters, digits, '.', '_' and '-'")
+	}
+	cert, key, chain, err := loadCA(certFile, keyFile)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA", "error", err)
+	}
+	keyPEM, err := readInput(keyFile)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to read CA private key", "error", err)
+	}
+	// The key is kept in its original encoding, e.g. PKCS#1 or a key
+	// restricted to RSA-PSS
+	block := findPEMBlock(keyPEM, "PRIVATE KEY")
+
+	entryDir := filepath.Join(dir, name)
+	if _, err := os.Stat(entryDir); err == nil {
+		fatal("CA already in inventory, remove it first", "name", name, "dir", entryDir)
+	}
+	if err := os.MkdirAll(entryDir, 0700); err != nil {
+		fatal("Failed to create inventory directory", "dir", entryDir, "error", err)
+	}
+	var certPEM []byte
+	for _, c := range append([]*x509.Certificate{cert}, chain...) {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	if err := os.WriteFile(filepath.Join(entryDir, inventoryCertFile), certPEM, 0644); err != nil {
+		fatal("Failed to write CA certificate", "error", err)
+	}
+	if err := os.WriteFile(filepath.Join(entryDir, inventoryKeyFile), pem.EncodeToMemory(block), 0600); err != nil {
+		fatal("Failed to write CA private key", "error", err)
+	}
+	slog.Info("Added CA to inventory", "name", name, "subject", cert.Subject.String(), "key", x509util.DescribePublicKey(key.Public()), "dir", entryDir)
+}
+
+func removeFromInventory(dir, name string) {
+	if !inventoryNamePattern.MatchString(name) {
+		usageError("invalid CA name " + name)
+	}
+	entryDir := filepath.Join(dir, name)
+	if _, err := os.Stat(filepath.Join(entryDir, inventoryCertFile)); err != nil {
+		fatal("CA not in inventory", "name", name, "error", err)
+	}
+	if err := os.RemoveAll(entryDir); err != nil {
+		fatal("Failed to remove CA from inventory", "name", name, "error", err)
+	}
+	slog.Info("Removed CA from inventory", "name", name, "dir", entryDir)
+}
+
+// regenerateInventory regenerates every CA of the inventory, or the named
+// ones, with critical basic constraints and writes them to new-ca.pem.
+// A failing CA does not stop the others.
+func regenerateInventory(dir string, names []string, force bool) {
+	entries, err := loadInventory(dir, names)
+	if err != nil {
+		fatal("Failed to load CA inventory", "dir", dir, "error", err)
+	}
+	var opts caOptions
+	failed := 0
+	for _, entry := range entries {
+		logger := slog.With("name", entry.name)
+		if entry.newCA != nil && !force {
+			logger.Info("Skipping CA which was already regenerated, use -force to regenerate it again")
+			continue
+		}
+		newCA, err := func() (*x509.Certificate, error) {
+			cert, key, _, err := loadCA(filepath.Join(entry.dir, inventoryCertFile), filepath.Join(entry.dir, inventoryKeyFile))
+			if err != nil {
+				return nil, err
+			}
+			if err := checkOriginalCABasicConstraints(cert); err != nil {
+				return nil, err
+			}
+			return opts.regenerate(cert, key)
+		}()
+		if err == nil {
+			err = saveCAToFile(newCA, filepath.Join(entry.dir, inventoryNewCAFile))
+		}
+		if err != nil {
+			logger.Error("Failed to regenerate CA", "error", err)
+			failed++
+			continue
+		}
+		logger.Info("Regenerated CA", "subject", newCA.Subject.String(), "file", filepath.Join(entry.dir, inventoryNewCAFile))
+	}
+	if failed > 0 {
+		exitWith(exitRegenerationFailed, "Failed to regenerate CAs", "failed", failed, "total", len(entries))
+	}
+}
+
+// lintInventory lints the current CA of every CA of the inventory, or the
+// named ones, like the lint subcommand.
+func lintInventory(dir string, names []string, expiryWarning time.Duration) {
+	entries, err := loadInventory(dir, names)
+	if err != nil {
+		fatal("Failed to load CA inventory", "dir", dir, "error", err)
+	}
+	problems := 0
+	for _, entry := range entries {
+		cert := entry.current()
+		problems += printFindings(fmt.Sprintf("%s: %s", entry.name, cert.Subject), lintCA(cert, now.Now(), expiryWarning))
+	}
+	if problems > 0 {
+		exitWith(exitLintFailed, "Lint found problems", "errors", problems)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// certProfile describes the certificates issued for a request: key usages
+// and validity. Subject, names and key come from the request.
+type certProfile struct {
+	keyUsage x509.KeyUsage
+	// rsaKeyUsage and ecdsaKeyUsage are added to keyUsage depending on the
+	// type of the certified key.
+	rsaKeyUsage   x509.KeyUsage
+	ecdsaKeyUsage x509.KeyUsage
+	extKeyUsage   []x509.ExtKeyUsage
+	// unknownExtKeyUsage are extended key usages by OID.
+	unknownExtKeyUsage []asn1.ObjectIdentifier
+	expiry             time.Duration
+	// requireEmail rejects requests without an email address SAN.
+	requireEmail bool
+}
+
+// defaultCertProfile is used without a profile, the same as cfssl's
+// default.
+var defaultCertProfile = certProfile{
+	keyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	expiry:      365 * 24 * time.Hour,
+}
+
+// builtinProfiles can be selected with -profile without a cfssl config.
+var builtinProfiles = map[string]certProfile{
+	"server": {
+		keyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		expiry:      365 * 24 * time.Hour,
+	},
+	"client": {
+		keyUsage:    x509.KeyUsageDigitalSignature,
+		extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		expiry:      365 * 24 * time.Hour,
+	},
+	// Code signing certificates must not be usable for TLS, and signatures
+	// are usually timestamped, so they can outlive a short validity.
+	"code-signing": {
+		keyUsage:    x509.KeyUsageDigitalSignature,
+		extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		expiry:      365 * 24 * time.Hour,
+	},
+	// S/MIME certificates follow the CA/Browser Forum S/MIME baseline
+	// requirements: encryption uses key transport with RSA and key
+	// agreement with ECDSA keys.
+	"smime": {
+		keyUsage:      x509.KeyUsageDigitalSignature,
+		rsaKeyUsage:   x509.KeyUsageKeyEncipherment,
+		ecdsaKeyUsage: x509.KeyUsageKeyAgreement,
+		extKeyUsage:   []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		expiry:        365 * 24 * time.Hour,
+		requireEmail:  true,
+	},
+}
+
+// oidEmailAddress is the PKCS#9 emailAddress attribute of subjects.
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// issueOptions are the flags shared by the issue and sign modes.
+type issueOptions struct {
+	configFile   string
+	profile      string
+	hostnames    string
+	templateFile string
+	out          string
+	caa          caaOptions
+}
+
+func (o *issueOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.configFile, "config", "", "cfssl config.json with the signing profiles")
+	fs.StringVar(&o.profile, "profile", "", "Signing profile of the -config file to use (default: its default profile), without -config one of "+strings.Join(builtinProfileNames(), ", "))
+	fs.StringVar(&o.hostnames, "hostname", "", "Comma separated SANs, replacing the names of the request")
+	fs.StringVar(&o.templateFile, "template", "", "JSON certificate template, instead of a signing profile")
+	fs.StringVar(&o.out, "out", "cert", "Base name of the output files, <out>.pem for the certificate")
+	o.caa.register(fs)
+}
+
+// valid reports whether a template and a profile are not both given.
+func (o *issueOptions) valid() bool {
+	return o.templateFile == "" || (o.configFile == "" && o.profile == "")
+}
+
+// certProfile returns the selected profile.
+func (o *issueOptions) certProfile() (certProfile, error) {
+	if o.configFile != "" {
+		return loadCFSSLProfile(o.configFile, o.profile)
+	}
+	if o.profile == "" {
+		return defaultCertProfile, nil
+	}
+	profile, ok := builtinProfiles[o.profile]
+	if !ok {
+		return certProfile{}, fmt.Errorf("unknown profile %q, use -config or one of: %s", o.profile, strings.Join(builtinProfileNames(), ", "))
+	}
+	return profile, nil
+}
+
+func builtinProfileNames() []string {
+	var names []string
+	for name := range builtinProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyHostnames replaces the SANs of csr if -hostname is given.
+func (o *issueOptions) applyHostnames(csr *x509.CertificateRequest) {
+	if o.hostnames == "" {
+		return
+	}
+	csr.DNSNames, csr.EmailAddresses, csr.IPAddresses, csr.URIs = nil, nil, nil, nil
+	setHosts(csr, strings.Split(o.hostnames, ","))
+}
+
+// newTemplate returns the template of the certificate for csr, from the
+// JSON template if given or from the selected profile, with the command
+// line flags applied. The JSON template is completed from csr.
+func (o *issueOptions) newTemplate(csr *x509.CertificateRequest, template *x509.Certificate, leaf *leafOptions) (*x509.Certificate, error) {
+	o.applyHostnames(csr)
+	if template != nil {
+		completeTemplate(template, csr)
+		leaf.apply(template)
+		return template, nil
+	}
+	profile, err := o.certProfile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing profile: %w", err)
+	}
+	leaf.applyProfile(&profile)
+	leaf.addNames(csr)
+	template, err = profileTemplate(csr, profile)
+	if err != nil {
+		return nil, err
+	}
+	leaf.addMustStaple(template)
+	return template, nil
+}
+
+// Issues a certificate and key for a cfssl style csr.json from the
+// regenerated CA, like `cfssl gencert`.
+func runIssue(args []string) {
+	fs := flag.NewFlagSet("issue", flag.ContinueOnError)
+	// The flags of the regenerated CA and of the server certificate have
+	// no effect on issued certificates
+	var caOpts caOptions
+	caOpts.registerInput(fs)
+	caOpts.leaf.register(fs)
+	var issueOpts issueOptions
+	issueOpts.register(fs)
+	csrJSON := fs.String("csr-json", "", "cfssl style csr.json describing the certificate (- for stdin)")
+	var encryptTo keyRecipients
+	encryptTo.register(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() || (*csrJSON == "" && issueOpts.templateFile == "") || !issueOpts.valid() {
+		usageError("go run *.go issue (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) (-csr-json <csr.json> [-config config.json] [-profile name] | [-csr-json <csr.json>] -template <cert.json>) [-hostname names] [-out cert] [-encrypt-to recipient] [-check-caa [-caa-issuer domain] [-caa-resolver host:port]]")
+	}
+	flagKey, err := caOpts.leaf.keySpec()
+	if err != nil {
+		exitWith(exitUsage, "Invalid leaf key", "error", err)
+	}
+	csr := &x509.CertificateRequest{}
+	var template *x509.Certificate
+	var requested keySpec
+	if issueOpts.templateFile != "" {
+		template, requested, err = loadCertTemplate(issueOpts.templateFile)
+		if err != nil {
+			fatal("Failed to load certificate template", "error", err)
+		}
+	}
+	if *csrJSON != "" {
+		var csrKey keySpec
+		csr, csrKey, err = loadCFSSLCSR(*csrJSON)
+		if err != nil {
+			fatal("Failed to load certificate request", "error", err)
+		}
+		requested = csrKey.or(requested)
+	}
+	// The key stanza and the flags would silently override each other
+	if flagKey.algo != "" && requested.algo != "" {
+		exitWith(exitUsage, "-leaf-key-type, -leaf-key-bits and -curve cannot be combined with the key stanza of -csr-json or -template")
+	}
+	// cfssl defaults to ECDSA P-256 keys
+	key, err := flagKey.or(requested).or(keyTypes["p256"]).generate()
+	if err != nil {
+		fatal("Failed to generate key", "error", err)
+	}
+	csr.PublicKey = key.Public()
+	template, err = issueOpts.newTemplate(csr, template, &caOpts.leaf)
+	if err != nil {
+		fatal("Invalid certificate", "error", err)
+	}
+	issueOpts.caa.checkNames(template.DNSNames)
+
+	setup := loadCAs(caOpts)
+	cert, err := signCertificate(setup.newCA, setup.caKey, template, csr.PublicKey, caOpts.leaf.ctLogs)
+	if err != nil {
+		exitWith(exitFailure, "Failed to issue certificate", "error", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		exitWith(exitFailure, "Failed to encode key", "error", err)
+	}
+	writeIssued(issueOpts.out, cert)
+	keyFile, err := encryptTo.writeKey(issueOpts.out+"-key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		exitWith(exitFailure, "Failed to write key", "file", keyFile, "error", err)
+	}
+	slog.Info("Wrote key", "file", keyFile, "key", x509util.DescribePublicKey(key.Public()))
+}
+
+// Signs a PKCS#10 request with the regenerated CA, like `cfssl sign`.
+func runSign(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	// The key is the one of the request
+	var caOpts caOptions
+	caOpts.registerInput(fs)
+	caOpts.leaf.registerCertificate(fs)
+	var issueOpts issueOptions
+	issueOpts.register(fs)
+	csrFile := fs.String("csr", "", "PEM or DER encoded certificate request to sign (- for stdin)")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() || *csrFile == "" || !issueOpts.valid() {
+		usageError("go run *.go sign (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) -csr <request.csr> [-config config.json] [-profile name | -template cert.json] [-hostname names] [-out cert] [-check-caa [-caa-issuer domain] [-caa-resolver host:port]]")
+	}
+	var template *x509.Certificate
+	var err error
+	if issueOpts.templateFile != "" {
+		template, _, err = loadCertTemplate(issueOpts.templateFile)
+		if err != nil {
+			fatal("Failed to load certificate template", "error", err)
+		}
+	}
+	data, err := readInput(*csrFile)
+	if err != nil {
+		fatal("Failed to read certificate request", "error", err)
+	}
+	if block := findPEMBlock(data, "CERTIFICATE REQUEST"); block != nil {
+		data = block.Bytes
+	}
+	csr, err := x509.ParseCertificateRequest(data)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		fatal("Invalid certificate request", "error", err)
+	}
+	template, err = issueOpts.newTemplate(csr, template, &caOpts.leaf)
+	if err != nil {
+		fatal("Invalid certificate", "error", err)
+	}
+	issueOpts.caa.checkNames(template.DNSNames)
+
+	setup := loadCAs(caOpts)
+	cert, err := signCertificate(setup.newCA, setup.caKey, template, csr.PublicKey, caOpts.leaf.ctLogs)
+	if err != nil {
+		exitWith(exitFailure, "Failed to issue certificate", "error", err)
+	}
+	writeIssued(issueOpts.out, cert)
+}
+
+// writeIssued writes an issued certificate to <out>.pem.
+func writeIssued(out string, cert *x509.Certificate) {
+	certFile := out + ".pem"
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		exitWith(exitFailure, "Failed to write certificate", "file", certFile, "error", err)
+	}
+	slog.Info("Issued certificate", "file", certFile, "subject", cert.Subject.String(), "serial", x509util.FormatHex(cert.SerialNumber.Bytes()), "not_after", cert.NotAfter.Format(time.RFC3339))
+}
+
+// issueFromCSR signs a certificate with the subject, SANs and public key of
+// csr and the usages and validity of profile.
+func issueFromCSR(ca *x509.Certificate, caKey crypto.Signer, csr *x509.CertificateRequest, profile certProfile) (*x509.Certificate, error) {
+	template, err := profileTemplate(csr, profile)
+	if err != nil {
+		return nil, err
+	}
+	return signCertificate(ca, caKey, template, csr.PublicKey, nil)
+}
+
+// profileTemplate returns the template of a certificate with the subject
+// and SANs of csr and the usages and validity of profile.
+func profileTemplate(csr *x509.CertificateRequest, profile certProfile) (*x509.Certificate, error) {
+	emailAddresses := csr.EmailAddresses
+	if profile.requireEmail && len(emailAddresses) == 0 {
+		// Mail clients only look at the SAN, the address is often just
+		// given as common name or emailAddress attribute
+		email := csr.Subject.CommonName
+		for _, name := range csr.Subject.Names {
+			if name.Type.Equal(oidEmailAddress) {
+				email, _ = name.Value.(string)
+			}
+		}
+		if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+			return nil, fmt.Errorf("profile requires an email address SAN")
+		}
+		emailAddresses = []string{email}
+	}
+	keyUsage := profile.keyUsage
+	switch csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		keyUsage |= profile.rsaKeyUsage
+	case *ecdsa.PublicKey:
+		keyUsage |= profile.ecdsaKeyUsage
+	}
+
+	return &x509.Certificate{
+		Subject:            csr.Subject,
+		DNSNames:           csr.DNSNames,
+		EmailAddresses:     emailAddresses,
+		IPAddresses:        csr.IPAddresses,
+		URIs:               csr.URIs,
+		NotBefore:          now.Now().Add(-time.Minute),
+		NotAfter:           now.Now().Add(profile.expiry),
+		KeyUsage:           keyUsage,
+		ExtKeyUsage:        profile.extKeyUsage,
+		UnknownExtKeyUsage: profile.unknownExtKeyUsage,
+	}, nil
+}
+
+// signCertificate signs template for pub with the CA. A random serial
+// number is used unless the template has one.
+func signCertificate(ca *x509.Certificate, caKey crypto.Signer, template *x509.Certificate, pub crypto.PublicKey, logs ctLogList) (*x509.Certificate, error) {
+	for _, name := range template.DNSNames {
+		if err := checkWildcard(name); err != nil {
+			return nil, err
+		}
+	}
+	opts := caregenOptions()
+	if len(logs) > 0 {
+		opts = append(opts, caregen.WithCT(logs.submitPrecertificate))
+	}
+	cert, err := caregen.Sign(context.Background(), ca, caKey, template, pub, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return recordCertificate("issue", cert.Raw)
+}
+
+// setHosts adds hosts to the SANs of csr the way cfssl does: IP addresses,
+// email addresses and URIs are recognized, everything else is a DNS name.
+func setHosts(csr *x509.CertificateRequest, hosts []string) {
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			csr.IPAddresses = append(csr.IPAddresses, ip)
+		} else if email, err := mail.ParseAddress(host); err == nil && email.Address == host {
+			csr.EmailAddresses = append(csr.EmailAddresses, host)
+		} else if uri, err := url.Parse(host); err == nil && uri.Scheme != "" && (uri.Host != "" || uri.Opaque != "") {
+			csr.URIs = append(csr.URIs, uri)
+		} else {
+			csr.DNSNames = append(csr.DNSNames, host)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// writeTestCA writes a CA to ca-cert.pem and ca-key.pem in the working
+// directory.
+func writeTestCA(t *testing.T) {
+	t.Helper()
+	ca, key := newTestCA(t, "p256", nil)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("ca-cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("ca-key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIssueRecordsOnlyRequestedCertificate checks that issuing a
+// certificate records that certificate alone, and no regenerated CA or
+// server certificate, in the audit log and the database.
+func TestIssueRecordsOnlyRequestedCertificate(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("the database needs the sqlite3 tool")
+	}
+	t.Chdir(t.TempDir())
+	t.Cleanup(func() {
+		auditLog.file, auditLog.loaded = "", false
+		certDB.file, certDB.created = "", false
+	})
+	writeTestCA(t)
+	csr := `{"CN":"www.example.com","hosts":["www.example.com"],"key":{"algo":"ecdsa","size":256}}`
+	if err := os.WriteFile("csr.json", []byte(csr), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runIssue([]string{"-ca-cert", "ca-cert.pem", "-ca-key", "ca-key.pem", "-csr-json", "csr.json", "-out", "web", "-audit-log", "audit.log", "-db", "issued.db", "-q"})
+
+	data, err := os.ReadFile("audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("audit log has %d entries, want 1:\n%s", len(lines), data)
+	}
+	var entry auditEntry
+	if err := json.Unmarshal(lines[0], &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Event != "issue" || entry.Subject != "CN=www.example.com" {
+		t.Errorf("audit log entry is %s of %s, want issue of CN=www.example.com", entry.Event, entry.Subject)
+	}
+
+	out, err := runSQLite("issued.db", "SELECT event || ' ' || subject FROM certificates;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := strings.TrimSpace(string(out)); rows != "issue CN=www.example.com" {
+		t.Errorf("database has the certificates\n%s\nwant only issue CN=www.example.com", rows)
+	}
+
+	if _, err := os.Stat("new-ca.pem"); err == nil {
+		t.Error("issue wrote new-ca.pem")
+	}
+}
+
+// TestIssueLeafKeyType checks that -leaf-key-type selects the key of a
+// request without key stanza.
+func TestIssueLeafKeyType(t *testing.T) {
+	t.Chdir(t.TempDir())
+	writeTestCA(t)
+	if err := os.WriteFile("csr.json", []byte(`{"CN":"www.example.com","hosts":["www.example.com"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runIssue([]string{"-ca-cert", "ca-cert.pem", "-ca-key", "ca-key.pem", "-csr-json", "csr.json", "-out", "web", "-leaf-key-type", "ed25519", "-q"})
+
+	data, err := os.ReadFile("web.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("web.pem has no certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.PublicKeyAlgorithm != x509.Ed25519 {
+		t.Errorf("the certificate has a %s key, want Ed25519", cert.PublicKeyAlgorithm)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// kubeadmCAs are the CA certificates of a kubeadm style pki directory,
+// relative to the directory. Each has its key next to it as *.key.
+var kubeadmCAs = []string{"ca.crt", "front-proxy-ca.crt", "etcd/ca.crt"}
+
+// regeneratedCA is a CA of the pki directory together with its
+// regenerated version.
+type regeneratedCA struct {
+	file     string
+	original *x509.Certificate
+	new      *x509.Certificate
+	key      crypto.Signer
+}
+
+func runK8sResign(args []string) {
+	flags := flag.NewFlagSet("k8s-resign", flag.ContinueOnError)
+	pkiDir := flags.String("pki-dir", "/etc/kubernetes/pki", "Kubernetes pki directory (kubeadm layout)")
+	outDir := flags.String("out-dir", "", "Write regenerated certificates to this directory instead of updating pki-dir in place")
+	backup := flags.Bool("backup", true, "Keep a copy of each certificate updated in place as <file>.bak")
+	dryRun := flags.Bool("dry-run", false, "Only show what would be changed")
+	registerAudit(flags)
+	registerCertDB(flags)
+	registerSerials(flags)
+	var logOpts logOptions
+	logOpts.register(flags)
+	parseFlags(flags, args)
+	logOpts.setup()
+
+	// Regenerate all CAs of the directory
+	var cas []*regeneratedCA
+	for _, name := range kubeadmCAs {
+		certFile := filepath.Join(*pkiDir, name)
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			slog.Debug("CA not present", "file", certFile)
+			continue
+		}
+		original, key, _, err := loadCA(certFile, keyFile)
+		if err != nil {
+			exitWith(exitInvalidCA, "Failed to load CA", "file", certFile, "error", err)
+		}
+		if ext := x509util.FindExtension(original, oidExtensionBasicConstraints); ext != nil && ext.Critical {
+			slog.Info("CA already has critical basic constraints, skipping", "file", certFile)
+			continue
+		}
+		newCA, err := (&caOptions{}).regenerate(original, key)
+		if err != nil {
+			exitWith(exitRegenerationFailed, "Failed to generate new CA", "file", certFile, "error", err)
+		}
+		cas = append(cas, &regeneratedCA{file: name, original: original, new: newCA, key: key})
+	}
+	if len(cas) == 0 {
+		slog.Info("No CA needs to be regenerated", "pki_dir", *pkiDir)
+		return
+	}
+
+	// Collect all certificates issued by one of the regenerated CAs
+	outputs := map[string][]byte{}
+	for _, ca := range cas {
+		outputs[ca.file] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.new.Raw})
+	}
+	err := filepath.WalkDir(*pkiDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".crt") {
+			return err
+		}
+		rel, err := filepath.Rel(*pkiDir, path)
+		if err != nil {
+			return err
+		}
+		if _, isCA := outputs[rel]; isCA {
+			return nil
+		}
+		certs, err := loadCertificates(path)
+		if err != nil {
+			slog.Warn("Skipping unreadable certificate", "file", path, "error", err)
+			return nil
+		}
+		leaf := certs[0]
+		for _, ca := range cas {
+			if leaf.CheckSignatureFrom(ca.original) != nil {
+				continue
+			}
+			der, err := resignCertificate(leaf, ca.new, ca.key)
+			if err != nil {
+				return fmt.Errorf("failed to re-sign %s: %w", path, err)
+			}
+			outputs[rel] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+			slog.Info("Re-signed certificate", "file", rel, "ca", ca.file, "subject", leaf.Subject.String())
+			return nil
+		}
+		slog.Debug("Certificate not issued by a regenerated CA", "file", rel)
+		return nil
+	})
+	if err != nil {
+		exitWith(exitRegenerationFailed, "Failed to re-sign certificates", "error", err)
+	}
+
+	files := make([]string, 0, len(outputs))
+	for file := range outputs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	if *dryRun {
+		for _, file := range files {
+			slog.Info("Dry run: would write", "file", filepath.Join(targetDir(*pkiDir, *outDir), file))
+		}
+		return
+	}
+
+	for _, file := range files {
+		target := filepath.Join(targetDir(*pkiDir, *outDir), file)
+		if *outDir == "" && *backup {
+			data, err := os.ReadFile(target)
+			if err == nil {
+				err = os.WriteFile(target+".bak", data, 0644)
+			}
+			if err != nil {
+				exitWith(exitFailure, "Failed to write backup", "file", target, "error", err)
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			exitWith(exitFailure, "Failed to create output directory", "error", err)
+		}
+		if err := os.WriteFile(target, outputs[file], 0644); err != nil {
+			exitWith(exitFailure, "Failed to write certificate", "file", target, "error", err)
+		}
+		slog.Info("Wrote certificate", "file", target)
+	}
+}
+
+func targetDir(pkiDir, outDir string) string {
+	if outDir != "" {
+		return outDir
+	}
+	return pkiDir
+}
+
+// resignCertificate issues a copy of cert from newCA. Subject, SANs, key
+// usages, validity, serial number and public key are preserved.
+func resignCertificate(cert, newCA *x509.Certificate, caKey crypto.Signer) ([]byte, error) {
+	template := *cert
+	template.SignatureAlgorithm = x509util.SignatureAlgorithmFor(caKey, cert.SignatureAlgorithm)
+	der, err := x509.CreateCertificate(rand.Reader, &template, newCA, cert.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := recordCertificate("resign", der); err != nil {
+		return nil, err
+	}
+	return der, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// systemKeychain needs admin rights and trust settings in the admin
+// domain.
+const systemKeychain = "/Library/Keychains/System.keychain"
+
+// Reads a CA identity (certificate and private key) from a macOS keychain
+// and writes the regenerated CA back next to it, optionally trusted as
+// root. Like the other backends it shells out, to security(1) and for the
+// PKCS#12 export, which Go cannot parse, to openssl(1).
+func runKeychain(args []string) {
+	fs := flag.NewFlagSet("keychain", flag.ContinueOnError)
+	identity := fs.String("identity", "", "Common name (or a part of it) of the CA certificate in the keychain")
+	keychain := fs.String("keychain", "", "Path of the keychain, e.g. "+systemKeychain+" (default the keychain search list)")
+	importCA := fs.Bool("import", false, "Import the regenerated CA into the keychain")
+	trust := fs.Bool("trust", false, "Trust the imported CA as root, in the admin domain for the System keychain")
+	replace := fs.Bool("replace", false, "Delete the original CA certificate from the keychain after importing the regenerated CA, keeping the key")
+	dryRun := fs.Bool("dry-run", false, "Only show what would be changed")
+	var caOpts caOptions
+	registerAudit(fs)
+	registerWebhook(fs)
+	registerCertDB(fs)
+	registerSerials(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if *identity == "" || ((*trust || *replace) && !*importCA) {
+		usageError("go run *.go keychain -identity <name> [-keychain <path>] [-import [-trust] [-replace]] [-dry-run]")
+	}
+	if runtime.GOOS != "darwin" {
+		exitWith(exitFailure, "Keychains are only available on macOS", "os", runtime.GOOS)
+	}
+
+	originalCA, caKey, err := readKeychainIdentity(*identity, *keychain)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to read CA from keychain", "identity", *identity, "error", err)
+	}
+	slog.Info("Loaded original CA certificate and key from keychain", "subject", originalCA.Subject.String())
+
+	if err := checkOriginalCABasicConstraints(originalCA); err != nil {
+		exitWith(exitInvalidCA, "Original CA validation failed", "error", err)
+	}
+	newCA, err := caOpts.regenerate(originalCA, caKey)
+	if err != nil {
+		exitWith(exitRegenerationFailed, "Failed to generate new CA", "error", err)
+	}
+	slog.Info("Generated new CA with critical basic constraints")
+
+	if err := saveCAToFile(newCA, "new-ca.pem"); err != nil {
+		exitWith(exitFailure, "Failed to save new CA to file", "error", err)
+	}
+	slog.Info("Saved new CA for inspection", "file", "new-ca.pem")
+
+	if !*importCA {
+		return
+	}
+	if *dryRun {
+		slog.Info("Dry run: would import regenerated CA", "keychain", *keychain, "trust", *trust, "delete_original", *replace)
+		return
+	}
+
+	importArgs := []string{"import", "new-ca.pem", "-t", "cert"}
+	if *keychain != "" {
+		importArgs = append(importArgs, "-k", *keychain)
+	}
+	if _, err := runSecurity(importArgs...); err != nil {
+		exitWith(exitFailure, "Failed to import regenerated CA into keychain", "error", err)
+	}
+	slog.Info("Imported regenerated CA into keychain", "keychain", *keychain)
+
+	if *trust {
+		trustArgs := []string{"add-trusted-cert", "-r", "trustRoot"}
+		if *keychain == systemKeychain {
+			trustArgs = append(trustArgs, "-d")
+		}
+		if *keychain != "" {
+			trustArgs = append(trustArgs, "-k", *keychain)
+		}
+		if _, err := runSecurity(append(trustArgs, "new-ca.pem")...); err != nil {
+			exitWith(exitFailure, "Failed to trust regenerated CA", "error", err)
+		}
+		slog.Info("Trusted regenerated CA as root")
+	}
+
+	if *replace {
+		// delete-certificate leaves the key alone, which then forms an
+		// identity with the regenerated CA
+		deleteArgs := []string{"delete-certificate", "-Z", sha1Thumbprint(originalCA)}
+		if *keychain != "" {
+			deleteArgs = append(deleteArgs, *keychain)
+		}
+		if _, err := runSecurity(deleteArgs...); err != nil {
+			exitWith(exitFailure, "Failed to delete original CA from keychain", "error", err)
+		}
+		slog.Info("Deleted original CA certificate from keychain", "sha1", sha1Thumbprint(originalCA))
+	}
+}
+
+// readKeychainIdentity returns the CA certificate matching name and its
+// private key. security(1) only exports all identities of a keychain at
+// once, as PKCS#12 protected by a random password, so the key is picked
+// by its public key.
+func readKeychainIdentity(name, keychain string) (*x509.Certificate, crypto.Signer, error) {
+	findArgs := []string{"find-certificate", "-a", "-p", "-c", name}
+	if keychain != "" {
+		findArgs = append(findArgs, keychain)
+	}
+	certPEM, err := runSecurity(findArgs...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no certificate named %q found: %w", name, err)
+	}
+
+	dir, err := os.MkdirTemp("", "ca-regen-keychain")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return nil, nil, err
+	}
+	p12File := filepath.Join(dir, "identities.p12")
+	exportArgs := []string{"export", "-t", "identities", "-f", "pkcs12", "-P", hex.EncodeToString(password), "-o", p12File}
+	if keychain != "" {
+		exportArgs = append(exportArgs, "-k", keychain)
+	}
+	if _, err := runSecurity(exportArgs...); err != nil {
+		return nil, nil, fmt.Errorf("failed to export identities: %w", err)
+	}
+	keysPEM, err := pkcs12ToPEM(p12File, hex.EncodeToString(password))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for rest := keysPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			continue
+		}
+		key, err := parsePrivateKey(pem.EncodeToMemory(block))
+		if err != nil {
+			slog.Debug("Skipping unsupported key in keychain", "error", err)
+			continue
+		}
+		if cert, _, err := selectCA(certPEM, key.Public()); err == nil {
+			return cert, key, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("the keychain has no private key for the certificate(s) named %q", name)
+}
+
+// pkcs12ToPEM returns the certificates and unencrypted private keys of a
+// PKCS#12 file as PEM. OpenSSL 3 needs -legacy for the RC2/3DES encryption
+// used by security(1) and certutil, LibreSSL shipped with macOS does not
+// know the flag.
+func pkcs12ToPEM(file, password string) ([]byte, error) {
+	var lastErr error
+	for _, extra := range [][]string{nil, {"-legacy"}} {
+		args := append([]string{"pkcs12", "-in", file, "-nodes", "-passin", "env:CA_REGEN_P12_PASSWORD"}, extra...)
+		cmd := exec.Command("openssl", args...)
+		cmd.Env = append(os.Environ(), "CA_REGEN_P12_PASSWORD="+password)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err == nil {
+			return out, nil
+		}
+		lastErr = fmt.Errorf("openssl pkcs12 failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil, lastErr
+}
+
+// runSecurity runs security(1) and returns its output. Keychain access may
+// be confirmed by the user in a dialog.
+func runSecurity(args ...string) ([]byte, error) {
+	slog.Debug("Running security", "args", strings.Join(args, " "))
+	cmd := exec.Command("security", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("security %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// keyRecipients is the repeatable -encrypt-to flag: age recipients (age1...
+// or SSH public keys) or OpenPGP key fingerprints, to which generated
+// private keys are written encrypted instead of as plain PEM. With
+// -tpm-seal the keys are protected by the TPM instead.
+type keyRecipients struct {
+	age     []string
+	pgp     []string
+	tpmSeal bool
+}
+
+// register registers -encrypt-to and -tpm-seal.
+func (r *keyRecipients) register(fs *flag.FlagSet) {
+	fs.Var(r, "encrypt-to", encryptToUsage)
+	fs.BoolFunc("tpm-seal", "Write generated private keys encrypted with a passphrase sealed into the TPM ($TPM2TOOLS_TCTI), which only this machine can decrypt", func(value string) error {
+		seal, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		if seal && (len(r.age) > 0 || len(r.pgp) > 0) {
+			return fmt.Errorf("-tpm-seal cannot be combined with -encrypt-to")
+		}
+		r.tpmSeal = seal
+		return nil
+	})
+}
+
+func (r *keyRecipients) String() string {
+	return strings.Join(append(append([]string{}, r.age...), r.pgp...), ",")
+}
+
+func (r *keyRecipients) Set(value string) error {
+	if strings.HasPrefix(value, "age1") || strings.HasPrefix(value, "ssh-") {
+		r.age = append(r.age, value)
+	} else if fingerprint, ok := pgpFingerprint(value); ok {
+		r.pgp = append(r.pgp, fingerprint)
+	} else {
+		return fmt.Errorf("invalid recipient %q, use an age recipient (age1...), an SSH public key or an OpenPGP key fingerprint", value)
+	}
+	if len(r.age) > 0 && len(r.pgp) > 0 {
+		return fmt.Errorf("age and OpenPGP recipients cannot be combined")
+	}
+	if r.tpmSeal {
+		return fmt.Errorf("-encrypt-to cannot be combined with -tpm-seal")
+	}
+	return nil
+}
+
+const encryptToUsage = "Write generated private keys encrypted to the age recipient (age1... or an SSH public key) with age or to the OpenPGP key fingerprint with gpg, can be repeated"
+
+// pgpFingerprint returns value as upper case v4 (40 hex digits) or v5/v6
+// (64 hex digits) fingerprint, ignoring spaces and a 0x prefix.
+func pgpFingerprint(value string) (string, bool) {
+	fingerprint := strings.TrimPrefix(strings.ReplaceAll(value, " ", ""), "0x")
+	if _, err := hex.DecodeString(fingerprint); err != nil || (len(fingerprint) != 40 && len(fingerprint) != 64) {
+		return "", false
+	}
+	return strings.ToUpper(fingerprint), true
+}
+
+// each returns the recipients one by one, in the order given.
+func (r *keyRecipients) each() []*keyRecipients {
+	var each []*keyRecipients
+	for _, recipient := range r.age {
+		each = append(each, &keyRecipients{age: []string{recipient}})
+	}
+	for _, fingerprint := range r.pgp {
+		each = append(each, &keyRecipients{pgp: []string{fingerprint}})
+	}
+	return each
+}
+
+// writeKey writes keyPEM to file, or encrypted to the recipients to file
+// with the suffix .age or .asc, or sealed by the TPM, see tpmSeal. It
+// returns the name of the written file.
+func (r *keyRecipients) writeKey(file string, keyPEM []byte) (string, error) {
+	if r.tpmSeal {
+		return tpmSeal(file, keyPEM)
+	}
+	data := keyPEM
+	var err error
+	switch {
+	case len(r.age) > 0:
+		file += ".age"
+		data, err = ageEncrypt(r.age, keyPEM)
+	case len(r.pgp) > 0:
+		file += ".asc"
+		data, err = gpgEncrypt(r.pgp, keyPEM)
+	}
+	if err != nil {
+		return file, err
+	}
+	return file, os.WriteFile(file, data, 0600)
+}
+
+// gpgEncrypt encrypts data to the OpenPGP keys with the fingerprints with
+// gpg, ASCII armored. The keys must be in the keyring, they are trusted as
+// they are selected by their full fingerprint.
+func gpgEncrypt(fingerprints []string, data []byte) ([]byte, error) {
+	args := []string{"--batch", "--armor", "--trust-model", "always", "--encrypt"}
+	for _, fingerprint := range fingerprints {
+		args = append(args, "--recipient", fingerprint)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("gpg", args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("gpg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
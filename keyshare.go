@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// keyShare is one share of a CA private key split with Shamir's secret
+// sharing. The key is encrypted with a random AES-256-GCM data key, which
+// is split, so every share carries the encrypted key and any threshold
+// shares recover it. Shares of different splits do not mix, as the
+// interpolated data key would not decrypt the key.
+type keyShare struct {
+	Index     int
+	Threshold int
+	Shares    int
+	// KeyFingerprint is the SHA-256 of the public key, it is authenticated
+	// along with the encrypted key.
+	KeyFingerprint []byte
+	Share          []byte
+	Nonce          []byte
+	EncryptedKey   []byte
+}
+
+const keySharePEMType = "CA-REGEN KEY SHARE"
+
+// Splits a CA private key into shares or combines shares into the key, so
+// no single operator holds the full key after the regeneration.
+func runKey(args []string) {
+	const usage = "go run *.go key split [-n 5] [-t 3] [-out-dir .] (-encrypt-to recipient... | -insecure-plaintext) <ca-key.pem|-> | key combine [-out ca-key.pem] <share.pem>..."
+	if len(args) == 0 {
+		usageError(usage)
+	}
+	switch args[0] {
+	case "split":
+		runKeySplit(args[1:], usage)
+	case "combine":
+		runKeyCombine(args[1:], usage)
+	default:
+		usageError(usage)
+	}
+}
+
+func runKeySplit(args []string, usage string) {
+	fs := flag.NewFlagSet("key split", flag.ContinueOnError)
+	n := fs.Int("n", 5, "Number of shares to create")
+	threshold := fs.Int("t", 3, "Number of shares needed to recover the key")
+	outDir := fs.String("out-dir", ".", "Directory to write the shares to")
+	var encryptTo keyRecipients
+	fs.Var(&encryptTo, "encrypt-to", "Write share i encrypted to the i-th age recipient (age1... or an SSH public key) with age or OpenPGP key fingerprint with gpg, give one per share")
+	insecurePlaintext := fs.Bool("insecure-plaintext", false, "Write the shares unencrypted, readable by anyone with access to -out-dir")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if fs.NArg() != 1 || *threshold < 2 || *threshold > *n || *n > 255 {
+		usageError(usage + " (2 <= t <= n <= 255)")
+	}
+	recipients := encryptTo.each()
+	switch {
+	case len(recipients) == 0 && !*insecurePlaintext:
+		// Shares written side by side in one directory are no better than
+		// the key itself
+		usageError("-encrypt-to is required to encrypt every share to its operator, or -insecure-plaintext to write them unencrypted")
+	case len(recipients) > 0 && *insecurePlaintext:
+		usageError("-insecure-plaintext cannot be combined with -encrypt-to")
+	case len(recipients) > 0 && len(recipients) != *n:
+		usageError(fmt.Sprintf("-encrypt-to needs one recipient per share, got %d for %d shares", len(recipients), *n))
+	}
+	file := fs.Arg(0)
+	keyPEM, err := readInput(file)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to read CA private key", "file", file, "error", err)
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA private key", "file", file, "error", err)
+	}
+	// The key is shared in its original encoding, e.g. PKCS#1 or a key
+	// restricted to RSA-PSS
+	block := findPEMBlock(keyPEM, "PRIVATE KEY")
+	block.Headers = nil
+	fingerprint, err := keyFingerprint(key.Public())
+	if err != nil {
+		fatal("Failed to fingerprint CA key", "error", err)
+	}
+
+	shares, err := splitKey(pem.EncodeToMemory(block), fingerprint, *n, *threshold)
+	if err != nil {
+		fatal("Failed to split CA private key", "error", err)
+	}
+	base := "ca-key"
+	if file != "-" {
+		base = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	for i, share := range shares {
+		der, err := asn1.Marshal(share)
+		if err != nil {
+			fatal("Failed to encode key share", "error", err)
+		}
+		shareFile := filepath.Join(*outDir, fmt.Sprintf("%s.share-%d-of-%d.pem", base, share.Index, share.Shares))
+		data := pem.EncodeToMemory(&pem.Block{
+			Type: keySharePEMType,
+			Headers: map[string]string{
+				"Share":           fmt.Sprintf("%d of %d", share.Index, share.Shares),
+				"Threshold":       strconv.Itoa(share.Threshold),
+				"Key-Fingerprint": hex.EncodeToString(fingerprint),
+			},
+			Bytes: der,
+		})
+		shareRecipients := &keyRecipients{}
+		if len(recipients) > 0 {
+			shareRecipients = recipients[i]
+		}
+		shareFile, err = shareRecipients.writeKey(shareFile, data)
+		if err != nil {
+			fatal("Failed to write key share", "file", shareFile, "error", err)
+		}
+		slog.Info("Wrote key share", "file", shareFile, "share", share.Index)
+	}
+	slog.Info("Split CA private key", "shares", *n, "threshold", *threshold, "sha256", hex.EncodeToString(fingerprint))
+	slog.Warn("Hand the shares to different operators and delete the original key file", "file", file)
+}
+
+func runKeyCombine(args []string, usage string) {
+	fs := flag.NewFlagSet("key combine", flag.ContinueOnError)
+	out := fs.String("out", "ca-key.pem", "File to write the recovered CA private key to, it must not exist")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if fs.NArg() < 2 {
+		usageError(usage)
+	}
+	var shares []keyShare
+	for _, file := range fs.Args() {
+		share, err := readKeyShare(file)
+		if err != nil {
+			fatal("Failed to load key share", "file", file, "error", err)
+		}
+		shares = append(shares, share)
+	}
+	keyPEM, err := combineKey(shares)
+	if err != nil {
+		fatal("Failed to combine key shares", "error", err)
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fatal("Failed to create key file", "error", err)
+	}
+	if _, err := f.Write(keyPEM); err != nil {
+		f.Close()
+		fatal("Failed to write key file", "error", err)
+	}
+	if err := f.Close(); err != nil {
+		fatal("Failed to write key file", "error", err)
+	}
+	slog.Info("Recovered CA private key", "file", *out, "shares", len(shares), "sha256", hex.EncodeToString(shares[0].KeyFingerprint))
+}
+
+// keyFingerprint returns the SHA-256 of the DER encoded public key.
+func keyFingerprint(pub any) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	return sum[:], nil
+}
+
+// splitKey encrypts keyPEM and splits the data key into n shares, any
+// threshold of which recover it.
+func splitKey(keyPEM, fingerprint []byte, n, threshold int) ([]keyShare, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newKeyShareAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	encrypted := aead.Seal(nil, nonce, keyPEM, fingerprint)
+
+	parts, err := shamirSplit(dataKey, n, threshold)
+	if err != nil {
+		return nil, err
+	}
+	shares := make([]keyShare, n)
+	for i, part := range parts {
+		shares[i] = keyShare{
+			Index:          i + 1,
+			Threshold:      threshold,
+			Shares:         n,
+			KeyFingerprint: fingerprint,
+			Share:          part,
+			Nonce:          nonce,
+			EncryptedKey:   encrypted,
+		}
+	}
+	return shares, nil
+}
+
+// combineKey recovers the PEM encoded key from at least threshold shares
+// of the same split and checks it against the fingerprint.
+func combineKey(shares []keyShare) ([]byte, error) {
+	first := shares[0]
+	seen := map[int]bool{}
+	for _, share := range shares {
+		if share.Threshold != first.Threshold || !bytes.Equal(share.KeyFingerprint, first.KeyFingerprint) ||
+			!bytes.Equal(share.Nonce, first.Nonce) || !bytes.Equal(share.EncryptedKey, first.EncryptedKey) {
+			return nil, fmt.Errorf("share %d belongs to another split", share.Index)
+		}
+		if seen[share.Index] {
+			return nil, fmt.Errorf("share %d was given twice", share.Index)
+		}
+		seen[share.Index] = true
+	}
+	if len(shares) < first.Threshold {
+		return nil, fmt.Errorf("%d shares are needed, got %d", first.Threshold, len(shares))
+	}
+
+	xs := make([]byte, first.Threshold)
+	ys := make([][]byte, first.Threshold)
+	for i, share := range shares[:first.Threshold] {
+		xs[i], ys[i] = byte(share.Index), share.Share
+	}
+	dataKey := shamirCombine(xs, ys)
+	aead, err := newKeyShareAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := aead.Open(nil, first.Nonce, first.EncryptedKey, first.KeyFingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the key, a share is corrupted")
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := keyFingerprint(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fingerprint, first.KeyFingerprint) {
+		return nil, fmt.Errorf("recovered key does not match the fingerprint of the shares")
+	}
+	return keyPEM, nil
+}
+
+func newKeyShareAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readKeyShare reads a share written by key split.
+func readKeyShare(file string) (keyShare, error) {
+	var share keyShare
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return share, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != keySharePEMType {
+		return share, fmt.Errorf("no %s PEM block found", keySharePEMType)
+	}
+	if rest, err := asn1.Unmarshal(block.Bytes, &share); err != nil || len(rest) > 0 {
+		return share, fmt.Errorf("invalid key share")
+	}
+	if share.Index < 1 || share.Index > 255 || len(share.Share) != 32 {
+		return share, fmt.Errorf("invalid key share")
+	}
+	return share, nil
+}
+
+// shamirSplit splits secret into n shares with the x coordinates 1 to n,
+// any threshold of which recover it. Every byte is shared on its own
+// random polynomial of degree threshold-1 over GF(2^8).
+func shamirSplit(secret []byte, n, threshold int) ([][]byte, error) {
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	coefficients := make([]byte, threshold)
+	for i, b := range secret {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for j := range shares {
+			x := byte(j + 1)
+			// Horner's method
+			var y byte
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coefficients[k]
+			}
+			shares[j][i] = y
+		}
+	}
+	return shares, nil
+}
+
+// shamirCombine recovers the secret from the shares ys at the distinct x
+// coordinates xs by Lagrange interpolation at 0.
+func shamirCombine(xs []byte, ys [][]byte) []byte {
+	secret := make([]byte, len(ys[0]))
+	for i := range xs {
+		// The Lagrange basis polynomial of xs[i] at 0, subtraction is
+		// addition in GF(2^8)
+		basis := byte(1)
+		for j := range xs {
+			if i != j {
+				basis = gfMul(basis, gfMul(xs[j], gfInverse(xs[i]^xs[j])))
+			}
+		}
+		for k := range secret {
+			secret[k] ^= gfMul(ys[i][k], basis)
+		}
+	}
+	return secret
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial x^8+x^4+x^3+x+1.
+func gfMul(a, b byte) byte {
+	var product byte
+	for b > 0 {
+		if b&1 != 0 {
+			product ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return product
+}
+
+// gfInverse returns a^254, the multiplicative inverse of a != 0.
+func gfInverse(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 254; i++ {
+		result = gfMul(result, a)
+	}
+	return result
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// kubeconfigDataLine matches the base64 encoded certificate entries of a
+// kubeconfig. Kubeconfigs are edited line by line rather than by decoding
+// and re-encoding the YAML, which keeps comments, ordering and formatting
+// intact.
+var kubeconfigDataLine = regexp.MustCompile(`^(\s*(?:-\s+)?)(certificate-authority-data|client-certificate-data):(\s*)("?)([A-Za-z0-9+/=]+)("?)\s*$`)
+
+func runKubeconfig(args []string) {
+	fs := flag.NewFlagSet("kubeconfig", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.registerInput(fs)
+	resignClientCerts := fs.Bool("resign-client-certs", false, "Re-sign embedded client certificates issued by the CA with the regenerated CA")
+	backup := fs.Bool("backup", true, "Keep a copy of each modified kubeconfig as <file>.bak")
+	dryRun := fs.Bool("dry-run", false, "Only show what would be changed")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() || fs.NArg() == 0 {
+		usageError("go run *.go kubeconfig (-ca <ca-bundle.pem> | -ca-cert <ca-cert.pem> (-ca-key <ca-key.pem> | -gcp-kms-key <key> | -pkcs11-module <module> -pkcs11-key-label <label> | -yubikey-slot 9c | -tpm-key <handle> | -remote-signer <host:port>)) [-resign-client-certs] [-backup=false] [-dry-run] <kubeconfig>...")
+	}
+
+	originalCA, caKey, _, err := caOpts.load()
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA", "error", err)
+	}
+	if err := checkOriginalCABasicConstraints(originalCA); err != nil {
+		exitWith(exitInvalidCA, "Original CA validation failed", "error", err)
+	}
+	newCA, err := caOpts.regenerate(originalCA, caKey)
+	if err != nil {
+		exitWith(exitRegenerationFailed, "Failed to generate new CA", "error", err)
+	}
+
+	failed := false
+	for _, file := range fs.Args() {
+		if err := rotateKubeconfig(file, originalCA, newCA, caKey, *resignClientCerts, *backup, *dryRun); err != nil {
+			slog.Error("Failed to rotate kubeconfig", "file", file, "error", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+// rotateKubeconfig replaces the original CA in all certificate-authority-data
+// entries of a kubeconfig with newCA and checks that the embedded client
+// certificates chain to it, optionally re-signing them.
+func rotateKubeconfig(file string, originalCA, newCA *x509.Certificate, caKey crypto.Signer, resign, backup, dryRun bool) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(newCA)
+
+	lines := strings.SplitAfter(string(data), "\n")
+	changed := 0
+	for i, line := range lines {
+		m := kubeconfigDataLine.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+		if m == nil {
+			continue
+		}
+		prefix, key, sep, quote, value := m[1], m[2], m[3], m[4], m[5]
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			slog.Warn("Skipping invalid base64 data", "file", file, "line", i+1, "key", key)
+			continue
+		}
+
+		var replacement []byte
+		switch key {
+		case "certificate-authority-data":
+			replacement = replaceMatchingCA(decoded, originalCA, newCA)
+			if replacement != nil {
+				slog.Info("Replacing CA certificate", "file", file, "line", i+1)
+			}
+		case "client-certificate-data":
+			replacement, err = checkClientCertificate(decoded, roots, newCA, caKey, resign)
+			if err != nil {
+				slog.Warn("Client certificate does not chain to the regenerated CA", "file", file, "line", i+1, "error", err)
+				var verifyErr *caregen.VerificationError
+				if errors.As(err, &verifyErr) {
+					for _, cause := range verifyErr.Causes {
+						slog.Warn("Cause: " + cause)
+					}
+				}
+				continue
+			}
+			if replacement != nil {
+				slog.Info("Re-signed client certificate", "file", file, "line", i+1)
+			} else {
+				slog.Info("Verified: client certificate chains to the regenerated CA", "file", file, "line", i+1)
+			}
+		}
+		if replacement == nil {
+			continue
+		}
+
+		newline := strings.TrimPrefix(line, strings.TrimRight(line, "\r\n"))
+		lines[i] = prefix + key + ":" + sep + quote + base64.StdEncoding.EncodeToString(replacement) + quote + newline
+		changed++
+	}
+
+	if changed == 0 {
+		slog.Info("Nothing to change", "file", file)
+		return nil
+	}
+	if dryRun {
+		slog.Info("Dry run: would update kubeconfig", "file", file, "entries", changed)
+		return nil
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if backup {
+		if err := os.WriteFile(file+".bak", data, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to write backup: %w", err)
+		}
+	}
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "")), info.Mode().Perm()); err != nil {
+		return err
+	}
+	slog.Info("Updated kubeconfig", "file", file, "entries", changed)
+	return nil
+}
+
+// replaceMatchingCA returns the PEM bundle with every certificate that is
+// a version of the original CA (same subject and public key) replaced by
+// newCA, or nil if there was nothing to replace.
+func replaceMatchingCA(bundle []byte, originalCA, newCA *x509.Certificate) []byte {
+	newCAPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newCA.Raw})
+	var out []byte
+	replaced := false
+	for rest := bundle; ; {
+		block, next := pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		rest = next
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err == nil && isSameCA(cert, originalCA) && !bytes.Equal(cert.Raw, newCA.Raw) {
+				out = append(out, newCAPEM...)
+				replaced = true
+				continue
+			}
+		}
+		out = append(out, pem.EncodeToMemory(block)...)
+	}
+	if !replaced {
+		return nil
+	}
+	return out
+}
+
+// isSameCA reports whether a and b are versions of the same CA, i.e. have
+// the same subject and public key.
+func isSameCA(a, b *x509.Certificate) bool {
+	return bytes.Equal(a.RawSubject, b.RawSubject) && x509util.IsPublicKey(a.PublicKey, b.PublicKey)
+}
+
+// checkClientCertificate verifies that the first certificate of a client
+// certificate bundle chains to the regenerated CA. If resign is set and
+// the certificate was issued by the CA, it is re-issued by newCA with
+// identical contents and the new PEM is returned.
+func checkClientCertificate(bundle []byte, roots *x509.CertPool, newCA *x509.Certificate, caKey crypto.Signer, resign bool) ([]byte, error) {
+	block := findPEMBlock(bundle, "CERTIFICATE")
+	if block == nil {
+		return nil, fmt.Errorf("no certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, caregen.NewVerificationError(err, []*x509.Certificate{cert}, []*x509.Certificate{newCA}, "", now.Now())
+	}
+	if !resign {
+		return nil, nil
+	}
+
+	der, err := resignCertificate(cert, newCA, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-sign client certificate: %w", err)
+	}
+	if bytes.Equal(der, cert.Raw) {
+		return nil, nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
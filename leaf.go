@@ -0,0 +1,467 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"flag"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// leafOptions are the flags customizing the server certificate issued by
+// the regenerated CA. They are registered along with the caOptions.
+type leafOptions struct {
+	keyUsage       keyUsageFlag
+	extKeyUsage    extKeyUsageFlag
+	dnsNames       []string
+	ipAddresses    []net.IP
+	uris           []*url.URL
+	emailAddresses []string
+	subject        subjectFlag
+	ctLogs         ctLogList
+	// validity overrides the validity of the server certificate, it is
+	// only registered by the modes rotating it.
+	validity time.Duration
+	// keyType, keyBits and curve select the generated keys, see keySpec.
+	keyType string
+	keyBits int
+	curve   string
+	// mustStaple adds the TLS Feature extension requiring OCSP stapling.
+	mustStaple bool
+}
+
+// keySpec is the algorithm and size of a generated key, as understood by
+// caregen.GenerateKey. The zero value leaves the choice to the caller.
+type keySpec struct {
+	algo string
+	size int
+}
+
+// keyTypes are the values of -leaf-key-type.
+var keyTypes = map[string]keySpec{
+	"rsa":     {"rsa", 0},
+	"rsa2048": {"rsa", 2048},
+	"rsa3072": {"rsa", 3072},
+	"rsa4096": {"rsa", 4096},
+	"ecdsa":   {"ecdsa", 0},
+	"p256":    {"ecdsa", 256},
+	"p384":    {"ecdsa", 384},
+	"ed25519": {"ed25519", 0},
+}
+
+// keyCurves are the values of -curve.
+var keyCurves = map[string]int{"p256": 256, "p384": 384}
+
+// or returns k, or fallback if no key was selected.
+func (k keySpec) or(fallback keySpec) keySpec {
+	if k.algo == "" {
+		return fallback
+	}
+	return k
+}
+
+func (k keySpec) generate() (crypto.Signer, error) {
+	return caregen.GenerateKey(caregen.WithKeyType(caregen.KeyType{Algorithm: k.algo, Size: k.size}))
+}
+
+func (k keySpec) String() string {
+	switch k.algo {
+	case "rsa":
+		return fmt.Sprintf("RSA %d", max(k.size, 2048))
+	case "ecdsa":
+		return fmt.Sprintf("ECDSA P-%d", max(k.size, 256))
+	case "ed25519":
+		return "Ed25519"
+	}
+	return "default"
+}
+
+func (o *leafOptions) register(fs *flag.FlagSet) {
+	o.registerCertificate(fs)
+	o.registerKey(fs)
+}
+
+// registerCertificate registers the flags for the contents of issued
+// certificates, for modes signing keys they do not generate.
+func (o *leafOptions) registerCertificate(fs *flag.FlagSet) {
+	fs.Var(&o.keyUsage, "key-usage", "Key usage of issued certificates, e.g. digitalSignature or keyEncipherment, can be repeated")
+	fs.Var(&o.extKeyUsage, "eku", "Extended key usage of issued certificates, e.g. serverAuth, clientAuth or an OID, can be repeated")
+	fs.Var(&o.subject, "subject", "Subject attributes of issued certificates, e.g. CN=web,O=Example,OU=Ops,C=DE,L=Berlin,ST=Berlin")
+	fs.Func("dns", "Additional DNS name SAN of issued certificates, e.g. *.example.com, can be repeated", func(value string) error {
+		if err := checkWildcard(value); err != nil {
+			return err
+		}
+		o.dnsNames = append(o.dnsNames, value)
+		return nil
+	})
+	registerPublicSuffixList(fs, &o.dnsNames)
+	fs.Func("ip", "Additional IP address SAN of issued certificates, e.g. 10.0.0.1 or [2001:db8::1], can be repeated", func(value string) error {
+		ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", value)
+		}
+		o.ipAddresses = append(o.ipAddresses, ip)
+		return nil
+	})
+	fs.Func("uri", "Additional URI SAN of issued certificates, e.g. a SPIFFE ID, can be repeated", func(value string) error {
+		uri, err := url.Parse(value)
+		if err != nil || uri.Scheme == "" {
+			return fmt.Errorf("invalid URI %q", value)
+		}
+		o.uris = append(o.uris, uri)
+		return nil
+	})
+	fs.Func("email", "Additional email address SAN of issued certificates, can be repeated", func(value string) error {
+		if address, err := mail.ParseAddress(value); err != nil || address.Address != value {
+			return fmt.Errorf("invalid email address %q", value)
+		}
+		o.emailAddresses = append(o.emailAddresses, value)
+		return nil
+	})
+	fs.BoolVar(&o.mustStaple, "must-staple", false, "Add the TLS Feature extension requiring OCSP stapling (OCSP Must-Staple) to issued server certificates")
+	fs.Var(&o.ctLogs, "ct-log", "Submit issued certificates to the Certificate Transparency log <url>=<public-key-file> and embed the SCT, can be repeated")
+}
+
+// registerKey registers the flags selecting generated keys.
+func (o *leafOptions) registerKey(fs *flag.FlagSet) {
+	fs.Func("leaf-key-type", "Type of generated leaf and test CA keys: rsa2048, rsa3072, rsa4096, p256, p384, ed25519, or rsa and ecdsa with -leaf-key-bits and -curve (default rsa2048 for the server certificate)", func(value string) error {
+		if _, ok := keyTypes[value]; !ok {
+			return fmt.Errorf("unsupported key type %q", value)
+		}
+		o.keyType = value
+		return nil
+	})
+	fs.IntVar(&o.keyBits, "leaf-key-bits", 0, "Size of generated RSA leaf and test CA keys in bits, e.g. 3072 or 4096")
+	fs.Func("curve", "Curve of generated ECDSA leaf and test CA keys: p256 or p384", func(value string) error {
+		if _, ok := keyCurves[value]; !ok {
+			return fmt.Errorf("unsupported curve %q, use p256 or p384", value)
+		}
+		o.curve = value
+		return nil
+	})
+}
+
+// keySpec returns the key selected by -leaf-key-type, -leaf-key-bits and
+// -curve, or the zero keySpec if none was given. -leaf-key-bits alone
+// selects RSA and -curve alone ECDSA.
+func (o *leafOptions) keySpec() (keySpec, error) {
+	spec := keyTypes[o.keyType]
+	if o.keyBits != 0 {
+		if spec.algo == "" {
+			spec.algo = "rsa"
+		}
+		if spec.algo != "rsa" || (spec.size != 0 && spec.size != o.keyBits) {
+			return keySpec{}, fmt.Errorf("-leaf-key-bits %d does not match key type %s", o.keyBits, o.keyType)
+		}
+		spec.size = o.keyBits
+	}
+	if o.curve != "" {
+		if spec.algo == "" {
+			spec.algo = "ecdsa"
+		}
+		if spec.algo != "ecdsa" || (spec.size != 0 && spec.size != keyCurves[o.curve]) {
+			return keySpec{}, fmt.Errorf("-curve %s does not match key type %s", o.curve, o.keyType)
+		}
+		spec.size = keyCurves[o.curve]
+	}
+	return spec, nil
+}
+
+// apply sets the usages given on the command line on template and adds
+// the SANs.
+func (o *leafOptions) apply(template *x509.Certificate) {
+	o.subject.apply(&template.Subject)
+	template.DNSNames = append(template.DNSNames, o.dnsNames...)
+	template.IPAddresses = append(template.IPAddresses, o.ipAddresses...)
+	template.URIs = append(template.URIs, o.uris...)
+	template.EmailAddresses = append(template.EmailAddresses, o.emailAddresses...)
+	if o.keyUsage != 0 {
+		template.KeyUsage = x509.KeyUsage(o.keyUsage)
+	}
+	if !o.extKeyUsage.empty() {
+		template.ExtKeyUsage = o.extKeyUsage.usages
+		template.UnknownExtKeyUsage = o.extKeyUsage.oids
+	}
+	o.addMustStaple(template)
+}
+
+// addMustStaple adds the TLS Feature extension to template if requested.
+func (o *leafOptions) addMustStaple(template *x509.Certificate) {
+	if o.mustStaple && !hasMustStaple(template) {
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oidExtensionTLSFeature, Value: mustStapleFeature})
+	}
+}
+
+// mustStapleFeature is the TLS Feature extension value (RFC 7633) with
+// status_request, the TLS extension of OCSP stapling.
+var mustStapleFeature = []byte{0x30, 0x03, 0x02, 0x01, 0x05}
+
+// hasMustStaple reports whether cert requires OCSP stapling.
+func hasMustStaple(cert *x509.Certificate) bool {
+	for _, extensions := range [][]pkix.Extension{cert.Extensions, cert.ExtraExtensions} {
+		for _, ext := range extensions {
+			var features []int
+			if !ext.Id.Equal(oidExtensionTLSFeature) {
+				continue
+			}
+			if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+				continue
+			}
+			for _, feature := range features {
+				if feature == 5 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// applyProfile overrides the usages of profile with the ones given on the
+// command line.
+func (o *leafOptions) applyProfile(profile *certProfile) {
+	if o.keyUsage != 0 {
+		profile.keyUsage = x509.KeyUsage(o.keyUsage)
+		profile.rsaKeyUsage, profile.ecdsaKeyUsage = 0, 0
+	}
+	if !o.extKeyUsage.empty() {
+		profile.extKeyUsage = o.extKeyUsage.usages
+		profile.unknownExtKeyUsage = o.extKeyUsage.oids
+	}
+}
+
+// addNames adds the SANs given on the command line to csr and replaces
+// the given subject attributes.
+func (o *leafOptions) addNames(csr *x509.CertificateRequest) {
+	if !o.subject.empty() {
+		o.subject.apply(&csr.Subject)
+	}
+	csr.DNSNames = append(csr.DNSNames, o.dnsNames...)
+	csr.IPAddresses = append(csr.IPAddresses, o.ipAddresses...)
+	csr.URIs = append(csr.URIs, o.uris...)
+	csr.EmailAddresses = append(csr.EmailAddresses, o.emailAddresses...)
+}
+
+// checkWildcard checks that a wildcard DNS name like *.example.com only
+// uses the whole leftmost label as wildcard (RFC 6125 section 7.2) and is
+// not issued for a public suffix like *.com or *.co.uk.
+func checkWildcard(name string) error {
+	if !strings.Contains(name, "*") {
+		return nil
+	}
+	suffix, ok := strings.CutPrefix(name, "*.")
+	if !ok || strings.Contains(suffix, "*") {
+		return fmt.Errorf("invalid wildcard name %q, only the whole leftmost label may be a wildcard", name)
+	}
+	suffix = strings.ToLower(strings.TrimSuffix(suffix, "."))
+	if publicSuffixes.isPublicSuffix(suffix) {
+		return fmt.Errorf("invalid wildcard name %q, %s is a public suffix", name, suffix)
+	}
+	return nil
+}
+
+// keyUsageAliases are the OpenSSL names of key usages which differ from
+// the cfssl ones, see normalizeUsage.
+var keyUsageAliases = map[string]x509.KeyUsage{
+	"nonrepudiation": x509.KeyUsageContentCommitment,
+	"keycertsign":    x509.KeyUsageCertSign,
+}
+
+// extKeyUsageAliases are the OpenSSL names of extended key usages which
+// differ from the cfssl ones.
+var extKeyUsageAliases = map[string]x509.ExtKeyUsage{
+	"anyextendedkeyusage": x509.ExtKeyUsageAny,
+	"ipsecendsystem":      x509.ExtKeyUsageIPSECEndSystem,
+	"msgsc":               x509.ExtKeyUsageMicrosoftServerGatedCrypto,
+	"nsgsc":               x509.ExtKeyUsageNetscapeServerGatedCrypto,
+}
+
+// normalizeUsage makes usage names comparable, so both the cfssl
+// ("client auth") and the OpenSSL ("clientAuth") spelling are accepted.
+func normalizeUsage(name string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "", "_", "").Replace(name))
+}
+
+// keyUsageFlag is a repeatable flag accumulating key usages.
+type keyUsageFlag x509.KeyUsage
+
+func (f *keyUsageFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(x509util.KeyUsageStrings(x509.KeyUsage(*f)), ", ")
+}
+
+func (f *keyUsageFlag) Set(value string) error {
+	name := normalizeUsage(value)
+	if usage, ok := keyUsageAliases[name]; ok {
+		*f |= keyUsageFlag(usage)
+		return nil
+	}
+	for cfsslName, usage := range cfsslKeyUsages {
+		if normalizeUsage(cfsslName) == name {
+			*f |= keyUsageFlag(usage)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown key usage %q", value)
+}
+
+// extKeyUsageFlag is a repeatable flag accumulating extended key usages,
+// either by name or as dotted OID.
+type extKeyUsageFlag struct {
+	usages []x509.ExtKeyUsage
+	oids   []asn1.ObjectIdentifier
+}
+
+func (f *extKeyUsageFlag) empty() bool {
+	return len(f.usages) == 0 && len(f.oids) == 0
+}
+
+func (f *extKeyUsageFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var names []string
+	for _, usage := range f.usages {
+		names = append(names, x509util.ExtKeyUsageNames[usage])
+	}
+	for _, oid := range f.oids {
+		names = append(names, oid.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+func (f *extKeyUsageFlag) Set(value string) error {
+	if oid, err := parseOID(value); err == nil {
+		f.oids = append(f.oids, oid)
+		return nil
+	}
+	name := normalizeUsage(value)
+	if usage, ok := extKeyUsageAliases[name]; ok {
+		f.usages = append(f.usages, usage)
+		return nil
+	}
+	for cfsslName, usage := range cfsslExtKeyUsages {
+		if normalizeUsage(cfsslName) == name {
+			f.usages = append(f.usages, usage)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown extended key usage %q", value)
+}
+
+// parseOID parses a dotted OID like 1.3.6.1.5.5.7.3.1.
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+// subjectFlag is a repeatable flag with subject attributes in the RFC 4514
+// form "CN=name,O=Org" or the OpenSSL form "/CN=name/O=Org".
+type subjectFlag struct {
+	attributes [][2]string
+}
+
+// subjectFields maps the supported attribute types to pkix.Name fields.
+var subjectFields = map[string]func(name *pkix.Name) *[]string{
+	"O":  func(name *pkix.Name) *[]string { return &name.Organization },
+	"OU": func(name *pkix.Name) *[]string { return &name.OrganizationalUnit },
+	"C":  func(name *pkix.Name) *[]string { return &name.Country },
+	"L":  func(name *pkix.Name) *[]string { return &name.Locality },
+	"ST": func(name *pkix.Name) *[]string { return &name.Province },
+}
+
+func (f *subjectFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	for _, attribute := range f.attributes {
+		parts = append(parts, attribute[0]+"="+attribute[1])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *subjectFlag) Set(value string) error {
+	separator := ','
+	if strings.HasPrefix(value, "/") {
+		separator, value = '/', value[1:]
+	}
+	for _, part := range splitEscaped(value, separator) {
+		key, attributeValue, ok := strings.Cut(part, "=")
+		key = strings.ToUpper(strings.TrimSpace(key))
+		if _, known := subjectFields[key]; !ok || (!known && key != "CN") {
+			return fmt.Errorf("invalid subject attribute %q, use CN, O, OU, C, L or ST", part)
+		}
+		f.attributes = append(f.attributes, [2]string{key, attributeValue})
+	}
+	return nil
+}
+
+// apply replaces the attributes of name given in the flag. Attribute types
+// which are not given keep their values.
+func (f *subjectFlag) apply(name *pkix.Name) {
+	replaced := map[string]bool{}
+	for _, attribute := range f.attributes {
+		key, value := attribute[0], attribute[1]
+		if key == "CN" {
+			name.CommonName = value
+			continue
+		}
+		field := subjectFields[key](name)
+		if !replaced[key] {
+			*field = nil
+			replaced[key] = true
+		}
+		*field = append(*field, value)
+	}
+}
+
+func (f *subjectFlag) empty() bool {
+	return len(f.attributes) == 0
+}
+
+// splitEscaped splits s at separators not escaped with a backslash and
+// removes the escapes.
+func splitEscaped(s string, separator rune) []string {
+	var parts []string
+	var part strings.Builder
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			part.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == separator:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+	return append(parts, part.String())
+}
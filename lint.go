@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+const (
+	lintError   = "ERROR"
+	lintWarning = "WARNING"
+)
+
+// minRSAKeyBits is the smallest RSA modulus lint accepts for a CA key.
+const minRSAKeyBits = 2048
+
+// lintFinding is a single problem detected in a CA certificate.
+type lintFinding struct {
+	Severity string
+	Check    string
+	Message  string
+}
+
+// printFindings prints the findings for the certificate described by
+// title, or OK if there are none, and returns the number of errors.
+func printFindings(title string, findings []lintFinding) int {
+	fmt.Println(title)
+	if len(findings) == 0 {
+		fmt.Println("  OK")
+	}
+	count := 0
+	for _, f := range findings {
+		fmt.Printf("  %-8s %-32s %s\n", f.Severity, f.Check, f.Message)
+		if f.Severity == lintError {
+			count++
+		}
+	}
+	return count
+}
+
+func runLint(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+	expiryWarning := fs.Duration("expiry-warning", 30*24*time.Hour, "Warn about CAs expiring within this duration")
+	registerClock(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if fs.NArg() == 0 {
+		usageError("go run *.go lint [-expiry-warning 720h] <ca.pem>...")
+	}
+
+	problems := 0
+	for _, file := range fs.Args() {
+		certs, err := loadCertificates(file)
+		if err != nil {
+			exitWith(exitFailure, "Failed to load certificates", "file", file, "error", err)
+		}
+		for _, cert := range certs {
+			problems += printFindings(fmt.Sprintf("%s: %s", file, cert.Subject), lintCA(cert, now.Now(), *expiryWarning))
+		}
+	}
+
+	if problems > 0 {
+		exitWith(exitLintFailed, "Lint found problems", "errors", problems)
+	}
+}
+
+// lintCA checks a CA certificate for common hygiene problems. In
+// particular it detects non-critical basic constraints, which is the
+// problem the regeneration in this tool fixes.
+func lintCA(cert *x509.Certificate, now time.Time, expiryWarning time.Duration) []lintFinding {
+	var findings []lintFinding
+	add := func(severity, check, format string, args ...any) {
+		findings = append(findings, lintFinding{severity, check, fmt.Sprintf(format, args...)})
+	}
+
+	basicConstraints := x509util.FindExtension(cert, oidExtensionBasicConstraints)
+	switch {
+	case basicConstraints == nil:
+		add(lintError, "basic-constraints-missing", "basicConstraints extension is missing")
+	case !basicConstraints.Critical:
+		add(lintError, "basic-constraints-not-critical", "basicConstraints extension is not marked critical (RFC 5280 4.2.1.9)")
+	}
+	if basicConstraints != nil && !cert.IsCA {
+		add(lintError, "not-a-ca", "basicConstraints has CA:FALSE")
+	}
+
+	keyUsage := x509util.FindExtension(cert, oidExtensionKeyUsage)
+	switch {
+	case keyUsage == nil:
+		add(lintError, "key-usage-missing", "keyUsage extension is missing")
+	case cert.KeyUsage&x509.KeyUsageCertSign == 0:
+		add(lintError, "key-cert-sign-missing", "keyUsage does not include keyCertSign")
+	}
+	if keyUsage != nil && !keyUsage.Critical {
+		add(lintWarning, "key-usage-not-critical", "keyUsage extension is not marked critical")
+	}
+	if keyUsage != nil && cert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		add(lintWarning, "crl-sign-missing", "keyUsage does not include cRLSign")
+	}
+
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA:
+		add(lintError, "weak-signature-algorithm", "certificate is signed with %s", cert.SignatureAlgorithm)
+	case x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		add(lintError, "sha1-signature", "certificate is signed with %s", cert.SignatureAlgorithm)
+	}
+
+	if key, ok := cert.PublicKey.(*rsa.PublicKey); ok && key.N.BitLen() < minRSAKeyBits {
+		add(lintError, "small-rsa-key", "RSA key has %d bits, at least %d are required", key.N.BitLen(), minRSAKeyBits)
+	}
+
+	if len(cert.SubjectKeyId) == 0 {
+		add(lintWarning, "subject-key-id-missing", "subjectKeyIdentifier extension is missing")
+	}
+
+	switch {
+	case now.After(cert.NotAfter):
+		add(lintError, "expired", "certificate expired on %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	case now.Add(expiryWarning).After(cert.NotAfter):
+		add(lintWarning, "expiring-soon", "certificate expires on %s", cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if now.Before(cert.NotBefore) {
+		add(lintError, "not-yet-valid", "certificate is not valid before %s", cert.NotBefore.UTC().Format(time.RFC3339))
+	}
+
+	if cert.Version != 3 {
+		add(lintError, "not-x509v3", "certificate is X.509 version %d", cert.Version)
+	}
+
+	return findings
+}
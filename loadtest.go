@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Opens new TLS connections to the test server, which serves the
+// certificate issued by the regenerated CA, at a fixed rate for a given
+// duration, to validate the regenerated chain under production-like
+// handshake volume. Connections are started on schedule regardless of
+// how long earlier ones take, like independent clients would.
+func runLoadTest(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	rate := fs.Int("rate", 100, "New connections per second")
+	duration := fs.Duration("duration", 30*time.Second, "Duration of the load test")
+	maxInFlight := fs.Int("max-in-flight", 1000, "Maximum number of concurrent handshakes, further connections are dropped")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() || *rate < 1 || *duration <= 0 || *maxInFlight < 1 {
+		usageError("go run *.go loadtest (-ca <ca-bundle.pem> | -ca-cert <ca-cert.pem> -ca-key <ca-key.pem>) [-rate 100] [-duration 30s] [-max-in-flight 1000]")
+	}
+
+	setup := prepareCAs(caOpts)
+	server := startWebServer(&tls.Config{Certificates: []tls.Certificate{setup.serverTLSCertificate()}})
+	defer server.Close()
+	config := handshakeConfig(setup.newCA)
+
+	slog.Info("Starting load test", "rate", *rate, "duration", *duration)
+	stats := &handshakeStats{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var inFlight atomic.Int64
+	started, dropped := 0, 0
+	interval := time.Second / time.Duration(*rate)
+	start := time.Now()
+	nextReport := start.Add(time.Second)
+	for i := 0; ; i++ {
+		at := start.Add(time.Duration(i) * interval)
+		if at.Sub(start) >= *duration {
+			break
+		}
+		time.Sleep(time.Until(at))
+		if time.Now().After(nextReport) {
+			mu.Lock()
+			slog.Info("Load test running", "elapsed", time.Since(start).Round(time.Second), "started", started, "succeeded", len(stats.latencies), "failed", stats.errors, "dropped", dropped, "in_flight", inFlight.Load())
+			mu.Unlock()
+			nextReport = nextReport.Add(time.Second)
+		}
+		if inFlight.Load() >= int64(*maxInFlight) {
+			dropped++
+			continue
+		}
+		started++
+		inFlight.Add(1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer inFlight.Add(-1)
+			latency, err := handshake(config)
+			mu.Lock()
+			stats.add(latency, err)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	stats.elapsed = time.Since(start)
+
+	fmt.Printf("Connections: %d started, %d succeeded, %d failed, %d dropped\n", started, len(stats.latencies), stats.errors, dropped)
+	fmt.Printf("Throughput:  %.1f handshakes/s (target %d/s)\n", stats.rate(), *rate)
+	fmt.Printf("Latency:     p50 %s, p95 %s, p99 %s\n", stats.percentile(50), stats.percentile(95), stats.percentile(99))
+	if stats.errors > 0 || dropped > 0 {
+		os.Exit(exitVerifyFailed)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// logOptions holds the logging related command line flags shared by all
+// modes.
+type logOptions struct {
+	verbose bool
+	quiet   bool
+	format  string
+}
+
+func (o *logOptions) register(fs *flag.FlagSet) {
+	fs.BoolVar(&o.verbose, "v", false, "Verbose output (include debug messages)")
+	fs.BoolVar(&o.quiet, "q", false, "Quiet output (only warnings and errors)")
+	fs.StringVar(&o.format, "log-format", "text", "Log format: text or json")
+}
+
+// setup installs the default slog logger according to the options. All
+// log output goes to stderr so stdout stays usable for data.
+func (o *logOptions) setup() {
+	level := slog.LevelInfo
+	switch {
+	case o.verbose:
+		level = slog.LevelDebug
+	case o.quiet:
+		level = slog.LevelWarn
+	}
+
+	var handler slog.Handler
+	switch o.format {
+	case "text":
+		handler = newConsoleHandler(os.Stderr, level)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -log-format %q (must be text or json)\n", o.format)
+		os.Exit(exitUsage)
+	}
+
+	slog.SetDefault(slog.New(handler))
+}
+
+// consoleHandler is a slog.Handler producing the human friendly output
+// of the tool: one line per record, prefixed with a status symbol derived
+// from the level, followed by the attributes as key=value pairs. An
+// "error" attribute is appended to the message instead.
+type consoleHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Level
+	attrs []slog.Attr
+}
+
+func newConsoleHandler(w io.Writer, level slog.Level) *consoleHandler {
+	return &consoleHandler{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString("❌ ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString("⚠ ")
+	case r.Level >= slog.LevelInfo:
+		b.WriteString("✓ ")
+	default:
+		b.WriteString("  ")
+	}
+	b.WriteString(r.Message)
+
+	var errText string
+	appendAttr := func(a slog.Attr) {
+		if a.Key == "error" {
+			errText = a.Value.String()
+			return
+		}
+		fmt.Fprintf(&b, " %s=%s", a.Key, quoteIfNeeded(a.Value.String()))
+	}
+	for _, a := range h.attrs {
+		appendAttr(a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(a)
+		return true
+	})
+	if errText != "" {
+		b.WriteString(": ")
+		b.WriteString(errText)
+	}
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)
+	return &h2
+}
+
+// WithGroup is not supported by the console output, attributes of groups
+// are printed without qualification.
+func (h *consoleHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
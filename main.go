@@ -1,7 +1,8 @@
 package main
 
 import (
-	"crypto/rand"
+	"context"
+	"crypto"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
@@ -10,135 +11,888 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"math/big"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve-grpc":
+			runServeGRPC(os.Args[2:])
+			return
+		case "serve-smtp":
+			runServeSMTP(os.Args[2:])
+			return
+		case "serve-tcp":
+			runServeTCP(os.Args[2:])
+			return
+		case "serve-dtls":
+			runServeDTLS(os.Args[2:])
+			return
+		case "serve-rotate":
+			runServeRotate(os.Args[2:])
+			return
+		case "inspect":
+			runInspect(os.Args[2:])
+			return
+		case "lint":
+			runLint(os.Args[2:])
+			return
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "cert-manager":
+			runCertManager(os.Args[2:])
+			return
+		case "kubeconfig":
+			runKubeconfig(os.Args[2:])
+			return
+		case "vault":
+			runVault(os.Args[2:])
+			return
+		case "acme-serve":
+			runACMEServe(os.Args[2:])
+			return
+		case "scep-serve":
+			runSCEPServe(os.Args[2:])
+			return
+		case "est-serve":
+			runESTServe(os.Args[2:])
+			return
+		case "cmp-serve":
+			runCMPServe(os.Args[2:])
+			return
+		case "issue":
+			runIssue(os.Args[2:])
+			return
+		case "sign":
+			runSign(os.Args[2:])
+			return
+		case "ssh":
+			runSSH(os.Args[2:])
+			return
+		case "api":
+			runAPI(os.Args[2:])
+			return
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "loadtest":
+			runLoadTest(os.Args[2:])
+			return
+		case "resign":
+			runResign(os.Args[2:])
+			return
+		case "renew":
+			runRenew(os.Args[2:])
+			return
+		case "graph":
+			runGraph(os.Args[2:])
+			return
+		case "keychain":
+			runKeychain(os.Args[2:])
+			return
+		case "windows-store":
+			runWindowsStore(os.Args[2:])
+			return
+		case "mobile-profile":
+			runMobileProfile(os.Args[2:])
+			return
+		case "pq":
+			runPQ(os.Args[2:])
+			return
+		case "trust":
+			runTrust(os.Args[2:])
+			return
+		case "key":
+			runKey(os.Args[2:])
+			return
+		case "audit":
+			runAudit(os.Args[2:])
+			return
+		case "db":
+			runDB(os.Args[2:])
+			return
+		case "revoke":
+			runRevoke(os.Args[2:])
+			return
+		case "backup":
+			runBackup(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "interactive":
+			runInteractive(os.Args[2:])
+			return
+		case "signer-server":
+			runSignerServer(os.Args[2:])
+			return
+		case "k8s-resign":
+			runK8sResign(os.Args[2:])
+			return
+		case "ocsp-responder":
+			runOCSPResponder(os.Args[2:])
+			return
+		case "ocsp-serve":
+			runOCSPServe(os.Args[2:])
+			return
+		case "tsa-serve":
+			runTSAServe(os.Args[2:])
+			return
+		case "ca":
+			runCA(os.Args[2:])
+			return
+		case "hierarchy":
+			runHierarchy(os.Args[2:])
+			return
+		case "cross-sign":
+			runCrossSign(os.Args[2:])
+			return
+		case "rekey":
+			runRekey(os.Args[2:])
+			return
+		case "pins":
+			runPins(os.Args[2:])
+			return
+		case "tlsa":
+			runTLSA(os.Args[2:])
+			return
+		case "check-chain":
+			runCheckChain(os.Args[2:])
+			return
+		case "scan":
+			runScan(os.Args[2:])
+			return
+		}
+	}
+
 	// Parse command line arguments
-	caCertFile := flag.String("ca-cert", "", "Path to PEM encoded CA certificate file")
-	caKeyFile := flag.String("ca-key", "", "Path to PEM encoded CA private key file")
-	flag.Parse()
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	htmlReport := fs.String("html-report", "", "Write a self-contained HTML compatibility report to this file")
+	junitReport := fs.String("junit-report", "", "Write the compatibility test results as JUnit XML to this file")
+	fs.DurationVar(&caOpts.leaf.validity, "validity", 0, "Validity of the server certificate (default 1 year)")
+	watch := fs.Bool("watch", false, "Keep running and regenerate and test again whenever the CA certificate or key file changes")
+	watchInterval := fs.Duration("watch-interval", 2*time.Second, "Interval in which the CA files are checked for changes with -watch")
+	negativeTests := fs.Bool("negative-tests", false, "Also check that clients reject deliberately broken server certificates (expired, wrong host, missing intermediate, untrusted, revoked)")
+	earlyData := fs.Bool("early-data", false, "Also check that a client resuming a session offers TLS 1.3 0-RTT early data and the server accepts it with both CAs")
+	systemTrust := fs.Bool("system-trust", false, "Also report whether the CAs are in the system trust store and check that the server certificate verifies against it if the original CA is")
+	requireSCT := fs.Bool("require-sct", false, "Fail client tests which receive no valid SCT of the -ct-log logs, embedded or in the TLS extension")
+	fs.Var(&testPins, "pin", "Also test a pinning client, which requires a key of the verified chain to have this SPKI pin, as sha256/<base64> (repeatable)")
+	registerAIAFetch(fs)
+	registerProxy(fs)
+	registerTarget(fs, "Run the client tests against this `host[:port]` (default port 443), e.g. a staging load balancer already serving the regenerated chain, instead of the built-in server")
+	registerIPFamily(fs)
+	registerListen(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, os.Args[1:])
+	logOpts.setup()
 
-	if *caCertFile == "" || *caKeyFile == "" {
-		log.Fatal("Usage: go run main.go -ca-cert <ca-cert.pem> -ca-key <ca-key.pem>")
+	if !caOpts.valid() {
+		usageError("go run *.go (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> (-ca-key <ca-key.pem|-> | -gcp-kms-key <key> | -pkcs11-module <module> -pkcs11-key-label <label> | -yubikey-slot 9c | -tpm-key <handle> | -remote-signer <host:port>)) [-stdout] [-negative-tests] [-early-data] [-system-trust] [-pin sha256/...] [-aia-fetch] [-html-report report.html] [-junit-report results.xml] [-watch [-watch-interval 2s]] [-proxy http://proxy:3128] [-target host[:port] [-servername name]] [-ip-family any|ipv4|ipv6|dual] [-listen unix:/path.sock] [-v|-q] [-log-format text|json]")
+	}
+	if *requireSCT && len(caOpts.leaf.ctLogs) == 0 {
+		usageError("-require-sct needs the CT logs to verify the SCTs with, given with -ct-log")
+	}
+	checkTestFlags()
+	if *watch && testTarget != "" {
+		usageError("-watch tests the built-in server, it cannot be combined with -target")
+	}
+	if *watch {
+		files := caOpts.watchedFiles()
+		if len(files) == 0 {
+			usageError("-watch needs CA files, stdin cannot be watched")
+		}
+		runWatch(files, *watchInterval)
+		return
 	}
 
-	// Load the original CA certificate and key
-	originalCA, originalCAKey, err := loadCA(*caCertFile, *caKeyFile)
-	if err != nil {
-		log.Fatalf("Failed to load CA: %v", err)
+	setup := prepareCAs(caOpts)
+
+	if testTarget == "" {
+		// Start web server with the new certificate
+		server := startWebServer(&tls.Config{Certificates: []tls.Certificate{setup.serverTLSCertificate()}})
+		defer server.Close()
+
+		slog.Info("Web server started", "url", testServerURL())
+	} else {
+		slog.Info("Testing existing server", "target", testTarget, "servername", testHostname(testNetworks()[0]))
 	}
 
-	fmt.Println("✓ Loaded original CA certificate and key")
+	if len(testPins) > 0 {
+		logPins(setup)
+	}
 
-	// Check that the original CA doesn't have critical basic constraints
-	err = checkOriginalCABasicConstraints(originalCA)
+	// Test client compatibility with both CAs
+	testsStarted := time.Now()
+	results := runCompatibilityTests(setup, *requireSCT)
+	if *negativeTests {
+		results = append(results, runNegativeTests(setup)...)
+	}
+	if *earlyData {
+		results = append(results, runEarlyDataTests(setup)...)
+	}
+	if *systemTrust {
+		results = append(results, checkSystemTrust(setup)...)
+	}
+	notifyCompatibilityRun(setup, results)
+
+	if *htmlReport != "" {
+		err := writeHTMLReport(*htmlReport, setup.originalCA, setup.newCA, setup.serverCert, results)
+		if err != nil {
+			slog.Warn("Failed to write HTML report", "error", err)
+		} else {
+			slog.Info("Wrote HTML compatibility report", "file", *htmlReport)
+		}
+	}
+	if *junitReport != "" {
+		err := writeJUnitReport(*junitReport, testsStarted, results)
+		if err != nil {
+			slog.Warn("Failed to write JUnit report", "error", err)
+		} else {
+			slog.Info("Wrote JUnit test report", "file", *junitReport)
+		}
+	}
+
+	for _, r := range results {
+		if r.CA == "New CA" && r.Err != nil {
+			exitWith(exitNewCAVerificationFailed, "Unexpected failure with new CA", "client", r.Client, "error", r.Err)
+		}
+	}
+	for _, r := range results {
+		if r.CA == "Original CA" && r.Err != nil {
+			exitWith(exitOriginalCAIncompatible, "Unexpected failure with original CA", "client", r.Client, "error", r.Err)
+		}
+	}
+
+	slog.Info("Success! The regenerated CA with critical basic constraints is compatible with clients using the original CA")
+}
+
+// compatResult is the outcome of a single client compatibility test.
+type compatResult struct {
+	CA       string
+	Client   string
+	Duration time.Duration
+	Err      error
+	// SCTs summarizes the SCTs received, if CT logs are configured.
+	SCTs string
+}
+
+// runCompatibilityTests runs every client test against the web server
+// trusting the new and the original CA. Failures are logged and recorded
+// in the results but do not stop the remaining tests. With requireSCT the
+// HTTPS client fails without a valid SCT.
+func runCompatibilityTests(setup *caSetup, requireSCT bool) []compatResult {
+	cas := []struct {
+		name string
+		cert *x509.Certificate
+	}{
+		{"New CA", setup.newCA},
+		{"Original CA", setup.originalCA},
+	}
+	presented := append([]*x509.Certificate{setup.serverCert}, setup.chain...)
+	if testTarget != "" {
+		presented = fetchPresentedChain()
+	}
+	// The hostname is verified by the client, for the chain analysis
+	type compatClient struct {
+		name     string
+		hostname string
+		test     func(ca *x509.Certificate, caName string) (scts string, err error)
+	}
+	var clients []compatClient
+	networks := testNetworks()
+	for _, network := range networks {
+		name := "HTTPS"
+		if len(networks) > 1 {
+			name += " (" + networkName(network) + ")"
+		}
+		clients = append(clients, compatClient{name, testHostname(network), func(ca *x509.Certificate, caName string) (string, error) {
+			return testClientCompatibility(network, ca, caName, setup.ctLogs, requireSCT)
+		}})
+	}
+	hostname := testHostname(networks[0])
+	if len(testPins) > 0 {
+		clients = append(clients, compatClient{"Certificate pinning", hostname, func(ca *x509.Certificate, caName string) (string, error) {
+			return "", testPinning(networks[0], ca, caName, testPins)
+		}})
+	}
+	clients = append(clients, compatClient{"Session resumption", hostname, func(ca *x509.Certificate, caName string) (string, error) {
+		return "", testSessionResumption(networks[0], ca, caName)
+	}})
+	if testTarget == "" {
+		clients = append(clients, compatClient{"WebSocket", hostname, func(ca *x509.Certificate, _ string) (string, error) { return "", testWebSocketCompatibility(ca) }})
+	}
+	if len(presented) > 0 && hasMustStaple(presented[0]) {
+		clients = append(clients, compatClient{"OCSP stapling", hostname, func(ca *x509.Certificate, _ string) (string, error) { return "", testOCSPStapling(ca) }})
+	}
+
+	var results []compatResult
+	for _, ca := range cas {
+		slog.Debug("Testing client compatibility", "ca", ca.name)
+		for _, client := range clients {
+			start := time.Now()
+			scts, err := client.test(ca.cert, ca.name)
+			if err != nil {
+				slog.Error("Client test failed", "ca", ca.name, "client", client.name, "error", err)
+				logChainProblems(presented, []*x509.Certificate{ca.cert}, client.hostname)
+			}
+			results = append(results, compatResult{
+				CA:       ca.name,
+				Client:   client.name,
+				Duration: time.Since(start).Round(time.Microsecond),
+				Err:      err,
+				SCTs:     scts,
+			})
+		}
+	}
+	return results
+}
+
+// caOptions holds the flags selecting the input CA and the output of the
+// regenerated CA. They are shared by all modes regenerating the CA.
+type caOptions struct {
+	bundleFile   string
+	certFile     string
+	keyFile      string
+	includeChain bool
+	stdout       bool
+	// deterministic makes the regenerated CA reproducible.
+	deterministic bool
+	// minimalDiff rewrites the DER of the original CA instead of
+	// rebuilding it from a template.
+	minimalDiff bool
+	leaf        leafOptions
+	caSubject   subjectFlag
+	// ctTLS delivers the SCTs of the server certificate in the TLS
+	// extension instead of embedding them.
+	ctTLS bool
+	// pss re-signs with RSA-PSS instead of the algorithm of the CA.
+	pss bool
+	// invariants are checked after every regeneration.
+	invariants invariantList
+	// backends holds an instance of every registered signer backend.
+	backends []caregen.SignerBackend
+}
+
+func (o *caOptions) register(fs *flag.FlagSet) {
+	o.registerInput(fs)
+	fs.BoolVar(&o.includeChain, "include-chain", false, "Send additional certificates found in the CA file as chain after the server certificate")
+	fs.BoolVar(&o.stdout, "stdout", false, "Write the new CA PEM to stdout instead of new-ca.pem")
+	fs.BoolVar(&o.deterministic, "deterministic", false, "Regenerate the CA reproducibly, byte-identical for the same inputs, failing for keys with randomized signatures")
+	fs.BoolVar(&o.pss, "pss", false, "Sign the regenerated CA and the server certificate with RSA-PSS, keeping the hash of the original CA if it is SHA-384 or SHA-512")
+	fs.BoolVar(&o.minimalDiff, "minimal-diff", false, "Only mark basicConstraints critical in the DER of the original self-signed CA and sign it again, keeping every other byte")
+	fs.Var(&o.caSubject, "ca-subject", "Rename the regenerated CA, replacing the given subject attributes, e.g. O=New Org,CN=New CA")
+	fs.BoolVar(&o.ctTLS, "ct-tls", false, "Submit the server certificate to the -ct-log logs as is and send the SCTs in the TLS extension instead of embedding them")
+	fs.Var(&o.invariants, "invariants", "Comma separated invariants the regenerated CA must satisfy, or all: "+strings.Join(caregen.InvariantNames(), ", "))
+	o.leaf.register(fs)
+}
+
+// registerInput registers only the flags selecting the input CA, for
+// modes which do not produce the regular outputs.
+func (o *caOptions) registerInput(fs *flag.FlagSet) {
+	fs.StringVar(&o.bundleFile, "ca", "", "Path to PEM file containing both the CA certificate and private key (- for stdin)")
+	fs.StringVar(&o.certFile, "ca-cert", "", "Path to PEM encoded CA certificate file (- for stdin)")
+	fs.StringVar(&o.keyFile, "ca-key", "", "Path to PEM encoded CA private key file (- for stdin), defaults to the -ca-cert file")
+	o.backends = caregen.SignerBackends()
+	for _, backend := range o.backends {
+		backend.Register(fs)
+	}
+	registerClock(fs)
+	registerFIPS(fs)
+	registerAudit(fs)
+	registerWebhook(fs)
+	registerCertDB(fs)
+	registerSerials(fs)
+}
+
+// valid reports whether either a bundle or a certificate file (optionally
+// with a separate key file) was given, but not both. With a KMS or
+// hardware key only the certificate file is needed.
+func (o *caOptions) valid() bool {
+	switch o.externalKeys() {
+	case 0:
+	case 1:
+		return o.certFile != "" && o.keyFile == "" && o.bundleFile == ""
+	default:
+		return false
+	}
+	if o.bundleFile != "" {
+		return o.certFile == "" && o.keyFile == ""
+	}
+	return o.certFile != ""
+}
+
+// files returns the files to load the CA certificate and key from. A key
+// file defaults to the certificate file, which then has to be a bundle.
+func (o *caOptions) files() (certFile, keyFile string) {
+	if o.bundleFile != "" {
+		return o.bundleFile, o.bundleFile
+	}
+	if o.keyFile == "" {
+		return o.certFile, o.certFile
+	}
+	return o.certFile, o.keyFile
+}
+
+// watchedFiles returns the files the CA is loaded from, for -watch. It is
+// empty if the CA is read from stdin.
+func (o *caOptions) watchedFiles() []string {
+	certFile, keyFile := o.files()
+	if o.externalKeys() > 0 {
+		keyFile = certFile
+	}
+	if certFile == "-" || keyFile == "-" {
+		return nil
+	}
+	if keyFile == certFile {
+		return []string{certFile}
+	}
+	return []string{certFile, keyFile}
+}
+
+// signer loads only the CA key, from a signer backend or the key file
+// (for bundles the bundle file).
+func (o *caOptions) signer() (crypto.Signer, error) {
+	for _, backend := range o.backends {
+		if backend.Selected() {
+			return backend.Signer()
+		}
+	}
+	_, keyFile := o.files()
+	keyPEM, err := readInput(keyFile)
 	if err != nil {
-		log.Fatalf("Original CA validation failed: %v", err)
+		return nil, fmt.Errorf("failed to read CA private key: %w", err)
 	}
+	return parsePrivateKey(keyPEM)
+}
 
-	// Generate new CA with critical basic constraints
-	newCA, newCAKey, err := generateNewCA(originalCA, originalCAKey)
+// externalKeys returns the number of selected KMS and hardware keys.
+func (o *caOptions) externalKeys() int {
+	n := 0
+	for _, backend := range o.backends {
+		if backend.Selected() {
+			n++
+		}
+	}
+	return n
+}
+
+// load loads the CA certificate and its signer, either from files or, if
+// selected, from a KMS or hardware key and the certificate file.
+func (o *caOptions) load() (*x509.Certificate, crypto.Signer, []*x509.Certificate, error) {
+	var backend caregen.SignerBackend
+	for _, b := range o.backends {
+		if b.Selected() {
+			backend = b
+		}
+	}
+	if backend == nil {
+		return loadCA(o.files())
+	}
+	signer, err := backend.Signer()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	certPEM, err := readInput(o.certFile)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	cert, chain, err := selectCA(certPEM, signer.Public())
 	if err != nil {
-		log.Fatalf("Failed to generate new CA: %v", err)
+		return nil, nil, nil, err
+	}
+	return cert, signer, chain, nil
+}
+
+// caSetup holds the original and the regenerated CA together with the
+// server certificate issued by the new CA, if any.
+type caSetup struct {
+	originalCA *x509.Certificate
+	newCA      *x509.Certificate
+	caKey      crypto.Signer
+	// chain holds additional certificates loaded along with the CA which
+	// are sent to clients after the server certificate, if requested.
+	chain      []*x509.Certificate
+	serverCert *x509.Certificate
+	serverKey  crypto.Signer
+	// leafKey is the key selected for the leaves of the test scenarios.
+	leafKey keySpec
+	// ctLogs are the CT logs whose SCTs the test client verifies.
+	ctLogs ctLogList
+	// serverSCTs are sent in the TLS extension along with serverCert.
+	serverSCTs [][]byte
+}
+
+// serverTLSCertificate returns the server certificate for use in a
+// tls.Config, including the chain of the CA if there is one.
+func (s *caSetup) serverTLSCertificate() tls.Certificate {
+	tlsCert := tls.Certificate{
+		Certificate: [][]byte{s.serverCert.Raw},
+		PrivateKey:  s.serverKey,
+
+		SignedCertificateTimestamps: s.serverSCTs,
+	}
+	if hasMustStaple(s.serverCert) {
+		// Valid as long as the certificate, so long running servers do not
+		// need to refresh it
+		staple, err := createOCSPResponse(s.newCA, ocspStatus{serial: s.serverCert.SerialNumber}, s.newCA, s.caKey, now.Now(), s.serverCert.NotAfter, nil)
+		if err != nil {
+			slog.Warn("Failed to create OCSP response to staple", "error", err)
+		}
+		tlsCert.OCSPStaple = staple
 	}
+	for _, cert := range s.chain {
+		tlsCert.Certificate = append(tlsCert.Certificate, cert.Raw)
+	}
+	return tlsCert
+}
 
-	fmt.Println("✓ Generated new CA with critical basic constraints")
+// prepareCAs regenerates the CA like regenerateCAs and issues a localhost
+// server certificate from the new CA. It is shared by the modes running
+// the test servers and exits on failure.
+func prepareCAs(opts caOptions) *caSetup {
+	setup := regenerateCAs(opts)
 
-	// Save the new CA to a file for inspection
-	err = saveCAToFile(newCA, "new-ca.pem")
+	// Generate server certificate using the new CA
+	serverCert, serverKey, serverSCTs, err := opts.serverCertificate(setup.newCA, setup.caKey)
 	if err != nil {
-		log.Printf("Warning: Failed to save new CA to file: %v", err)
+		exitWith(exitRegenerationFailed, "Failed to generate server certificate", "error", err)
+	}
+
+	slog.Info("Generated server certificate", "dns", strings.Join(serverCert.DNSNames, ","))
+
+	setup.serverCert, setup.serverKey, setup.serverSCTs = serverCert, serverKey, serverSCTs
+	return setup
+}
+
+// regenerateCAs loads and regenerates the CA like loadCAs, records the
+// regenerated CA and saves it to new-ca.pem, or streams it to stdout with
+// -stdout. It is used by the modes publishing the regenerated CA.
+func regenerateCAs(opts caOptions) *caSetup {
+	setup := loadCAs(opts)
+	if err := recordSigned("regenerate", setup.newCA); err != nil {
+		exitWith(exitRegenerationFailed, "Failed to generate new CA", "error", err)
+	}
+
+	// Save the new CA to a file for inspection, or stream it to stdout
+	if opts.stdout {
+		err := pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE", Bytes: setup.newCA.Raw})
+		if err != nil {
+			slog.Warn("Failed to write new CA to stdout", "error", err)
+		}
 	} else {
-		fmt.Println("✓ Saved new CA to new-ca.pem for inspection")
+		err := saveCAToFile(setup.newCA, "new-ca.pem")
+		if err != nil {
+			slog.Warn("Failed to save new CA to file", "error", err)
+		} else {
+			slog.Info("Saved new CA for inspection", "file", "new-ca.pem")
+		}
 	}
+	return setup
+}
 
-	// Generate server certificate using the new CA
-	serverCert, serverKey, err := generateServerCert(newCA, newCAKey)
+// loadCAs loads the original CA and regenerates it with critical basic
+// constraints in memory, without recording or saving the new CA or issuing
+// any certificate. Modes only signing what was requested use it directly.
+// It exits on failure.
+func loadCAs(opts caOptions) *caSetup {
+	if opts.minimalDiff && !opts.caSubject.empty() {
+		usageError("-minimal-diff keeps the subject, it cannot be combined with -ca-subject")
+	}
+	leafKey, err := opts.leaf.keySpec()
 	if err != nil {
-		log.Fatalf("Failed to generate server certificate: %v", err)
+		exitWith(exitUsage, "Invalid leaf key", "error", err)
 	}
 
-	fmt.Println("✓ Generated server certificate for localhost")
+	// Load the original CA certificate and key
+	originalCA, originalCAKey, chain, err := opts.load()
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA", "error", err)
+	}
 
-	// Start web server with the new certificate
-	server := startWebServer(serverCert, serverKey)
-	defer server.Close()
+	slog.Info("Loaded original CA certificate and key", "subject", originalCA.Subject.String())
+	if len(chain) > 0 {
+		if opts.includeChain {
+			slog.Info("Loaded additional certificates as CA chain", "count", len(chain))
+		} else {
+			slog.Debug("Ignoring additional certificates in CA file", "count", len(chain))
+			chain = nil
+		}
+	}
 
-	fmt.Println("✓ Web server started on https://localhost:8443")
+	// Check that the original CA doesn't have critical basic constraints
+	err = checkOriginalCABasicConstraints(originalCA)
+	if err != nil {
+		exitWith(exitInvalidCA, "Original CA validation failed", "error", err)
+	}
 
-	// Test client compatibility with both CAs
-	fmt.Println("\n=== Testing CA Compatibility ===")
+	// Generate new CA with critical basic constraints
+	if !opts.caSubject.empty() {
+		slog.Warn("Renaming the regenerated CA, certificates issued by the original CA will not chain to it", "subject", renameCA(originalCA, &opts.caSubject).Subject.String())
+	}
+	newCA, err := opts.regenerateCA(originalCA, originalCAKey)
+	if err != nil {
+		notifyWebhook(webhookEvent{
+			Operation:    "regenerate",
+			Result:       "failure",
+			Error:        err.Error(),
+			Subject:      originalCA.Subject.String(),
+			Fingerprints: map[string]string{"original_ca": sha256Hex(originalCA)},
+		})
+		exitWith(exitRegenerationFailed, "Failed to generate new CA", "error", err)
+	}
 
-	// Test 1: Client with new CA (should succeed)
-	fmt.Println("\nTest 2: Client with new CA")
-	err = testClientCompatibility(newCA, "New CA")
+	slog.Info("Generated new CA with critical basic constraints")
+
+	return &caSetup{
+		originalCA: originalCA,
+		newCA:      newCA,
+		caKey:      originalCAKey,
+		chain:      chain,
+		leafKey:    leafKey,
+		ctLogs:     opts.leaf.ctLogs,
+	}
+}
+
+// regenerate regenerates originalCA like regenerateCA and records the new
+// CA in the audit log and the database.
+func (o *caOptions) regenerate(originalCA *x509.Certificate, key crypto.Signer) (*x509.Certificate, error) {
+	newCA, err := o.regenerateCA(originalCA, key)
 	if err != nil {
-		log.Fatalf("❌ Unexpected failure with new CA: %v", err)
+		return nil, err
+	}
+	if err := recordSigned("regenerate", newCA); err != nil {
+		return nil, err
+	}
+	return newCA, nil
+}
+
+// regenerateCA regenerates originalCA with critical basic constraints,
+// renamed, reproducibly or as minimal diff as selected, and checks the
+// invariants of the result.
+func (o *caOptions) regenerateCA(originalCA *x509.Certificate, key crypto.Signer) (*x509.Certificate, error) {
+	if fipsMode {
+		logFIPSModule()
+	}
+	opts := caregenOptions()
+	if !o.caSubject.empty() {
+		opts = append(opts, caregen.WithSubject(renameCA(originalCA, &o.caSubject).Subject))
+	}
+	if o.pss {
+		opts = append(opts, caregen.WithPSS())
+	}
+	if o.deterministic {
+		opts = append(opts, caregen.WithDeterministic())
+	}
+	if o.minimalDiff {
+		opts = append(opts, caregen.WithMinimalDiff())
+	}
+	if o.invariants.names != nil {
+		opts = append(opts, caregen.WithInvariants(o.invariants.names...))
+	}
+	return caregen.Regenerate(context.Background(), originalCA, key, opts...)
+}
+
+// caregenOptions returns the options shared by every certificate the
+// command creates: the global -fips flag, the serials in use and logging.
+func caregenOptions() []caregen.Option {
+	opts := []caregen.Option{
+		caregen.WithLogger(slog.Default()),
+		caregen.WithSerialInUse(serialInUse),
 	}
+	if fipsMode {
+		opts = append(opts, caregen.WithFIPS())
+	}
+	return opts
+}
 
-	// Test 1: Client with original CA (should fail)
-	fmt.Println("\nTest 1: Client with original CA")
-	err = testClientCompatibility(originalCA, "Original CA")
+// serverCertificate issues the localhost server certificate from the new
+// CA. With -ct-tls it returns the SCTs to send in the TLS extension.
+func (o *caOptions) serverCertificate(ca *x509.Certificate, caKey crypto.Signer) (*x509.Certificate, crypto.Signer, [][]byte, error) {
+	leaf := o.leaf
+	if o.ctTLS {
+		leaf.ctLogs = nil
+	}
+	if o.pss {
+		var err error
+		if caKey, err = x509util.NewPSSSigner(caKey, ca); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	cert, key, err := generateServerCert(ca, caKey, leaf)
+	if err != nil || !o.ctTLS {
+		return cert, key, nil, err
+	}
+	scts, err := o.leaf.ctLogs.submitCertificate(cert, ca)
 	if err != nil {
-		fmt.Printf("❌ Unexpected failure with original CA: %v\n", err)
+		return nil, nil, nil, err
 	}
-	fmt.Println("\n🎉 Success! The regenerated CA with critical basic constraints is compatible with clients using the original CA.")
-	fmt.Println("This demonstrates that changing basic constraints to critical does not break backward compatibility.")
+	return cert, key, scts, nil
 }
 
-func loadCA(certFile, keyFile string) (*x509.Certificate, *rsa.PrivateKey, error) {
-	// Load CA certificate
-	certPEM, err := os.ReadFile(certFile)
+// loadCA loads the CA private key and the certificate matching it. If the
+// certificate file contains several certificates (a chain or bundle), the
+// one whose public key matches the private key is used as the CA and the
+// remaining ones are returned as its chain.
+func loadCA(certFile, keyFile string) (*x509.Certificate, crypto.Signer, []*x509.Certificate, error) {
+	keyPEM, err := readInput(keyFile)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read CA certificate: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to read CA private key: %w", err)
 	}
 
-	block, _ := pem.Decode(certPEM)
-	if block == nil {
-		return nil, nil, fmt.Errorf("failed to decode CA certificate PEM")
+	certPEM, err := readInput(certFile)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read CA certificate: %w", err)
 	}
 
-	caCert, err := x509.ParseCertificate(block.Bytes)
+	return parseCA(certPEM, keyPEM)
+}
+
+// parseCA is the in-memory variant of loadCA for PEM data which does not
+// come from files.
+func parseCA(certPEM, keyPEM []byte) (*x509.Certificate, crypto.Signer, []*x509.Certificate, error) {
+	caKey, err := parsePrivateKey(keyPEM)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse CA certificate: %v", err)
+		return nil, nil, nil, err
 	}
 
-	// Load CA private key
-	keyPEM, err := os.ReadFile(keyFile)
+	cert, chain, err := selectCA(certPEM, caKey.Public())
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read CA private key: %v", err)
+		return nil, nil, nil, err
 	}
+	return cert, caKey, chain, nil
+}
 
-	block, _ = pem.Decode(keyPEM)
+// parsePrivateKey parses the first private key found in keyPEM.
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block := findPEMBlock(keyPEM, "PRIVATE KEY")
 	if block == nil {
-		return nil, nil, fmt.Errorf("failed to decode CA private key PEM")
+		return nil, fmt.Errorf("failed to decode CA private key PEM")
+	}
+	if block.Type == "CERTIFICATE" {
+		return nil, fmt.Errorf("no private key PEM block found")
 	}
 
-	var caKey *rsa.PrivateKey
+	var caKey crypto.Signer
 
 	// Try PKCS#1 first
-	caKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	caKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
-		// Try PKCS#8
+		// Try PKCS#8, then SEC 1 EC keys
 		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to parse CA private key (tried PKCS#1 and PKCS#8): %v", err)
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		}
+		if err != nil {
+			if key, pssErr := x509util.ParsePSSPrivateKey(block.Bytes); pssErr == nil {
+				return key, nil
+			}
+			return nil, fmt.Errorf("failed to parse CA private key (tried PKCS#1, PKCS#8 and SEC 1): %w", err)
 		}
 
-		// Type assert to RSA private key
 		var ok bool
-		caKey, ok = key.(*rsa.PrivateKey)
+		caKey, ok = key.(crypto.Signer)
 		if !ok {
-			return nil, nil, fmt.Errorf("CA private key is not an RSA key")
+			return nil, fmt.Errorf("CA private key of type %T cannot sign", key)
+		}
+	}
+	return caKey, nil
+}
+
+// selectCA parses the certificates in certPEM and returns the one with the
+// given public key along with the remaining certificates.
+func selectCA(certPEM []byte, public crypto.PublicKey) (*x509.Certificate, []*x509.Certificate, error) {
+	// Load CA certificate(s)
+	var block *pem.Block
+	var certs []*x509.Certificate
+	for rest := certPEM; ; {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509util.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		// Fall back to the first block for files using unusual block types
+		block = findPEMBlock(certPEM, "CERTIFICATE")
+		if block == nil {
+			return nil, nil, fmt.Errorf("failed to decode CA certificate PEM")
+		}
+		cert, err := x509util.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse CA certificate: %w", err)
 		}
+		certs = append(certs, cert)
 	}
 
-	return caCert, caKey, nil
+	// Pick the certificate belonging to the private key
+	for i, cert := range certs {
+		if x509util.IsPublicKey(cert.PublicKey, public) {
+			chain := append(certs[:i:i], certs[i+1:]...)
+			return cert, chain, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("%w: none of the %d certificate(s) matches the CA private key", caregen.ErrKeyMismatch, len(certs))
+}
+
+// readInput reads the named file, or stdin if name is "-". Stdin is only
+// read once, so the certificate and the key can both be read from it.
+func readInput(name string) ([]byte, error) {
+	if name != "-" {
+		return os.ReadFile(name)
+	}
+	stdinOnce.Do(func() {
+		stdinData, stdinErr = io.ReadAll(os.Stdin)
+	})
+	return stdinData, stdinErr
+}
+
+var (
+	stdinOnce sync.Once
+	stdinData []byte
+	stdinErr  error
+)
+
+// findPEMBlock returns the first PEM block whose type ends with typeSuffix
+// (so "PRIVATE KEY" matches PKCS#1 and PKCS#8 keys). If there is none, the
+// first block of any type is returned for compatibility with files using
+// unusual block types.
+func findPEMBlock(data []byte, typeSuffix string) *pem.Block {
+	var first *pem.Block
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return first
+		}
+		if strings.HasSuffix(block.Type, typeSuffix) {
+			return block
+		}
+		if first == nil {
+			first = block
+		}
+	}
 }
 
 func checkOriginalCABasicConstraints(ca *x509.Certificate) error {
@@ -150,7 +904,7 @@ func checkOriginalCABasicConstraints(ca *x509.Certificate) error {
 				if ext.Critical {
 					return fmt.Errorf("original CA already has critical basic constraints - this test requires a CA with non-critical basic constraints")
 				} else {
-					fmt.Println("✓ Verified: Original CA has non-critical basic constraints")
+					slog.Info("Verified: Original CA has non-critical basic constraints")
 					return nil
 				}
 			}
@@ -158,134 +912,120 @@ func checkOriginalCABasicConstraints(ca *x509.Certificate) error {
 	}
 
 	// If no basic constraints extension found, that's also acceptable
-	fmt.Println("✓ Verified: Original CA has no basic constraints extension (non-critical)")
+	slog.Info("Verified: Original CA has no basic constraints extension (non-critical)")
 	return nil
 }
 
-func generateNewCA(originalCA *x509.Certificate, originalCAKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey, error) {
-	// Create a new CA certificate identical to the original except for critical basic constraints
-	// Use the same serial number as the original
-	newCATemplate := &x509.Certificate{
-		SerialNumber:          originalCA.SerialNumber,
-		RawSubject:            originalCA.RawSubject,
-		NotBefore:             originalCA.NotBefore,
-		NotAfter:              originalCA.NotAfter,
-		IsCA:                  true,
-		ExtKeyUsage:           originalCA.ExtKeyUsage,
-		KeyUsage:              originalCA.KeyUsage | x509.KeyUsageCertSign | x509.KeyUsageDataEncipherment | x509.KeyUsageDigitalSignature,
-		BasicConstraintsValid: true,
-		// Copy other relevant fields from original CA
-		Issuer:             originalCA.Issuer,
-		SignatureAlgorithm: originalCA.SignatureAlgorithm,
-		PublicKeyAlgorithm: originalCA.PublicKeyAlgorithm,
-		AuthorityKeyId:     originalCA.AuthorityKeyId,
-		SubjectKeyId:       originalCA.SubjectKeyId,
-	}
-
-	// Create the new CA certificate (self-signed)
-	newCABytes, err := x509.CreateCertificate(rand.Reader, newCATemplate, newCATemplate, &originalCAKey.PublicKey, originalCAKey)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create new CA certificate: %v", err)
-	}
-
-	newCA, err := x509.ParseCertificate(newCABytes)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse new CA certificate: %v", err)
-	}
-
-	// Verify that the basic constraints are critical
-	if len(newCA.Extensions) > 0 {
-		for _, ext := range newCA.Extensions {
-			if len(ext.Id) == 4 && ext.Id[0] == 2 && ext.Id[1] == 5 && ext.Id[2] == 29 && ext.Id[3] == 19 {
-				// This is the basicConstraints extension
-				if ext.Critical {
-					fmt.Println("✓ Verified: Basic constraints are critical in the new CA")
-				} else {
-					fmt.Println("⚠ Warning: Basic constraints are not critical in the new CA")
-				}
-				break
-			}
-		}
-	}
+// renameCA returns a copy of ca with the subject attributes of subject
+// replaced, to be regenerated under the new name.
+func renameCA(ca *x509.Certificate, subject *subjectFlag) *x509.Certificate {
+	renamed := *ca
+	subject.apply(&renamed.Subject)
+	// The subject is encoded from the fields without the raw subject
+	renamed.RawSubject = nil
+	return &renamed
+}
 
-	return newCA, originalCAKey, nil
+func generateServerCert(ca *x509.Certificate, caKey crypto.Signer, leaf leafOptions) (*x509.Certificate, crypto.Signer, error) {
+	// The loopback addresses allow testing via each IP family
+	return issueServerCert(ca, caKey, []string{"localhost", "127.0.0.1", "::1"}, leaf)
 }
 
-func generateServerCert(ca *x509.Certificate, caKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey, error) {
-	// Generate RSA key pair for server
-	serverKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// issueServerCert issues a server certificate for the given DNS names and
+// IP addresses with a new key. The usages can be overridden by leaf.
+func issueServerCert(ca *x509.Certificate, caKey crypto.Signer, names []string, leaf leafOptions) (*x509.Certificate, crypto.Signer, error) {
+	// Generate the key pair for the server, RSA 2048 unless selected
+	spec, err := leaf.keySpec()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to generate server key: %v", err)
+		return nil, nil, err
 	}
-
-	// Create server certificate template
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	serverKey, err := spec.or(keyTypes["rsa2048"]).generate()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to generate serial number: %v", err)
+		return nil, nil, fmt.Errorf("failed to generate server key: %w", err)
 	}
 
+	// Create server certificate template
 	serverTemplate := &x509.Certificate{
-		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			CommonName: "localhost",
+			CommonName: names[0],
 		},
-		DNSNames:    []string{"localhost"},
-		NotBefore:   time.Now(),
-		NotAfter:    time.Now().AddDate(1, 0, 0), // 1 year validity
+		NotBefore:   now.Now(),
+		NotAfter:    now.Now().AddDate(1, 0, 0), // 1 year validity by default
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
 	}
-
-	// Create the server certificate
-	serverCertBytes, err := x509.CreateCertificate(rand.Reader, serverTemplate, ca, &serverKey.PublicKey, caKey)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create server certificate: %v", err)
+	// Only RSA keys are used for key transport
+	if _, ok := serverKey.Public().(*rsa.PublicKey); ok {
+		serverTemplate.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			serverTemplate.IPAddresses = append(serverTemplate.IPAddresses, ip)
+		} else {
+			serverTemplate.DNSNames = append(serverTemplate.DNSNames, name)
+		}
+	}
+	leaf.apply(serverTemplate)
+	if leaf.validity > 0 {
+		serverTemplate.NotAfter = serverTemplate.NotBefore.Add(leaf.validity)
 	}
 
-	serverCert, err := x509.ParseCertificate(serverCertBytes)
+	// Create the server certificate
+	serverCert, err := signCertificate(ca, caKey, serverTemplate, serverKey.Public(), leaf.ctLogs)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse server certificate: %v", err)
+		return nil, nil, fmt.Errorf("failed to create server certificate: %w", err)
 	}
 
 	return serverCert, serverKey, nil
 }
 
-func startWebServer(cert *x509.Certificate, key *rsa.PrivateKey) *http.Server {
-	// Create TLS certificate
-	tlsCert := tls.Certificate{
-		Certificate: [][]byte{cert.Raw},
-		PrivateKey:  key,
+// issueClientCert signs a client certificate for the CSR of an enrollment
+// protocol. Subject and SANs are taken from the CSR as is.
+func issueClientCert(ca *x509.Certificate, caKey crypto.Signer, csr *x509.CertificateRequest, validity time.Duration) (*x509.Certificate, error) {
+	profile := certProfile{
+		keyUsage:    x509.KeyUsageDigitalSignature,
+		rsaKeyUsage: x509.KeyUsageKeyEncipherment,
+		extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		expiry:      validity,
 	}
+	return issueFromCSR(ca, caKey, csr, profile)
+}
 
-	// Configure TLS
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-	}
+func startWebServer(tlsConfig *tls.Config) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("Hello from regenerated CA server!"))
+	})
+	mux.HandleFunc(webSocketPath, handleWebSocket)
 
 	// Create server
 	server := &http.Server{
 		Addr:      ":8443",
 		TLSConfig: tlsConfig,
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "text/plain")
-			w.Write([]byte("Hello from regenerated CA server!"))
-		}),
+		Handler:   mux,
+		ErrorLog:  serverErrorLog(),
 	}
 
-	// Start server in goroutine
+	listeners, err := listenTestServer(server.Addr)
+	if err != nil {
+		fatal("Failed to start web server", "addr", server.Addr, "error", err)
+	}
+	errc, err := startServer(server, listeners...)
+	if err != nil {
+		fatal("Failed to start web server", "addr", server.Addr, "error", err)
+	}
 	go func() {
-		if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
-			log.Printf("Server error: %v", err)
+		if err := <-errc; err != http.ErrServerClosed {
+			slog.Error("Server error", "error", err)
 		}
 	}()
-
-	// Give server time to start
-	time.Sleep(100 * time.Millisecond)
-
 	return server
 }
 
-func testClientCompatibility(ca *x509.Certificate, caName string) error {
+// testClientCompatibility requests the web server trusting only ca. With CT
+// logs the SCTs received are verified and summarized.
+func testClientCompatibility(network string, ca *x509.Certificate, caName string, logs ctLogList, requireSCT bool) (string, error) {
 	// Create a certificate pool with the specified CA
 	caPool := x509.NewCertPool()
 	caPool.AddCert(ca)
@@ -293,32 +1033,49 @@ func testClientCompatibility(ca *x509.Certificate, caName string) error {
 	// Configure TLS client
 	tlsConfig := &tls.Config{
 		RootCAs: caPool,
+		Time:    now.Now,
+	}
+	if aiaFetch {
+		// Verified like by browsers instead
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = aiaVerifyConnection(caPool, testHostname(network), caName)
 	}
 
 	// Create HTTP client
 	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
-		Timeout: 10 * time.Second,
+		Transport: testTransport(network, tlsConfig),
+		Timeout:   10 * time.Second,
 	}
 
 	// Make request to the server
-	resp, err := client.Get("https://localhost:8443")
+	resp, err := client.Get(testURL(network))
 	if err != nil {
-		return fmt.Errorf("client request failed: %v", err)
+		return "", fmt.Errorf("client request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Read response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %v", err)
+		return "", fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	fmt.Printf("✓ Client received response: %s\n", string(body))
+	logArgs := []any{"ca", caName, "body", string(body)}
+	if family := networkName(network); family != "" {
+		logArgs = append(logArgs, "ip_family", family)
+	}
+	slog.Info("Client received response", logArgs...)
 
-	return nil
+	// Verify the SCTs, if CT logs are configured
+	if len(logs) == 0 {
+		return "", nil
+	}
+	scts, err := logs.checkSCTs(resp.TLS, requireSCT)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("Verified SCTs", "ca", caName, "scts", scts)
+	return scts, nil
 }
 
 func saveCAToFile(cert *x509.Certificate, filename string) error {
@@ -331,7 +1088,7 @@ func saveCAToFile(cert *x509.Certificate, filename string) error {
 	// Write to file
 	err := os.WriteFile(filename, pem.EncodeToMemory(block), 0644)
 	if err != nil {
-		return fmt.Errorf("failed to write CA certificate to file: %v", err)
+		return fmt.Errorf("failed to write CA certificate to file: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// mobileConfigTemplate is an unsigned Apple configuration profile with a
+// single certificate payload. iOS asks to trust a root CA from a profile
+// explicitly in Settings > General > About > Certificate Trust Settings.
+var mobileConfigTemplate = template.Must(template.New("mobileconfig").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>{{.FileName | xml}}</string>
+			<key>PayloadContent</key>
+			<data>{{.Certificate}}</data>
+			<key>PayloadDescription</key>
+			<string>Adds the CA certificate {{.Subject | xml}}</string>
+			<key>PayloadDisplayName</key>
+			<string>{{.Name | xml}}</string>
+			<key>PayloadIdentifier</key>
+			<string>{{.Identifier | xml}}.certificate</string>
+			<key>PayloadType</key>
+			<string>{{.PayloadType}}</string>
+			<key>PayloadUUID</key>
+			<string>{{.CertificateUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDescription</key>
+	<string>Installs the CA certificate {{.Subject | xml}} for testing</string>
+	<key>PayloadDisplayName</key>
+	<string>{{.Name | xml}}</string>
+	<key>PayloadIdentifier</key>
+	<string>{{.Identifier | xml}}</string>
+{{- if .Organization}}
+	<key>PayloadOrganization</key>
+	<string>{{.Organization | xml}}</string>
+{{- end}}
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.ProfileUUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+// Writes the regenerated CA as an unsigned Apple configuration profile
+// for iOS and macOS and as DER file for Android, to distribute it to
+// mobile test devices, e.g. by mail or a download link.
+func runMobileProfile(args []string) {
+	fs := flag.NewFlagSet("mobile-profile", flag.ContinueOnError)
+	outDir := fs.String("out-dir", ".", "Directory to write the profile and the DER file to")
+	name := fs.String("name", "", "Display name of the profile (default the common name of the CA)")
+	identifier := fs.String("identifier", "", "Reverse-DNS identifier of the profile, a profile with the same identifier is replaced on install (default ca-regen.<serial>)")
+	organization := fs.String("organization", "", "Organization shown for the profile")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if fs.NArg() > 1 {
+		usageError("go run *.go mobile-profile [-out-dir .] [-name name] [-identifier com.example.ca] [-organization org] [new-ca.pem]")
+	}
+	file := "new-ca.pem"
+	if fs.NArg() == 1 {
+		file = fs.Arg(0)
+	}
+	certs, err := loadCertificates(file)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA certificate", "file", file, "error", err)
+	}
+	cert := certs[0]
+	if !cert.IsCA {
+		exitWith(exitInvalidCA, "Certificate is not a CA", "file", file, "subject", cert.Subject.String())
+	}
+
+	// The serial is kept by the regeneration, so installing the profile of
+	// the regenerated CA replaces the one of the original
+	if *identifier == "" {
+		*identifier = "ca-regen." + hex.EncodeToString(cert.SerialNumber.Bytes())
+	}
+	if *name == "" {
+		*name = cert.Subject.CommonName
+	}
+	if *name == "" {
+		*name = cert.Subject.String()
+	}
+	base := profileFileName(*name)
+
+	// Android only offers files ending in .crt or .cer for import as CA
+	// certificate
+	derFile := filepath.Join(*outDir, base+".crt")
+	if err := os.WriteFile(derFile, cert.Raw, 0644); err != nil {
+		fatal("Failed to write DER file", "error", err)
+	}
+	slog.Info("Wrote DER encoded CA for Android", "file", derFile)
+
+	payloadType := "com.apple.security.root"
+	if !isSelfSigned(cert) {
+		payloadType = "com.apple.security.pkcs1"
+	}
+	var profile bytes.Buffer
+	err = mobileConfigTemplate.Execute(&profile, map[string]string{
+		"FileName":        base + ".crt",
+		"Certificate":     base64.StdEncoding.EncodeToString(cert.Raw),
+		"Subject":         cert.Subject.String(),
+		"Name":            *name,
+		"Identifier":      *identifier,
+		"Organization":    *organization,
+		"PayloadType":     payloadType,
+		"CertificateUUID": profileUUID(*identifier + ".certificate"),
+		"ProfileUUID":     profileUUID(*identifier),
+	})
+	if err != nil {
+		fatal("Failed to render configuration profile", "error", err)
+	}
+	profileFile := filepath.Join(*outDir, base+".mobileconfig")
+	if err := os.WriteFile(profileFile, profile.Bytes(), 0644); err != nil {
+		fatal("Failed to write configuration profile", "error", err)
+	}
+	slog.Info("Wrote unsigned Apple configuration profile", "file", profileFile, "identifier", *identifier)
+}
+
+// profileFileName returns name reduced to lower case letters, digits and
+// dashes.
+func profileFileName(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	if fileName := strings.TrimSuffix(b.String(), "-"); fileName != "" {
+		return fileName
+	}
+	return "ca"
+}
+
+// profileUUID derives a UUID from seed (like a version 5 UUID, but with
+// SHA-256), so the profile of the same CA is byte-identical every time.
+func profileUUID(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	return strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16]))
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
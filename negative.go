@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// errCertificateRevoked is returned by the test client for a server
+// certificate listed on the CRL of its scenario.
+var errCertificateRevoked = errors.New("certificate revoked")
+
+// negativeScenario is a deliberately broken server certificate, which
+// clients trusting either CA must reject for the expected reason.
+type negativeScenario struct {
+	name  string
+	chain []*x509.Certificate
+	key   crypto.Signer
+	// crl is checked by the client if set, as Go's TLS client does not
+	// check revocation on its own.
+	crl *x509.RevocationList
+	// expected describes the expected error, matches checks it.
+	expected string
+	matches  func(err error) bool
+}
+
+// runNegativeTests serves every negative scenario and checks that clients
+// trusting the new and the original CA fail with the expected error. A
+// test fails if the client accepts the certificate or rejects it for
+// another reason.
+func runNegativeTests(setup *caSetup) []compatResult {
+	scenarios, err := negativeScenarios(setup)
+	if err != nil {
+		return []compatResult{{CA: "New CA", Client: "Negative scenarios", Err: err}}
+	}
+
+	cas := []struct {
+		name string
+		cert *x509.Certificate
+	}{
+		{"New CA", setup.newCA},
+		{"Original CA", setup.originalCA},
+	}
+	var results []compatResult
+	for _, scenario := range scenarios {
+		addr, stop, err := serveNegativeScenario(scenario)
+		if err != nil {
+			results = append(results, compatResult{CA: "New CA", Client: "Rejects " + scenario.name, Err: err})
+			continue
+		}
+		for _, ca := range cas {
+			start := time.Now()
+			err := testNegativeScenario(addr, ca.cert, scenario)
+			if err != nil {
+				slog.Error("Negative test failed", "ca", ca.name, "scenario", scenario.name, "error", err)
+			} else {
+				slog.Info("Client rejected broken certificate as expected", "ca", ca.name, "scenario", scenario.name)
+			}
+			results = append(results, compatResult{
+				CA:       ca.name,
+				Client:   "Rejects " + scenario.name,
+				Duration: time.Since(start).Round(time.Microsecond),
+				Err:      err,
+			})
+		}
+		stop()
+	}
+	return results
+}
+
+// negativeScenarios issues the broken server certificates from the
+// regenerated CA.
+func negativeScenarios(setup *caSetup) ([]negativeScenario, error) {
+	issue := func(ca *x509.Certificate, caKey crypto.Signer, name string, notAfter time.Time, isCA bool) (*x509.Certificate, crypto.Signer, error) {
+		key, err := setup.leafKey.or(keyTypes["p256"]).generate()
+		if err != nil {
+			return nil, nil, err
+		}
+		template := &x509.Certificate{
+			Subject:   pkix.Name{CommonName: name},
+			NotBefore: now.Now().Add(-48 * time.Hour),
+			NotAfter:  notAfter,
+		}
+		if isCA {
+			template.IsCA, template.BasicConstraintsValid = true, true
+			template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		} else {
+			template.DNSNames = []string{name}
+			template.KeyUsage = x509.KeyUsageDigitalSignature
+			template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		}
+		cert, err := signCertificate(ca, caKey, template, key.Public(), nil)
+		return cert, key, err
+	}
+	valid := now.Now().Add(24 * time.Hour)
+	isUnknownAuthority := func(err error) bool {
+		var target x509.UnknownAuthorityError
+		return errors.As(err, &target)
+	}
+	var scenarios []negativeScenario
+
+	expired, expiredKey, err := issue(setup.newCA, setup.caKey, "localhost", now.Now().Add(-24*time.Hour), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue expired certificate: %w", err)
+	}
+	scenarios = append(scenarios, negativeScenario{
+		name: "expired leaf", chain: []*x509.Certificate{expired}, key: expiredKey,
+		expected: "certificate has expired",
+		matches: func(err error) bool {
+			var target x509.CertificateInvalidError
+			return errors.As(err, &target) && target.Reason == x509.Expired
+		},
+	})
+
+	wrongHost, wrongHostKey, err := issue(setup.newCA, setup.caKey, "wrong-host.example.com", valid, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate for wrong host: %w", err)
+	}
+	scenarios = append(scenarios, negativeScenario{
+		name: "hostname mismatch", chain: []*x509.Certificate{wrongHost}, key: wrongHostKey,
+		expected: "certificate is not valid for localhost",
+		matches: func(err error) bool {
+			var target x509.HostnameError
+			return errors.As(err, &target)
+		},
+	})
+
+	intermediate, intermediateKey, err := issue(setup.newCA, setup.caKey, "Negative Test Intermediate CA", valid, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue intermediate CA: %w", err)
+	}
+	orphan, orphanKey, err := issue(intermediate, intermediateKey, "localhost", valid, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate from intermediate CA: %w", err)
+	}
+	scenarios = append(scenarios, negativeScenario{
+		name: "missing intermediate", chain: []*x509.Certificate{orphan}, key: orphanKey,
+		expected: "certificate signed by unknown authority", matches: isUnknownAuthority,
+	})
+
+	untrustedKey, err := setup.leafKey.or(keyTypes["p256"]).generate()
+	if err != nil {
+		return nil, err
+	}
+	untrustedCA, err := rekeyedCA(&x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "Untrusted Test CA"}, NotBefore: now.Now().Add(-time.Hour), NotAfter: valid}, untrustedKey)
+	if err != nil {
+		return nil, err
+	}
+	untrusted, untrustedLeafKey, err := issue(untrustedCA, untrustedKey, "localhost", valid, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate from untrusted CA: %w", err)
+	}
+	scenarios = append(scenarios, negativeScenario{
+		name: "untrusted CA", chain: []*x509.Certificate{untrusted}, key: untrustedLeafKey,
+		expected: "certificate signed by unknown authority", matches: isUnknownAuthority,
+	})
+
+	revoked, revokedKey, err := issue(setup.newCA, setup.caKey, "localhost", valid, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue revoked certificate: %w", err)
+	}
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now.Now().Add(-time.Hour),
+		NextUpdate: valid,
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: revoked.SerialNumber, RevocationTime: now.Now().Add(-time.Hour)},
+		},
+	}, setup.newCA, setup.caKey)
+	if err != nil {
+		// E.g. the keyUsage of the CA does not include cRLSign
+		slog.Warn("Skipping revoked certificate scenario, the regenerated CA cannot sign a CRL", "error", err)
+		return scenarios, nil
+	}
+	crl, err := x509.ParseRevocationList(crlDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CRL: %w", err)
+	}
+	scenarios = append(scenarios, negativeScenario{
+		name: "revoked certificate", chain: []*x509.Certificate{revoked}, key: revokedKey, crl: crl,
+		expected: errCertificateRevoked.Error(),
+		matches:  func(err error) bool { return errors.Is(err, errCertificateRevoked) },
+	})
+	return scenarios, nil
+}
+
+// serveNegativeScenario serves the certificate of scenario on a random
+// local port, completing handshakes only.
+func serveNegativeScenario(scenario negativeScenario) (string, func(), error) {
+	tlsCert := tls.Certificate{PrivateKey: scenario.key, Leaf: scenario.chain[0]}
+	for _, cert := range scenario.chain {
+		tlsCert.Certificate = append(tlsCert.Certificate, cert.Raw)
+	}
+	listener, err := tls.Listen("tcp", "localhost:0", &tls.Config{Certificates: []tls.Certificate{tlsCert}})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start server: %w", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }, nil
+}
+
+// testNegativeScenario connects to addr trusting ca and returns an error
+// unless the handshake fails as expected by scenario.
+func testNegativeScenario(addr string, ca *x509.Certificate, scenario negativeScenario) error {
+	config := handshakeConfig(ca)
+	if scenario.crl != nil {
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return checkRevocation(state, scenario.crl)
+		}
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, config)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("client accepted the broken certificate, expected %q", scenario.expected)
+	}
+	if !scenario.matches(err) {
+		return fmt.Errorf("client rejected the certificate for an unexpected reason, expected %q: %w", scenario.expected, err)
+	}
+	slog.Debug("Client rejected certificate", "scenario", scenario.name, "error", err)
+	return nil
+}
+
+// checkRevocation checks the verified chain of state against crl, which
+// must be signed by the issuer of the server certificate.
+func checkRevocation(state tls.ConnectionState, crl *x509.RevocationList) error {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) < 2 {
+		return nil
+	}
+	leaf, issuer := state.VerifiedChains[0][0], state.VerifiedChains[0][1]
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return fmt.Errorf("invalid CRL: %w", err)
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			return fmt.Errorf("%w: serial %s since %s", errCertificateRevoked, x509util.FormatHex(leaf.SerialNumber.Bytes()), entry.RevocationTime.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// nssProfileDirs are the globs of the NSS databases of Chromium (which on
+// Linux uses NSS instead of the system store) and of Firefox profiles,
+// relative to the home directory.
+var nssProfileDirs = map[string][]string{
+	"linux": {
+		".pki/nssdb",
+		"snap/chromium/current/.pki/nssdb",
+		".mozilla/firefox/*",
+		"snap/firefox/common/.mozilla/firefox/*",
+		".var/app/org.mozilla.firefox/.mozilla/firefox/*",
+	},
+	"darwin": {
+		"Library/Application Support/Firefox/Profiles/*",
+	},
+}
+
+// nssCertutils are the usual install locations of the NSS certutil on
+// macOS, where it is not in the PATH.
+var nssCertutils = []string{
+	"/opt/homebrew/opt/nss/bin/certutil",
+	"/usr/local/opt/nss/bin/certutil",
+}
+
+// nssTrustStore is the set of NSS databases of the user, updated with the
+// certutil of NSS (not the certutil of Windows).
+type nssTrustStore struct {
+	certutil string
+	// dbs are the databases with their prefix, sql: for cert9.db and dbm:
+	// for the legacy cert8.db.
+	dbs []string
+}
+
+// findNSSTrustStore returns the NSS databases of the current user.
+func findNSSTrustStore(certutil string) (trustStore, error) {
+	dirs, ok := nssProfileDirs[runtime.GOOS]
+	if !ok {
+		return nil, fmt.Errorf("NSS databases on %s are not supported", runtime.GOOS)
+	}
+	if certutil == "" {
+		certutil = "certutil"
+		if runtime.GOOS == "darwin" {
+			for _, path := range nssCertutils {
+				if _, err := os.Stat(path); err == nil {
+					certutil = path
+					break
+				}
+			}
+		}
+	}
+	if _, err := exec.LookPath(certutil); err != nil {
+		return nil, fmt.Errorf("NSS certutil not found, install nss-tools (libnss3-tools on Debian) or Homebrew's nss: %w", err)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	store := nssTrustStore{certutil: certutil}
+	for _, dir := range dirs {
+		matches, _ := filepath.Glob(filepath.Join(home, dir))
+		for _, match := range matches {
+			if _, err := os.Stat(filepath.Join(match, "cert9.db")); err == nil {
+				store.dbs = append(store.dbs, "sql:"+match)
+			} else if _, err := os.Stat(filepath.Join(match, "cert8.db")); err == nil {
+				store.dbs = append(store.dbs, "dbm:"+match)
+			}
+		}
+	}
+	if len(store.dbs) == 0 {
+		return nil, fmt.Errorf("no NSS database of Firefox or Chromium found in %s, start the browser once to create it", home)
+	}
+	return store, nil
+}
+
+func (s nssTrustStore) name() string {
+	return fmt.Sprintf("NSS (%d databases)", len(s.dbs))
+}
+
+// install adds cert to every database as trusted CA for TLS servers.
+func (s nssTrustStore) install(cert *x509.Certificate, name string) error {
+	file, cleanup, err := writeTempCert(cert, name)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	var errs []error
+	for _, db := range s.dbs {
+		if err := s.run("-A", "-d", db, "-t", "C,,", "-n", name, "-i", file); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		slog.Debug("Installed CA into NSS database", "db", db)
+	}
+	return errors.Join(errs...)
+}
+
+// uninstall deletes the certificate with name from every database having
+// it.
+func (s nssTrustStore) uninstall(_ *x509.Certificate, name string) error {
+	var errs []error
+	for _, db := range s.dbs {
+		if s.run("-L", "-d", db, "-n", name) != nil {
+			continue
+		}
+		if err := s.run("-D", "-d", db, "-n", name); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		slog.Debug("Removed CA from NSS database", "db", db)
+	}
+	return errors.Join(errs...)
+}
+
+func (s nssTrustStore) run(args ...string) error {
+	out, err := exec.Command(s.certutil, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("certutil %s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+var (
+	oidOCSPBasic   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidOCSPNonce   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+	oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+	oidSHA1        = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+)
+
+// hashOIDs are the OIDs of the hashes of RSA-PSS signatures.
+var hashOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA256: x509util.OIDSHA256,
+	crypto.SHA384: x509util.OIDSHA384,
+	crypto.SHA512: x509util.OIDSHA512,
+}
+
+type ocspResponse struct {
+	Status asn1.Enumerated
+	Bytes  ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	Type     asn1.ObjectIdentifier
+	Response []byte
+}
+
+type ocspBasicResponse struct {
+	TBS       asn1.RawValue
+	Algorithm pkix.AlgorithmIdentifier
+	Signature asn1.BitString
+	Certs     []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int `asn1:"optional,explicit,tag:0,default:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+	Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Status     asn1.RawValue
+	ThisUpdate time.Time `asn1:"generalized"`
+	NextUpdate time.Time `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspStatus is the status of a certificate in an OCSP response.
+type ocspStatus struct {
+	serial *big.Int
+	// revokedAt is zero if the certificate is good.
+	revokedAt time.Time
+	reason    int
+	// unknown is set if the responder does not know the certificate.
+	unknown bool
+}
+
+// createOCSPResponse returns a successful OCSP response (RFC 6960) with
+// the status of a certificate of issuer, signed by responder with key.
+// The responder is the issuer or a delegated responder issued by it,
+// which is included in the response. A nonce of the request is echoed
+// unless nil.
+func createOCSPResponse(issuer *x509.Certificate, status ocspStatus, responder *x509.Certificate, key crypto.Signer, thisUpdate, nextUpdate time.Time, nonce []byte) ([]byte, error) {
+	issuerKeyHash, err := publicKeyHash(issuer)
+	if err != nil {
+		return nil, err
+	}
+	responderKeyHash, err := publicKeyHash(responder)
+	if err != nil {
+		return nil, err
+	}
+	issuerNameHash := sha1.Sum(issuer.RawSubject)
+
+	certStatus := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0}
+	if status.unknown {
+		certStatus.Tag = 2
+	} else if !status.revokedAt.IsZero() {
+		der, err := asn1.Marshal(ocspRevokedInfo{RevocationTime: status.revokedAt.UTC(), Reason: asn1.Enumerated(status.reason)})
+		if err != nil {
+			return nil, err
+		}
+		var info asn1.RawValue
+		if _, err := asn1.Unmarshal(der, &info); err != nil {
+			return nil, err
+		}
+		// revoked [1] IMPLICIT RevokedInfo
+		certStatus = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: info.Bytes}
+	}
+	keyHash, err := asn1.Marshal(responderKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	data := ocspResponseData{
+		// byKey [2] EXPLICIT KeyHash
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyHash},
+		ProducedAt:  now.Now().UTC().Truncate(time.Second),
+		Responses: []ocspSingleResponse{{
+			CertID: ocspCertID{
+				HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				IssuerNameHash: issuerNameHash[:],
+				IssuerKeyHash:  issuerKeyHash,
+				SerialNumber:   status.serial,
+			},
+			Status:     certStatus,
+			ThisUpdate: thisUpdate.UTC().Truncate(time.Second),
+			NextUpdate: nextUpdate.UTC().Truncate(time.Second),
+		}},
+	}
+	if nonce != nil {
+		data.Extensions = []pkix.Extension{{Id: oidOCSPNonce, Value: nonce}}
+	}
+	tbs, err := asn1.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm := x509util.SignatureAlgorithmFor(key, defaultSignatureAlgorithm(key.Public()))
+	identifier, err := signatureAlgorithmIdentifier(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signData(key, algorithm, tbs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign OCSP response: %w", err)
+	}
+	basic := ocspBasicResponse{
+		TBS:       asn1.RawValue{FullBytes: tbs},
+		Algorithm: identifier,
+		Signature: asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	}
+	if responder != issuer {
+		basic.Certs = []asn1.RawValue{{FullBytes: responder.Raw}}
+	}
+	basicDER, err := asn1.Marshal(basic)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ocspResponse{Bytes: ocspResponseBytes{Type: oidOCSPBasic, Response: basicDER}})
+}
+
+// publicKeyHash returns the SHA-1 hash of the public key of cert, without
+// the algorithm, as used to identify issuers and responders in OCSP.
+func publicKeyHash(cert *x509.Certificate) ([]byte, error) {
+	var spki x509util.SubjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return sum[:], nil
+}
+
+// defaultSignatureAlgorithm returns the algorithm Go signs with by default
+// with keys of the type of pub.
+func defaultSignatureAlgorithm(pub crypto.PublicKey) x509.SignatureAlgorithm {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P384():
+			return x509.ECDSAWithSHA384
+		case elliptic.P521():
+			return x509.ECDSAWithSHA512
+		}
+		return x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		return x509.PureEd25519
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// signatureAlgorithmIdentifier returns the AlgorithmIdentifier of
+// algorithm, encoded the way Go encodes it in certificates.
+func signatureAlgorithmIdentifier(algorithm x509.SignatureAlgorithm) (pkix.AlgorithmIdentifier, error) {
+	switch algorithm {
+	case x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS:
+		hash := pkix.AlgorithmIdentifier{Algorithm: hashOIDs[x509util.SignatureAlgorithmHashes[algorithm]], Parameters: asn1.NullRawValue}
+		hashDER, err := asn1.Marshal(hash)
+		if err != nil {
+			return pkix.AlgorithmIdentifier{}, err
+		}
+		params, err := asn1.Marshal(struct {
+			Hash       pkix.AlgorithmIdentifier `asn1:"explicit,tag:0"`
+			MGF        pkix.AlgorithmIdentifier `asn1:"explicit,tag:1"`
+			SaltLength int                      `asn1:"explicit,tag:2"`
+		}{hash, pkix.AlgorithmIdentifier{Algorithm: x509util.OIDMGF1, Parameters: asn1.RawValue{FullBytes: hashDER}}, x509util.SignatureAlgorithmHashes[algorithm].Size()})
+		if err != nil {
+			return pkix.AlgorithmIdentifier{}, err
+		}
+		return pkix.AlgorithmIdentifier{Algorithm: x509util.OIDRSASSAPSS, Parameters: asn1.RawValue{FullBytes: params}}, nil
+	}
+	for _, a := range cmpSignatureAlgorithms {
+		if a.algorithm != algorithm {
+			continue
+		}
+		identifier := pkix.AlgorithmIdentifier{Algorithm: a.oid}
+		switch algorithm {
+		case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA:
+			identifier.Parameters = asn1.NullRawValue
+		}
+		return identifier, nil
+	}
+	return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported signature algorithm %s", algorithm)
+}
+
+// signData signs data with key using algorithm.
+func signData(key crypto.Signer, algorithm x509.SignatureAlgorithm, data []byte) ([]byte, error) {
+	hash := x509util.SignatureAlgorithmHashes[algorithm]
+	var opts crypto.SignerOpts = hash
+	switch algorithm {
+	case x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS:
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}
+	}
+	digest := data
+	if hash != 0 {
+		h := hash.New()
+		h.Write(data)
+		digest = h.Sum(nil)
+	}
+	return key.Sign(rand.Reader, digest, opts)
+}
+
+// verifyOCSPResponse checks that der is a valid OCSP response for cert,
+// signed by issuer or a delegated responder issued by it, and returns
+// the status of cert.
+func verifyOCSPResponse(der []byte, issuer, cert *x509.Certificate) (ocspStatus, error) {
+	var status ocspStatus
+	var response ocspResponse
+	if rest, err := asn1.Unmarshal(der, &response); err != nil || len(rest) > 0 {
+		return status, fmt.Errorf("invalid OCSP response")
+	}
+	if response.Status != 0 {
+		return status, fmt.Errorf("OCSP response status %d", response.Status)
+	}
+	if !response.Bytes.Type.Equal(oidOCSPBasic) {
+		return status, fmt.Errorf("unsupported OCSP response type %s", response.Bytes.Type)
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(response.Bytes.Response, &basic); err != nil {
+		return status, fmt.Errorf("invalid basic OCSP response: %w", err)
+	}
+	var data ocspResponseData
+	if _, err := asn1.Unmarshal(basic.TBS.FullBytes, &data); err != nil {
+		return status, fmt.Errorf("invalid OCSP response data: %w", err)
+	}
+
+	responder := issuer
+	if len(basic.Certs) > 0 {
+		var err error
+		if responder, err = x509.ParseCertificate(basic.Certs[0].FullBytes); err != nil {
+			return status, fmt.Errorf("invalid OCSP responder certificate: %w", err)
+		}
+		if err := responder.CheckSignatureFrom(issuer); err != nil {
+			return status, fmt.Errorf("OCSP responder certificate is not issued by %s: %w", issuer.Subject, err)
+		}
+		if len(responder.ExtKeyUsage) != 1 || responder.ExtKeyUsage[0] != x509.ExtKeyUsageOCSPSigning {
+			return status, fmt.Errorf("OCSP responder certificate is not restricted to OCSP signing")
+		}
+	}
+	algorithm, err := signatureAlgorithmOf(basic.Algorithm)
+	if err != nil {
+		return status, err
+	}
+	if err := responder.CheckSignature(algorithm, basic.TBS.FullBytes, basic.Signature.RightAlign()); err != nil {
+		return status, fmt.Errorf("invalid OCSP response signature: %w", err)
+	}
+
+	issuerKeyHash, err := publicKeyHash(issuer)
+	if err != nil {
+		return status, err
+	}
+	issuerNameHash := sha1.Sum(issuer.RawSubject)
+	for _, single := range data.Responses {
+		id := single.CertID
+		if !id.HashAlgorithm.Algorithm.Equal(oidSHA1) || id.SerialNumber.Cmp(cert.SerialNumber) != 0 ||
+			!bytes.Equal(id.IssuerNameHash, issuerNameHash[:]) || !bytes.Equal(id.IssuerKeyHash, issuerKeyHash) {
+			continue
+		}
+		if t := now.Now(); t.Before(single.ThisUpdate) || (!single.NextUpdate.IsZero() && t.After(single.NextUpdate)) {
+			return status, fmt.Errorf("OCSP response is only valid from %s to %s", single.ThisUpdate, single.NextUpdate)
+		}
+		status.serial = id.SerialNumber
+		switch {
+		case single.Status.Class == asn1.ClassContextSpecific && single.Status.Tag == 0:
+		case single.Status.Class == asn1.ClassContextSpecific && single.Status.Tag == 1:
+			// revoked [1] IMPLICIT RevokedInfo
+			info := append([]byte{0x30}, single.Status.FullBytes[1:]...)
+			var revoked ocspRevokedInfo
+			if _, err := asn1.Unmarshal(info, &revoked); err != nil {
+				return status, fmt.Errorf("invalid revocation info: %w", err)
+			}
+			status.revokedAt, status.reason = revoked.RevocationTime, int(revoked.Reason)
+		default:
+			return status, fmt.Errorf("OCSP responder does not know the certificate")
+		}
+		return status, nil
+	}
+	return status, fmt.Errorf("OCSP response is not for the certificate")
+}
+
+// signatureAlgorithmOf returns the signature algorithm identified by
+// identifier, as encoded by signatureAlgorithmIdentifier.
+func signatureAlgorithmOf(identifier pkix.AlgorithmIdentifier) (x509.SignatureAlgorithm, error) {
+	der, err := asn1.Marshal(identifier)
+	if err != nil {
+		return x509.UnknownSignatureAlgorithm, err
+	}
+	for algorithm := range x509util.SignatureAlgorithmHashes {
+		candidate, err := signatureAlgorithmIdentifier(algorithm)
+		if err != nil {
+			continue
+		}
+		if candidateDER, err := asn1.Marshal(candidate); err == nil && bytes.Equal(candidateDER, der) {
+			return algorithm, nil
+		}
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signature algorithm %s", identifier.Algorithm)
+}
+
+// testOCSPStapling checks that the test server staples a valid OCSP
+// response for its certificate, which requires it, trusting ca.
+func testOCSPStapling(ca *x509.Certificate) error {
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca)
+	client := &http.Client{
+		Transport: testTransport(testNetworks()[0], &tls.Config{RootCAs: caPool, Time: now.Now}),
+		Timeout:   10 * time.Second,
+	}
+	resp, err := client.Get(testURL(testNetworks()[0]))
+	if err != nil {
+		return fmt.Errorf("client request failed: %w", err)
+	}
+	resp.Body.Close()
+	state := resp.TLS
+	if len(state.OCSPResponse) == 0 {
+		return fmt.Errorf("server did not staple an OCSP response for its Must-Staple certificate")
+	}
+	status, err := verifyOCSPResponse(state.OCSPResponse, ca, state.PeerCertificates[0])
+	if err != nil {
+		return err
+	}
+	if !status.revokedAt.IsZero() {
+		return fmt.Errorf("stapled OCSP response reports the certificate as revoked")
+	}
+	slog.Info("Verified stapled OCSP response", "serial", x509util.FormatHex(status.serial.Bytes()))
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// OCSP response statuses for failed requests.
+const (
+	ocspMalformedRequest = 1
+	ocspInternalError    = 2
+	ocspUnauthorized     = 6
+)
+
+type ocspRequest struct {
+	TBS struct {
+		Version       int           `asn1:"optional,explicit,tag:0,default:0"`
+		RequestorName asn1.RawValue `asn1:"optional,explicit,tag:1"`
+		Requests      []struct {
+			CertID     ocspCertID
+			Extensions []pkix.Extension `asn1:"optional,explicit,tag:0"`
+		}
+		Extensions []pkix.Extension `asn1:"optional,explicit,tag:2"`
+	}
+	Signature asn1.RawValue `asn1:"optional,explicit,tag:0"`
+}
+
+// Issues a delegated OCSP responder certificate from the regenerated CA,
+// so OCSP responses can be signed without the CA key online.
+func runOCSPResponder(args []string) {
+	fs := flag.NewFlagSet("ocsp-responder", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	validity := fs.Duration("cert-validity", 30*24*time.Hour, "Validity of the responder certificate, keep it short as it cannot be revoked")
+	out := fs.String("out", "ocsp-responder", "Base name of the written certificate (<out>.pem) and key (<out>-key.pem)")
+	var encryptTo keyRecipients
+	encryptTo.register(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() || *validity <= 0 {
+		usageError("go run *.go ocsp-responder (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-cert-validity 720h] [-out ocsp-responder] [-encrypt-to recipient]")
+	}
+	setup := regenerateCAs(caOpts)
+	key, err := setup.leafKey.or(keyTypes["p256"]).generate()
+	if err != nil {
+		fatal("Failed to generate key", "error", err)
+	}
+	cert, err := signCertificate(setup.newCA, setup.caKey, ocspResponderTemplate(setup.newCA, *validity), key.Public(), nil)
+	if err != nil {
+		exitWith(exitFailure, "Failed to issue OCSP responder certificate", "error", err)
+	}
+	writeIssued(*out, cert)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		fatal("Failed to encode key", "error", err)
+	}
+	keyFile, err := encryptTo.writeKey(*out+"-key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		exitWith(exitFailure, "Failed to write key", "file", keyFile, "error", err)
+	}
+	slog.Info("Wrote key", "file", keyFile, "key", x509util.DescribePublicKey(key.Public()))
+}
+
+// ocspResponderTemplate returns the template of a delegated OCSP responder
+// certificate (RFC 6960 section 4.2.2.2) of ca. It has id-pkix-ocsp-nocheck
+// as clients cannot check the revocation of the responder itself.
+func ocspResponderTemplate(ca *x509.Certificate, validity time.Duration) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:         pkix.Name{CommonName: ca.Subject.CommonName + " OCSP Responder", Organization: ca.Subject.Organization},
+		NotBefore:       now.Now().Add(-time.Minute),
+		NotAfter:        now.Now().Add(validity),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		ExtraExtensions: []pkix.Extension{{Id: oidOCSPNoCheck, Value: asn1.NullBytes}},
+	}
+}
+
+// OCSP responder answering from the database with a delegated responder
+// certificate, without the CA key.
+func runOCSPServe(args []string) {
+	const usage = "go run *.go ocsp-serve -ca-cert <new-ca.pem> -responder-cert <ocsp-responder.pem> -responder-key <ocsp-responder-key.pem> [-db issued.db] [-addr host:port] [-next-update 1h]"
+	fs := flag.NewFlagSet("ocsp-serve", flag.ContinueOnError)
+	caFile := fs.String("ca-cert", "", "Certificate of the CA the responder answers for")
+	responderFile := fs.String("responder-cert", "", "Delegated OCSP responder certificate issued by the CA, see ocsp-responder")
+	responderKeyFile := fs.String("responder-key", "", "Private key of the OCSP responder certificate")
+	registerCertDB(fs)
+	addr := fs.String("addr", "localhost:8889", "Address for the OCSP responder to listen on")
+	nextUpdate := fs.Duration("next-update", time.Hour, "Time until the next update of the responses")
+	registerShutdown(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if *caFile == "" || *responderFile == "" || *responderKeyFile == "" || fs.NArg() > 0 || *nextUpdate <= 0 {
+		usageError(usage)
+	}
+	if certDB.file == "" {
+		certDB.file = "issued.db"
+	}
+	ca, err := loadCertificates(*caFile)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA certificate", "error", err)
+	}
+	responderCerts, err := loadCertificates(*responderFile)
+	if err != nil {
+		fatal("Failed to load OCSP responder certificate", "error", err)
+	}
+	keyPEM, err := os.ReadFile(*responderKeyFile)
+	if err != nil {
+		fatal("Failed to read OCSP responder key", "error", err)
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		fatal("Failed to load OCSP responder key", "error", err)
+	}
+	s := &ocspServer{ca: ca[0], responder: responderCerts[0], key: key, nextUpdate: *nextUpdate}
+	if err := s.check(); err != nil {
+		fatal("Invalid OCSP responder certificate", "error", err)
+	}
+	if _, err := os.Stat(certDB.file); err != nil {
+		fatal("Failed to open database", "db", certDB.file, "error", err)
+	}
+
+	server := &http.Server{
+		Addr:     *addr,
+		Handler:  s,
+		ErrorLog: serverErrorLog(),
+	}
+	slog.Info("OCSP responder started", "url", "http://"+*addr+"/", "ca", s.ca.Subject.String(), "responder_not_after", s.responder.NotAfter.Format(time.RFC3339))
+	if err := serveUntilSignal(server); err != nil {
+		fatal("OCSP responder failed", "error", err)
+	}
+}
+
+type ocspServer struct {
+	ca         *x509.Certificate
+	responder  *x509.Certificate
+	key        crypto.Signer
+	nextUpdate time.Duration
+}
+
+// check checks that the responder is a delegated responder of the CA with
+// a matching key.
+func (s *ocspServer) check() error {
+	if err := s.responder.CheckSignatureFrom(s.ca); err != nil {
+		return fmt.Errorf("not issued by %s: %w", s.ca.Subject, err)
+	}
+	if len(s.responder.ExtKeyUsage) != 1 || s.responder.ExtKeyUsage[0] != x509.ExtKeyUsageOCSPSigning {
+		return fmt.Errorf("the extended key usage must be OCSP signing only")
+	}
+	if !x509util.IsPublicKey(s.responder.PublicKey, s.key.Public()) {
+		return caregen.ErrKeyMismatch
+	}
+	if now.Now().After(s.responder.NotAfter) {
+		return fmt.Errorf("expired at %s", s.responder.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ServeHTTP answers OCSP requests sent with POST or base64 encoded in the
+// path of a GET (RFC 6960 appendix A).
+func (s *ocspServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var der []byte
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		der, err = io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	case http.MethodGet:
+		der, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(r.URL.Path, "/"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var response []byte
+	if err != nil {
+		response = ocspErrorResponse(ocspMalformedRequest)
+	} else {
+		response = s.respond(der)
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(response)
+}
+
+// respond returns the response to the DER encoded request. Only the first
+// certificate of a request is answered, and only CertIDs with SHA-1, the
+// hash every client uses.
+func (s *ocspServer) respond(der []byte) []byte {
+	var req ocspRequest
+	if rest, err := asn1.Unmarshal(der, &req); err != nil || len(rest) > 0 || len(req.TBS.Requests) == 0 {
+		slog.Warn("Malformed OCSP request", "error", err)
+		return ocspErrorResponse(ocspMalformedRequest)
+	}
+	id := req.TBS.Requests[0].CertID
+	issuerKeyHash, err := publicKeyHash(s.ca)
+	if err != nil {
+		return ocspErrorResponse(ocspInternalError)
+	}
+	issuerNameHash := sha1.Sum(s.ca.RawSubject)
+	if !id.HashAlgorithm.Algorithm.Equal(oidSHA1) || !bytes.Equal(id.IssuerNameHash, issuerNameHash[:]) || !bytes.Equal(id.IssuerKeyHash, issuerKeyHash) {
+		slog.Warn("OCSP request for another CA", "serial", x509util.FormatHex(id.SerialNumber.Bytes()))
+		return ocspErrorResponse(ocspUnauthorized)
+	}
+
+	status, err := s.status(id.SerialNumber)
+	if err != nil {
+		slog.Error("Failed to look up certificate", "serial", x509util.FormatHex(id.SerialNumber.Bytes()), "error", err)
+		return ocspErrorResponse(ocspInternalError)
+	}
+	var nonce []byte
+	for _, ext := range req.TBS.Extensions {
+		if ext.Id.Equal(oidOCSPNonce) {
+			nonce = ext.Value
+		}
+	}
+	thisUpdate := now.Now()
+	response, err := createOCSPResponse(s.ca, status, s.responder, s.key, thisUpdate, thisUpdate.Add(s.nextUpdate), nonce)
+	if err != nil {
+		slog.Error("Failed to create OCSP response", "error", err)
+		return ocspErrorResponse(ocspInternalError)
+	}
+	slog.Info("Answered OCSP request", "serial", x509util.FormatHex(id.SerialNumber.Bytes()), "status", status.String())
+	return response
+}
+
+// status returns the status of the certificate with serial in the
+// database.
+func (s *ocspServer) status(serial *big.Int) (ocspStatus, error) {
+	status := ocspStatus{serial: serial}
+	rows, err := queryCertDB(certDB.file, "issuer = "+sqlQuote(s.ca.Subject.String())+" AND serial = "+sqlQuote(x509util.FormatHex(serial.Bytes())))
+	if err != nil {
+		return status, err
+	}
+	status.unknown = len(rows) == 0
+	for _, row := range rows {
+		if row.RevokedAt == "" {
+			continue
+		}
+		revokedAt, err := time.Parse(time.RFC3339, row.RevokedAt)
+		if err != nil {
+			return status, fmt.Errorf("invalid revocation time %q in database", row.RevokedAt)
+		}
+		status.revokedAt, status.reason = revokedAt, row.RevocationReason
+	}
+	return status, nil
+}
+
+func (s ocspStatus) String() string {
+	switch {
+	case s.unknown:
+		return "unknown"
+	case !s.revokedAt.IsZero():
+		return "revoked"
+	}
+	return "good"
+}
+
+// ocspErrorResponse returns an unsuccessful OCSP response with status.
+func ocspErrorResponse(status int) []byte {
+	der, _ := asn1.Marshal(ocspResponse{Status: asn1.Enumerated(status)})
+	return der
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io"
+)
+
+// maxPEMBlockSize limits the size of a single PEM block, so a missing END
+// line does not read the rest of a huge bundle into memory.
+const maxPEMBlockSize = 1 << 20
+
+// pemReader decodes PEM blocks one at a time from a stream, unlike
+// pem.Decode, which needs the whole input in memory. Text outside of the
+// blocks, like the output of openssl x509 -text, is skipped.
+type pemReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func newPEMReader(r io.Reader) *pemReader {
+	return &pemReader{r: bufio.NewReaderSize(r, 64<<10)}
+}
+
+// next returns the next block, or io.EOF at the end of the stream.
+func (p *pemReader) next() (*pem.Block, error) {
+	var block []byte
+	start := 0
+	for {
+		line, err := p.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Only base64 and headers belong to a block, both in short
+			// lines, so only text between blocks is this long
+			if block != nil {
+				return nil, fmt.Errorf("line %d: line too long in PEM block", p.line+1)
+			}
+			for err == bufio.ErrBufferFull {
+				_, err = p.r.ReadSlice('\n')
+			}
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) > 0 {
+			p.line++
+		}
+		trimmed := bytes.TrimSpace(line)
+		switch {
+		case block == nil && bytes.HasPrefix(trimmed, []byte("-----BEGIN ")):
+			block, start = append(block, line...), p.line
+		case block != nil:
+			block = append(block, line...)
+			if len(block) > maxPEMBlockSize {
+				return nil, fmt.Errorf("line %d: PEM block exceeds %d bytes", start, maxPEMBlockSize)
+			}
+			if bytes.HasPrefix(trimmed, []byte("-----END ")) {
+				decoded, _ := pem.Decode(block)
+				if decoded == nil {
+					return nil, fmt.Errorf("line %d: invalid PEM block", start)
+				}
+				return decoded, nil
+			}
+		}
+		if err == io.EOF {
+			if block != nil {
+				return nil, fmt.Errorf("line %d: PEM block without END line", start)
+			}
+			return nil, io.EOF
+		}
+	}
+}
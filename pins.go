@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// spkiPin returns the public key pin of an encoded SubjectPublicKeyInfo in
+// the sha256/<base64> form of OkHttp, Android's network security config
+// and TrustKit.
+func spkiPin(spki []byte) string {
+	sum := sha256.Sum256(spki)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// pinList is the repeatable -pin flag. Pins are given as sha256/<base64>
+// or only as the base64 encoded hash, like in HPKP headers.
+type pinList []string
+
+func (l *pinList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *pinList) Set(value string) error {
+	hash := strings.TrimPrefix(strings.TrimSpace(value), "sha256/")
+	if sum, err := base64.StdEncoding.DecodeString(hash); err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("invalid pin %q, use sha256/<base64 SHA-256 hash of the SPKI>", value)
+	}
+	*l = append(*l, "sha256/"+hash)
+	return nil
+}
+
+// testPins are the pins of -pin the pinning client test requires, none
+// if the test is not run.
+var testPins pinList
+
+// logPins logs the pins of the original and the regenerated CA and of the
+// server certificate, for comparison with the pins of -pin.
+func logPins(setup *caSetup) {
+	slog.Info("SPKI pins",
+		"original_ca", spkiPin(setup.originalCA.RawSubjectPublicKeyInfo),
+		"new_ca", spkiPin(setup.newCA.RawSubjectPublicKeyInfo),
+		"server_certificate", spkiPin(setup.serverCert.RawSubjectPublicKeyInfo))
+}
+
+// testPinning requests the test server like a pinning client trusting only
+// ca: after the chain is verified, one of the certificates of the verified
+// chain must have one of the pinned keys, like OkHttp's CertificatePinner
+// and Android's network security config check.
+func testPinning(network string, ca *x509.Certificate, caName string, pins pinList) error {
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca)
+
+	var matched string
+	tlsConfig := &tls.Config{
+		RootCAs: caPool,
+		Time:    now.Now,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			var chainPins []string
+			for _, chain := range state.VerifiedChains {
+				for _, cert := range chain {
+					pin := spkiPin(cert.RawSubjectPublicKeyInfo)
+					if slices.Contains(pins, pin) {
+						matched = cert.Subject.String()
+						return nil
+					}
+					chainPins = append(chainPins, pin)
+				}
+			}
+			return fmt.Errorf("no key of the verified chain is pinned, the chain has the pins %s", strings.Join(chainPins, ", "))
+		},
+	}
+	client := &http.Client{
+		Transport: testTransport(network, tlsConfig),
+		Timeout:   10 * time.Second,
+	}
+	resp, err := client.Get(testURL(network))
+	if err != nil {
+		return fmt.Errorf("pinning client request failed: %w", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	slog.Info("Pinning client accepted the chain", "ca", caName, "pinned", matched)
+	return nil
+}
+
+// Prints the SPKI pins of the certificates and keys in PEM files, e.g. of
+// the original and the regenerated CA and of old and new leaves, to
+// compare them with the pins of mobile apps.
+func runPins(args []string) {
+	fs := flag.NewFlagSet("pins", flag.ContinueOnError)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if fs.NArg() == 0 {
+		usageError("go run *.go pins <cert-or-key.pem|->...")
+	}
+	for _, file := range fs.Args() {
+		data, err := readInput(file)
+		if err != nil {
+			exitWith(exitInvalidCA, "Failed to read file", "file", file, "error", err)
+		}
+		pins, err := filePins(data)
+		if err != nil {
+			exitWith(exitInvalidCA, "Failed to compute pins", "file", file, "error", err)
+		}
+		if len(pins) == 0 {
+			exitWith(exitInvalidCA, "No certificates or keys found", "file", file)
+		}
+		for _, pin := range pins {
+			fmt.Printf("%s  %s: %s\n", pin[0], file, pin[1])
+		}
+	}
+}
+
+// filePins returns the pins of the certificates, public keys and private
+// keys in PEM encoded data, each with a description of what was pinned.
+func filePins(data []byte) ([][2]string, error) {
+	var pins [][2]string
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return pins, nil
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			cert, err := x509util.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse certificate: %w", err)
+			}
+			pins = append(pins, [2]string{spkiPin(cert.RawSubjectPublicKeyInfo), cert.Subject.String()})
+		case block.Type == "PUBLIC KEY":
+			pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse public key: %w", err)
+			}
+			pins = append(pins, [2]string{spkiPin(block.Bytes), "public key " + x509util.DescribePublicKey(pub)})
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			key, err := parsePrivateKey(pem.EncodeToMemory(block))
+			if err != nil {
+				return nil, err
+			}
+			pin, err := publicKeyPin(key.Public())
+			if err != nil {
+				return nil, err
+			}
+			pins = append(pins, [2]string{pin, "private key " + x509util.DescribePublicKey(key.Public())})
+		}
+	}
+}
+
+// publicKeyPin returns the pin of a public key.
+func publicKeyPin(pub crypto.PublicKey) (string, error) {
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode public key: %w", err)
+	}
+	return spkiPin(spki), nil
+}
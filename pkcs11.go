@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// pkcs1DigestInfoPrefixes are the DER encoded DigestInfo headers which
+// precede the digest for PKCS#1 v1.5 signatures with the raw RSA-PKCS
+// mechanism (RFC 8017, section 9.2).
+var pkcs1DigestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+func init() {
+	caregen.RegisterSignerBackend(func() caregen.SignerBackend { return &pkcs11Options{} })
+}
+
+// pkcs11Options selects a CA key stored in an HSM or token accessible via
+// a PKCS#11 module.
+type pkcs11Options struct {
+	module   string
+	slot     string
+	pin      string
+	keyLabel string
+	// keyID selects the key by its CKA_ID (hex) instead of the label.
+	keyID string
+	tool  string
+}
+
+func (o *pkcs11Options) Register(fs *flag.FlagSet) {
+	fs.StringVar(&o.module, "pkcs11-module", "", "Sign with a key accessed through this PKCS#11 module (e.g. /usr/lib/softhsm/libsofthsm2.so) instead of a CA key file")
+	fs.StringVar(&o.slot, "pkcs11-slot", "", "PKCS#11 slot ID of the token (default: first slot with a token)")
+	fs.StringVar(&o.pin, "pkcs11-pin", "", "User PIN of the token")
+	fs.StringVar(&o.keyLabel, "pkcs11-key-label", "", "Label of the CA private key on the token")
+	fs.StringVar(&o.tool, "pkcs11-tool", "pkcs11-tool", "Path to OpenSC's pkcs11-tool")
+}
+
+// pkcs11Signer is a crypto.Signer for a private key on a PKCS#11 token.
+// Loading PKCS#11 modules needs cgo, so the key is used through OpenSC's
+// pkcs11-tool instead, which works with every module.
+type pkcs11Signer struct {
+	opts   pkcs11Options
+	public crypto.PublicKey
+	// beforeSign is called before each signature, e.g. to ask for a touch.
+	beforeSign func()
+}
+
+func (o *pkcs11Options) Selected() bool {
+	return o.module != ""
+}
+
+func (o *pkcs11Options) Signer() (crypto.Signer, error) {
+	return o.open()
+}
+
+// open returns a signer for the configured key after reading its public
+// key from the token.
+func (o *pkcs11Options) open() (*pkcs11Signer, error) {
+	if o.keyLabel == "" && o.keyID == "" {
+		return nil, fmt.Errorf("-pkcs11-key-label is required")
+	}
+	s := &pkcs11Signer{opts: *o}
+
+	// The public key is stored as a separate object, or at least as part
+	// of the certificate object for the same key
+	der, err := s.run(false, append([]string{"--read-object", "--type", "pubkey"}, s.selector()...)...)
+	if err == nil {
+		s.public, err = parsePublicKeyDER(der)
+	}
+	if err != nil {
+		der, certErr := s.run(false, append([]string{"--read-object", "--type", "cert"}, s.selector()...)...)
+		if certErr != nil {
+			return nil, fmt.Errorf("failed to read public key from token: %w", err)
+		}
+		cert, certErr := x509.ParseCertificate(der)
+		if certErr != nil {
+			return nil, fmt.Errorf("failed to parse certificate from token: %v", certErr)
+		}
+		s.public = cert.PublicKey
+	}
+	slog.Debug("Using PKCS#11 key", "module", o.module, "label", o.keyLabel, "id", o.keyID, "key", x509util.DescribePublicKey(s.public))
+	return s, nil
+}
+
+// parsePublicKeyDER parses a SubjectPublicKeyInfo or, as written by older
+// OpenSC versions, a PKCS#1 RSA public key.
+func parsePublicKeyDER(der []byte) (crypto.PublicKey, error) {
+	if public, err := x509.ParsePKIXPublicKey(der); err == nil {
+		return public, nil
+	}
+	return x509.ParsePKCS1PublicKey(der)
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := opts.HashFunc()
+	var args []string
+	input := digest
+	switch s.public.(type) {
+	case *rsa.PublicKey:
+		if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+			if pssOpts.SaltLength != rsa.PSSSaltLengthEqualsHash && pssOpts.SaltLength != hash.Size() {
+				return nil, fmt.Errorf("unsupported PSS salt length %d", pssOpts.SaltLength)
+			}
+			name := strings.ReplaceAll(hash.String(), "-", "")
+			args = []string{"--mechanism", "RSA-PKCS-PSS", "--hash-algorithm", name, "--mgf", "MGF1-" + name, "--salt-len", "-1"}
+			break
+		}
+		prefix, ok := pkcs1DigestInfoPrefixes[hash]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash %s", hash)
+		}
+		input = append(append([]byte{}, prefix...), digest...)
+		args = []string{"--mechanism", "RSA-PKCS"}
+	case *ecdsa.PublicKey:
+		args = []string{"--mechanism", "ECDSA", "--signature-format", "openssl"}
+	default:
+		return nil, fmt.Errorf("PKCS#11 key: %w %T", caregen.ErrUnsupportedKeyType, s.public)
+	}
+
+	dir, err := os.MkdirTemp("", "ca-regen-pkcs11")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	inputFile := filepath.Join(dir, "input")
+	outputFile := filepath.Join(dir, "signature")
+	if err := os.WriteFile(inputFile, input, 0600); err != nil {
+		return nil, err
+	}
+
+	if s.beforeSign != nil {
+		s.beforeSign()
+	}
+	args = append(append(args, "--sign", "--input-file", inputFile, "--output-file", outputFile), s.selector()...)
+	if _, err := s.run(true, args...); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(outputFile)
+}
+
+// selector returns the pkcs11-tool arguments selecting the key objects.
+func (s *pkcs11Signer) selector() []string {
+	if s.opts.keyID != "" {
+		return []string{"--id", s.opts.keyID}
+	}
+	return []string{"--label", s.opts.keyLabel}
+}
+
+// run executes pkcs11-tool for the configured module and slot and returns
+// its stdout, which for --read-object is the object's DER encoding.
+func (s *pkcs11Signer) run(login bool, args ...string) ([]byte, error) {
+	base := []string{"--module", s.opts.module}
+	if s.opts.slot != "" {
+		base = append(base, "--slot", s.opts.slot)
+	}
+	if login {
+		base = append(base, "--login")
+	}
+
+	dir, err := os.MkdirTemp("", "ca-regen-pkcs11")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	// --read-object writes to stdout mixed with status messages unless an
+	// output file is given
+	outputFile := ""
+	if len(args) > 0 && args[0] == "--read-object" {
+		outputFile = filepath.Join(dir, "object")
+		args = append(args, "--output-file", outputFile)
+	}
+
+	cmd := exec.Command(s.opts.tool, append(base, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	switch {
+	case login && s.opts.pin != "":
+		// Without --pin pkcs11-tool reads the PIN from stdin, arguments
+		// are visible to other users
+		cmd.Stdin = strings.NewReader(s.opts.pin + "\n")
+	case login:
+		// Let pkcs11-tool prompt for the PIN
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11-tool failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if outputFile != "" {
+		return os.ReadFile(outputFile)
+	}
+	return out, nil
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+)
+
+// Just enough of PKCS#7 / CMS (RFC 5652) for the enrollment protocols:
+// SignedData with signed attributes, certs-only SignedData and
+// EnvelopedData with RSA key transport. Only DER is supported, BER
+// indefinite lengths as produced by streaming encoders are not.
+var (
+	oidPKCS7Data              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidPKCS7EnvelopedData     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidRSAEncryption          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidDESCBC                 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 7}
+	oidDESEDE3CBC             = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// pkcs7DigestAlgorithms maps the supported hashes to their digest
+// algorithm OIDs.
+var pkcs7DigestAlgorithms = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA1:   {1, 3, 14, 3, 2, 26},
+	crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+	crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+	crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+}
+
+// pkcs7HashFor returns the hash of a digest algorithm OID.
+func pkcs7HashFor(oid asn1.ObjectIdentifier) (crypto.Hash, bool) {
+	for hash, digestOID := range pkcs7DigestAlgorithms {
+		if digestOID.Equal(oid) {
+			return hash, true
+		}
+	}
+	return 0, false
+}
+
+// pkcs7ECDSAAlgorithms maps hashes to the ECDSA signature algorithm OIDs.
+var pkcs7ECDSAAlgorithms = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA1:   {1, 2, 840, 10045, 4, 1},
+	crypto.SHA256: {1, 2, 840, 10045, 4, 3, 2},
+	crypto.SHA384: {1, 2, 840, 10045, 4, 3, 3},
+	crypto.SHA512: {1, 2, 840, 10045, 4, 3, 4},
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	// Content is EXPLICIT [0], so its Bytes are the DER of the content.
+	Content asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7SignerInfo struct {
+	Version            int
+	SignerIdentifier   asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type pkcs7EnvelopedData struct {
+	Version              int
+	RecipientInfos       []pkcs7RecipientInfo `asn1:"set"`
+	EncryptedContentInfo pkcs7EncryptedContentInfo
+}
+
+type pkcs7RecipientInfo struct {
+	Version                int
+	RecipientIdentifier    asn1.RawValue
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type pkcs7EncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// signedMessage is a parsed SignedData whose signature has been verified.
+type signedMessage struct {
+	content      []byte
+	certificates []*x509.Certificate
+	signer       *x509.Certificate
+	hash         crypto.Hash
+	attributes   map[string][]byte
+}
+
+// attribute returns the DER encoded value of a signed attribute, or nil.
+func (m *signedMessage) attribute(oid asn1.ObjectIdentifier) []byte {
+	return m.attributes[oid.String()]
+}
+
+// stringAttribute returns a signed attribute holding a string type.
+func (m *signedMessage) stringAttribute(oid asn1.ObjectIdentifier) string {
+	var s string
+	asn1.Unmarshal(m.attribute(oid), &s)
+	return s
+}
+
+// bytesAttribute returns a signed attribute holding an OCTET STRING.
+func (m *signedMessage) bytesAttribute(oid asn1.ObjectIdentifier) []byte {
+	var b []byte
+	asn1.Unmarshal(m.attribute(oid), &b)
+	return b
+}
+
+// parseSignedData parses a ContentInfo holding SignedData and verifies the
+// signature of its (first) signer, whose certificate has to be included.
+// Whether the signer is trusted is up to the caller.
+func parseSignedData(der []byte) (*signedMessage, error) {
+	var info pkcs7ContentInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS#7 content info: %w", err)
+	} else if len(rest) > 0 {
+		return nil, fmt.Errorf("trailing data after PKCS#7 content info")
+	}
+	if !info.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, fmt.Errorf("PKCS#7 content type %s is not signed data", info.ContentType)
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS#7 signed data: %w", err)
+	}
+	msg := &signedMessage{attributes: map[string][]byte{}}
+	if len(sd.ContentInfo.Content.Bytes) > 0 {
+		content, err := octetStringContent(sd.ContentInfo.Content.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		msg.content = content
+	}
+	if len(sd.Certificates.Bytes) > 0 {
+		certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PKCS#7 certificates: %w", err)
+		}
+		msg.certificates = certs
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, fmt.Errorf("PKCS#7 signed data has no signer")
+	}
+
+	si := sd.SignerInfos[0]
+	msg.signer = findSignerCertificate(si.SignerIdentifier, msg.certificates)
+	if msg.signer == nil {
+		return nil, fmt.Errorf("certificate of the PKCS#7 signer is not included")
+	}
+	hash, ok := pkcs7HashFor(si.DigestAlgorithm.Algorithm)
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm %s", si.DigestAlgorithm.Algorithm)
+	}
+	msg.hash = hash
+
+	// With signed attributes the signature is over their DER encoding as
+	// SET OF, which has to contain the digest of the content
+	signed := msg.content
+	if len(si.SignedAttributes.FullBytes) > 0 {
+		signed = append([]byte{0x31}, si.SignedAttributes.FullBytes[1:]...)
+		rest := si.SignedAttributes.Bytes
+		for len(rest) > 0 {
+			var attr pkcs7Attribute
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+				return nil, fmt.Errorf("failed to parse PKCS#7 signed attributes: %w", err)
+			}
+			msg.attributes[attr.Type.String()] = attr.Values.Bytes
+		}
+		h := hash.New()
+		h.Write(msg.content)
+		if !bytes.Equal(msg.bytesAttribute(oidAttributeMessageDigest), h.Sum(nil)) {
+			return nil, fmt.Errorf("PKCS#7 message digest does not match the content")
+		}
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	var err error
+	switch public := msg.signer.PublicKey.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(public, hash, digest, si.Signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(public, digest, si.Signature) {
+			err = fmt.Errorf("ECDSA verification failure")
+		}
+	default:
+		err = fmt.Errorf("%w %T", caregen.ErrUnsupportedKeyType, public)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid PKCS#7 signature: %w", err)
+	}
+	return msg, nil
+}
+
+// findSignerCertificate returns the certificate matching a signer
+// identifier, which is either issuer and serial number or a subject key
+// identifier.
+func findSignerCertificate(id asn1.RawValue, certs []*x509.Certificate) *x509.Certificate {
+	var ias pkcs7IssuerAndSerial
+	if _, err := asn1.Unmarshal(id.FullBytes, &ias); err == nil {
+		for _, cert := range certs {
+			if bytes.Equal(cert.RawIssuer, ias.Issuer.FullBytes) && cert.SerialNumber.Cmp(ias.SerialNumber) == 0 {
+				return cert
+			}
+		}
+		return nil
+	}
+	for _, cert := range certs {
+		if id.Class == asn1.ClassContextSpecific && len(cert.SubjectKeyId) > 0 && bytes.Equal(cert.SubjectKeyId, id.Bytes) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// octetStringContent returns the content of an OCTET STRING, which may be
+// constructed from several segments.
+func octetStringContent(der []byte) ([]byte, error) {
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS#7 content: %w", err)
+	}
+	if !raw.IsCompound {
+		return raw.Bytes, nil
+	}
+	var content []byte
+	for rest := raw.Bytes; len(rest) > 0; {
+		var segment []byte
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &segment); err != nil {
+			return nil, fmt.Errorf("failed to parse PKCS#7 content: %w", err)
+		}
+		content = append(content, segment...)
+	}
+	return content, nil
+}
+
+// pkcs7SignedAttribute returns a signed attribute with a single value of
+// any type which can be marshalled with the given asn1 parameters.
+func pkcs7SignedAttribute(oid asn1.ObjectIdentifier, value any, params string) (pkcs7Attribute, error) {
+	der, err := asn1.MarshalWithParams(value, params)
+	if err != nil {
+		return pkcs7Attribute{}, err
+	}
+	return pkcs7Attribute{Type: oid, Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: der}}, nil
+}
+
+// createSignedData returns a ContentInfo with SignedData over content of
+// contentType, which may be nil for a message without content. The signed
+// attributes always include content type, message digest and signing time.
+func createSignedData(contentType asn1.ObjectIdentifier, content []byte, attrs []pkcs7Attribute, cert *x509.Certificate, key crypto.Signer, hash crypto.Hash, certs []*x509.Certificate) ([]byte, error) {
+	digestAlgorithm, ok := pkcs7DigestAlgorithms[hash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash %s", hash)
+	}
+	h := hash.New()
+	h.Write(content)
+	standard := make([]pkcs7Attribute, 3)
+	var err error
+	if standard[0], err = pkcs7SignedAttribute(oidAttributeContentType, contentType, ""); err != nil {
+		return nil, err
+	}
+	if standard[1], err = pkcs7SignedAttribute(oidAttributeMessageDigest, h.Sum(nil), ""); err != nil {
+		return nil, err
+	}
+	if standard[2], err = pkcs7SignedAttribute(oidAttributeSigningTime, time.Now().UTC(), "utc"); err != nil {
+		return nil, err
+	}
+
+	// SET OF has to be sorted by the encoding of its elements in DER
+	var encoded [][]byte
+	for _, attr := range append(standard, attrs...) {
+		der, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, der)
+	}
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+	signedAttributes, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(encoded, nil)})
+	if err != nil {
+		return nil, err
+	}
+	h = hash.New()
+	h.Write(signedAttributes)
+	signature, err := key.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign PKCS#7 signed data: %w", err)
+	}
+	var signatureAlgorithm asn1.ObjectIdentifier
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		signatureAlgorithm = oidRSAEncryption
+	case *ecdsa.PublicKey:
+		signatureAlgorithm = pkcs7ECDSAAlgorithms[hash]
+	default:
+		return nil, fmt.Errorf("%w %T", caregen.ErrUnsupportedKeyType, key.Public())
+	}
+
+	issuerAndSerial, err := asn1.Marshal(pkcs7IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber})
+	if err != nil {
+		return nil, err
+	}
+	// The signed attributes are IMPLICIT [0] in the signer info
+	signedAttributes[0] = 0xa0
+	sd := pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: digestAlgorithm, Parameters: asn1.NullRawValue}},
+		ContentInfo:      pkcs7ContentInfo{ContentType: contentType},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version:            1,
+			SignerIdentifier:   asn1.RawValue{FullBytes: issuerAndSerial},
+			DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: digestAlgorithm, Parameters: asn1.NullRawValue},
+			SignedAttributes:   asn1.RawValue{FullBytes: signedAttributes},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: signatureAlgorithm},
+			Signature:          signature,
+		}},
+	}
+	if signatureAlgorithm.Equal(oidRSAEncryption) {
+		sd.SignerInfos[0].SignatureAlgorithm.Parameters = asn1.NullRawValue
+	}
+	if !contentType.Equal(oidPKCS7Data) {
+		// RFC 5652 section 5.1
+		sd.Version = 3
+	}
+	if content != nil {
+		der, err := asn1.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		sd.ContentInfo.Content = explicitContent(der)
+	}
+	sd.Certificates = pkcs7CertificateSet(certs)
+	return marshalContentInfo(oidPKCS7SignedData, sd)
+}
+
+// createCertsOnlyPKCS7 returns a degenerate SignedData without signers,
+// the usual container for distributing certificates.
+func createCertsOnlyPKCS7(certs []*x509.Certificate) ([]byte, error) {
+	return marshalContentInfo(oidPKCS7SignedData, pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{},
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidPKCS7Data},
+		Certificates:     pkcs7CertificateSet(certs),
+		SignerInfos:      []pkcs7SignerInfo{},
+	})
+}
+
+// parseCertsOnlyPKCS7 returns the certificates of a SignedData, e.g. a
+// degenerate one without signers, without verifying any signature.
+func parseCertsOnlyPKCS7(der []byte) ([]*x509.Certificate, error) {
+	var info pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS#7 content info: %w", err)
+	}
+	if !info.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, fmt.Errorf("PKCS#7 content type %s is not signed data", info.ContentType)
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS#7 signed data: %w", err)
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS#7 certificates: %w", err)
+	}
+	return certs, nil
+}
+
+// pkcs7CertificateSet returns the IMPLICIT [0] SET OF Certificate field.
+func pkcs7CertificateSet(certs []*x509.Certificate) asn1.RawValue {
+	if len(certs) == 0 {
+		return asn1.RawValue{}
+	}
+	var der []byte
+	for _, cert := range certs {
+		der = append(der, cert.Raw...)
+	}
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+func marshalContentInfo(contentType asn1.ObjectIdentifier, content any) ([]byte, error) {
+	der, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{ContentType: contentType, Content: explicitContent(der)})
+}
+
+// explicitContent returns the EXPLICIT [0] content field of a ContentInfo.
+func explicitContent(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// decryptEnvelopedData decrypts a ContentInfo holding EnvelopedData with
+// key, which has to be the RSA key of one of the recipients. It also
+// returns the content encryption algorithm so replies can use the same.
+func decryptEnvelopedData(der []byte, key crypto.Decrypter) ([]byte, asn1.ObjectIdentifier, error) {
+	var info pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse PKCS#7 content info: %w", err)
+	}
+	if !info.ContentType.Equal(oidPKCS7EnvelopedData) {
+		return nil, nil, fmt.Errorf("PKCS#7 content type %s is not enveloped data", info.ContentType)
+	}
+	var ed pkcs7EnvelopedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &ed); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse PKCS#7 enveloped data: %w", err)
+	}
+
+	// Recipients are not matched by identifier, the key of whichever one
+	// decrypts is used
+	var contentKey []byte
+	for _, recipient := range ed.RecipientInfos {
+		if !recipient.KeyEncryptionAlgorithm.Algorithm.Equal(oidRSAEncryption) {
+			continue
+		}
+		if k, err := key.Decrypt(rand.Reader, recipient.EncryptedKey, nil); err == nil {
+			contentKey = k
+			break
+		}
+	}
+	if contentKey == nil {
+		return nil, nil, fmt.Errorf("no PKCS#7 recipient can be decrypted with the key")
+	}
+
+	eci := ed.EncryptedContentInfo
+	block, err := newPKCS7Cipher(eci.ContentEncryptionAlgorithm.Algorithm, contentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil || len(iv) != block.BlockSize() {
+		return nil, nil, fmt.Errorf("invalid PKCS#7 content encryption IV")
+	}
+	// The encrypted content is an IMPLICIT [0] OCTET STRING
+	encrypted := eci.EncryptedContent.Bytes
+	if eci.EncryptedContent.IsCompound {
+		encrypted, err = octetStringContent(append([]byte{0x24}, eci.EncryptedContent.FullBytes[1:]...))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(encrypted) == 0 || len(encrypted)%block.BlockSize() != 0 {
+		return nil, nil, fmt.Errorf("invalid PKCS#7 encrypted content length")
+	}
+	content := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(content, encrypted)
+	padding := int(content[len(content)-1])
+	if padding == 0 || padding > block.BlockSize() || !bytes.Equal(content[len(content)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, nil, fmt.Errorf("invalid PKCS#7 content padding, wrong key?")
+	}
+	return content[:len(content)-padding], eci.ContentEncryptionAlgorithm.Algorithm, nil
+}
+
+// createEnvelopedData encrypts content for the RSA key of recipient with
+// the given content encryption algorithm.
+func createEnvelopedData(content []byte, recipient *x509.Certificate, algorithm asn1.ObjectIdentifier) ([]byte, error) {
+	public, ok := recipient.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("recipient key type %T can't be used for key transport", recipient.PublicKey)
+	}
+	keySize := map[string]int{
+		oidDESCBC.String():     8,
+		oidDESEDE3CBC.String(): 24,
+		oidAES128CBC.String():  16,
+		oidAES192CBC.String():  24,
+		oidAES256CBC.String():  32,
+	}[algorithm.String()]
+	contentKey := make([]byte, keySize)
+	if _, err := rand.Read(contentKey); err != nil {
+		return nil, err
+	}
+	block, err := newPKCS7Cipher(algorithm, contentKey)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	padding := block.BlockSize() - len(content)%block.BlockSize()
+	encrypted := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, public, contentKey)
+	if err != nil {
+		return nil, err
+	}
+	ivDER, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	issuerAndSerial, err := asn1.Marshal(pkcs7IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: recipient.RawIssuer}, SerialNumber: recipient.SerialNumber})
+	if err != nil {
+		return nil, err
+	}
+	return marshalContentInfo(oidPKCS7EnvelopedData, pkcs7EnvelopedData{
+		RecipientInfos: []pkcs7RecipientInfo{{
+			RecipientIdentifier:    asn1.RawValue{FullBytes: issuerAndSerial},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: pkcs7EncryptedContentInfo{
+			ContentType:                oidPKCS7Data,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: algorithm, Parameters: asn1.RawValue{FullBytes: ivDER}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encrypted},
+		},
+	})
+}
+
+func newPKCS7Cipher(algorithm asn1.ObjectIdentifier, key []byte) (cipher.Block, error) {
+	switch {
+	case algorithm.Equal(oidDESCBC):
+		return des.NewCipher(key)
+	case algorithm.Equal(oidDESEDE3CBC):
+		return des.NewTripleDESCipher(key)
+	case algorithm.Equal(oidAES128CBC), algorithm.Equal(oidAES192CBC), algorithm.Equal(oidAES256CBC):
+		return aes.NewCipher(key)
+	}
+	return nil, fmt.Errorf("unsupported content encryption algorithm %s", algorithm)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto"
+	"crypto/mldsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// Extensions of the "catalyst" hybrid certificates of ITU-T X.509 (2019)
+// section 9.8, carrying an alternative public key and signature next to
+// the classical ones.
+var (
+	oidExtensionSubjectAltPublicKeyInfo = asn1.ObjectIdentifier{2, 5, 29, 72}
+	oidExtensionAltSignatureAlgorithm   = asn1.ObjectIdentifier{2, 5, 29, 73}
+	oidExtensionAltSignatureValue       = asn1.ObjectIdentifier{2, 5, 29, 74}
+)
+
+// mldsaParameterSets maps the -mldsa flag to the parameter sets and their
+// algorithm identifiers (RFC 9881).
+var mldsaParameterSets = map[int]struct {
+	params mldsa.Parameters
+	oid    asn1.ObjectIdentifier
+}{
+	44: {mldsa.MLDSA44(), asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 17}},
+	65: {mldsa.MLDSA65(), asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 18}},
+	87: {mldsa.MLDSA87(), asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 3, 19}},
+}
+
+// Experimental: creates an ML-DSA CA parallel to the regenerated CA and
+// tests TLS handshakes with a pure ML-DSA chain issued by it and, with
+// -hybrid, with a hybrid chain: the regenerated CA and a leaf signed
+// classically as before, carrying an alternative ML-DSA signature of the
+// PQ CA that clients without PQ support ignore.
+func runPQ(args []string) {
+	fs := flag.NewFlagSet("pq", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	level := fs.Int("mldsa", 65, "ML-DSA parameter set of the PQ CA and leaf: 44, 65 or 87")
+	pqKeyFile := fs.String("pq-key", "", "Unencrypted ML-DSA CA key of an earlier run (pq-ca-key.pem) to create the same ML-DSA CA again, instead of a new random key")
+	hybrid := fs.Bool("hybrid", false, "Also issue and test a hybrid chain with alternative ML-DSA signatures (X.509 section 9.8)")
+	var encryptTo keyRecipients
+	encryptTo.register(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	set, ok := mldsaParameterSets[*level]
+	if !caOpts.valid() || !ok {
+		usageError("go run *.go pq (-ca <ca-bundle.pem> | -ca-cert <ca-cert.pem> -ca-key <ca-key.pem>) [-mldsa 44|65|87] [-pq-key pq-ca-key.pem] [-hybrid] [-encrypt-to recipient]")
+	}
+
+	setup := loadCAs(caOpts)
+	pqKey, err := loadPQKey(*pqKeyFile, set.params)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load ML-DSA CA key", "error", err)
+	}
+	pqCA, err := createPQCA(setup.newCA, pqKey)
+	if err != nil {
+		exitWith(exitRegenerationFailed, "Failed to create ML-DSA CA", "error", err)
+	}
+	slog.Info("Created parallel ML-DSA CA", "subject", pqCA.Subject.String(), "algorithm", set.params.String())
+	if err := saveCAToFile(pqCA, "pq-ca.pem"); err != nil {
+		exitWith(exitFailure, "Failed to save ML-DSA CA", "error", err)
+	}
+	keyFile := "pq-ca-key.pem"
+	keyDER, err := x509.MarshalPKCS8PrivateKey(pqKey)
+	if err == nil {
+		keyFile, err = encryptTo.writeKey(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	}
+	if err != nil {
+		exitWith(exitFailure, "Failed to save ML-DSA CA key", "error", err)
+	}
+	slog.Info("Saved ML-DSA CA", "cert", "pq-ca.pem", "key", keyFile)
+
+	scenarios, err := pqScenarios(setup, pqCA, pqKey, set.params, *hybrid)
+	if err != nil {
+		exitWith(exitRegenerationFailed, "Failed to issue PQ certificates", "error", err)
+	}
+
+	var current atomic.Pointer[tls.Certificate]
+	server := startWebServer(&tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return current.Load(), nil
+		},
+	})
+	defer server.Close()
+
+	failed := false
+	for _, scenario := range scenarios {
+		current.Store(&scenario.cert)
+		_, err := handshake(handshakeConfig(scenario.root))
+		if err != nil {
+			failed = true
+			slog.Error("Handshake failed", "scenario", scenario.name, "error", err)
+			continue
+		}
+		slog.Info("Handshake succeeded", "scenario", scenario.name)
+	}
+	if failed {
+		os.Exit(exitVerifyFailed)
+	}
+}
+
+// loadPQKey loads the ML-DSA CA key of an earlier run from file, or
+// generates a new one without a file. The key is random and not derived
+// from the CA key: anything derived from signatures of the CA key could be
+// recomputed by everyone allowed to sign with it.
+func loadPQKey(file string, params mldsa.Parameters) (*mldsa.PrivateKey, error) {
+	if file == "" {
+		return mldsa.GenerateKey(params)
+	}
+	keyPEM, err := readInput(file)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := signer.(*mldsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w %T, the ML-DSA CA key must be an ML-DSA key", caregen.ErrUnsupportedKeyType, signer)
+	}
+	if got := key.PublicKey().Parameters(); got != params {
+		return nil, fmt.Errorf("the ML-DSA CA key is %s, not %s as selected with -mldsa", got, params)
+	}
+	return key, nil
+}
+
+// createPQCA returns a self-signed ML-DSA CA with the validity of ca. The
+// common name is suffixed with the parameter set, as clients would look
+// for the classical CA by a subject shared with it.
+func createPQCA(ca *x509.Certificate, key *mldsa.PrivateKey) (*x509.Certificate, error) {
+	subject := ca.Subject
+	subject.Names, subject.ExtraNames = nil, nil
+	subject.CommonName = fmt.Sprintf("%s %s", ca.Subject.CommonName, key.PublicKey().Parameters())
+	template := &x509.Certificate{
+		SerialNumber:          ca.SerialNumber,
+		Subject:               subject,
+		NotBefore:             ca.NotBefore,
+		NotAfter:              ca.NotAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return recordCertificate("create-ca", der)
+}
+
+// pqScenarios issues the ML-DSA leaf and, with hybrid, the hybrid CA and
+// leaf, with the CAs clients trust for each of them.
+func pqScenarios(setup *caSetup, pqCA *x509.Certificate, pqKey *mldsa.PrivateKey, params mldsa.Parameters, hybrid bool) ([]benchScenario, error) {
+	leafTemplate := func() *x509.Certificate {
+		return &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "localhost"},
+			DNSNames:    []string{"localhost"},
+			NotBefore:   now.Now().Add(-time.Minute),
+			NotAfter:    now.Now().Add(24 * time.Hour),
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+		}
+	}
+	leafKey, err := mldsa.GenerateKey(params)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := signCertificate(pqCA, pqKey, leafTemplate(), leafKey.Public(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue ML-DSA leaf: %w", err)
+	}
+	scenarios := []benchScenario{{
+		name: params.String() + " chain, client trusting the ML-DSA CA",
+		root: pqCA,
+		cert: tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: leafKey, Leaf: leaf},
+	}}
+	if !hybrid {
+		return scenarios, nil
+	}
+
+	// The regenerated CA with the ML-DSA CA key as alternative key
+	caTemplate := *setup.newCA
+	caTemplate.SignatureAlgorithm = x509util.SignatureAlgorithmFor(setup.caKey, x509.UnknownSignatureAlgorithm)
+	hybridCA, err := createHybridCertificate("create-ca", &caTemplate, nil, setup.caKey.Public(), setup.caKey, pqKey.PublicKey(), pqKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create hybrid CA: %w", err)
+	}
+	if err := saveCAToFile(hybridCA, "hybrid-ca.pem"); err != nil {
+		return nil, err
+	}
+	slog.Info("Saved hybrid CA", "file", "hybrid-ca.pem")
+
+	hybridLeafKey, err := setup.leafKey.or(keyTypes["p256"]).generate()
+	if err != nil {
+		return nil, err
+	}
+	template := leafTemplate()
+	template.SignatureAlgorithm = x509util.SignatureAlgorithmFor(setup.caKey, x509.UnknownSignatureAlgorithm)
+	hybridLeaf, err := createHybridCertificate("issue", template, hybridCA, hybridLeafKey.Public(), setup.caKey, nil, pqKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue hybrid leaf: %w", err)
+	}
+	for _, cert := range []*x509.Certificate{hybridCA, hybridLeaf} {
+		if err := verifyAltSignature(cert, pqKey.PublicKey()); err != nil {
+			return nil, err
+		}
+	}
+	slog.Info("Verified alternative ML-DSA signatures of the hybrid chain")
+
+	hybridCert := tls.Certificate{Certificate: [][]byte{hybridLeaf.Raw}, PrivateKey: hybridLeafKey, Leaf: hybridLeaf}
+	for _, c := range setup.chain {
+		hybridCert.Certificate = append(hybridCert.Certificate, c.Raw)
+	}
+	return append(scenarios,
+		benchScenario{name: "Hybrid chain, client trusting the original CA", root: setup.originalCA, cert: hybridCert},
+		benchScenario{name: "Hybrid chain, client trusting the hybrid CA", root: hybridCA, cert: hybridCert},
+	), nil
+}
+
+// createHybridCertificate signs template classically like
+// x509.CreateCertificate (self-signed if parent is nil) and adds an
+// alternative signature by altSigner, and the alternative public key
+// altPublic if not nil. The alternative signature covers the
+// tbsCertificate without the signature algorithm and the
+// altSignatureValue extension, so the certificate is created twice. It is
+// recorded as event.
+func createHybridCertificate(event string, template, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer, altPublic *mldsa.PublicKey, altSigner *mldsa.PrivateKey) (*x509.Certificate, error) {
+	if parent == nil {
+		parent = template
+	}
+	if template.SerialNumber == nil {
+		serial, err := newSerialNumber(parent)
+		if err != nil {
+			return nil, err
+		}
+		template.SerialNumber = serial
+	}
+	set, ok := mldsaParameterSets[mldsaLevel(altSigner.PublicKey().Parameters())]
+	if !ok {
+		return nil, fmt.Errorf("unsupported ML-DSA parameter set %s", altSigner.PublicKey().Parameters())
+	}
+	algorithm, err := asn1.Marshal(pkix.AlgorithmIdentifier{Algorithm: set.oid})
+	if err != nil {
+		return nil, err
+	}
+	template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oidExtensionAltSignatureAlgorithm, Value: algorithm})
+	if altPublic != nil {
+		spki, err := x509.MarshalPKIXPublicKey(altPublic)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oidExtensionSubjectAltPublicKeyInfo, Value: spki})
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return nil, err
+	}
+	preTBS, err := hybridPreTBS(der)
+	if err != nil {
+		return nil, err
+	}
+	altSignature, err := altSigner.Sign(rand.Reader, preTBS, &mldsa.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with ML-DSA: %w", err)
+	}
+	value, err := asn1.Marshal(asn1.BitString{Bytes: altSignature, BitLength: 8 * len(altSignature)})
+	if err != nil {
+		return nil, err
+	}
+	template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oidExtensionAltSignatureValue, Value: value})
+	der, err = x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return nil, err
+	}
+	return recordCertificate(event, der)
+}
+
+// verifyAltSignature checks the alternative signature of cert with the
+// alternative public key of its issuer.
+func verifyAltSignature(cert *x509.Certificate, issuerAltPublic *mldsa.PublicKey) error {
+	ext := x509util.FindExtension(cert, oidExtensionAltSignatureValue)
+	if ext == nil {
+		return fmt.Errorf("%s has no alternative signature", x509util.DescribeCert(cert))
+	}
+	var signature asn1.BitString
+	if _, err := asn1.Unmarshal(ext.Value, &signature); err != nil {
+		return fmt.Errorf("invalid altSignatureValue of %s: %w", x509util.DescribeCert(cert), err)
+	}
+	preTBS, err := hybridPreTBS(cert.Raw)
+	if err != nil {
+		return err
+	}
+	if err := mldsa.Verify(issuerAltPublic, preTBS, signature.Bytes, &mldsa.Options{}); err != nil {
+		return fmt.Errorf("alternative signature of %s does not verify: %w", x509util.DescribeCert(cert), err)
+	}
+	return nil
+}
+
+// hybridPreTBS returns the part of the certificate der covered by the
+// alternative signature: the tbsCertificate without the signature field
+// and the altSignatureValue extension.
+func hybridPreTBS(der []byte) ([]byte, error) {
+	var cert struct {
+		TBS       asn1.RawValue
+		Algorithm asn1.RawValue
+		Signature asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &cert); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	tbs, err := x509util.RewriteExtensions(cert.TBS.FullBytes, func(raw []byte, extension pkix.Extension) ([]byte, error) {
+		if extension.Id.Equal(oidExtensionAltSignatureValue) {
+			return nil, nil
+		}
+		return raw, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var tbsSeq asn1.RawValue
+	if _, err := asn1.Unmarshal(tbs, &tbsSeq); err != nil {
+		return nil, err
+	}
+	// version [0], serialNumber INTEGER, then the signature SEQUENCE
+	var fields []byte
+	removed := false
+	for rest := tbsSeq.Bytes; len(rest) > 0; {
+		var field asn1.RawValue
+		if rest, err = asn1.Unmarshal(rest, &field); err != nil {
+			return nil, fmt.Errorf("failed to parse tbsCertificate: %w", err)
+		}
+		if !removed && field.Class == asn1.ClassUniversal && field.Tag == asn1.TagSequence {
+			removed = true
+			continue
+		}
+		fields = append(fields, field.FullBytes...)
+	}
+	return x509util.MarshalConstructed(asn1.ClassUniversal, asn1.TagSequence, fields)
+}
+
+func mldsaLevel(params mldsa.Parameters) int {
+	for level, set := range mldsaParameterSets {
+		if set.params == params {
+			return level
+		}
+	}
+	return 0
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// clientProxy is the proxy of -proxy, nil to use the proxy of the
+// environment.
+var clientProxy *url.URL
+
+// registerProxy registers the -proxy flag of the modes running client
+// tests.
+func registerProxy(fs *flag.FlagSet) {
+	fs.Func("proxy", "Connect the test clients, check-chain and scan via this proxy, e.g. http://proxy.example.com:3128 (default HTTPS_PROXY and NO_PROXY, which never apply to localhost)", func(value string) error {
+		u, err := url.Parse(value)
+		if err != nil {
+			return err
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", u.Scheme)
+		}
+		if u.Host == "" {
+			return fmt.Errorf("proxy URL %q has no host", value)
+		}
+		clientProxy = u
+		return nil
+	})
+}
+
+// testClientProxy returns the proxy for a request of a test client: the
+// one of -proxy, or the one of HTTPS_PROXY and NO_PROXY.
+func testClientProxy(req *http.Request) (*url.URL, error) {
+	if clientProxy != nil {
+		return clientProxy, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// dialViaProxy connects to addr via network, or through the proxy
+// testClientProxy returns for it, like the HTTPS test clients do. The
+// proxy is always reached via TCP, whatever the IP family of network.
+func dialViaProxy(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	proxy, err := testClientProxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	port := proxy.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443", "socks5": "1080"}[proxy.Scheme]
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(proxy.Hostname(), port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxy.Redacted(), err)
+	}
+	if proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else if dialer.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(dialer.Timeout))
+	}
+	if proxy.Scheme == "socks5" {
+		err = socks5Connect(conn, proxy.User, addr)
+	} else {
+		err = httpConnect(conn, proxy.User, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Redacted(), err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// dialTLSViaProxy connects to addr like tls.DialWithDialer, through the
+// proxy for it.
+func dialTLSViaProxy(timeout time.Duration, network, addr string, config *tls.Config) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	rawConn, err := dialViaProxy(ctx, &net.Dialer{}, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(rawConn, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// httpConnect opens a tunnel to addr through the HTTP proxy connected to
+// via conn.
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) error {
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// The proxy only sends data of the tunnel after the client did, so
+	// nothing beyond the response is buffered
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT to %s failed: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// socks5Connect opens a tunnel to addr through the SOCKS5 proxy connected
+// to via conn (RFC 1928), authenticating with user if given (RFC 1929).
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portString)
+	}
+	method := byte(0x00)
+	if user != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("SOCKS5 proxy refused the authentication method")
+	}
+	if user != nil {
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 user name or password too long")
+		}
+		auth := append([]byte{0x01, byte(len(user.Username()))}, user.Username()...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip.To4() != nil {
+		req = append(append(req, 0x01), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 0x04), ip...)
+	} else if len(host) <= 255 {
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	} else {
+		return fmt.Errorf("host name %q too long", host)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	// Version, status, reserved and the type of the bound address
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("SOCKS5 CONNECT to %s failed with status %d", addr, header[1])
+	}
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("invalid SOCKS5 address type %d", header[3])
+	}
+	// The bound address and port
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// pssAlgorithmIdentifier returns an encoded RSA-PSS AlgorithmIdentifier
+// with the signature hash, the MGF1 hash and the salt length.
+func pssAlgorithmIdentifier(t *testing.T, hash asn1.ObjectIdentifier, mgfHash asn1.ObjectIdentifier, saltLength int) []byte {
+	t.Helper()
+	mgfHashDER, err := asn1.Marshal(pkix.AlgorithmIdentifier{Algorithm: mgfHash, Parameters: asn1.NullRawValue})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := asn1.Marshal(x509util.PSSSignatureParameters{
+		Hash:         pkix.AlgorithmIdentifier{Algorithm: hash, Parameters: asn1.NullRawValue},
+		MaskGen:      pkix.AlgorithmIdentifier{Algorithm: x509util.OIDMGF1, Parameters: asn1.RawValue{FullBytes: mgfHashDER}},
+		SaltLength:   saltLength,
+		TrailerField: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(pkix.AlgorithmIdentifier{Algorithm: x509util.OIDRSASSAPSS, Parameters: asn1.RawValue{FullBytes: params}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// newPSSTestCA returns a CA signed with RSA-PSS with SHA-256 and the
+// algorithm identifier of pss, which Go cannot create itself.
+func newPSSTestCA(t *testing.T, pss *x509util.PSSSignature) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	ca, key := newTestCA(t, "rsa2048", func(template *x509.Certificate) {
+		template.SignatureAlgorithm = x509.SHA256WithRSAPSS
+	})
+	der, err := pss.SignAgain(rand.Reader, ca.Raw, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+func TestRegenerateKeepsPSSParameters(t *testing.T) {
+	// A salt of 20 bytes, as with SHA-1, is shorter than the hash, Go
+	// neither signs nor verifies certificates with it
+	want := &x509util.PSSSignature{Hash: crypto.SHA256, SaltLength: 20, Algorithm: pssAlgorithmIdentifier(t, x509util.OIDSHA256, x509util.OIDSHA256, 20)}
+	original, key := newPSSTestCA(t, want)
+	if original.SignatureAlgorithm != x509.UnknownSignatureAlgorithm {
+		t.Fatalf("Go parsed the signature algorithm of the original CA as %s", original.SignatureAlgorithm)
+	}
+	if err := x509util.CheckSignedBy(original, original); err != nil {
+		t.Fatalf("the self-signature of the original CA does not verify: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		opts []caregen.Option
+	}{
+		{"regenerate", nil},
+		{"minimal diff", []caregen.Option{caregen.WithMinimalDiff()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newCA, err := caregen.Regenerate(context.Background(), original, key, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := x509util.ParsePSSSignature(newCA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == nil {
+				t.Fatalf("the regenerated CA is signed with %s instead of RSA-PSS", newCA.SignatureAlgorithm)
+			}
+			if got.Hash != want.Hash || got.SaltLength != want.SaltLength || !bytes.Equal(got.Algorithm, want.Algorithm) {
+				t.Errorf("the regenerated CA is signed with RSA-PSS with %s and a salt of %d bytes, want %s and %d bytes", got.Hash, got.SaltLength, want.Hash, want.SaltLength)
+			}
+			if err := x509util.CheckSignedBy(newCA, newCA); err != nil {
+				t.Errorf("the self-signature of the regenerated CA does not verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestRegenerateRefusesUnsupportedPSSParameters(t *testing.T) {
+	// Go only generates the mask with the signature hash
+	original, key := newPSSTestCA(t, &x509util.PSSSignature{Hash: crypto.SHA256, SaltLength: 32, Algorithm: pssAlgorithmIdentifier(t, x509util.OIDSHA256, oidSHA1, 32)})
+	if newCA, err := caregen.Regenerate(context.Background(), original, key); err == nil {
+		t.Errorf("regenerating a CA signed with MGF1 with SHA-1 succeeded with %s instead of failing", newCA.SignatureAlgorithm)
+	}
+	if _, err := caregen.Regenerate(context.Background(), original, key, caregen.WithMinimalDiff()); err == nil {
+		t.Error("minimal-diff regeneration of a CA signed with MGF1 with SHA-1 succeeded instead of failing")
+	}
+}
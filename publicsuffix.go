@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// publicSuffixList holds the rules of the Public Suffix List
+// (https://publicsuffix.org/list/), for which wildcard certificates are
+// refused. Internationalized rules are stored as A-labels, the form of
+// DNS names in certificates.
+type publicSuffixList struct {
+	rules map[string]bool
+	// wildcards are the rules *.<suffix>, stored as <suffix>.
+	wildcards  map[string]bool
+	exceptions map[string]bool
+}
+
+// publicSuffixes is the list wildcards are checked against. Without
+// -public-suffix-list it is a small built-in excerpt of common suffixes
+// with more than one label, which is a best-effort heuristic only, as the
+// list is not part of the standard library.
+var publicSuffixes = publicSuffixList{rules: map[string]bool{
+	"co.uk": true, "org.uk": true, "ac.uk": true, "gov.uk": true,
+	"com.au": true, "net.au": true, "org.au": true,
+	"co.jp": true, "ne.jp": true, "or.jp": true,
+	"co.nz": true, "co.za": true, "co.in": true, "co.kr": true,
+	"com.br": true, "com.cn": true, "com.mx": true, "com.tr": true,
+	"github.io": true, "herokuapp.com": true, "appspot.com": true,
+	"cloudfront.net": true, "s3.amazonaws.com": true, "azurewebsites.net": true,
+}}
+
+// registerPublicSuffixList registers the -public-suffix-list flag. The
+// names in checked may be given before it and are checked again once the
+// list is loaded.
+func registerPublicSuffixList(fs *flag.FlagSet, checked *[]string) {
+	fs.Func("public-suffix-list", "Refuse wildcard names for the public suffixes of this `file` in the format of the Public Suffix List (public_suffix_list.dat) instead of a small built-in excerpt", func(file string) error {
+		data, err := readInput(file)
+		if err != nil {
+			return err
+		}
+		if publicSuffixes, err = parsePublicSuffixList(data); err != nil {
+			return fmt.Errorf("invalid public suffix list %s: %w", file, err)
+		}
+		if checked != nil {
+			for _, name := range *checked {
+				if err := checkWildcard(name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// parsePublicSuffixList parses the rules of a list in the format of the
+// Public Suffix List: one rule per line, up to the first white space,
+// with comments starting with //.
+func parsePublicSuffixList(data []byte) (publicSuffixList, error) {
+	list := publicSuffixList{rules: map[string]bool{}, wildcards: map[string]bool{}, exceptions: map[string]bool{}}
+	lines := bufio.NewScanner(bytes.NewReader(data))
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule, err := aLabels(strings.ToLower(fields[0]))
+		if err != nil {
+			return list, err
+		}
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			list.exceptions[rule[1:]] = true
+		case strings.HasPrefix(rule, "*."):
+			list.wildcards[rule[2:]] = true
+		default:
+			list.rules[rule] = true
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return list, err
+	}
+	if len(list.rules)+len(list.wildcards) == 0 {
+		return list, fmt.Errorf("no rules")
+	}
+	return list, nil
+}
+
+// isPublicSuffix returns whether domain, in lower case and without the
+// trailing dot, is a public suffix. As with the implicit rule * of the
+// list, every single label is one.
+func (l publicSuffixList) isPublicSuffix(domain string) bool {
+	if l.exceptions[domain] {
+		return false
+	}
+	_, parent, ok := strings.Cut(domain, ".")
+	return !ok || l.rules[domain] || l.wildcards[parent]
+}
+
+// aLabels converts the internationalized labels of a domain to their
+// A-label form with Punycode (RFC 3492).
+func aLabels(domain string) (string, error) {
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if !utf8.ValidString(label) {
+			return "", fmt.Errorf("invalid UTF-8 in %q", domain)
+		}
+		for _, r := range label {
+			if r >= 0x80 {
+				labels[i] = "xn--" + punycode(label)
+				break
+			}
+		}
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// punycode encodes label with the Punycode parameters of IDNA.
+func punycode(label string) string {
+	const base, tMin, tMax, skew, damp = 36, 1, 26, 38, 700
+	digit := func(d int) byte {
+		if d < 26 {
+			return byte('a' + d)
+		}
+		return byte('0' + d - 26)
+	}
+	adapt := func(delta, points int, first bool) int {
+		if first {
+			delta /= damp
+		} else {
+			delta /= 2
+		}
+		delta += delta / points
+		k := 0
+		for delta > (base-tMin)*tMax/2 {
+			delta /= base - tMin
+			k += base
+		}
+		return k + (base-tMin+1)*delta/(delta+skew)
+	}
+
+	runes := []rune(label)
+	var out []byte
+	for _, r := range runes {
+		if r < 0x80 {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := 0x80, 0, 72
+	for handled := basic; handled < len(runes); {
+		m := int(utf8.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := base; ; k += base {
+				t := min(max(k-bias, tMin), tMax)
+				if q < t {
+					break
+				}
+				out = append(out, digit(t+(q-t)%(base-t)))
+				q = (q - t) / (base - t)
+			}
+			out = append(out, digit(q))
+			bias = adapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testPublicSuffixList is an excerpt of the Public Suffix List with the
+// suffixes the built-in excerpt misses.
+const testPublicSuffixList = `// ===BEGIN ICANN DOMAINS===
+com
+au
+com.au
+gov.au
+ck
+*.ck
+!www.ck
+cn
+公司.cn
+
+// ===BEGIN PRIVATE DOMAINS===
+blogspot.com
+`
+
+func TestPunycode(t *testing.T) {
+	for label, want := range map[string]string{
+		"公司":      "55qx5d",
+		"münchen": "mnchen-3ya",
+		"bücher":  "bcher-kva",
+		"ελ":      "qxam",
+	} {
+		if got := punycode(label); got != want {
+			t.Errorf("punycode(%q) = %q, want %q", label, got, want)
+		}
+	}
+}
+
+func TestCheckWildcardPublicSuffixList(t *testing.T) {
+	builtin := publicSuffixes
+	t.Cleanup(func() { publicSuffixes = builtin })
+	// The built-in excerpt misses these
+	if err := checkWildcard("*.gov.au"); err != nil {
+		t.Fatalf("the built-in excerpt refuses *.gov.au: %v", err)
+	}
+	list, err := parsePublicSuffixList([]byte(testPublicSuffixList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicSuffixes = list
+
+	for name, public := range map[string]bool{
+		"*.com":                  true,
+		"*.gov.au":               true,
+		"*.blogspot.com":         true,
+		"*.Blogspot.com.":        true,
+		"*.example.ck":           true,
+		"*.xn--55qx5d.cn":        true,
+		"*.www.ck":               false,
+		"*.example.gov.au":       false,
+		"*.example.com":          false,
+		"*.example.blogspot.com": false,
+		"*.xn--85x722f.cn":       false,
+	} {
+		if err := checkWildcard(name); (err != nil) != public {
+			t.Errorf("checkWildcard(%q) = %v, want a public suffix error: %t", name, err, public)
+		}
+	}
+}
+
+func TestPublicSuffixListFlagChecksEarlierNames(t *testing.T) {
+	builtin := publicSuffixes
+	t.Cleanup(func() { publicSuffixes = builtin })
+	file := filepath.Join(t.TempDir(), "public_suffix_list.dat")
+	if err := os.WriteFile(file, []byte(testPublicSuffixList), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var leaf leafOptions
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	leaf.register(fs)
+	if err := fs.Parse([]string{"-dns", "*.gov.au", "-public-suffix-list", file}); err == nil {
+		t.Error("-dns *.gov.au before -public-suffix-list was accepted")
+	}
+}
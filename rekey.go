@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// Creates a successor of the regenerated CA with the same subject and
+// constraints but a new key, and cross-signs it with the regenerated CA,
+// so clients which only trust the current CA accept certificates of the
+// successor while it is rolled out as new trust anchor.
+func runRekey(args []string) {
+	fs := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	var caOpts caOptions
+	// Only the CA is needed, the successor is the output
+	caOpts.registerInput(fs)
+	keyType := fs.String("key-type", "p384", "Type of the new CA key: rsa2048, rsa3072, rsa4096, p256, p384 or ed25519")
+	out := fs.String("out", "rekeyed-ca", "Base name of the written successor CA (<out>.pem, <out>-key.pem) and its cross certificate (<out>-cross.pem)")
+	var encryptTo keyRecipients
+	encryptTo.register(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	spec, ok := keyTypes[*keyType]
+	if !caOpts.valid() || !ok || fs.NArg() > 0 {
+		usageError("go run *.go rekey (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-key-type p384] [-out rekeyed-ca] [-encrypt-to recipient]")
+	}
+
+	setup := loadCAs(caOpts)
+	if err := rekeyCA(setup.newCA, setup.caKey, spec, *out, &encryptTo); err != nil {
+		exitWith(exitRegenerationFailed, "Failed to re-key the CA", "error", err)
+	}
+}
+
+// rekeyCA creates the successor of ca with a new key of spec and its
+// cross certificate issued by ca, and writes them with the base name out.
+func rekeyCA(ca *x509.Certificate, caKey crypto.Signer, spec keySpec, out string, encryptTo *keyRecipients) error {
+	key, err := spec.generate()
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	successor, err := successorCA(ca, key)
+	if err != nil {
+		return fmt.Errorf("failed to create successor CA: %w", err)
+	}
+	if err := saveCAToFile(successor, out+".pem"); err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyFile, err := encryptTo.writeKey(out+"-key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	slog.Info("Created successor CA", "cert", out+".pem", "key", keyFile, "subject", successor.Subject.String(), "key_type", x509util.DescribePublicKey(key.Public()), "not_after", successor.NotAfter.Format(time.RFC3339))
+
+	cross, err := crossCertificate(successor, ca, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to cross-sign the successor CA: %w", err)
+	}
+	writeIssued(out+"-cross", cross)
+	return nil
+}
+
+// successorCA returns a self-signed CA with the subject, constraints and
+// key usages of ca and key. It is valid as long as ca was, from now on.
+func successorCA(ca *x509.Certificate, key crypto.Signer) (*x509.Certificate, error) {
+	template := caTemplate(ca)
+	// A new identifier is derived from the new key
+	template.SubjectKeyId = nil
+	template.NotBefore = now.Now().Add(-time.Minute)
+	template.NotAfter = template.NotBefore.Add(ca.NotAfter.Sub(ca.NotBefore))
+	return signCertificate(template, key, template, key.Public(), nil)
+}
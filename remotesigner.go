@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// Remote signing service (proto/signer.proto), served over gRPC with
+// mutual TLS so the CA key can stay on a locked-down host.
+const (
+	signerPublicKeyPath = "/caregen.signer.v1.Signer/PublicKey"
+	signerSignPath      = "/caregen.signer.v1.Signer/Sign"
+)
+
+// signerHashes are the hash functions accepted by the signing service.
+var signerHashes = []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512}
+
+func runSignerServer(args []string) {
+	fs := flag.NewFlagSet("signer-server", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.registerInput(fs)
+	addr := fs.String("addr", "localhost:8444", "Address for the signing service to listen on")
+	tlsCertFile := fs.String("tls-cert", "", "PEM file with the server certificate (and chain) of the signing service")
+	tlsKeyFile := fs.String("tls-key", "", "PEM file with the private key of the server certificate")
+	clientCAFile := fs.String("client-ca", "", "PEM file with the CA(s) client certificates must chain to")
+	registerShutdown(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	keyGiven := caOpts.externalKeys() == 1 || (caOpts.externalKeys() == 0 && (caOpts.bundleFile != "" || caOpts.keyFile != ""))
+	if !keyGiven || *tlsCertFile == "" || *tlsKeyFile == "" || *clientCAFile == "" {
+		usageError("go run *.go signer-server (-ca <ca-bundle.pem> | -ca-key <ca-key.pem> | -gcp-kms-key <key> | -pkcs11-module <module> -pkcs11-key-label <label> | -yubikey-slot 9c | -tpm-key <handle>) -tls-cert <server.pem> -tls-key <server-key.pem> -client-ca <client-ca.pem> [-addr host:port]")
+	}
+
+	signer, err := caOpts.signer()
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA key", "error", err)
+	}
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to encode public key", "error", err)
+	}
+
+	tlsCert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		fatal("Failed to load server certificate", "error", err)
+	}
+	clientCAs, err := loadCertificates(*clientCAFile)
+	if err != nil {
+		fatal("Failed to load client CA", "error", err)
+	}
+	clientPool := x509.NewCertPool()
+	for _, cert := range clientCAs {
+		clientPool.AddCert(cert)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(signerPublicKeyPath, grpcUnaryHandler(func(r *http.Request, req []byte) ([]byte, error) {
+		var resp []byte
+		resp = appendProtoBytes(resp, 1, publicKeyDER)
+		if algorithm := x509util.SignatureAlgorithmFor(signer, x509.UnknownSignatureAlgorithm); algorithm != x509.UnknownSignatureAlgorithm {
+			resp = appendProtoBytes(resp, 2, []byte(algorithm.String()))
+		}
+		return resp, nil
+	}))
+	mux.HandleFunc(signerSignPath, grpcUnaryHandler(func(r *http.Request, req []byte) ([]byte, error) {
+		msg, err := parseProtoMessage(req)
+		if err != nil {
+			return nil, err
+		}
+		var opts crypto.SignerOpts = crypto.Hash(0)
+		if name := string(msg.bytes[2]); name != "" {
+			hash, ok := hashByName(name)
+			if !ok {
+				return nil, fmt.Errorf("unsupported hash %s", name)
+			}
+			opts = hash
+			if msg.varints[3] != 0 {
+				opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}
+			}
+		}
+		signature, err := signer.Sign(rand.Reader, msg.bytes[1], opts)
+		if err != nil {
+			slog.Error("Signing failed", "client", r.TLS.PeerCertificates[0].Subject.String(), "error", err)
+			return nil, err
+		}
+		slog.Info("Signed digest", "client", r.TLS.PeerCertificates[0].Subject.String(), "hash", opts.HashFunc().String())
+		return appendProtoBytes(nil, 1, signature), nil
+	}))
+
+	server := &http.Server{
+		Addr: *addr,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{tlsCert},
+			ClientCAs:    clientPool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			NextProtos:   []string{"h2"},
+			MinVersion:   tls.VersionTLS12,
+		},
+		Handler:  mux,
+		ErrorLog: serverErrorLog(),
+	}
+	slog.Info("Signing service started", "addr", *addr, "key", x509util.DescribePublicKey(signer.Public()))
+	if err := serveUntilSignal(server); err != nil {
+		fatal("Signing service failed", "error", err)
+	}
+}
+
+func hashByName(name string) (crypto.Hash, bool) {
+	for _, hash := range signerHashes {
+		if hash.String() == name {
+			return hash, true
+		}
+	}
+	return 0, false
+}
+
+func init() {
+	caregen.RegisterSignerBackend(func() caregen.SignerBackend { return &remoteSignerOptions{} })
+}
+
+// remoteSignerOptions selects a CA key held by a signer-server.
+type remoteSignerOptions struct {
+	addr     string
+	certFile string
+	keyFile  string
+	caFile   string
+}
+
+func (o *remoteSignerOptions) Register(fs *flag.FlagSet) {
+	fs.StringVar(&o.addr, "remote-signer", "", "Sign with the key of the signer-server at this host:port instead of a CA key file")
+	fs.StringVar(&o.certFile, "remote-signer-cert", "", "PEM file with the client certificate for the signer-server")
+	fs.StringVar(&o.keyFile, "remote-signer-key", "", "PEM file with the private key of the client certificate")
+	fs.StringVar(&o.caFile, "remote-signer-ca", "", "PEM file with the CA of the signer-server's certificate (default: system roots)")
+}
+
+func (o *remoteSignerOptions) Selected() bool {
+	return o.addr != ""
+}
+
+// remoteSigner is a crypto.Signer forwarding all signatures to a
+// signer-server.
+type remoteSigner struct {
+	addr      string
+	client    *http.Client
+	public    crypto.PublicKey
+	algorithm x509.SignatureAlgorithm
+}
+
+func (o *remoteSignerOptions) Signer() (crypto.Signer, error) {
+	if o.certFile == "" || o.keyFile == "" {
+		return nil, fmt.Errorf("-remote-signer-cert and -remote-signer-key are required, the signer-server only accepts mutual TLS")
+	}
+	clientCert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{clientCert}}
+	if o.caFile != "" {
+		cas, err := loadCertificates(o.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load signer-server CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		for _, cert := range cas {
+			tlsConfig.RootCAs.AddCert(cert)
+		}
+	}
+
+	s := &remoteSigner{
+		addr: o.addr,
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true},
+			Timeout:   2 * time.Minute,
+		},
+	}
+	resp, err := callGRPC(s.client, "https://"+o.addr+signerPublicKeyPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key from signer-server: %w", err)
+	}
+	msg, err := parseProtoMessage(resp)
+	if err != nil {
+		return nil, err
+	}
+	s.public, err = x509.ParsePKIXPublicKey(msg.bytes[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key from signer-server: %w", err)
+	}
+	if name := string(msg.bytes[2]); name != "" {
+		for algorithm := x509.SignatureAlgorithm(1); algorithm < 64; algorithm++ {
+			if algorithm.String() == name {
+				s.algorithm = algorithm
+			}
+		}
+		if s.algorithm == x509.UnknownSignatureAlgorithm {
+			return nil, fmt.Errorf("signer-server key requires unknown signature algorithm %s", name)
+		}
+	}
+	slog.Debug("Using remote signer", "addr", o.addr, "key", x509util.DescribePublicKey(s.public))
+	return s, nil
+}
+
+func (s *remoteSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// SignatureAlgorithm returns the algorithm the remote key is restricted
+// to, if any.
+func (s *remoteSigner) SignatureAlgorithm() x509.SignatureAlgorithm {
+	return s.algorithm
+}
+
+func (s *remoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var req []byte
+	req = appendProtoBytes(req, 1, digest)
+	if hash := opts.HashFunc(); hash != 0 {
+		req = appendProtoBytes(req, 2, []byte(hash.String()))
+	}
+	if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+		if pssOpts.SaltLength != rsa.PSSSaltLengthEqualsHash && pssOpts.SaltLength != opts.HashFunc().Size() {
+			return nil, fmt.Errorf("unsupported PSS salt length %d", pssOpts.SaltLength)
+		}
+		req = appendProtoVarint(req, 3, 1)
+	}
+	resp, err := callGRPC(s.client, "https://"+s.addr+signerSignPath, req)
+	if err != nil {
+		return nil, fmt.Errorf("remote signing failed: %w", err)
+	}
+	msg, err := parseProtoMessage(resp)
+	if err != nil {
+		return nil, err
+	}
+	return msg.bytes[1], nil
+}
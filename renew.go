@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// renewPolicy is the policy of a renewal run, so batch renewals comply
+// with the policy of the organization.
+type renewPolicy struct {
+	// rekey generates new keys instead of reusing the existing ones.
+	rekey bool
+	// validity is the validity of renewed certificates, zero for the one
+	// of each certificate.
+	validity time.Duration
+	// maxValidity caps the validity, zero for no cap.
+	maxValidity time.Duration
+}
+
+// Renews leaf certificates from the regenerated CA, keeping their keys,
+// subjects, SANs and usages, the most common migration operation for
+// running services. Unlike resign, the certificates get a new serial and
+// a fresh validity.
+func runRenew(args []string) {
+	fs := flag.NewFlagSet("renew", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	outDir := fs.String("out-dir", "renewed", "Directory to write the renewed certificates to, as <name>.pem")
+	var policy renewPolicy
+	fs.DurationVar(&policy.validity, "cert-validity", 0, "Validity of the renewed certificates (default the validity of each certificate)")
+	fs.DurationVar(&policy.maxValidity, "max-validity", 0, "Cap the validity of renewed certificates, e.g. 9528h (397 days) for publicly trusted TLS certificates")
+	keyPolicy := fs.String("key-policy", "reuse", "Keep the key of each certificate (reuse) or generate a new one (rekey), of the same type unless -leaf-key-type is given")
+	var encryptTo keyRecipients
+	encryptTo.register(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() || fs.NArg() == 0 || policy.validity < 0 || policy.maxValidity < 0 || (*keyPolicy != "reuse" && *keyPolicy != "rekey") {
+		usageError("go run *.go renew (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-out-dir renewed] [-cert-validity 8760h] [-max-validity 9528h] [-key-policy reuse|rekey] [-encrypt-to recipient] <cert.pem>...")
+	}
+	policy.rekey = *keyPolicy == "rekey"
+	setup := loadCAs(caOpts)
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		fatal("Failed to create output directory", "dir", *outDir, "error", err)
+	}
+
+	failed := 0
+	for _, file := range fs.Args() {
+		cert, key, err := renewCertificate(file, setup, policy, &caOpts.leaf)
+		if err != nil {
+			slog.Error("Failed to renew certificate", "file", file, "error", err)
+			failed++
+			continue
+		}
+		out := filepath.Join(*outDir, certificateBaseName(file))
+		writeIssued(out, cert)
+		if key == nil {
+			continue
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			fatal("Failed to encode key", "error", err)
+		}
+		keyFile, err := encryptTo.writeKey(out+"-key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+		if err != nil {
+			exitWith(exitFailure, "Failed to write key", "file", keyFile, "error", err)
+		}
+		slog.Info("Wrote key", "file", keyFile, "key", x509util.DescribePublicKey(key.Public()))
+	}
+	if failed > 0 {
+		exitWith(exitRegenerationFailed, "Failed to renew certificates", "failed", failed, "total", fs.NArg())
+	}
+}
+
+// renewCertificate issues a new certificate for the certificate in file
+// from the regenerated CA. The key is read from the file or from
+// <name>-key.pem next to it and must match the certificate; with rekey it
+// is not needed and the new key is returned.
+func renewCertificate(file string, setup *caSetup, policy renewPolicy, leaf *leafOptions) (*x509.Certificate, crypto.Signer, error) {
+	certs, err := loadCertificates(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert := certs[0]
+	if cert.IsCA {
+		return nil, nil, fmt.Errorf("%s is a CA certificate", cert.Subject)
+	}
+	pub := cert.PublicKey
+	var newKey crypto.Signer
+	if policy.rekey {
+		if newKey, err = setup.leafKey.or(keySpecOf(cert.PublicKey)).generate(); err != nil {
+			return nil, nil, err
+		}
+		pub = newKey.Public()
+	} else {
+		key, err := loadLeafKey(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !x509util.IsPublicKey(cert.PublicKey, key.Public()) {
+			return nil, nil, caregen.ErrKeyMismatch
+		}
+	}
+
+	validity := policy.validity
+	if validity == 0 {
+		validity = cert.NotAfter.Sub(cert.NotBefore)
+	}
+	if policy.maxValidity != 0 && validity > policy.maxValidity {
+		slog.Info("Capping the validity of the renewed certificate", "file", file, "validity", validity.String(), "max_validity", policy.maxValidity.String())
+		validity = policy.maxValidity
+	}
+	template := renewalTemplate(cert, validity)
+	leaf.addMustStaple(template)
+	renewed, err := signCertificate(setup.newCA, setup.caKey, template, pub, leaf.ctLogs)
+	return renewed, newKey, err
+}
+
+// keySpecOf returns the type of the key pub, so new keys have the type of
+// the key they replace.
+func keySpecOf(pub crypto.PublicKey) keySpec {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return keySpec{"rsa", max(pub.N.BitLen(), 2048)}
+	case *ecdsa.PublicKey:
+		if size := pub.Curve.Params().BitSize; size == 384 || size == 521 {
+			return keySpec{"ecdsa", size}
+		}
+		return keySpec{"ecdsa", 256}
+	case ed25519.PublicKey:
+		return keySpec{"ed25519", 0}
+	}
+	return keyTypes["p256"]
+}
+
+// renewalTemplate returns the template of a renewal of cert: subject,
+// SANs, usages and OCSP Must-Staple are kept, serial and validity are new.
+func renewalTemplate(cert *x509.Certificate, validity time.Duration) *x509.Certificate {
+	template := &x509.Certificate{
+		RawSubject:         cert.RawSubject,
+		DNSNames:           cert.DNSNames,
+		IPAddresses:        cert.IPAddresses,
+		EmailAddresses:     cert.EmailAddresses,
+		URIs:               cert.URIs,
+		NotBefore:          now.Now().Add(-time.Minute),
+		NotAfter:           now.Now().Add(validity),
+		KeyUsage:           cert.KeyUsage,
+		ExtKeyUsage:        cert.ExtKeyUsage,
+		UnknownExtKeyUsage: cert.UnknownExtKeyUsage,
+	}
+	if hasMustStaple(cert) {
+		template.ExtraExtensions = []pkix.Extension{{Id: oidExtensionTLSFeature, Value: mustStapleFeature}}
+	}
+	return template
+}
+
+// loadLeafKey loads the private key of the certificate in file, from the
+// file itself or from <name>-key.pem next to it, as written by issue.
+func loadLeafKey(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if block := findPEMBlock(data, "PRIVATE KEY"); block == nil || !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+		keyFile := filepath.Join(filepath.Dir(file), certificateBaseName(file)+"-key.pem")
+		if data, err = os.ReadFile(keyFile); err != nil {
+			return nil, fmt.Errorf("no private key in the file and %w", err)
+		}
+	}
+	return parsePrivateKey(data)
+}
+
+// certificateBaseName returns the name of a certificate file without
+// directory and extension.
+func certificateBaseName(file string) string {
+	name := filepath.Base(file)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
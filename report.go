@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"html/template"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// reportProperty is a row of the CA comparison table.
+type reportProperty struct {
+	Name     string
+	Original string
+	New      string
+}
+
+func (p reportProperty) Changed() bool {
+	return p.Original != p.New
+}
+
+// reportData is passed to htmlReportTemplate.
+type reportData struct {
+	Generated  string
+	Success    bool
+	Properties []reportProperty
+	ServerCert []reportProperty
+	CAs        []string
+	Clients    []string
+	Matrix     map[string]map[string]compatResult
+}
+
+// certificateProperties returns the properties shown in the report, in
+// display order. The names are the same for every certificate.
+func certificateProperties(cert *x509.Certificate) []reportProperty {
+	basicConstraints := "absent"
+	if ext := x509util.FindExtension(cert, oidExtensionBasicConstraints); ext != nil {
+		basicConstraints = fmt.Sprintf("CA:%t", cert.IsCA)
+		if ext.Critical {
+			basicConstraints += " (critical)"
+		} else {
+			basicConstraints += " (non-critical)"
+		}
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	return []reportProperty{
+		{Name: "Subject", Original: cert.Subject.String()},
+		{Name: "Issuer", Original: cert.Issuer.String()},
+		{Name: "Serial Number", Original: x509util.FormatHex(cert.SerialNumber.Bytes())},
+		{Name: "Not Before", Original: cert.NotBefore.UTC().Format(time.RFC3339)},
+		{Name: "Not After", Original: cert.NotAfter.UTC().Format(time.RFC3339)},
+		{Name: "Signature Algorithm", Original: cert.SignatureAlgorithm.String()},
+		{Name: "Public Key", Original: x509util.DescribePublicKey(cert.PublicKey)},
+		{Name: "Basic Constraints", Original: basicConstraints},
+		{Name: "Key Usage", Original: strings.Join(x509util.KeyUsageStrings(cert.KeyUsage), ", ")},
+		{Name: "Extended Key Usage", Original: strings.Join(x509util.ExtKeyUsageStrings(cert), ", ")},
+		{Name: "Subject Key ID", Original: x509util.FormatHex(cert.SubjectKeyId)},
+		{Name: "Authority Key ID", Original: x509util.FormatHex(cert.AuthorityKeyId)},
+		{Name: "SHA-256 Fingerprint", Original: x509util.FormatHex(fingerprint[:])},
+	}
+}
+
+// writeHTMLReport writes a self-contained HTML page comparing the original
+// and the new CA and showing the results of the compatibility tests.
+func writeHTMLReport(filename string, originalCA, newCA, serverCert *x509.Certificate, results []compatResult) error {
+	data := reportData{
+		Generated:  time.Now().UTC().Format(time.RFC3339),
+		Success:    true,
+		Properties: certificateProperties(originalCA),
+		ServerCert: certificateProperties(serverCert),
+		Matrix:     map[string]map[string]compatResult{},
+	}
+	for i, p := range certificateProperties(newCA) {
+		data.Properties[i].New = p.Original
+	}
+
+	for _, r := range results {
+		if _, ok := data.Matrix[r.Client]; !ok {
+			data.Clients = append(data.Clients, r.Client)
+			data.Matrix[r.Client] = map[string]compatResult{}
+		}
+		if !containsString(data.CAs, r.CA) {
+			data.CAs = append(data.CAs, r.CA)
+		}
+		data.Matrix[r.Client][r.CA] = r
+		if r.Err != nil {
+			data.Success = false
+		}
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create report file: %w", err)
+	}
+	defer f.Close()
+
+	if err := htmlReportTemplate.Execute(f, data); err != nil {
+		return fmt.Errorf("failed to render report: %w", err)
+	}
+
+	return f.Close()
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>CA Regeneration Compatibility Report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.6em; }
+h2 { font-size: 1.2em; margin-top: 2em; }
+table { border-collapse: collapse; margin-top: 0.5em; }
+th, td { border: 1px solid #ccc; padding: 0.4em 0.8em; text-align: left; vertical-align: top; }
+th { background: #f3f3f3; }
+td.mono { font-family: Menlo, Consolas, monospace; font-size: 0.85em; word-break: break-all; }
+tr.changed td { background: #fff8dc; }
+.pass { color: #1a7f37; font-weight: bold; }
+.fail { color: #cf222e; font-weight: bold; }
+.error { font-family: Menlo, Consolas, monospace; font-size: 0.85em; color: #cf222e; }
+.banner { padding: 0.8em 1em; border-radius: 4px; }
+.banner.pass { background: #dafbe1; }
+.banner.fail { background: #ffebe9; }
+</style>
+</head>
+<body>
+<h1>CA Regeneration Compatibility Report</h1>
+<p>Generated {{.Generated}}</p>
+{{if .Success}}
+<p class="banner pass">All clients accepted the server certificate issued by the regenerated CA, using either the original or the regenerated CA as trust root.</p>
+{{else}}
+<p class="banner fail">At least one client rejected the server certificate issued by the regenerated CA.</p>
+{{end}}
+
+<h2>Original vs. Regenerated CA</h2>
+<table>
+<tr><th>Property</th><th>Original CA</th><th>Regenerated CA</th></tr>
+{{range .Properties}}<tr{{if .Changed}} class="changed"{{end}}><th>{{.Name}}</th><td class="mono">{{.Original}}</td><td class="mono">{{.New}}</td></tr>
+{{end}}</table>
+<p>Highlighted rows differ between the original and the regenerated CA.</p>
+
+<h2>Test Matrix</h2>
+<table>
+<tr><th>Client</th>{{range .CAs}}<th>Trusting {{.}}</th>{{end}}</tr>
+{{range $client := .Clients}}<tr><th>{{$client}}</th>{{range $ca := $.CAs}}{{with index $.Matrix $client $ca}}<td>{{if .Err}}<span class="fail">FAIL</span><div class="error">{{.Err}}</div>{{else}}<span class="pass">PASS</span>{{end}} <small>({{.Duration}})</small>{{if .SCTs}}<div><small>SCTs: {{.SCTs}}</small></div>{{end}}</td>{{end}}{{end}}</tr>
+{{end}}</table>
+
+<h2>Server Certificate</h2>
+<table>
+{{range .ServerCert}}<tr><th>{{.Name}}</th><td class="mono">{{.Original}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
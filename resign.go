@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// resignStats counts the certificates processed by the workers.
+type resignStats struct {
+	resigned, skipped, failed, files, read atomic.Int64
+}
+
+// resignInput is a file to re-sign and its name in the output directory.
+type resignInput struct {
+	path, rel string
+	size      int64
+}
+
+// resignJob is a certificate re-signed by the worker pool, which sends
+// the result to the buffered result channel.
+type resignJob struct {
+	der    []byte
+	result chan resignResult
+}
+
+type resignResult struct {
+	der []byte
+	err error
+}
+
+// pendingBlock is a block of a file waiting to be written, in the order
+// of the input. result is nil for blocks copied unchanged.
+type pendingBlock struct {
+	block  *pem.Block
+	result chan resignResult
+	err    error
+}
+
+// Re-signs certificates issued by the original CA under the regenerated
+// CA, e.g. all leaves exported from an old CA. Subject, SANs, usages,
+// validity, serial and public key are kept, so the holders need no new
+// key. Signing is the slow part, so the certificates are signed by a pool
+// of workers, while the files are read and written as streams, keeping
+// only the certificates in flight in memory even for huge bundles.
+func runResign(args []string) {
+	flags := flag.NewFlagSet("resign", flag.ContinueOnError)
+	// Only the CA is needed, the flags of the regenerated CA and of the
+	// server certificate have no effect on the re-signed certificates
+	var caOpts caOptions
+	caOpts.registerInput(flags)
+	outDir := flags.String("out-dir", "", "Write the re-signed certificates to this directory, keeping the layout of the inputs")
+	concurrency := flags.Int("concurrency", runtime.NumCPU(), "Number of certificates signed and files processed in parallel")
+	progressInterval := flags.Duration("progress-interval", 5*time.Second, "Log the progress this often (0 disables it)")
+	var logOpts logOptions
+	logOpts.register(flags)
+	parseFlags(flags, args)
+	logOpts.setup()
+
+	if !caOpts.valid() || *outDir == "" || flags.NArg() == 0 || *concurrency < 1 {
+		usageError("go run *.go resign (-ca <ca-bundle.pem> | -ca-cert <ca-cert.pem> -ca-key <ca-key.pem>) -out-dir <dir> [-concurrency n] [-progress-interval 5s] <cert.pem|dir>...")
+	}
+
+	files, err := collectCertificateFiles(flags.Args())
+	if err != nil {
+		fatal("Failed to find certificates", "error", err)
+	}
+	setup := loadCAs(caOpts)
+
+	var total int64
+	for _, file := range files {
+		total += file.size
+	}
+	var stats resignStats
+	start := time.Now()
+	done := make(chan struct{})
+	if *progressInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(*progressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					logResignProgress("Re-signing certificates", &stats, len(files), total, start)
+				}
+			}
+		}()
+	}
+
+	jobs := make(chan resignJob)
+	for range *concurrency {
+		go func() {
+			for job := range jobs {
+				der, err := resignIfIssuedBy(job.der, setup, &stats)
+				job.result <- resignResult{der: der, err: err}
+			}
+		}()
+	}
+
+	// Several files are processed at once, so small files keep all
+	// signing workers busy as well as a single huge one
+	inputs := make(chan resignInput)
+	var wg sync.WaitGroup
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for input := range inputs {
+				out := filepath.Join(*outDir, input.rel)
+				if err := resignFile(input.path, out, jobs, *concurrency, &stats); err != nil {
+					slog.Error("Failed to re-sign certificate file", "file", input.path, "error", err)
+					stats.failed.Add(1)
+				} else {
+					slog.Debug("Wrote certificate file", "file", out)
+				}
+				stats.files.Add(1)
+			}
+		}()
+	}
+	for _, file := range files {
+		inputs <- file
+	}
+	close(inputs)
+	wg.Wait()
+	close(jobs)
+	close(done)
+
+	logResignProgress("Re-signed certificates", &stats, len(files), total, start)
+	if stats.failed.Load() > 0 {
+		exitWith(exitRegenerationFailed, "Failed to re-sign some certificate files", "failed", stats.failed.Load())
+	}
+}
+
+// collectCertificateFiles returns the files to re-sign. Directories are
+// searched for *.pem, *.crt and *.cer files, which keep their path
+// relative to the directory in the output.
+func collectCertificateFiles(args []string) ([]resignInput, error) {
+	var files []resignInput
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, resignInput{path: arg, rel: filepath.Base(arg), size: info.Size()})
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			switch filepath.Ext(path) {
+			case ".pem", ".crt", ".cer":
+			default:
+				return nil
+			}
+			rel, err := filepath.Rel(arg, path)
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files = append(files, resignInput{path: path, rel: rel, size: info.Size()})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no certificate files in %v", args)
+	}
+	return files, nil
+}
+
+// resignFile re-signs every certificate of file issued by the original CA
+// and writes the result to out. Other PEM blocks, like keys or
+// certificates of other issuers, are copied unchanged. The blocks are
+// streamed through the signing workers with at most inFlight of them
+// waiting, and out is only replaced once all of them were written.
+func resignFile(file, out string, jobs chan<- resignJob, inFlight int, stats *resignStats) (err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	in := bufio.NewReader(&countingReader{r: f, n: &stats.read})
+	var blocks *pemReader
+	if first, _ := in.Peek(1); len(first) == 1 && first[0] == 0x30 {
+		// A single DER encoded certificate, starting with a SEQUENCE
+		der, err := io.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		blocks = newPEMReader(bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	} else {
+		blocks = newPEMReader(in)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(out), "."+filepath.Base(out)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	pending := make(chan pendingBlock, inFlight)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(pending)
+		for {
+			block, err := blocks.next()
+			if err == io.EOF {
+				return
+			}
+			item := pendingBlock{block: block, err: err}
+			if err == nil && block.Type == "CERTIFICATE" {
+				item.result = make(chan resignResult, 1)
+				select {
+				case jobs <- resignJob{der: block.Bytes, result: item.result}:
+				case <-stop:
+					return
+				}
+			}
+			select {
+			case pending <- item:
+			case <-stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	w := bufio.NewWriter(tmp)
+	for item := range pending {
+		if item.err != nil {
+			return item.err
+		}
+		if item.result != nil {
+			result := <-item.result
+			if result.err != nil {
+				return result.err
+			}
+			item.block.Bytes = result.der
+		}
+		if err := pem.Encode(w, item.block); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), out)
+}
+
+// resignIfIssuedBy returns der re-signed by the regenerated CA if it was
+// issued by the original CA, otherwise der itself.
+func resignIfIssuedBy(der []byte, setup *caSetup, stats *resignStats) ([]byte, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	if !bytes.Equal(cert.RawIssuer, setup.originalCA.RawSubject) || x509util.CheckSignedBy(cert, setup.originalCA) != nil || cert.Equal(setup.originalCA) {
+		slog.Debug("Certificate not issued by the original CA, keeping it", "subject", cert.Subject.String())
+		stats.skipped.Add(1)
+		return der, nil
+	}
+	der, err = resignCertificate(cert, setup.newCA, setup.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-sign %s: %w", x509util.DescribeCert(cert), err)
+	}
+	stats.resigned.Add(1)
+	return der, nil
+}
+
+func logResignProgress(msg string, stats *resignStats, files int, total int64, start time.Time) {
+	elapsed := time.Since(start)
+	resigned := stats.resigned.Load()
+	attrs := []any{
+		"files", fmt.Sprintf("%d/%d", stats.files.Load(), files),
+		"read", fmt.Sprintf("%.1f/%.1f MB", float64(stats.read.Load())/1e6, float64(total)/1e6),
+		"resigned", resigned,
+		"skipped", stats.skipped.Load(),
+		"failed_files", stats.failed.Load(),
+		"elapsed", elapsed.Round(100 * time.Millisecond),
+	}
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		attrs = append(attrs, "per_second", fmt.Sprintf("%.1f", float64(resigned)/seconds))
+	}
+	slog.Info(msg, attrs...)
+}
+
+// countingReader adds the number of bytes read to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
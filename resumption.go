@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// resumptionVersions are the TLS versions session resumption is tested
+// with, by their resumption mechanism.
+var resumptionVersions = []struct {
+	name    string
+	version uint16
+}{
+	{"TLS 1.3 PSK", tls.VersionTLS13},
+	{"TLS 1.2 session ticket", tls.VersionTLS12},
+}
+
+// testSessionResumption requests the test server twice per TLS version
+// trusting only ca, each time on a new connection, and checks that the
+// second handshake resumes the session of the first. Clients keep the
+// verified chain with the session, so a chain they accept must be
+// resumable as well.
+func testSessionResumption(network string, ca *x509.Certificate, caName string) error {
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca)
+
+	var resumed []string
+	for _, v := range resumptionVersions {
+		transport := testTransport(network, &tls.Config{
+			RootCAs:            caPool,
+			Time:               now.Now,
+			MinVersion:         v.version,
+			MaxVersion:         v.version,
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		})
+		transport.DisableKeepAlives = true
+		client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+		for i := range 2 {
+			resp, err := client.Get(testURL(network))
+			if err != nil {
+				return fmt.Errorf("%s: client request failed: %w", v.name, err)
+			}
+			// The TLS 1.3 ticket arrives along with the response
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if i == 1 && !resp.TLS.DidResume {
+				return fmt.Errorf("%s: the second handshake did not resume the session of the first", v.name)
+			}
+		}
+		resumed = append(resumed, v.name)
+	}
+	slog.Info("Client resumed TLS sessions", "ca", caName, "resumed", strings.Join(resumed, ", "))
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// crlReasons are the revocation reason codes of RFC 5280. removeFromCRL
+// is left out as certificates cannot be unrevoked.
+var crlReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"cACompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"certificateHold":      6,
+	"privilegeWithdrawn":   9,
+	"aACompromise":         10,
+}
+
+// Revokes certificates of the CA in the database and publishes the CRL
+// and OCSP responses of all revocations. Without certificates, the CRL and
+// OCSP responses are only signed again, e.g. before the next update.
+func runRevoke(args []string) {
+	const usage = "go run *.go revoke (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-db issued.db] [-reason keyCompromise] [-crl crl.pem] [-ocsp-dir ocsp] [-next-update 168h] [<serial|cert.pem>...]"
+	fs := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.registerInput(fs)
+	reason := fs.String("reason", "unspecified", "Revocation reason: unspecified, keyCompromise, cACompromise, affiliationChanged, superseded, cessationOfOperation, certificateHold, privilegeWithdrawn or aACompromise")
+	crlFile := fs.String("crl", "crl.pem", "File to write the CRL of the CA to")
+	ocspDir := fs.String("ocsp-dir", "", "Directory to write pre-signed OCSP responses for all unexpired certificates of the CA to, as <serial>.der")
+	nextUpdate := fs.Duration("next-update", 7*24*time.Hour, "Time until the next update of the CRL and the OCSP responses")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	reasonCode, ok := crlReasons[*reason]
+	if !caOpts.valid() || !ok || *nextUpdate <= 0 {
+		usageError(usage)
+	}
+	if certDB.file == "" {
+		certDB.file = "issued.db"
+	}
+	ca, caKey, _, err := caOpts.load()
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA", "error", err)
+	}
+
+	revokedAt := now.Now().UTC()
+	for _, arg := range fs.Args() {
+		serial, err := revocationSerial(ca, arg)
+		if err != nil {
+			fatal("Invalid certificate to revoke", "certificate", arg, "error", err)
+		}
+		revoked, err := revokeSerial(ca, serial, reasonCode, revokedAt)
+		if err != nil {
+			fatal("Failed to revoke certificate", "serial", x509util.FormatHex(serial.Bytes()), "error", err)
+		}
+		if revoked {
+			slog.Info("Revoked certificate", "serial", x509util.FormatHex(serial.Bytes()), "reason", *reason)
+		} else {
+			slog.Warn("Certificate is already revoked", "serial", x509util.FormatHex(serial.Bytes()))
+		}
+	}
+
+	if err := publishRevocations(ca, caKey, *crlFile, *ocspDir, *nextUpdate); err != nil {
+		fatal("Failed to publish revocations", "error", err)
+	}
+}
+
+// revocationSerial returns the serial of the certificate to revoke, given
+// as hex serial or as certificate file. Certificates of the CA which are
+// not in the database yet are added.
+func revocationSerial(ca *x509.Certificate, arg string) (*big.Int, error) {
+	if _, err := os.Stat(arg); err != nil {
+		serial, ok := parseSerial(arg)
+		if !ok {
+			return nil, fmt.Errorf("neither a certificate file nor a hex serial")
+		}
+		return serial, nil
+	}
+	certs, err := loadCertificates(arg)
+	if err != nil {
+		return nil, err
+	}
+	cert := certs[0]
+	if !bytes.Equal(cert.RawIssuer, ca.RawSubject) {
+		return nil, fmt.Errorf("certificate is issued by %s, not by the CA", cert.Issuer)
+	}
+	if err := cert.CheckSignatureFrom(ca); err != nil {
+		return nil, fmt.Errorf("certificate is not signed by the CA: %w", err)
+	}
+	if err := recordInCertDB("import", cert); err != nil {
+		return nil, err
+	}
+	return cert.SerialNumber, nil
+}
+
+// revokeSerial marks the certificates with serial by ca as revoked. It
+// returns false if they already are.
+func revokeSerial(ca *x509.Certificate, serial *big.Int, reason int, revokedAt time.Time) (bool, error) {
+	where := "issuer = " + sqlQuote(ca.Subject.String()) + " AND serial = " + sqlQuote(x509util.FormatHex(serial.Bytes()))
+	rows, err := queryCertDB(certDB.file, where)
+	if err != nil {
+		return false, err
+	}
+	if len(rows) == 0 {
+		return false, fmt.Errorf("no certificate with this serial by %s in the database", ca.Subject)
+	}
+	revoked := true
+	for _, row := range rows {
+		revoked = revoked && row.RevokedAt != ""
+	}
+	if revoked {
+		return false, nil
+	}
+	_, err = runSQLite(certDB.file, fmt.Sprintf("UPDATE certificates SET revoked_at = %s, revocation_reason = %d WHERE %s AND revoked_at IS NULL;\n",
+		sqlQuote(revokedAt.Format(time.RFC3339)), reason, where))
+	return err == nil, err
+}
+
+// publishRevocations writes the CRL of ca with all revoked certificates in
+// the database and, if ocspDir is given, an OCSP response for every
+// unexpired certificate of ca.
+func publishRevocations(ca *x509.Certificate, caKey crypto.Signer, crlFile, ocspDir string, nextUpdate time.Duration) error {
+	rows, err := queryCertDB(certDB.file, "issuer = "+sqlQuote(ca.Subject.String()))
+	if err != nil {
+		return err
+	}
+	// Certificates re-signed with the same serial share its status
+	statuses := map[string]*ocspStatus{}
+	var serials []string
+	for _, row := range rows {
+		if row.Subject == row.Issuer && row.IsCA != 0 {
+			continue
+		}
+		serial, ok := parseSerial(row.Serial)
+		if !ok {
+			return fmt.Errorf("invalid serial %q in database", row.Serial)
+		}
+		status := statuses[row.Serial]
+		if status == nil {
+			status = &ocspStatus{serial: serial}
+			statuses[row.Serial] = status
+			serials = append(serials, row.Serial)
+		}
+		if row.RevokedAt != "" && status.revokedAt.IsZero() {
+			revokedAt, err := time.Parse(time.RFC3339, row.RevokedAt)
+			if err != nil {
+				return fmt.Errorf("invalid revocation time %q in database", row.RevokedAt)
+			}
+			status.revokedAt, status.reason = revokedAt, row.RevocationReason
+		}
+	}
+
+	thisUpdate := now.Now()
+	var entries []x509.RevocationListEntry
+	for _, serial := range serials {
+		if status := statuses[serial]; !status.revokedAt.IsZero() {
+			entries = append(entries, x509.RevocationListEntry{SerialNumber: status.serial, RevocationTime: status.revokedAt, ReasonCode: status.reason})
+		}
+	}
+	number, err := nextCRLNumber(ca)
+	if err != nil {
+		return err
+	}
+	crlDER, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		SignatureAlgorithm:        x509util.SignatureAlgorithmFor(caKey, x509.UnknownSignatureAlgorithm),
+		Number:                    number,
+		ThisUpdate:                thisUpdate,
+		NextUpdate:                thisUpdate.Add(nextUpdate),
+		RevokedCertificateEntries: entries,
+	}, ca, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create CRL: %w", err)
+	}
+	if err := os.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0644); err != nil {
+		return err
+	}
+	slog.Info("Wrote CRL", "file", crlFile, "number", number, "revoked", len(entries), "next_update", thisUpdate.Add(nextUpdate).Format(time.RFC3339))
+
+	if ocspDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(ocspDir, 0755); err != nil {
+		return err
+	}
+	written := map[string]bool{}
+	for _, row := range rows {
+		status := statuses[row.Serial]
+		if status == nil || written[row.Serial] {
+			continue
+		}
+		if notAfter, err := time.Parse(time.RFC3339, row.NotAfter); err == nil && thisUpdate.After(notAfter) && status.revokedAt.IsZero() {
+			continue
+		}
+		response, err := createOCSPResponse(ca, *status, ca, caKey, thisUpdate, thisUpdate.Add(nextUpdate), nil)
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(ocspDir, strings.ReplaceAll(row.Serial, ":", "")+".der")
+		if err := os.WriteFile(file, response, 0644); err != nil {
+			return err
+		}
+		written[row.Serial] = true
+	}
+	slog.Info("Wrote OCSP responses", "dir", ocspDir, "count", len(written))
+	return nil
+}
+
+// nextCRLNumber increments and returns the number of the CRL of ca, which
+// must grow with every CRL issued.
+func nextCRLNumber(ca *x509.Certificate) (*big.Int, error) {
+	issuer := sqlQuote(ca.Subject.String())
+	out, err := runSQLite(certDB.file, certDBSchema+fmt.Sprintf("INSERT INTO crls (issuer, number) VALUES (%s, 1) ON CONFLICT (issuer) DO UPDATE SET number = number + 1;\nSELECT number FROM crls WHERE issuer = %s;\n", issuer, issuer))
+	if err != nil {
+		return nil, err
+	}
+	number, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRL number %q", strings.TrimSpace(string(out)))
+	}
+	return big.NewInt(number), nil
+}
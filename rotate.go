@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// Serves the test web server like the default mode, but keeps running and
+// re-issues the server certificate from the regenerated CA before it
+// expires. The new certificate is used for every following handshake
+// without restarting the server.
+func runServeRotate(args []string) {
+	fs := flag.NewFlagSet("serve-rotate", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	fs.DurationVar(&caOpts.leaf.validity, "validity", 24*time.Hour, "Validity of the server certificates")
+	renewBefore := fs.Duration("renew-before", 8*time.Hour, "Re-issue the server certificate this long before it expires")
+	registerShutdown(fs)
+	registerProxy(fs)
+	registerIPFamily(fs)
+	registerListen(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() {
+		usageError("go run *.go serve-rotate (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-validity 24h] [-renew-before 8h] [-v|-q] [-log-format text|json]")
+	}
+	if *renewBefore <= 0 || *renewBefore >= caOpts.leaf.validity {
+		usageError("-renew-before must be positive and shorter than -validity")
+	}
+	checkTestFlags()
+
+	setup := prepareCAs(caOpts)
+	ctx, stop := shutdownSignal()
+	defer stop()
+	// wait waits for d and reports whether the server should keep running
+	wait := func(d time.Duration) bool {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var current atomic.Pointer[tls.Certificate]
+	tlsCert := setup.serverTLSCertificate()
+	current.Store(&tlsCert)
+	server := startWebServer(&tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return current.Load(), nil
+		},
+	})
+
+	slog.Info("Web server started", "url", testServerURL())
+
+	for {
+		renewAt := setup.serverCert.NotAfter.Add(-*renewBefore)
+		slog.Info("Waiting to renew server certificate", "serial", x509util.FormatHex(setup.serverCert.SerialNumber.Bytes()), "not_after", setup.serverCert.NotAfter.Format(time.RFC3339), "renew_at", renewAt.Format(time.RFC3339))
+		if !wait(renewAt.Sub(now.Now())) {
+			break
+		}
+
+		running := true
+		for running {
+			cert, key, scts, err := caOpts.serverCertificate(setup.newCA, setup.caKey)
+			if err == nil {
+				setup.serverCert, setup.serverKey, setup.serverSCTs = cert, key, scts
+				break
+			}
+			// Retry more often as the current certificate approaches its expiry
+			retry := min(time.Minute, max(setup.serverCert.NotAfter.Sub(now.Now())/2, time.Second))
+			slog.Error("Failed to renew server certificate", "error", err, "retry_in", retry)
+			running = wait(retry)
+		}
+		if !running {
+			break
+		}
+		tlsCert := setup.serverTLSCertificate()
+		current.Store(&tlsCert)
+		slog.Info("Rotated server certificate", "serial", x509util.FormatHex(setup.serverCert.SerialNumber.Bytes()), "not_after", setup.serverCert.NotAfter.Format(time.RFC3339))
+
+		// Check that the new certificate is served and accepted
+		if _, err := testClientCompatibility(testNetworks()[0], setup.newCA, "New CA", setup.ctLogs, false); err != nil {
+			slog.Error("Client test failed after rotation", "error", err)
+		}
+	}
+	stop()
+	if err := shutdownServer(server); err != nil {
+		fatal("Failed to stop web server", "error", err)
+	}
+}
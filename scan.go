@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// Statuses of a scanned endpoint.
+const (
+	scanRegenerated = "regenerated"
+	scanOriginal    = "original"
+	scanEither      = "either"
+	scanOther       = "other"
+	scanUnreachable = "unreachable"
+)
+
+// scanTarget is an endpoint of the -targets file.
+type scanTarget struct {
+	addr       string
+	serverName string
+}
+
+// scanResult is the outcome of scanning one endpoint.
+type scanResult struct {
+	Target     string `json:"target"`
+	ServerName string `json:"server_name"`
+	Status     string `json:"status"`
+	// Reason tells how the status was determined, or why the endpoint
+	// could not be scanned.
+	Reason       string `json:"reason"`
+	Leaf         string `json:"leaf,omitempty"`
+	LeafNotAfter string `json:"leaf_not_after,omitempty"`
+}
+
+// scanSummary counts the endpoints by status.
+type scanSummary struct {
+	Total       int `json:"total"`
+	Regenerated int `json:"regenerated"`
+	Original    int `json:"original"`
+	Either      int `json:"either"`
+	Other       int `json:"other"`
+	Unreachable int `json:"unreachable"`
+	// Progress is the percentage of the endpoints of the original or the
+	// regenerated CA known to be on the regenerated CA.
+	Progress float64 `json:"progress_percent"`
+}
+
+// Connects to many endpoints concurrently and reports which of them serve
+// chains of the regenerated CA, which still of the original CA and which
+// of another CA, to follow the progress of a migration.
+func runScan(args []string) {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	targetsFile := fs.String("targets", "", "File with one endpoint per line, host:port (default port 443) optionally followed by the server name to send; # starts a comment")
+	originalFile := fs.String("original-ca", "", "Path to the PEM encoded original CA certificate")
+	newFile := fs.String("new-ca", "new-ca.pem", "Path to the PEM encoded regenerated CA certificate")
+	var regeneratedAt time.Time
+	fs.Func("regenerated-at", "Time of the regeneration as RFC 3339 or date: leaves verifying with both CAs count as issued by the regenerated CA if issued since, and by the original CA otherwise", func(value string) error {
+		var err error
+		if len(value) == len(time.DateOnly) {
+			regeneratedAt, err = time.Parse(time.DateOnly, value)
+		} else {
+			regeneratedAt, err = time.Parse(time.RFC3339, value)
+		}
+		return err
+	})
+	concurrency := fs.Int("concurrency", 16, "Number of endpoints scanned at the same time")
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout of the connection to each endpoint")
+	jsonOutput := fs.Bool("json", false, "Print the results and the summary as JSON")
+	registerProxy(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if *targetsFile == "" || *originalFile == "" || *concurrency < 1 || fs.NArg() > 0 {
+		usageError("go run *.go scan -targets hosts.txt -original-ca ca-cert.pem [-new-ca new-ca.pem] [-regenerated-at 2025-01-02T15:04:05Z] [-concurrency 16] [-timeout 10s] [-proxy url] [-json]")
+	}
+	originalCA := loadScanCA(*originalFile)
+	newCA := loadScanCA(*newFile)
+	targets, err := loadScanTargets(*targetsFile)
+	if err != nil {
+		fatal("Failed to load targets", "file", *targetsFile, "error", err)
+	}
+
+	results := make([]scanResult, len(targets))
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = scanEndpoint(target, originalCA, newCA, regeneratedAt, *timeout)
+		})
+	}
+	wg.Wait()
+
+	summary := summarizeScan(results)
+	if *jsonOutput {
+		data, err := json.MarshalIndent(struct {
+			Summary scanSummary  `json:"summary"`
+			Targets []scanResult `json:"targets"`
+		}{summary, results}, "", "  ")
+		if err != nil {
+			fatal("Failed to encode scan results", "error", err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tSERVER NAME\tSTATUS\tLEAF NOT AFTER\tREASON")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Target, r.ServerName, r.Status, r.LeafNotAfter, r.Reason)
+	}
+	w.Flush()
+	fmt.Printf("\nMigration progress: %d of %d endpoints on the regenerated CA (%.1f%%), %d still on the original CA, %d on either, %d on other CAs, %d unreachable\n",
+		summary.Regenerated, summary.Regenerated+summary.Original+summary.Either, summary.Progress, summary.Original, summary.Either, summary.Other, summary.Unreachable)
+}
+
+// loadScanCA loads the first certificate of a CA file.
+func loadScanCA(file string) *x509.Certificate {
+	certs, err := loadCertificates(file)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA certificate", "file", file, "error", err)
+	}
+	return certs[0]
+}
+
+// loadScanTargets parses the -targets file.
+func loadScanTargets(file string) ([]scanTarget, error) {
+	data, err := readInput(file)
+	if err != nil {
+		return nil, err
+	}
+	var targets []scanTarget
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected host:port and an optional server name", line)
+		}
+		addr := fields[0]
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "443")
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		target := scanTarget{addr: addr, serverName: host}
+		if len(fields) == 2 {
+			target.serverName = fields[1]
+		}
+		targets = append(targets, target)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets found")
+	}
+	return targets, nil
+}
+
+// scanEndpoint fetches the chain an endpoint presents, without verifying
+// it, and classifies it.
+func scanEndpoint(target scanTarget, originalCA, newCA *x509.Certificate, regeneratedAt time.Time, timeout time.Duration) scanResult {
+	result := scanResult{Target: target.addr, ServerName: target.serverName}
+	conn, err := dialTLSViaProxy(timeout, "tcp", target.addr, &tls.Config{
+		ServerName:         target.serverName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		result.Status, result.Reason = scanUnreachable, err.Error()
+		return result
+	}
+	chain := conn.ConnectionState().PeerCertificates
+	conn.Close()
+	result.Leaf = chain[0].Subject.String()
+	result.LeafNotAfter = chain[0].NotAfter.Format(time.RFC3339)
+	result.Status, result.Reason = classifyChain(chain, originalCA, newCA, regeneratedAt)
+	return result
+}
+
+// classifyChain determines which CA a presented chain terminates in. A CA
+// sent along identifies it. Otherwise the chain is followed to its last
+// certificate, which is issued by the original or the regenerated CA. As
+// the regeneration keeps subject and key, certificates of both verify
+// with both unless the CA was renamed. Then the leaf counts as issued by
+// the regenerated CA if it was issued since regeneratedAt, allowing for
+// the minute issued certificates are backdated, and by either without it.
+func classifyChain(chain []*x509.Certificate, originalCA, newCA *x509.Certificate, regeneratedAt time.Time) (status, reason string) {
+	for _, cert := range chain {
+		switch {
+		case cert.Equal(newCA):
+			return scanRegenerated, "sends the regenerated CA"
+		case cert.Equal(originalCA):
+			return scanOriginal, "sends the original CA"
+		}
+	}
+	top := chain[0]
+	for range chain {
+		issuer, _ := x509util.FindIssuer(top, chain)
+		if issuer == nil || issuer == top {
+			break
+		}
+		top = issuer
+	}
+	byNew, byOriginal := issuedBy(top, newCA), issuedBy(top, originalCA)
+	switch {
+	case byNew && !byOriginal:
+		return scanRegenerated, "issued by the regenerated CA"
+	case byOriginal && !byNew:
+		return scanOriginal, "issued by the original CA"
+	case byNew && byOriginal && regeneratedAt.IsZero():
+		return scanEither, "verifies with both CAs, -regenerated-at tells them apart by issuance time"
+	case byNew && byOriginal && !chain[0].NotBefore.Add(time.Minute).Before(regeneratedAt):
+		return scanRegenerated, "leaf issued since the regeneration"
+	case byNew && byOriginal:
+		return scanOriginal, "leaf issued before the regeneration"
+	}
+	return scanOther, fmt.Sprintf("chain ends in %q", top.Issuer)
+}
+
+// summarizeScan counts the results by status.
+func summarizeScan(results []scanResult) scanSummary {
+	summary := scanSummary{Total: len(results)}
+	for _, r := range results {
+		switch r.Status {
+		case scanRegenerated:
+			summary.Regenerated++
+		case scanOriginal:
+			summary.Original++
+		case scanEither:
+			summary.Either++
+		case scanOther:
+			summary.Other++
+		case scanUnreachable:
+			summary.Unreachable++
+		}
+	}
+	if onCA := summary.Regenerated + summary.Original + summary.Either; onCA > 0 {
+		summary.Progress = float64(summary.Regenerated) * 100 / float64(onCA)
+	}
+	return summary
+}
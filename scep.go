@@ -0,0 +1,332 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// SCEP (RFC 8894) attributes and message types.
+var (
+	oidSCEPMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPPKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidSCEPTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+	oidChallengePassword  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+)
+
+const (
+	scepCertRep    = "3"
+	scepRenewalReq = "17"
+	scepPKCSReq    = "19"
+
+	scepStatusSuccess = "0"
+	scepStatusFailure = "2"
+
+	scepFailBadAlg          = "0"
+	scepFailBadMessageCheck = "1"
+	scepFailBadRequest      = "2"
+)
+
+// scepCapabilities are returned for GetCACaps.
+var scepCapabilities = []string{"POSTPKIOperation", "Renewal", "SHA-1", "SHA-256", "SHA-512", "AES", "DES3", "SCEPStandard"}
+
+// SCEP responder issuing certificates from the regenerated CA, for testing
+// and migrating devices enrolled through MDM. Requests are answered
+// immediately, there is no manual approval and thus no pending state.
+func runSCEPServe(args []string) {
+	fs := flag.NewFlagSet("scep-serve", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	addr := fs.String("addr", "localhost:8080", "Address for the SCEP server to listen on")
+	challenge := fs.String("challenge", "", "Challenge password enrollment requests have to contain (default: accept all requests)")
+	validity := fs.Duration("cert-validity", 365*24*time.Hour, "Validity of issued certificates")
+	registerShutdown(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() {
+		usageError("go run *.go scep-serve (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-addr host:port] [-challenge <password>] [-cert-validity 8760h]")
+	}
+
+	setup := regenerateCAs(caOpts)
+	scep := &scepServer{
+		ca:        setup.newCA,
+		caKey:     setup.caKey,
+		challenge: *challenge,
+		validity:  *validity,
+	}
+	if err := scep.setupRA(); err != nil {
+		exitWith(exitRegenerationFailed, "Failed to generate SCEP RA certificate", "error", err)
+	}
+	if *challenge == "" {
+		slog.Warn("No -challenge given, every enrollment request will be accepted")
+	}
+
+	server := &http.Server{
+		Addr:     *addr,
+		Handler:  scep.handler(),
+		ErrorLog: serverErrorLog(),
+	}
+	slog.Info("SCEP server started", "url", "http://"+*addr+"/scep", "ca_file", "new-ca.pem")
+	if err := serveUntilSignal(server); err != nil {
+		fatal("SCEP server failed", "error", err)
+	}
+}
+
+type scepServer struct {
+	ca        *x509.Certificate
+	caKey     crypto.Signer
+	challenge string
+	validity  time.Duration
+	// raCert and raKey decrypt requests and sign replies. This is the CA
+	// itself if its key is a local RSA key.
+	raCert *x509.Certificate
+	raKey  *rsa.PrivateKey
+}
+
+// setupRA selects the certificate and key used for the SCEP messages.
+// Clients encrypt requests with RSA key transport, so CAs with other keys
+// or keys which can only sign (HSM, KMS, ...) need a separate RA
+// certificate issued by the CA.
+func (s *scepServer) setupRA() error {
+	if key, ok := s.caKey.(*rsa.PrivateKey); ok {
+		s.raCert, s.raKey = s.ca, key
+		return nil
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return fmt.Errorf("failed to generate RA key: %w", err)
+	}
+	serialNumber, err := newSerialNumber(s.ca)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:       serialNumber,
+		Subject:            pkix.Name{CommonName: s.ca.Subject.CommonName + " SCEP RA"},
+		NotBefore:          now.Now(),
+		NotAfter:           now.Now().AddDate(1, 0, 0),
+		KeyUsage:           x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		SignatureAlgorithm: x509util.SignatureAlgorithmFor(s.caKey, x509.UnknownSignatureAlgorithm),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, &key.PublicKey, s.caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create RA certificate: %w", err)
+	}
+	if s.raCert, err = recordCertificate("issue", der); err != nil {
+		return fmt.Errorf("failed to parse RA certificate: %w", err)
+	}
+	s.raKey = key
+	slog.Info("Generated SCEP RA certificate", "subject", s.raCert.Subject.String())
+	return nil
+}
+
+func (s *scepServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scep", s.handle)
+	// Default path of many clients, e.g. sscep
+	mux.HandleFunc("/cgi-bin/pkiclient.exe", s.handle)
+	return mux
+}
+
+func (s *scepServer) handle(w http.ResponseWriter, r *http.Request) {
+	switch operation := r.URL.Query().Get("operation"); operation {
+	case "GetCACaps":
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, strings.Join(scepCapabilities, "\n"))
+	case "GetCACert":
+		if s.raCert == s.ca {
+			w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+			w.Write(s.ca.Raw)
+			return
+		}
+		der, err := createCertsOnlyPKCS7([]*x509.Certificate{s.raCert, s.ca})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-x509-ca-ra-cert")
+		w.Write(der)
+	case "PKIOperation":
+		var message []byte
+		var err error
+		if r.Method == http.MethodPost {
+			message, err = io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		} else {
+			message, err = base64.StdEncoding.DecodeString(r.URL.Query().Get("message"))
+		}
+		if err == nil {
+			message, err = s.pkiOperation(message)
+		}
+		if err != nil {
+			slog.Warn("Invalid SCEP request", "remote", r.RemoteAddr, "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pki-message")
+		w.Write(message)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported SCEP operation %q", operation), http.StatusBadRequest)
+	}
+}
+
+// pkiOperation handles a PKIMessage and returns the CertRep. Only messages
+// which can't be answered at all, e.g. because their signature is invalid,
+// result in an error.
+func (s *scepServer) pkiOperation(der []byte) ([]byte, error) {
+	req, err := parseSignedData(der)
+	if err != nil {
+		return nil, err
+	}
+	transactionID := req.stringAttribute(oidSCEPTransactionID)
+	cert, algorithm, failInfo, err := s.enroll(req)
+	if err != nil {
+		slog.Warn("Rejected SCEP request", "transaction", transactionID, "signer", req.signer.Subject.String(), "error", err)
+		return s.certRep(req, nil, nil, failInfo)
+	}
+	slog.Info("Issued certificate", "transaction", transactionID, "subject", cert.Subject.String(), "serial", x509util.FormatHex(cert.SerialNumber.Bytes()))
+	return s.certRep(req, cert, algorithm, "")
+}
+
+// enroll issues a certificate for a PKCSReq or RenewalReq. On failure the
+// SCEP failInfo is returned along with the error.
+func (s *scepServer) enroll(req *signedMessage) (*x509.Certificate, asn1.ObjectIdentifier, string, error) {
+	messageType := req.stringAttribute(oidSCEPMessageType)
+	if messageType != scepPKCSReq && messageType != scepRenewalReq {
+		return nil, nil, scepFailBadRequest, fmt.Errorf("unsupported message type %q", messageType)
+	}
+	// The reply is encrypted for the signer with RSA key transport
+	if _, ok := req.signer.PublicKey.(*rsa.PublicKey); !ok {
+		return nil, nil, scepFailBadAlg, fmt.Errorf("signer key: %w %T", caregen.ErrUnsupportedKeyType, req.signer.PublicKey)
+	}
+	csrDER, algorithm, err := decryptEnvelopedData(req.content, s.raKey)
+	if err != nil {
+		return nil, nil, scepFailBadMessageCheck, err
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		return nil, nil, scepFailBadRequest, fmt.Errorf("invalid CSR: %w", err)
+	}
+
+	// Requests signed with a certificate of the CA are renewals and need no
+	// challenge. Certificates of the original CA are accepted as well, so
+	// devices can be moved over to the regenerated CA.
+	t := now.Now()
+	if req.signer.CheckSignatureFrom(s.ca) == nil && t.After(req.signer.NotBefore) && t.Before(req.signer.NotAfter) {
+		return s.issueForRequest(csr, algorithm)
+	}
+	if messageType == scepRenewalReq {
+		return nil, nil, scepFailBadRequest, fmt.Errorf("renewal request not signed by a valid certificate of the CA")
+	}
+	if s.challenge != "" {
+		password, err := csrChallengePassword(csr)
+		if err != nil {
+			return nil, nil, scepFailBadRequest, err
+		}
+		if subtle.ConstantTimeCompare([]byte(password), []byte(s.challenge)) != 1 {
+			return nil, nil, scepFailBadRequest, fmt.Errorf("wrong challenge password")
+		}
+	}
+	return s.issueForRequest(csr, algorithm)
+}
+
+// issueForRequest issues the certificate of an authorized request.
+func (s *scepServer) issueForRequest(csr *x509.CertificateRequest, algorithm asn1.ObjectIdentifier) (*x509.Certificate, asn1.ObjectIdentifier, string, error) {
+	cert, err := issueClientCert(s.ca, s.caKey, csr, s.validity)
+	if err != nil {
+		return nil, nil, scepFailBadRequest, fmt.Errorf("issuance failed: %w", err)
+	}
+	return cert, algorithm, "", nil
+}
+
+// certRep returns the reply to req. On success the issued certificate is
+// sent in a certs-only PKCS#7, encrypted for the signer of the request.
+func (s *scepServer) certRep(req *signedMessage, cert *x509.Certificate, algorithm asn1.ObjectIdentifier, failInfo string) ([]byte, error) {
+	senderNonce := make([]byte, 16)
+	if _, err := rand.Read(senderNonce); err != nil {
+		return nil, err
+	}
+	status := scepStatusSuccess
+	if cert == nil {
+		status = scepStatusFailure
+	}
+	var attrs []pkcs7Attribute
+	var err error
+	add := func(oid asn1.ObjectIdentifier, value any, params string) {
+		var attr pkcs7Attribute
+		if err == nil {
+			attr, err = pkcs7SignedAttribute(oid, value, params)
+			attrs = append(attrs, attr)
+		}
+	}
+	add(oidSCEPMessageType, scepCertRep, "printable")
+	add(oidSCEPPKIStatus, status, "printable")
+	add(oidSCEPTransactionID, req.stringAttribute(oidSCEPTransactionID), "printable")
+	add(oidSCEPRecipientNonce, req.bytesAttribute(oidSCEPSenderNonce), "")
+	add(oidSCEPSenderNonce, senderNonce, "")
+	if cert == nil {
+		add(oidSCEPFailInfo, failInfo, "printable")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	if cert != nil {
+		certs, err := createCertsOnlyPKCS7([]*x509.Certificate{cert})
+		if err != nil {
+			return nil, err
+		}
+		if content, err = createEnvelopedData(certs, req.signer, algorithm); err != nil {
+			return nil, fmt.Errorf("failed to encrypt certificate for the requester: %w", err)
+		}
+	}
+	return createSignedData(oidPKCS7Data, content, attrs, s.raCert, s.raKey, req.hash, []*x509.Certificate{s.raCert})
+}
+
+// csrChallengePassword returns the challengePassword attribute of a CSR,
+// which crypto/x509 doesn't expose.
+func csrChallengePassword(csr *x509.CertificateRequest) (string, error) {
+	var tbs struct {
+		Version    int
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Attributes []pkcs7Attribute `asn1:"tag:0"`
+	}
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs); err != nil {
+		return "", fmt.Errorf("failed to parse CSR attributes: %w", err)
+	}
+	for _, attr := range tbs.Attributes {
+		if attr.Type.Equal(oidChallengePassword) {
+			var password string
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &password); err != nil {
+				return "", fmt.Errorf("failed to parse challenge password: %w", err)
+			}
+			return password, nil
+		}
+	}
+	return "", fmt.Errorf("CSR contains no challenge password")
+}
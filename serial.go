@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// serials keeps track of the serials in use per issuer, as duplicate
+// serials under one issuer break revocation with CRLs and OCSP. Serials
+// are checked against the ones signed by this process, the -serial-list
+// and the -db database.
+var serials struct {
+	sync.Mutex
+	list string
+	// used holds the serials signed by this process, keyed by serialKey.
+	used map[string]bool
+	// listed holds the serials of the list once loaded, for any issuer.
+	listed map[string]bool
+}
+
+// registerSerials registers the -serial-list flag.
+func registerSerials(fs *flag.FlagSet) {
+	fs.StringVar(&serials.list, "serial-list", "", "File with serials in use (hex, one per line) that issued certificates must not reuse")
+}
+
+// newSerialNumber returns a random 128 bit serial not in use under issuer.
+func newSerialNumber(issuer *x509.Certificate) (*big.Int, error) {
+	return caregen.NewSerialNumber(context.Background(), issuer, caregen.WithSerialInUse(serialInUse))
+}
+
+// serialInUse returns whether serial was signed by this process, is on
+// the list or in the database.
+func serialInUse(issuer *x509.Certificate, serial *big.Int) (bool, error) {
+	serials.Lock()
+	defer serials.Unlock()
+	if serials.listed == nil && serials.list != "" {
+		listed, err := readSerialList(serials.list)
+		if err != nil {
+			return false, fmt.Errorf("failed to read serial list: %w", err)
+		}
+		serials.listed = listed
+	}
+	serialHex := x509util.FormatHex(serial.Bytes())
+	if serials.used[serialKey(issuer.Subject.String(), serial)] || serials.listed[serialHex] {
+		return true, nil
+	}
+	return serialInCertDB(issuer, serialHex)
+}
+
+// markSerialUsed records that cert was signed by this process.
+func markSerialUsed(cert *x509.Certificate) {
+	serials.Lock()
+	defer serials.Unlock()
+	if serials.used == nil {
+		serials.used = map[string]bool{}
+	}
+	serials.used[serialKey(cert.Issuer.String(), cert.SerialNumber)] = true
+}
+
+func serialKey(issuer string, serial *big.Int) string {
+	return issuer + "/" + x509util.FormatHex(serial.Bytes())
+}
+
+// serialInCertDB returns whether the database has a certificate with the
+// serial by issuer.
+func serialInCertDB(issuer *x509.Certificate, serialHex string) (bool, error) {
+	if certDB.file == "" {
+		return false, nil
+	}
+	if _, err := os.Stat(certDB.file); os.IsNotExist(err) {
+		return false, nil
+	}
+	rows, err := queryCertDB(certDB.file, "issuer = "+sqlQuote(issuer.Subject.String())+" AND serial = "+sqlQuote(serialHex))
+	if err != nil {
+		return false, fmt.Errorf("failed to look up serial in database: %w", err)
+	}
+	return len(rows) > 0, nil
+}
+
+// readSerialList reads the serials of file as x509util.FormatHex strings. Colons
+// and spaces are ignored, as are empty lines and lines starting with #.
+func readSerialList(file string) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	listed := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		serial, ok := parseSerial(line)
+		if !ok {
+			return nil, fmt.Errorf("line %d: invalid serial %q", n, line)
+		}
+		listed[x509util.FormatHex(serial.Bytes())] = true
+	}
+	return listed, scanner.Err()
+}
+
+// parseSerial parses a hex serial, ignoring colons, spaces and a 0x
+// prefix.
+func parseSerial(s string) (*big.Int, bool) {
+	digits := strings.TrimPrefix(strings.NewReplacer(":", "", " ", "").Replace(s), "0x")
+	serial, ok := new(big.Int).SetString(digits, 16)
+	if !ok || serial.Sign() <= 0 {
+		return nil, false
+	}
+	return serial, true
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long servers wait for open requests when they
+// are stopped.
+var shutdownTimeout = 10 * time.Second
+
+// registerShutdown registers the -shutdown-timeout flag of the server
+// modes.
+func registerShutdown(fs *flag.FlagSet) {
+	fs.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "On SIGINT or SIGTERM, wait this long for open requests to complete before stopping the server")
+}
+
+// serverErrorLog returns the logger for the errors of servers, e.g.
+// failed TLS handshakes, which net/http otherwise prints to stderr
+// bypassing -log-format and -q.
+func serverErrorLog() *log.Logger {
+	return slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
+}
+
+// startServer serves server in the background on listeners, or if there
+// are none on a listener it binds for its address, via TLS if it has a
+// TLS config. It returns once the listeners are up, so clients can
+// connect right away. The error ending Serve is sent on the returned
+// channel, http.ErrServerClosed after a shutdown.
+func startServer(server *http.Server, listeners ...net.Listener) (<-chan error, error) {
+	if len(listeners) == 0 {
+		addr := server.Addr
+		if addr == "" {
+			addr = ":http"
+			if server.TLSConfig != nil {
+				addr = ":https"
+			}
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	errc := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func() {
+			if server.TLSConfig != nil {
+				errc <- server.ServeTLS(listener, "", "")
+			} else {
+				errc <- server.Serve(listener)
+			}
+		}()
+	}
+	return errc, nil
+}
+
+// serveUntilSignal runs server until it fails or SIGINT or SIGTERM is
+// received, then shuts it down gracefully. It returns nil after a graceful
+// shutdown.
+func serveUntilSignal(server *http.Server) error {
+	ctx, stop := shutdownSignal()
+	defer stop()
+	errc, err := startServer(server)
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	// A second signal stops the server right away
+	stop()
+	return shutdownServer(server)
+}
+
+// shutdownSignal returns a context which is done on SIGINT or SIGTERM.
+func shutdownSignal() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// shutdownServer stops server gracefully, waiting up to -shutdown-timeout
+// for open requests before closing their connections.
+func shutdownServer(server *http.Server) error {
+	slog.Info("Shutting down server", "timeout", shutdownTimeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		server.Close()
+		return fmt.Errorf("open requests did not complete in time: %w", err)
+	}
+	slog.Info("Server stopped")
+	return nil
+}
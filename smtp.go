@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+func runServeSMTP(args []string) {
+	fs := flag.NewFlagSet("serve-smtp", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	addr := fs.String("addr", "localhost:2525", "Address for the SMTP server to listen on")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() {
+		usageError("go run *.go serve-smtp (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-stdout] [-addr host:port] [-v|-q] [-log-format text|json]")
+	}
+
+	setup := prepareCAs(caOpts)
+
+	listener, err := startSMTPServer(*addr, setup.serverTLSCertificate())
+	if err != nil {
+		fatal("Failed to start SMTP server", "error", err)
+	}
+	defer listener.Close()
+
+	slog.Info("SMTP server with STARTTLS started", "addr", *addr)
+
+	slog.Debug("Testing client compatibility", "ca", "new")
+	err = testSMTPClientCompatibility(*addr, setup.newCA)
+	if err != nil {
+		exitWith(exitNewCAVerificationFailed, "Unexpected failure with new CA", "error", err)
+	}
+
+	slog.Debug("Testing client compatibility", "ca", "original")
+	err = testSMTPClientCompatibility(*addr, setup.originalCA)
+	if err != nil {
+		exitWith(exitOriginalCAIncompatible, "Unexpected failure with original CA", "error", err)
+	}
+
+	slog.Info("Success! SMTP clients complete STARTTLS with both the original and the regenerated CA")
+}
+
+// startSMTPServer starts a minimal mock SMTP server which supports the
+// STARTTLS extension. Accepted messages are discarded.
+func startSMTPServer(addr string, tlsCert tls.Certificate) (net.Listener, error) {
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleSMTPConn(conn, tlsConfig)
+		}
+	}()
+
+	return listener, nil
+}
+
+func handleSMTPConn(conn net.Conn, tlsConfig *tls.Config) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP ca-regen mock server")
+
+	secure := false
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, _, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			if secure {
+				text.PrintfLine("250-localhost\r\n250 8BITMIME")
+			} else {
+				text.PrintfLine("250-localhost\r\n250-8BITMIME\r\n250 STARTTLS")
+			}
+		case "HELO":
+			text.PrintfLine("250 localhost")
+		case "STARTTLS":
+			if secure {
+				text.PrintfLine("503 TLS already active")
+				continue
+			}
+			text.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			// RFC 3207: the session state is reset after the handshake
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+			secure = true
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			if _, err := text.ReadDotBytes(); err != nil {
+				return
+			}
+			text.PrintfLine("250 OK: message accepted")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func testSMTPClientCompatibility(addr string, ca *x509.Certificate) error {
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca)
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		return fmt.Errorf("server does not advertise STARTTLS")
+	}
+
+	err = client.StartTLS(&tls.Config{
+		RootCAs:    caPool,
+		ServerName: "localhost",
+		Time:       now.Now,
+	})
+	if err != nil {
+		return fmt.Errorf("STARTTLS failed: %w", err)
+	}
+
+	slog.Info("STARTTLS handshake succeeded")
+
+	// Send a test message over the secured session
+	if err := client.Mail("ca-regen@localhost"); err != nil {
+		return fmt.Errorf("MAIL FROM failed: %w", err)
+	}
+	if err := client.Rcpt("postmaster@localhost"); err != nil {
+		return fmt.Errorf("RCPT TO failed: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("DATA failed: %w", err)
+	}
+	fmt.Fprintf(w, "Subject: ca-regen test\r\n\r\nHello from the regenerated CA test client!\r\n")
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+
+	slog.Info("Test message accepted over STARTTLS")
+
+	return client.Quit()
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// SSH certificate types of PROTOCOL.certkeys.
+const (
+	sshUserCert = 1
+	sshHostCert = 2
+)
+
+// sshUserExtensions are the extensions ssh-keygen adds to user
+// certificates by default. Without them sessions get no PTY.
+var sshUserExtensions = []string{
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+// sshCurves maps the OpenSSH curve identifiers to curves.
+var sshCurves = map[string]elliptic.Curve{
+	"nistp256": elliptic.P256(),
+	"nistp384": elliptic.P384(),
+	"nistp521": elliptic.P521(),
+}
+
+// Mints OpenSSH host and user certificates. The SSH CA key is either an
+// OpenSSH key or the key of the X.509 CA, so both can share one root.
+func runSSH(args []string) {
+	fs := flag.NewFlagSet("ssh", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.registerInput(fs)
+	sshCAKeyFile := fs.String("ssh-ca-key", "", "OpenSSH (unencrypted) or PEM private key of the SSH CA, instead of the X.509 CA key")
+	caPubFile := fs.String("ca-pub", "ssh-ca.pub", "File to write the public key of the SSH CA to")
+	keyFile := fs.String("key", "", "OpenSSH public key to certify, e.g. id_ed25519.pub (- for stdin)")
+	certType := fs.String("type", "user", "Certificate type, user or host")
+	identity := fs.String("identity", "", "Key ID of the certificate, logged by sshd (default: the first principal)")
+	principals := fs.String("principals", "", "Comma separated user names or host names the certificate is valid for")
+	validity := fs.Duration("validity", 24*time.Hour, "Validity of the certificate")
+	out := fs.String("out", "", "File to write the certificate to (default: <key>-cert.pub)")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	x509KeyGiven := caOpts.externalKeys() == 1 || (caOpts.externalKeys() == 0 && (caOpts.bundleFile != "" || caOpts.keyFile != "" || caOpts.certFile != ""))
+	if x509KeyGiven == (*sshCAKeyFile != "") || (*certType != "user" && *certType != "host") || (*keyFile == "-" && *out == "") {
+		usageError("go run *.go ssh (-ssh-ca-key <ca_key> | -ca <ca-bundle.pem> | -ca-key <ca-key.pem> | -gcp-kms-key <key> | ...) [-ca-pub ssh-ca.pub] [-key <id.pub> -principals <names> [-type user|host] [-identity id] [-validity 24h] [-out <id-cert.pub>]]")
+	}
+
+	var signer crypto.Signer
+	var err error
+	if *sshCAKeyFile != "" {
+		signer, err = loadSSHPrivateKey(*sshCAKeyFile)
+	} else {
+		signer, err = caOpts.signer()
+	}
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load SSH CA key", "error", err)
+	}
+	caPub, err := marshalSSHPublicKey(signer.Public())
+	if err != nil {
+		exitWith(exitInvalidCA, "Unsupported SSH CA key", "error", err)
+	}
+	if err := os.WriteFile(*caPubFile, []byte(formatSSHPublicKey(caPub, "ssh-ca")), 0644); err != nil {
+		fatal("Failed to write SSH CA public key", "file", *caPubFile, "error", err)
+	}
+	slog.Info("Wrote SSH CA public key", "file", *caPubFile, "key", x509util.DescribePublicKey(signer.Public()))
+
+	if *keyFile == "" {
+		return
+	}
+	data, err := readInput(*keyFile)
+	if err != nil {
+		fatal("Failed to read public key", "error", err)
+	}
+	pub, comment, err := parseSSHAuthorizedKey(data)
+	if err != nil {
+		fatal("Invalid public key", "file", *keyFile, "error", err)
+	}
+
+	cert := sshCertificate{
+		key:         pub,
+		certType:    sshUserCert,
+		keyID:       *identity,
+		validAfter:  now.Now().Add(-time.Minute),
+		validBefore: now.Now().Add(*validity),
+	}
+	for _, principal := range strings.Split(*principals, ",") {
+		if principal = strings.TrimSpace(principal); principal != "" {
+			cert.principals = append(cert.principals, principal)
+		}
+	}
+	if *certType == "host" {
+		cert.certType = sshHostCert
+	} else {
+		cert.extensions = sshUserExtensions
+	}
+	if cert.keyID == "" && len(cert.principals) > 0 {
+		cert.keyID = cert.principals[0]
+	}
+	certBlob, err := cert.sign(signer)
+	if err != nil {
+		exitWith(exitFailure, "Failed to sign SSH certificate", "error", err)
+	}
+
+	certFile := *out
+	if certFile == "" {
+		certFile = strings.TrimSuffix(*keyFile, ".pub") + "-cert.pub"
+	}
+	if comment == "" {
+		comment = cert.keyID
+	}
+	if err := os.WriteFile(certFile, []byte(formatSSHPublicKey(certBlob, comment)), 0644); err != nil {
+		fatal("Failed to write SSH certificate", "file", certFile, "error", err)
+	}
+	slog.Info("Issued SSH certificate", "file", certFile, "type", *certType, "key_id", cert.keyID, "principals", strings.Join(cert.principals, ","), "valid_before", cert.validBefore.Format(time.RFC3339))
+}
+
+// sshCertificate is an OpenSSH certificate to be signed. key is the wire
+// encoding of the certified public key.
+type sshCertificate struct {
+	key         []byte
+	certType    uint32
+	keyID       string
+	principals  []string
+	validAfter  time.Time
+	validBefore time.Time
+	extensions  []string
+}
+
+// sign returns the wire encoding of the certificate signed by signer.
+func (c *sshCertificate) sign(signer crypto.Signer) ([]byte, error) {
+	keyType, keyFields, ok := readSSHString(c.key)
+	if !ok {
+		return nil, fmt.Errorf("malformed public key")
+	}
+	caPub, err := marshalSSHPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, err
+	}
+
+	var principals, extensions []byte
+	for _, principal := range c.principals {
+		principals = appendSSHString(principals, []byte(principal))
+	}
+	for _, extension := range c.extensions {
+		extensions = appendSSHString(extensions, []byte(extension))
+		extensions = appendSSHString(extensions, nil)
+	}
+
+	var blob []byte
+	blob = appendSSHString(blob, []byte(string(keyType)+"-cert-v01@openssh.com"))
+	blob = appendSSHString(blob, nonce)
+	blob = append(blob, keyFields...)
+	blob = append(blob, serial...)
+	blob = binary.BigEndian.AppendUint32(blob, c.certType)
+	blob = appendSSHString(blob, []byte(c.keyID))
+	blob = appendSSHString(blob, principals)
+	blob = binary.BigEndian.AppendUint64(blob, uint64(c.validAfter.Unix()))
+	blob = binary.BigEndian.AppendUint64(blob, uint64(c.validBefore.Unix()))
+	blob = appendSSHString(blob, nil) // critical options
+	blob = appendSSHString(blob, extensions)
+	blob = appendSSHString(blob, nil) // reserved
+	blob = appendSSHString(blob, caPub)
+
+	signature, err := sshSign(signer, blob)
+	if err != nil {
+		return nil, err
+	}
+	return appendSSHString(blob, signature), nil
+}
+
+// sshSign signs data and returns the SSH signature blob. RSA keys sign
+// with rsa-sha2-512, ECDSA keys with the hash matching their curve.
+func sshSign(signer crypto.Signer, data []byte) ([]byte, error) {
+	var algorithm string
+	var hash crypto.Hash
+	switch pub := signer.Public().(type) {
+	case *rsa.PublicKey:
+		algorithm, hash = "rsa-sha2-512", crypto.SHA512
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			hash = crypto.SHA256
+		case elliptic.P384():
+			hash = crypto.SHA384
+		default:
+			hash = crypto.SHA512
+		}
+		algorithm = sshECDSAKeyType(pub)
+	case ed25519.PublicKey:
+		algorithm = "ssh-ed25519"
+	default:
+		return nil, fmt.Errorf("SSH CA key: %w %T", caregen.ErrUnsupportedKeyType, pub)
+	}
+
+	digest := data
+	if hash != 0 {
+		h := hash.New()
+		h.Write(data)
+		digest = h.Sum(nil)
+	}
+	signature, err := signer.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := signer.Public().(*ecdsa.PublicKey); ok {
+		var sig struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+			return nil, fmt.Errorf("failed to parse ECDSA signature: %w", err)
+		}
+		signature = appendSSHMpint(appendSSHMpint(nil, sig.R), sig.S)
+	}
+
+	blob := appendSSHString(nil, []byte(algorithm))
+	return appendSSHString(blob, signature), nil
+}
+
+// marshalSSHPublicKey returns the SSH wire encoding of pub.
+func marshalSSHPublicKey(pub crypto.PublicKey) ([]byte, error) {
+	var blob []byte
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		blob = appendSSHString(blob, []byte("ssh-rsa"))
+		blob = appendSSHMpint(blob, big.NewInt(int64(pub.E)))
+		blob = appendSSHMpint(blob, pub.N)
+	case *ecdsa.PublicKey:
+		key, err := pub.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		keyType := sshECDSAKeyType(pub)
+		blob = appendSSHString(blob, []byte(keyType))
+		blob = appendSSHString(blob, []byte(strings.TrimPrefix(keyType, "ecdsa-sha2-")))
+		blob = appendSSHString(blob, key.Bytes())
+	case ed25519.PublicKey:
+		blob = appendSSHString(blob, []byte("ssh-ed25519"))
+		blob = appendSSHString(blob, pub)
+	default:
+		return nil, fmt.Errorf("%w %T", caregen.ErrUnsupportedKeyType, pub)
+	}
+	return blob, nil
+}
+
+func sshECDSAKeyType(pub *ecdsa.PublicKey) string {
+	for name, curve := range sshCurves {
+		if pub.Curve == curve {
+			return "ecdsa-sha2-" + name
+		}
+	}
+	return "ecdsa-sha2-unknown"
+}
+
+// formatSSHPublicKey formats a public key or certificate blob in the
+// authorized_keys format.
+func formatSSHPublicKey(blob []byte, comment string) string {
+	keyType, _, _ := readSSHString(blob)
+	line := string(keyType) + " " + base64.StdEncoding.EncodeToString(blob)
+	if comment != "" {
+		line += " " + comment
+	}
+	return line + "\n"
+}
+
+// parseSSHAuthorizedKey parses the first key of data in the
+// authorized_keys format and returns its blob and comment.
+func parseSSHAuthorizedKey(data []byte) ([]byte, string, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		blob, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid base64: %w", err)
+		}
+		keyType, _, ok := readSSHString(blob)
+		if !ok || string(keyType) != fields[0] {
+			return nil, "", fmt.Errorf("malformed %s key", fields[0])
+		}
+		switch fields[0] {
+		case "ssh-rsa", "ssh-ed25519", "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		default:
+			return nil, "", fmt.Errorf("%w %s", caregen.ErrUnsupportedKeyType, fields[0])
+		}
+		return blob, strings.Join(fields[2:], " "), nil
+	}
+	return nil, "", fmt.Errorf("no public key found")
+}
+
+// loadSSHPrivateKey loads an unencrypted private key in the OpenSSH format
+// written by ssh-keygen, or a PEM encoded key.
+func loadSSHPrivateKey(file string) (crypto.Signer, error) {
+	data, err := readInput(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+		return parsePrivateKey(data)
+	}
+
+	const magic = "openssh-key-v1\x00"
+	if !bytes.HasPrefix(block.Bytes, []byte(magic)) {
+		return nil, fmt.Errorf("not an openssh-key-v1 key")
+	}
+	rest := block.Bytes[len(magic):]
+	var cipher, privateSection []byte
+	var ok bool
+	cipher, rest, ok = readSSHString(rest)
+	for i := 0; ok && i < 2; i++ { // kdf name and options
+		_, rest, ok = readSSHString(rest)
+	}
+	if !ok || len(rest) < 4 {
+		return nil, fmt.Errorf("malformed OpenSSH private key")
+	}
+	if string(cipher) != "none" {
+		return nil, fmt.Errorf("encrypted OpenSSH keys are not supported, remove the passphrase with ssh-keygen -p")
+	}
+	if binary.BigEndian.Uint32(rest) != 1 {
+		return nil, fmt.Errorf("OpenSSH private key files with multiple keys are not supported")
+	}
+	_, rest, ok = readSSHString(rest[4:]) // public key
+	if ok {
+		privateSection, _, ok = readSSHString(rest)
+	}
+	if !ok || len(privateSection) < 8 {
+		return nil, fmt.Errorf("malformed OpenSSH private key")
+	}
+	return parseSSHPrivateKeyFields(privateSection[8:]) // skip the check ints
+}
+
+// parseSSHPrivateKeyFields parses the private key fields of an
+// openssh-key-v1 private section.
+func parseSSHPrivateKeyFields(data []byte) (crypto.Signer, error) {
+	keyType, rest, ok := readSSHString(data)
+	if !ok {
+		return nil, fmt.Errorf("malformed OpenSSH private key")
+	}
+	var fields [][]byte
+	for ok && len(fields) < 6 {
+		var field []byte
+		if field, rest, ok = readSSHString(rest); ok {
+			fields = append(fields, field)
+		}
+	}
+	malformed := fmt.Errorf("malformed %s private key", keyType)
+	switch string(keyType) {
+	case "ssh-ed25519":
+		if len(fields) < 2 || len(fields[1]) != ed25519.PrivateKeySize {
+			return nil, malformed
+		}
+		return ed25519.PrivateKey(fields[1]), nil
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		if len(fields) < 3 {
+			return nil, malformed
+		}
+		curve := sshCurves[string(fields[0])]
+		if curve == nil {
+			return nil, fmt.Errorf("unsupported curve %s", fields[0])
+		}
+		// mpints may have a leading zero or be shorter than the curve size
+		d := new(big.Int).SetBytes(fields[2]).FillBytes(make([]byte, (curve.Params().BitSize+7)/8))
+		key, err := ecdsa.ParseRawPrivateKey(curve, d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ECDSA private key: %w", err)
+		}
+		return key, nil
+	case "ssh-rsa":
+		if len(fields) < 6 {
+			return nil, malformed
+		}
+		n, e, d := new(big.Int).SetBytes(fields[0]), new(big.Int).SetBytes(fields[1]), new(big.Int).SetBytes(fields[2])
+		p, q := new(big.Int).SetBytes(fields[4]), new(big.Int).SetBytes(fields[5])
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid RSA private key: %w", err)
+		}
+		key.Precompute()
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w %s", caregen.ErrUnsupportedKeyType, keyType)
+}
+
+// readSSHString reads a length prefixed string of the SSH wire format.
+func readSSHString(data []byte) (value, rest []byte, ok bool) {
+	if len(data) < 4 {
+		return nil, nil, false
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return nil, nil, false
+	}
+	return data[4 : 4+n], data[4+n:], true
+}
+
+func appendSSHString(buf, value []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+	return append(buf, value...)
+}
+
+// appendSSHMpint appends a non-negative integer as SSH mpint.
+func appendSSHMpint(buf []byte, n *big.Int) []byte {
+	value := n.Bytes()
+	if len(value) > 0 && value[0]&0x80 != 0 {
+		value = append([]byte{0}, value...)
+	}
+	return appendSSHString(buf, value)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// checkSystemTrust reports whether the original and the regenerated CA are
+// in the system trust store and whether the server certificate would
+// verify against it, as it does for clients of a CA distributed via OS
+// packages. Missing trust is only reported, the check fails if the
+// original CA is trusted by the system but the server certificate issued
+// by the regenerated CA is not.
+func checkSystemTrust(setup *caSetup) []compatResult {
+	start := time.Now()
+	result := func(err error) []compatResult {
+		return []compatResult{{CA: "New CA", Client: "System trust store", Duration: time.Since(start).Round(time.Microsecond), Err: err}}
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		return result(fmt.Errorf("failed to load system trust store: %w", err))
+	}
+
+	originalTrusted := inSystemStore(roots, setup.originalCA)
+	slog.Info("Checked system trust store", "original_ca_present", originalTrusted, "new_ca_present", inSystemStore(roots, setup.newCA))
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range setup.chain {
+		intermediates.AddCert(cert)
+	}
+	_, err = setup.serverCert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       "localhost",
+		CurrentTime:   now.Now(),
+	})
+	switch {
+	case err == nil:
+		slog.Info("Server certificate issued by the regenerated CA verifies against the system trust store")
+	case !originalTrusted:
+		slog.Warn("Server certificate does not verify against the system trust store, which does not trust the original CA either", "error", err)
+		err = nil
+	default:
+		err = fmt.Errorf("original CA is in the system trust store but the server certificate does not verify against it: %w", err)
+	}
+	return result(err)
+}
+
+// inSystemStore reports whether ca itself is in roots. Verify returns a
+// chain of ca alone only then; a root with the same subject and key does
+// not count, as Go does not build chains through it.
+func inSystemStore(roots *x509.CertPool, ca *x509.Certificate) bool {
+	chains, err := ca.Verify(x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: now.Now(),
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		slog.Debug("CA does not verify against the system trust store", "subject", ca.Subject.String(), "error", err)
+		return false
+	}
+	for _, chain := range chains {
+		if len(chain) == 1 && bytes.Equal(chain[0].Raw, ca.Raw) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// builtinTarget is the address of the built-in test web server.
+const builtinTarget = "localhost:8443"
+
+// testTarget is the host:port of -target the compatibility tests connect
+// to instead of the built-in server, if not empty.
+var testTarget string
+
+// testServerName is the server name of -servername, sent via SNI and as
+// Host header and verified instead of the host of the target.
+var testServerName string
+
+// registerTarget registers the -target and -servername flags, with the
+// usage of -target. A target without port connects to port 443.
+func registerTarget(fs *flag.FlagSet, usage string) {
+	fs.Func("target", usage, func(value string) error {
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			value = net.JoinHostPort(strings.Trim(value, "[]"), "443")
+		}
+		if host, _, _ := net.SplitHostPort(value); host == "" {
+			return fmt.Errorf("invalid target %q, use host:port", value)
+		}
+		testTarget = value
+		return nil
+	})
+	fs.StringVar(&testServerName, "servername", "", "Server name to send via SNI and verify with -target (default the host of -target)")
+}
+
+// ipFamily is the value of -ip-family.
+var ipFamily = "any"
+
+// registerIPFamily registers the -ip-family flag.
+func registerIPFamily(fs *flag.FlagSet) {
+	fs.Func("ip-family", "IP family of the test server and clients: any (localhost), ipv4 (127.0.0.1), ipv6 ([::1]) or dual (both, testing HTTPS via each) (default any)", func(value string) error {
+		switch value {
+		case "any", "ipv4", "ipv6", "dual":
+			ipFamily = value
+			return nil
+		}
+		return fmt.Errorf("invalid IP family %q, use any, ipv4, ipv6 or dual", value)
+	})
+}
+
+// testSocket is the path of the Unix domain socket of -listen the test
+// server listens on instead of port 8443, if not empty.
+var testSocket string
+
+// registerListen registers the -listen flag.
+func registerListen(fs *flag.FlagSet) {
+	fs.Func("listen", "Serve the test server via TLS on this Unix domain socket, as unix:/path.sock, instead of port 8443, e.g. for sidecar scenarios", func(value string) error {
+		path, ok := strings.CutPrefix(value, "unix:")
+		if !ok || path == "" {
+			return fmt.Errorf("invalid listen address %q, use unix:/path.sock", value)
+		}
+		testSocket = path
+		return nil
+	})
+}
+
+// checkTestFlags exits if -listen, -target, -servername, -ip-family and
+// -proxy are combined in ways which cannot work.
+func checkTestFlags() {
+	switch {
+	case testServerName != "" && testTarget == "":
+		usageError("-servername needs a -target")
+	case testSocket != "" && testTarget != "":
+		usageError("-listen serves the built-in server, it cannot be combined with -target")
+	case testSocket != "" && ipFamily != "any":
+		usageError("-ip-family cannot be combined with a Unix domain socket")
+	case testSocket != "" && clientProxy != nil:
+		usageError("-proxy cannot connect to a Unix domain socket")
+	}
+}
+
+// testNetworks returns the networks the test server listens on and the
+// test clients connect via: tcp4 and tcp6 for dual-stack, unix for a
+// Unix domain socket.
+func testNetworks() []string {
+	if testSocket != "" {
+		return []string{"unix"}
+	}
+	switch ipFamily {
+	case "ipv4":
+		return []string{"tcp4"}
+	case "ipv6":
+		return []string{"tcp6"}
+	case "dual":
+		return []string{"tcp4", "tcp6"}
+	}
+	return []string{"tcp"}
+}
+
+// networkName returns the name of the IP family of network for results.
+func networkName(network string) string {
+	switch network {
+	case "tcp4":
+		return "IPv4"
+	case "tcp6":
+		return "IPv6"
+	}
+	return ""
+}
+
+// testAddr returns the address the test clients connect to via network.
+// The built-in server is addressed by its IP literal for one IP family,
+// so its IP SAN is verified, and as localhost via a Unix domain socket.
+func testAddr(network string) string {
+	if testTarget != "" {
+		return testTarget
+	}
+	switch network {
+	case "tcp4":
+		return "127.0.0.1:8443"
+	case "tcp6":
+		return "[::1]:8443"
+	}
+	return builtinTarget
+}
+
+// testHostname returns the name the test clients verify.
+func testHostname(network string) string {
+	if testServerName != "" {
+		return testServerName
+	}
+	host, _, _ := net.SplitHostPort(testAddr(network))
+	return host
+}
+
+// testURL returns the URL the HTTPS test clients request. It has the
+// server name as host, so it is also the Host header.
+func testURL(network string) string {
+	_, port, _ := net.SplitHostPort(testAddr(network))
+	return "https://" + net.JoinHostPort(testHostname(network), port)
+}
+
+// testTransport returns the transport of the HTTPS test clients, which
+// connects via network. The host of testURL is resolved to the address
+// of the target, unless a proxy connects to it.
+func testTransport(network string, tlsConfig *tls.Config) *http.Transport {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	requested := strings.TrimPrefix(testURL(network), "https://")
+	return &http.Transport{
+		Proxy:           testClientProxy,
+		TLSClientConfig: tlsConfig,
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			if addr != requested {
+				// The proxy, always reached via TCP
+				return dialer.DialContext(ctx, "tcp", addr)
+			}
+			if network == "unix" {
+				return dialer.DialContext(ctx, network, testSocket)
+			}
+			return dialer.DialContext(ctx, network, testAddr(network))
+		},
+	}
+}
+
+// testServerURL returns where the built-in test server is reachable, for
+// logs.
+func testServerURL() string {
+	if testSocket != "" {
+		return "unix:" + testSocket
+	}
+	return "https://" + builtinTarget
+}
+
+// dialTest connects to the test server or target via network, through
+// the proxy for it.
+func dialTest(ctx context.Context, dialer *net.Dialer, network string) (net.Conn, error) {
+	if network == "unix" {
+		return dialer.DialContext(ctx, network, testSocket)
+	}
+	return dialViaProxy(ctx, dialer, network, testAddr(network))
+}
+
+// listenTestServer returns the listeners of the built-in test server for
+// -listen and -ip-family, none for any. A socket left behind by a previous
+// run is replaced.
+func listenTestServer(addr string) ([]net.Listener, error) {
+	if testSocket != "" {
+		if info, err := os.Stat(testSocket); err == nil && info.Mode().Type() == os.ModeSocket {
+			os.Remove(testSocket)
+		}
+		listener, err := net.Listen("unix", testSocket)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+	if ipFamily == "any" {
+		return nil, nil
+	}
+	var listeners []net.Listener
+	for _, network := range testNetworks() {
+		listener, err := net.Listen(network, addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", networkName(network), err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// fetchPresentedChain returns the chain the target presents, without
+// verifying it, to explain verification failures.
+func fetchPresentedChain() []*x509.Certificate {
+	chain, err := presentedChain()
+	if err != nil {
+		slog.Warn("Failed to fetch the chain presented by the target", "target", testTarget, "error", err)
+	}
+	return chain
+}
+
+// presentedChain connects to the target, through the proxy for it, and
+// returns the chain it presents in the order it is sent, without
+// verifying it.
+func presentedChain() ([]*x509.Certificate, error) {
+	network := testNetworks()[0]
+	conn, err := dialTLSViaProxy(10*time.Second, network, testAddr(network), &tls.Config{
+		ServerName:         testHostname(network),
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+func runServeTCP(args []string) {
+	fs := flag.NewFlagSet("serve-tcp", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	addr := fs.String("addr", "localhost:8443", "Address for the TLS echo server to listen on")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() {
+		usageError("go run *.go serve-tcp (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-stdout] [-addr host:port] [-v|-q] [-log-format text|json]")
+	}
+
+	setup := prepareCAs(caOpts)
+
+	listener, err := startTLSEchoServer(*addr, setup.serverTLSCertificate())
+	if err != nil {
+		fatal("Failed to start TLS echo server", "error", err)
+	}
+	defer listener.Close()
+
+	slog.Info("TLS echo server started", "addr", *addr)
+
+	slog.Debug("Testing client compatibility", "ca", "new")
+	err = testTLSClientCompatibility(*addr, setup.newCA)
+	if err != nil {
+		exitWith(exitNewCAVerificationFailed, "Unexpected failure with new CA", "error", err)
+	}
+
+	slog.Debug("Testing client compatibility", "ca", "original")
+	err = testTLSClientCompatibility(*addr, setup.originalCA)
+	if err != nil {
+		exitWith(exitOriginalCAIncompatible, "Unexpected failure with original CA", "error", err)
+	}
+
+	slog.Info("Success! Raw TLS clients trust the server with both the original and the regenerated CA")
+}
+
+// startTLSEchoServer starts a TLS listener which echoes back everything it
+// receives on a connection.
+func startTLSEchoServer(addr string, tlsCert tls.Certificate) (net.Listener, error) {
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+	}
+
+	listener, err := tls.Listen("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(30 * time.Second))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener, nil
+}
+
+func testTLSClientCompatibility(addr string, ca *x509.Certificate) error {
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca)
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+		RootCAs:    caPool,
+		ServerName: "localhost",
+		Time:       now.Now,
+	})
+	if err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	state := conn.ConnectionState()
+	slog.Info("TLS handshake succeeded", "version", tls.VersionName(state.Version), "cipher", tls.CipherSuiteName(state.CipherSuite))
+
+	const message = "Hello from the regenerated CA test client!"
+	if _, err := fmt.Fprintln(conn, message); err != nil {
+		return fmt.Errorf("failed to write to TLS connection: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read echo: %w", err)
+	}
+	if reply != message+"\n" {
+		return fmt.Errorf("unexpected echo %q", reply)
+	}
+
+	slog.Info("Server echoed message", "reply", strings.TrimSuffix(reply, "\n"))
+
+	return nil
+}
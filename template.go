@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/url"
+	"time"
+)
+
+// certTemplate is a JSON certificate template for the -template flag of
+// the issue and sign modes. Subject and names default to the request.
+type certTemplate struct {
+	Subject          string    `json:"subject"`
+	DNSNames         []string  `json:"dns"`
+	IPAddresses      []string  `json:"ip"`
+	URIs             []string  `json:"uri"`
+	EmailAddresses   []string  `json:"email"`
+	Serial           string    `json:"serial"`
+	NotBefore        time.Time `json:"not_before"`
+	NotAfter         time.Time `json:"not_after"`
+	Validity         string    `json:"validity"`
+	KeyUsage         []string  `json:"key_usage"`
+	ExtKeyUsage      []string  `json:"ext_key_usage"`
+	BasicConstraints *struct {
+		CA         bool `json:"ca"`
+		MaxPathLen *int `json:"max_path_len"`
+	} `json:"basic_constraints"`
+	Extensions []struct {
+		OID      string `json:"oid"`
+		Critical bool   `json:"critical"`
+		Hex      string `json:"hex"`
+		Base64   string `json:"base64"`
+	} `json:"extensions"`
+	// Key is only used by the issue mode without -csr-json.
+	Key *struct {
+		Algo string `json:"algo"`
+		Size int    `json:"size"`
+	} `json:"key"`
+}
+
+// loadCertTemplate reads a JSON certificate template. It returns the
+// template along with the key requested, or the zero keySpec if it has no
+// key stanza.
+func loadCertTemplate(file string) (*x509.Certificate, keySpec, error) {
+	data, err := readInput(file)
+	if err != nil {
+		return nil, keySpec{}, err
+	}
+	var t certTemplate
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, keySpec{}, fmt.Errorf("failed to parse template %s: %w", file, err)
+	}
+	template, err := t.certificate()
+	if err != nil {
+		return nil, keySpec{}, fmt.Errorf("invalid template %s: %w", file, err)
+	}
+	var key keySpec
+	if t.Key != nil {
+		key = keySpec{t.Key.Algo, t.Key.Size}
+	}
+	return template, key, nil
+}
+
+// certificate converts the template to an x509 template, using the
+// parsers of the corresponding command line flags.
+func (t *certTemplate) certificate() (*x509.Certificate, error) {
+	template := &x509.Certificate{
+		NotBefore: t.NotBefore,
+		NotAfter:  t.NotAfter,
+	}
+
+	if t.Subject != "" {
+		var subject subjectFlag
+		if err := subject.Set(t.Subject); err != nil {
+			return nil, err
+		}
+		subject.apply(&template.Subject)
+	}
+	for _, name := range t.DNSNames {
+		if err := checkWildcard(name); err != nil {
+			return nil, err
+		}
+		template.DNSNames = append(template.DNSNames, name)
+	}
+	for _, value := range t.IPAddresses {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", value)
+		}
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+	for _, value := range t.URIs {
+		uri, err := url.Parse(value)
+		if err != nil || uri.Scheme == "" {
+			return nil, fmt.Errorf("invalid URI %q", value)
+		}
+		template.URIs = append(template.URIs, uri)
+	}
+	for _, value := range t.EmailAddresses {
+		if address, err := mail.ParseAddress(value); err != nil || address.Address != value {
+			return nil, fmt.Errorf("invalid email address %q", value)
+		}
+		template.EmailAddresses = append(template.EmailAddresses, value)
+	}
+
+	if t.Serial != "" {
+		serial, ok := new(big.Int).SetString(t.Serial, 16)
+		if !ok || serial.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid serial %q, must be a positive hex number", t.Serial)
+		}
+		template.SerialNumber = serial
+	}
+	if template.NotBefore.IsZero() {
+		template.NotBefore = now.Now().Add(-time.Minute)
+	}
+	if template.NotAfter.IsZero() {
+		validity := defaultCertProfile.expiry
+		if t.Validity != "" {
+			var err error
+			if validity, err = time.ParseDuration(t.Validity); err != nil {
+				return nil, fmt.Errorf("invalid validity: %w", err)
+			}
+		}
+		template.NotAfter = template.NotBefore.Add(validity)
+	} else if t.Validity != "" {
+		return nil, fmt.Errorf("validity and not_after are mutually exclusive")
+	}
+
+	var keyUsage keyUsageFlag
+	for _, usage := range t.KeyUsage {
+		if err := keyUsage.Set(usage); err != nil {
+			return nil, err
+		}
+	}
+	template.KeyUsage = x509.KeyUsage(keyUsage)
+	var extKeyUsage extKeyUsageFlag
+	for _, usage := range t.ExtKeyUsage {
+		if err := extKeyUsage.Set(usage); err != nil {
+			return nil, err
+		}
+	}
+	template.ExtKeyUsage, template.UnknownExtKeyUsage = extKeyUsage.usages, extKeyUsage.oids
+
+	if bc := t.BasicConstraints; bc != nil {
+		template.BasicConstraintsValid = true
+		template.IsCA = bc.CA
+		if bc.MaxPathLen != nil {
+			template.MaxPathLen = *bc.MaxPathLen
+			template.MaxPathLenZero = *bc.MaxPathLen == 0
+		} else {
+			template.MaxPathLen = -1
+		}
+	}
+
+	for _, extension := range t.Extensions {
+		oid, err := parseOID(extension.OID)
+		if err != nil {
+			return nil, err
+		}
+		var value []byte
+		switch {
+		case extension.Hex != "" && extension.Base64 != "":
+			return nil, fmt.Errorf("extension %s has both a hex and a base64 value", oid)
+		case extension.Hex != "":
+			value, err = hex.DecodeString(extension.Hex)
+		default:
+			value, err = base64.StdEncoding.DecodeString(extension.Base64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of extension %s: %w", oid, err)
+		}
+		var raw asn1.RawValue
+		if rest, err := asn1.Unmarshal(value, &raw); err != nil || len(rest) > 0 {
+			return nil, fmt.Errorf("value of extension %s is not a single DER element", oid)
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{Id: oid, Critical: extension.Critical, Value: value})
+	}
+	return template, nil
+}
+
+// completeTemplate takes the subject and names missing in template from
+// the request.
+func completeTemplate(template *x509.Certificate, csr *x509.CertificateRequest) {
+	if len(template.Subject.ToRDNSequence()) == 0 {
+		template.Subject = csr.Subject
+	}
+	if len(template.DNSNames)+len(template.IPAddresses)+len(template.URIs)+len(template.EmailAddresses) == 0 {
+		template.DNSNames = csr.DNSNames
+		template.IPAddresses = csr.IPAddresses
+		template.URIs = csr.URIs
+		template.EmailAddresses = csr.EmailAddresses
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCATemplate returns the template of a CA with non-critical basic
+// constraints, as the tool expects it.
+func testCATemplate(t testing.TB) *x509.Certificate {
+	t.Helper()
+	basicConstraints, err := asn1.Marshal(struct {
+		IsCA bool `asn1:"optional"`
+	}{true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidExtensionBasicConstraints, Value: basicConstraints},
+		},
+	}
+}
+
+// newTestCA returns a self-signed CA created from testCATemplate and its
+// new key of keyType, a -leaf-key-type value. modify, if not nil, changes
+// the template before it is signed.
+func newTestCA(t testing.TB, keyType string, modify func(template *x509.Certificate)) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := keyTypes[keyType].generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := testCATemplate(t)
+	if modify != nil {
+		modify(template)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+// newTestCSR returns a request for the DNS name name with a new P-256 key.
+func newTestCSR(t testing.TB, name string) *x509.CertificateRequest {
+	t.Helper()
+	key, err := keyTypes["p256"].generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The RFC 7218 names of the TLSA certificate usages, selectors and
+// matching types, by value.
+var (
+	tlsaUsages    = []string{"PKIX-TA", "PKIX-EE", "DANE-TA", "DANE-EE"}
+	tlsaSelectors = []string{"Cert", "SPKI"}
+	tlsaMatchings = []string{"Full", "SHA2-256", "SHA2-512"}
+)
+
+// tlsaFlag is a TLSA parameter, given by value or its RFC 7218 name.
+type tlsaFlag struct {
+	value int
+	names []string
+	set   bool
+}
+
+func (f *tlsaFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strconv.Itoa(f.value)
+}
+
+func (f *tlsaFlag) Set(value string) error {
+	for i, name := range f.names {
+		if value == strconv.Itoa(i) || strings.EqualFold(value, name) {
+			f.value, f.set = i, true
+			return nil
+		}
+	}
+	return fmt.Errorf("use 0-%d or %s", len(f.names)-1, strings.Join(f.names, ", "))
+}
+
+// Outputs TLSA records for the regenerated CA and issued leaves, for
+// domains publishing DANE. The records are printed in zone file format.
+func runTLSA(args []string) {
+	fs := flag.NewFlagSet("tlsa", flag.ContinueOnError)
+	usage := tlsaFlag{names: tlsaUsages}
+	selector := tlsaFlag{value: 1, names: tlsaSelectors}
+	matching := tlsaFlag{value: 1, names: tlsaMatchings}
+	fs.Var(&usage, "usage", "Certificate usage: 0 (PKIX-TA), 1 (PKIX-EE), 2 (DANE-TA) or 3 (DANE-EE) (default 2 for CAs, 3 for leaves)")
+	fs.Var(&selector, "selector", "Selector: 0 (Cert, the full certificate) or 1 (SPKI, the public key)")
+	fs.Var(&matching, "matching", "Matching type: 0 (Full), 1 (SHA2-256) or 2 (SHA2-512)")
+	name := fs.String("name", "", "Owner name of the records, e.g. _443._tcp.www.example.com (default _<port>._<proto>.<first DNS SAN of the first leaf>)")
+	port := fs.Int("port", 443, "Port of the default owner name")
+	proto := fs.String("proto", "tcp", "Protocol of the default owner name: tcp, udp or sctp")
+	ttl := fs.Int("ttl", 0, "TTL of the records, omitted if 0")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	const usageLine = "go run *.go tlsa [-usage 0-3|DANE-TA|DANE-EE|...] [-selector 0|1] [-matching 0|1|2] [-name _443._tcp.example.com] [-port 443] [-proto tcp] [-ttl 3600] [new-ca.pem] [leaf.pem...]"
+	switch *proto {
+	case "tcp", "udp", "sctp":
+	default:
+		usageError(usageLine)
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"new-ca.pem"}
+	}
+	var certs []*x509.Certificate
+	for _, file := range files {
+		loaded, err := loadCertificates(file)
+		if err != nil {
+			exitWith(exitInvalidCA, "Failed to load certificates", "file", file, "error", err)
+		}
+		certs = append(certs, loaded...)
+	}
+
+	owner := *name
+	if owner == "" {
+		for _, cert := range certs {
+			if !cert.IsCA && len(cert.DNSNames) > 0 {
+				host := strings.TrimPrefix(cert.DNSNames[0], "*.")
+				owner = fmt.Sprintf("_%d._%s.%s", *port, *proto, host)
+				break
+			}
+		}
+		if owner == "" {
+			fatal("No owner name, give -name or a leaf with a DNS name")
+		}
+	}
+	if !strings.HasSuffix(owner, ".") {
+		owner += "."
+	}
+	class := "IN"
+	if *ttl > 0 {
+		class = strconv.Itoa(*ttl) + " IN"
+	}
+
+	for _, cert := range certs {
+		certUsage := usage.value
+		if !usage.set {
+			certUsage = 3
+			if cert.IsCA {
+				certUsage = 2
+			}
+		}
+		data := tlsaData(cert, selector.value, matching.value)
+		fmt.Printf("; %s %s %s %s\n", cert.Subject, tlsaUsages[certUsage], tlsaSelectors[selector.value], tlsaMatchings[matching.value])
+		fmt.Printf("%s %s TLSA %d %d %d %s\n", owner, class, certUsage, selector.value, matching.value, data)
+	}
+}
+
+// tlsaData returns the certificate association data of a TLSA record for
+// cert, hex encoded.
+func tlsaData(cert *x509.Certificate, selector, matching int) string {
+	data := cert.Raw
+	if selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch matching {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return strings.ToUpper(hex.EncodeToString(data))
+}
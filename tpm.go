@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/databus23/ca-regen/caregen"
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+func init() {
+	caregen.RegisterSignerBackend(func() caregen.SignerBackend { return &tpmOptions{} })
+}
+
+// tpmOptions selects a CA key held by a TPM 2.0.
+type tpmOptions struct {
+	key  string
+	auth string
+	tcti string
+}
+
+func (o *tpmOptions) Register(fs *flag.FlagSet) {
+	fs.StringVar(&o.key, "tpm-key", "", "Sign with this TPM key, a persistent handle (e.g. 0x81010001) or a tpm2-tools context file, instead of a CA key file")
+	fs.StringVar(&o.auth, "tpm-key-auth", "", "Authorization value of the TPM key")
+	fs.StringVar(&o.tcti, "tpm-tcti", "", "TCTI used to reach the TPM, e.g. device:/dev/tpmrm0 (default $TPM2TOOLS_TCTI)")
+}
+
+// tpmSigner is a crypto.Signer for a TPM 2.0 key. Like the PKCS#11
+// backend it shells out, here to tpm2-tools, instead of implementing the
+// TPM command protocol. The key has to be an unrestricted signing key,
+// since restricted keys only sign digests computed by the TPM itself.
+type tpmSigner struct {
+	opts   tpmOptions
+	public crypto.PublicKey
+}
+
+func (o *tpmOptions) Selected() bool {
+	return o.key != ""
+}
+
+// Signer returns a signer for the configured key after reading its
+// public key from the TPM.
+func (o *tpmOptions) Signer() (crypto.Signer, error) {
+	s := &tpmSigner{opts: *o}
+
+	dir, err := os.MkdirTemp("", "ca-regen-tpm")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	pubFile := filepath.Join(dir, "public.pem")
+	if err := runTPMTool(o.tcti, "", "tpm2_readpublic", "-c", o.key, "-f", "pem", "-o", pubFile); err != nil {
+		return nil, fmt.Errorf("failed to read public key of TPM key %s: %w", o.key, err)
+	}
+	pubPEM, err := os.ReadFile(pubFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pubPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode TPM public key PEM")
+	}
+	s.public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TPM public key: %w", err)
+	}
+	slog.Debug("Using TPM key", "key", o.key, "public_key", x509util.DescribePublicKey(s.public))
+	return s, nil
+}
+
+func (s *tpmSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *tpmSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := strings.ToLower(strings.ReplaceAll(opts.HashFunc().String(), "-", ""))
+	var scheme string
+	switch s.public.(type) {
+	case *rsa.PublicKey:
+		scheme = "rsassa"
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			scheme = "rsapss"
+		}
+	case *ecdsa.PublicKey:
+		scheme = "ecdsa"
+	default:
+		return nil, fmt.Errorf("TPM key: %w %T", caregen.ErrUnsupportedKeyType, s.public)
+	}
+
+	dir, err := os.MkdirTemp("", "ca-regen-tpm")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	digestFile := filepath.Join(dir, "digest")
+	sigFile := filepath.Join(dir, "signature")
+	if err := os.WriteFile(digestFile, digest, 0600); err != nil {
+		return nil, err
+	}
+
+	// -f plain writes PKCS#1 signatures for RSA and DER encoded ones for
+	// ECDSA, as expected by crypto.Signer
+	args := []string{"-c", s.opts.key, "-g", hash, "-s", scheme, "-d", "-f", "plain", "-o", sigFile}
+	if s.opts.auth != "" {
+		// Read from stdin, arguments are visible to other users
+		args = append(args, "-p", "file:-")
+	}
+	if err := runTPMTool(s.opts.tcti, s.opts.auth, "tpm2_sign", append(args, digestFile)...); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(sigFile)
+}
+
+// runTPMTool executes a tpm2-tools command reaching the TPM through tcti,
+// or $TPM2TOOLS_TCTI if empty, with stdin as its input.
+func runTPMTool(tcti, stdin, tool string, args ...string) error {
+	if tcti != "" {
+		args = append([]string{"-T", tcti}, args...)
+	}
+	cmd := exec.Command(tool, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", tool, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// tpmSealIterations is the PBKDF2 work factor of openssl enc -pbkdf2.
+const tpmSealIterations = 10000
+
+// tpmSeal writes keyPEM to file.enc, encrypted with a random passphrase
+// sealed into the TPM as file.tpm.pub and file.tpm.priv. Sealed objects
+// hold at most 128 bytes, too few for most keys. The sealed passphrase is
+// protected by the storage primary key of the owner hierarchy, so only
+// this TPM can unseal it. The key is encrypted like openssl enc
+// -aes-256-cbc -pbkdf2 does. It returns the name of the encrypted key.
+func tpmSeal(file string, keyPEM []byte) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	passphrase := hex.EncodeToString(secret)
+
+	dir, err := os.MkdirTemp("", "ca-regen-tpm")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	primary := filepath.Join(dir, "primary.ctx")
+	if err := runTPMTool("", "", "tpm2_createprimary", "-C", "o", "-c", primary); err != nil {
+		return "", err
+	}
+	pub, priv := file+".tpm.pub", file+".tpm.priv"
+	if err := runTPMTool("", passphrase, "tpm2_create", "-C", primary, "-i", "-", "-u", pub, "-r", priv); err != nil {
+		return "", err
+	}
+	// Check the sealed object can be loaded again
+	if err := runTPMTool("", "", "tpm2_load", "-C", primary, "-u", pub, "-r", priv, "-c", filepath.Join(dir, "sealed.ctx")); err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	keyIV, err := pbkdf2.Key(sha256.New, passphrase, salt, tpmSealIterations, 32+aes.BlockSize)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(keyIV[:32])
+	if err != nil {
+		return "", err
+	}
+	padding := aes.BlockSize - len(keyPEM)%aes.BlockSize
+	data := append(append([]byte{}, keyPEM...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, keyIV[32:]).CryptBlocks(data, data)
+	encrypted := file + ".enc"
+	return encrypted, os.WriteFile(encrypted, append(append([]byte("Salted__"), salt...), data...), 0600)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// trustStore is a trust store of the operating system the CA can be
+// installed into. Like the signer backends it shells out to the platform
+// tools, which know how to update the store and its derived bundles.
+type trustStore interface {
+	name() string
+	install(cert *x509.Certificate, name string) error
+	uninstall(cert *x509.Certificate, name string) error
+}
+
+// linuxTrustStore is an anchors directory of a Linux distribution and the
+// command regenerating the bundles from it.
+type linuxTrustStore struct {
+	dir    string
+	update []string
+}
+
+// linuxTrustStores are the anchor directories of Debian/Ubuntu,
+// Fedora/RHEL, Arch and openSUSE, in the order they are looked for.
+var linuxTrustStores = []linuxTrustStore{
+	{"/usr/local/share/ca-certificates", []string{"update-ca-certificates"}},
+	{"/etc/pki/ca-trust/source/anchors", []string{"update-ca-trust", "extract"}},
+	{"/etc/ca-certificates/trust-source/anchors", []string{"trust", "extract-compat"}},
+	{"/usr/share/pki/trust/anchors", []string{"update-ca-certificates"}},
+}
+
+// Installs the regenerated CA into the trust store of the operating
+// system, or removes it again, so developer machines trust it right away.
+func runTrust(args []string) {
+	const usage = "go run *.go trust install|uninstall [-name ca-regen-<serial>] [-system=false] [-nss] [new-ca.pem]"
+	if len(args) == 0 || (args[0] != "install" && args[0] != "uninstall") {
+		usageError(usage)
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("trust "+action, flag.ContinueOnError)
+	name := fs.String("name", "", "Name of the CA in the trust store (default ca-regen-<serial>)")
+	system := fs.Bool("system", true, "Update the trust store of the operating system")
+	nss := fs.Bool("nss", false, "Also update the NSS databases of Firefox and Chromium, which do not use the system trust store on Linux")
+	nssCertutil := fs.String("nss-certutil", "", "Path of the NSS certutil (default certutil from nss-tools or Homebrew's nss)")
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args[1:])
+	logOpts.setup()
+
+	if fs.NArg() > 1 || (!*system && !*nss) {
+		usageError(usage)
+	}
+	file := "new-ca.pem"
+	if fs.NArg() == 1 {
+		file = fs.Arg(0)
+	}
+	certs, err := loadCertificates(file)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA certificate", "file", file, "error", err)
+	}
+	cert := certs[0]
+	if !cert.IsCA {
+		exitWith(exitInvalidCA, "Certificate is not a CA", "file", file, "subject", cert.Subject.String())
+	}
+	if *name == "" {
+		*name = "ca-regen-" + hex.EncodeToString(cert.SerialNumber.Bytes())
+	}
+
+	if *nss {
+		store, err := findNSSTrustStore(*nssCertutil)
+		if err != nil {
+			fatal("No NSS databases found", "error", err)
+		}
+		updateTrustStore(store, action, cert, *name)
+	}
+	if !*system {
+		return
+	}
+	store, err := systemTrustStore()
+	if err != nil {
+		fatal("No supported trust store found", "error", err)
+	}
+	updateTrustStore(store, action, cert, *name)
+
+	// The system pool is only loaded now, after updating the store
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		slog.Warn("Failed to load the system trust store to check the result", "error", err)
+		return
+	}
+	if present := inSystemStore(roots, cert); present != (action == "install") {
+		slog.Warn("System trust store does not reflect the change yet, some applications keep their own store or need a restart", "present", present)
+	}
+}
+
+// updateTrustStore installs cert into store or uninstalls it, depending on
+// action, and exits on errors.
+func updateTrustStore(store trustStore, action string, cert *x509.Certificate, name string) {
+	logger := slog.With("store", store.name(), "subject", cert.Subject.String(), "name", name)
+	if action == "install" {
+		if err := store.install(cert, name); err != nil {
+			fatal("Failed to install CA into the trust store", "store", store.name(), "error", err)
+		}
+		logger.Info("Installed CA into the trust store")
+	} else {
+		if err := store.uninstall(cert, name); err != nil {
+			fatal("Failed to remove CA from the trust store", "store", store.name(), "error", err)
+		}
+		logger.Info("Removed CA from the trust store")
+	}
+}
+
+// systemTrustStore returns the trust store of the running system.
+func systemTrustStore() (trustStore, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return darwinTrustStore{}, nil
+	case "windows":
+		return windowsTrustStore{}, nil
+	case "linux":
+		for _, store := range linuxTrustStores {
+			if _, err := os.Stat(store.dir); err != nil {
+				continue
+			}
+			if _, err := exec.LookPath(store.update[0]); err != nil {
+				continue
+			}
+			return store, nil
+		}
+		return nil, errors.New("none of the anchor directories of update-ca-certificates, update-ca-trust or p11-kit trust exists")
+	}
+	return nil, fmt.Errorf("trust stores of %s are not supported", runtime.GOOS)
+}
+
+func (s linuxTrustStore) name() string {
+	return s.dir
+}
+
+func (s linuxTrustStore) install(cert *x509.Certificate, name string) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	// The anchors directory is only writable by root
+	if err := runAsRoot(bytes.NewReader(certPEM), "tee", s.file(name)); err != nil {
+		return err
+	}
+	return runAsRoot(nil, s.update...)
+}
+
+func (s linuxTrustStore) uninstall(_ *x509.Certificate, name string) error {
+	if _, err := os.Stat(s.file(name)); err != nil {
+		return fmt.Errorf("CA is not installed as %s: %w", name, err)
+	}
+	if err := runAsRoot(nil, "rm", "-f", s.file(name)); err != nil {
+		return err
+	}
+	return runAsRoot(nil, s.update...)
+}
+
+// file returns the path of the anchor, update-ca-certificates only picks
+// up files ending in .crt.
+func (s linuxTrustStore) file(name string) string {
+	return filepath.Join(s.dir, name+".crt")
+}
+
+// darwinTrustStore is the System keychain of macOS, with the CA trusted as
+// root for all users.
+type darwinTrustStore struct{}
+
+func (darwinTrustStore) name() string {
+	return "/Library/Keychains/System.keychain"
+}
+
+func (s darwinTrustStore) install(cert *x509.Certificate, name string) error {
+	file, cleanup, err := writeTempCert(cert, name)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return runAsRoot(nil, "security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", s.name(), file)
+}
+
+func (s darwinTrustStore) uninstall(cert *x509.Certificate, _ string) error {
+	// -t removes the trust settings along with the certificate
+	return runAsRoot(nil, "security", "delete-certificate", "-t", "-Z", sha1Thumbprint(cert), s.name())
+}
+
+// windowsTrustStore is the Root store of the local machine.
+type windowsTrustStore struct{}
+
+func (windowsTrustStore) name() string {
+	return `LocalMachine\Root`
+}
+
+func (windowsTrustStore) install(cert *x509.Certificate, name string) error {
+	file, cleanup, err := writeTempCert(cert, name)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	_, err = runCertutil("-addstore", "-f", "Root", file)
+	return err
+}
+
+func (windowsTrustStore) uninstall(cert *x509.Certificate, _ string) error {
+	// The thumbprint only matches this certificate, the serial would also
+	// match the original CA
+	_, err := runCertutil("-delstore", "Root", sha1Thumbprint(cert))
+	return err
+}
+
+// sha1Thumbprint returns the SHA-1 fingerprint by which the macOS and
+// Windows tools identify certificates.
+func sha1Thumbprint(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// writeTempCert writes cert PEM encoded to a temporary file for the
+// platform tools.
+func writeTempCert(cert *x509.Certificate, name string) (string, func(), error) {
+	dir, err := os.MkdirTemp("", "ca-regen-trust")
+	if err != nil {
+		return "", nil, err
+	}
+	file := filepath.Join(dir, name+".pem")
+	err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o644)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return file, func() { os.RemoveAll(dir) }, nil
+}
+
+// runAsRoot runs the command with stdin, through sudo unless already
+// running as root. sudo asks for the password on the terminal.
+func runAsRoot(stdin io.Reader, args ...string) error {
+	if os.Geteuid() != 0 {
+		if _, err := exec.LookPath("sudo"); err == nil {
+			args = append([]string{"sudo", "--prompt=Password to update the trust store: "}, args...)
+		}
+	}
+	slog.Debug("Running trust store command", "command", strings.Join(args, " "))
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
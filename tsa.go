@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+var (
+	oidTSTInfo                     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidAttributeSigningCertificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidExtKeyUsageTimeStamping     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}
+)
+
+type tsaMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type tsaRequest struct {
+	Version        int
+	MessageImprint tsaMessageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+	Extensions     []pkix.Extension      `asn1:"optional,tag:0"`
+}
+
+type tsaResponse struct {
+	Status         cmpStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint tsaMessageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Nonce          *big.Int  `asn1:"optional"`
+}
+
+// essCertIDv2 identifies the signing certificate by its SHA-256 hash, the
+// default hash algorithm which is omitted (RFC 5035).
+type essCertIDv2 struct {
+	CertHash []byte
+}
+
+// RFC 3161 timestamping authority with a timestamping certificate issued
+// from the regenerated CA, for artifact signing pipelines which need
+// trusted timestamps. Requests are sent with POST over HTTP.
+func runTSAServe(args []string) {
+	fs := flag.NewFlagSet("tsa-serve", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.register(fs)
+	addr := fs.String("addr", "localhost:8318", "Address for the timestamping authority to listen on")
+	policy := fs.String("policy", "1.2.3.4.1", "OID of the TSA policy of the timestamps, requests for other policies are rejected")
+	validity := fs.Duration("cert-validity", 365*24*time.Hour, "Validity of the timestamping certificate")
+	out := fs.String("out", "tsa", "Base name of the written timestamping certificate (<out>.pem)")
+	registerShutdown(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if !caOpts.valid() || *validity <= 0 {
+		usageError("go run *.go tsa-serve (-ca <ca-bundle.pem|-> | -ca-cert <ca-cert.pem|-> -ca-key <ca-key.pem|->) [-addr host:port] [-policy 1.2.3.4.1] [-cert-validity 8760h] [-out tsa]")
+	}
+	policyOID, err := parseOID(*policy)
+	if err != nil {
+		usageError("invalid -policy: " + err.Error())
+	}
+
+	setup := regenerateCAs(caOpts)
+	key, err := setup.leafKey.or(keyTypes["p256"]).generate()
+	if err != nil {
+		fatal("Failed to generate key", "error", err)
+	}
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		fatal("Ed25519 keys are not supported for timestamping, use -leaf-key-type with an RSA or ECDSA key")
+	}
+	template, err := tsaTemplate(setup.newCA, *validity)
+	if err != nil {
+		fatal("Invalid timestamping certificate", "error", err)
+	}
+	cert, err := signCertificate(setup.newCA, setup.caKey, template, key.Public(), nil)
+	if err != nil {
+		exitWith(exitFailure, "Failed to issue timestamping certificate", "error", err)
+	}
+	writeIssued(*out, cert)
+
+	tsa := &tsaServer{cert: cert, key: key, policy: policyOID}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /", tsa.handle)
+	server := &http.Server{
+		Addr:     *addr,
+		Handler:  mux,
+		ErrorLog: serverErrorLog(),
+	}
+	slog.Info("Timestamping authority started", "url", "http://"+*addr+"/", "ca_file", "new-ca.pem", "cert_file", *out+".pem", "policy", policyOID.String())
+	if err := serveUntilSignal(server); err != nil {
+		fatal("Timestamping authority failed", "error", err)
+	}
+}
+
+// tsaTemplate returns the template of a timestamping certificate of ca.
+// RFC 3161 section 2.3 requires the extended key usage to be critical and
+// to contain only timeStamping, which x509.CreateCertificate does not
+// mark critical, so it is added as extra extension.
+func tsaTemplate(ca *x509.Certificate, validity time.Duration) (*x509.Certificate, error) {
+	extKeyUsage, err := asn1.Marshal([]asn1.ObjectIdentifier{oidExtKeyUsageTimeStamping})
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		Subject:         pkix.Name{CommonName: ca.Subject.CommonName + " Timestamping Authority", Organization: ca.Subject.Organization},
+		NotBefore:       now.Now().Add(-time.Minute),
+		NotAfter:        now.Now().Add(validity),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{{Id: oidExtensionExtendedKeyUsage, Critical: true, Value: extKeyUsage}},
+	}, nil
+}
+
+type tsaServer struct {
+	cert   *x509.Certificate
+	key    crypto.Signer
+	policy asn1.ObjectIdentifier
+}
+
+func (s *tsaServer) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response, err := s.respond(body)
+	if err != nil {
+		var failure *cmpFailure
+		if !errors.As(err, &failure) {
+			failure = cmpError(cmpFailSystemFailure, "%v", err)
+		}
+		slog.Warn("Rejected timestamp request", "remote", r.RemoteAddr, "error", failure.message)
+		response, _ = asn1.Marshal(tsaResponse{Status: cmpRejection(failure)})
+	}
+	w.Header().Set("Content-Type", "application/timestamp-reply")
+	w.Write(response)
+}
+
+// respond returns the granted response with a timestamp token for the DER
+// encoded request.
+func (s *tsaServer) respond(der []byte) ([]byte, error) {
+	var req tsaRequest
+	if rest, err := asn1.Unmarshal(der, &req); err != nil || len(rest) > 0 {
+		return nil, cmpError(cmpFailBadDataFormat, "invalid timestamp request")
+	}
+	if req.Version != 1 {
+		return nil, cmpError(cmpFailBadRequest, "unsupported version %d", req.Version)
+	}
+	hash, ok := pkcs7HashFor(req.MessageImprint.HashAlgorithm.Algorithm)
+	if !ok {
+		return nil, cmpError(cmpFailBadAlg, "unsupported hash algorithm %s", req.MessageImprint.HashAlgorithm.Algorithm)
+	}
+	if len(req.MessageImprint.HashedMessage) != hash.Size() {
+		return nil, cmpError(cmpFailBadDataFormat, "%s message imprint has %d bytes", hash, len(req.MessageImprint.HashedMessage))
+	}
+	if len(req.ReqPolicy) > 0 && !req.ReqPolicy.Equal(s.policy) {
+		return nil, cmpError(cmpFailUnacceptedPolicy, "unsupported policy %s", req.ReqPolicy)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	info, err := asn1.Marshal(tstInfo{
+		Version:        1,
+		Policy:         s.policy,
+		MessageImprint: req.MessageImprint,
+		SerialNumber:   serial,
+		GenTime:        now.Now().UTC().Truncate(time.Second),
+		Nonce:          req.Nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The signing certificate is identified in a signed attribute
+	// (RFC 5816), so it cannot be substituted
+	certHash := sha256.Sum256(s.cert.Raw)
+	signingCertificate, err := pkcs7SignedAttribute(oidAttributeSigningCertificate, struct{ Certs []essCertIDv2 }{[]essCertIDv2{{certHash[:]}}}, "")
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	if req.CertReq {
+		certs = []*x509.Certificate{s.cert}
+	}
+	token, err := createSignedData(oidTSTInfo, info, []pkcs7Attribute{signingCertificate}, s.cert, s.key, crypto.SHA256, certs)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Issued timestamp", "serial", x509util.FormatHex(serial.Bytes()), "hash", hash.String())
+	return asn1.Marshal(tsaResponse{TimeStampToken: asn1.RawValue{FullBytes: token}})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// Guided workflow for operators who prefer being asked over flags: loads
+// the CA, asks for the options, previews the differences between the
+// original and the regenerated CA and runs the compatibility tests. The
+// equivalent command line is printed at the end for automation.
+func runInteractive(args []string) {
+	fs := flag.NewFlagSet("interactive", flag.ContinueOnError)
+	registerAudit(fs)
+	registerWebhook(fs)
+	registerCertDB(fs)
+	registerSerials(fs)
+	registerProxy(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	var caOpts caOptions
+	var flags []string
+
+	p.section("1. Load the CA")
+	var loaded *x509.Certificate
+	for {
+		caOpts.certFile = p.ask("CA certificate file", "ca-cert.pem")
+		caOpts.keyFile = p.ask("CA private key file (empty if part of the certificate file)", "")
+		original, key, _, err := caOpts.load()
+		loaded = original
+		if err == nil {
+			if err = checkOriginalCABasicConstraints(original); err == nil {
+				fmt.Fprintf(p.out, "Loaded %s (%s), valid until %s\n", original.Subject, x509util.DescribePublicKey(key.Public()), original.NotAfter.Format(time.DateOnly))
+				break
+			}
+		}
+		fmt.Fprintf(p.out, "Cannot use this CA: %v\n", err)
+	}
+	flags = append(flags, "-ca-cert", caOpts.certFile)
+	if caOpts.keyFile != "" {
+		flags = append(flags, "-ca-key", caOpts.keyFile)
+	}
+
+	p.section("2. Choose the options")
+	for {
+		subject := p.ask("Rename the regenerated CA, e.g. O=New Org,CN=New CA (empty keeps the subject)", "")
+		if subject == "" {
+			break
+		}
+		if err := caOpts.caSubject.Set(subject); err != nil {
+			fmt.Fprintf(p.out, "Invalid subject: %v\n", err)
+			continue
+		}
+		flags = append(flags, "-ca-subject", subject)
+		break
+	}
+	if caOpts.caSubject.empty() && p.confirm("Only mark basicConstraints critical in the DER of the original, keeping every other byte", false) {
+		caOpts.minimalDiff = true
+		flags = append(flags, "-minimal-diff")
+	}
+	if p.confirm("Regenerate reproducibly (byte-identical for the same CA)", false) {
+		caOpts.deterministic = true
+		flags = append(flags, "-deterministic")
+	}
+	for {
+		value := p.ask("Validity of the server certificate", "8760h")
+		validity, err := time.ParseDuration(value)
+		if err != nil || validity <= 0 {
+			fmt.Fprintf(p.out, "Invalid duration %q, e.g. 720h\n", value)
+			continue
+		}
+		caOpts.leaf.validity = validity
+		if validity != 365*24*time.Hour {
+			flags = append(flags, "-validity", value)
+		}
+		break
+	}
+	// Re-keying and cross-signing produce further CAs next to the
+	// regenerated one, which keeps the key of the original
+	var rekeyType string
+	for {
+		rekeyType = p.ask("Re-key: type of the new key of a successor CA cross-signed by the regenerated CA, rsa2048, rsa3072, rsa4096, p256, p384 or ed25519 (empty skips)", "")
+		if _, ok := keyTypes[rekeyType]; ok || rekeyType == "" {
+			break
+		}
+		fmt.Fprintf(p.out, "Unsupported key type %q\n", rekeyType)
+	}
+	var other *x509.Certificate
+	var otherKey crypto.Signer
+	var otherCertFile, otherKeyFile string
+	for {
+		otherCertFile = p.ask("Cross-sign with another CA: its certificate file (empty skips)", "")
+		if otherCertFile == "" {
+			break
+		}
+		otherKeyFile = p.ask("Private key file of the other CA (empty if part of the certificate file)", "")
+		keyFile := otherKeyFile
+		if keyFile == "" {
+			keyFile = otherCertFile
+		}
+		var err error
+		other, otherKey, _, err = loadCA(otherCertFile, keyFile)
+		if err == nil && !other.IsCA {
+			err = fmt.Errorf("%s is not a CA", other.Subject)
+		} else if err == nil && isSameCA(loaded, other) {
+			err = fmt.Errorf("it is the CA itself")
+		}
+		if err == nil {
+			break
+		}
+		fmt.Fprintf(p.out, "Cannot use this CA: %v\n", err)
+	}
+
+	p.section("3. Preview")
+	original, key, _, err := caOpts.load()
+	if err != nil {
+		fatal("Failed to load CA", "error", err)
+	}
+	preview, err := caOpts.regenerate(original, key)
+	if err != nil {
+		exitWith(exitRegenerationFailed, "Failed to generate new CA", "error", err)
+	}
+	printCADiff(p.out, certificateProperties(original), certificateProperties(preview))
+	if !p.confirm("Write new-ca.pem and run the compatibility tests", true) {
+		fmt.Fprintln(p.out, "Aborted, nothing was written.")
+		return
+	}
+
+	p.section("4. Compatibility tests")
+	setup := prepareCAs(caOpts)
+	server := startWebServer(&tls.Config{Certificates: []tls.Certificate{setup.serverTLSCertificate()}})
+	defer server.Close()
+	results := runCompatibilityTests(setup, false)
+	code := exitSuccess
+	for _, r := range results {
+		status := "PASS"
+		if r.Err != nil {
+			status = "FAIL"
+			if r.CA == "New CA" {
+				code = exitNewCAVerificationFailed
+			} else if code == exitSuccess {
+				code = exitOriginalCAIncompatible
+			}
+		}
+		fmt.Fprintf(p.out, "  %-4s %-10s trusting %s\n", status, r.Client, r.CA)
+	}
+
+	// The regenerated CA is only used for further CAs if clients accept it
+	commands := []string{strings.Join(flags, " ")}
+	caFlags := slices.Clip(flags[:2])
+	if caOpts.keyFile != "" {
+		caFlags = slices.Clip(flags[:4])
+	}
+	if code == exitSuccess && (rekeyType != "" || other != nil) {
+		p.section("5. Re-key and cross-sign")
+		if rekeyType != "" {
+			if err := rekeyCA(setup.newCA, setup.caKey, keyTypes[rekeyType], "rekeyed-ca", &keyRecipients{}); err != nil {
+				exitWith(exitRegenerationFailed, "Failed to re-key the CA", "error", err)
+			}
+			fmt.Fprintln(p.out, "The successor CA was saved as rekeyed-ca.pem with its key in rekeyed-ca-key.pem, and its cross certificate as rekeyed-ca-cross.pem.")
+			commands = append(commands, strings.Join(append([]string{"rekey"}, append(caFlags, "-key-type", rekeyType)...), " "))
+		}
+		if other != nil {
+			if err := crossSign(setup.newCA, setup.caKey, other, otherKey, "cross"); err != nil {
+				exitWith(exitFailure, "Failed to cross-sign", "error", err)
+			}
+			fmt.Fprintf(p.out, "The cross certificates with %s were saved as cross-forward.pem and cross-reverse.pem, the pair as cross-pair.der.\n", other.Subject)
+			command := append([]string{"cross-sign"}, append(caFlags, "-other-ca-cert", otherCertFile)...)
+			if otherKeyFile != "" {
+				command = append(command, "-other-ca-key", otherKeyFile)
+			}
+			commands = append(commands, strings.Join(command, " "))
+		}
+	}
+
+	p.section("Done")
+	if code != exitSuccess {
+		fmt.Fprintln(p.out, "At least one client rejected the server certificate, see the errors above.")
+		if rekeyType != "" || other != nil {
+			fmt.Fprintln(p.out, "Re-keying and cross-signing were skipped.")
+		}
+	} else {
+		fmt.Fprintln(p.out, "All clients accepted the server certificate issued by the regenerated CA, which was saved as new-ca.pem.")
+	}
+	fmt.Fprintln(p.out, "To repeat this without questions:")
+	for _, command := range commands {
+		fmt.Fprintf(p.out, "  go run *.go %s\n", command)
+	}
+	os.Exit(code)
+}
+
+// printCADiff prints the properties of the original and the regenerated
+// CA, marking those which differ.
+func printCADiff(w io.Writer, original, regenerated []reportProperty) {
+	for i, p := range original {
+		if p.Original == regenerated[i].Original {
+			fmt.Fprintf(w, "    %-20s %s\n", p.Name, p.Original)
+			continue
+		}
+		fmt.Fprintf(w, "  - %-20s %s\n", p.Name, p.Original)
+		fmt.Fprintf(w, "  + %-20s %s\n", p.Name, regenerated[i].Original)
+	}
+}
+
+// prompter asks questions on the terminal.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (p *prompter) section(title string) {
+	fmt.Fprintf(p.out, "\n== %s ==\n", title)
+}
+
+// ask returns the answer to question, or def for an empty answer.
+func (p *prompter) ask(question, def string) string {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		fmt.Fprintln(p.out)
+		exitWith(exitUsage, "No answer, aborting", "question", question)
+	}
+	if answer := strings.TrimSpace(line); answer != "" {
+		return answer
+	}
+	return def
+}
+
+// confirm asks a yes/no question.
+func (p *prompter) confirm(question string, def bool) bool {
+	options := "y/N"
+	if def {
+		options = "Y/n"
+	}
+	for {
+		switch strings.ToLower(p.ask(question+" ("+options+")", "")) {
+		case "":
+			return def
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultOptions holds the address and credentials of a Vault server. The
+// defaults are taken from the environment variables used by the vault CLI.
+type vaultOptions struct {
+	addr         string
+	token        string
+	namespace    string
+	caCert       string
+	roleID       string
+	secretID     string
+	approleMount string
+	client       *http.Client
+}
+
+func (o *vaultOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.addr, "vault-addr", envOr("VAULT_ADDR", "https://127.0.0.1:8200"), "Address of the Vault server (default $VAULT_ADDR)")
+	fs.StringVar(&o.token, "vault-token", "", "Vault token (default $VAULT_TOKEN)")
+	fs.StringVar(&o.namespace, "vault-namespace", os.Getenv("VAULT_NAMESPACE"), "Vault Enterprise namespace (default $VAULT_NAMESPACE)")
+	fs.StringVar(&o.caCert, "vault-ca-cert", os.Getenv("VAULT_CACERT"), "PEM file with the CA certificate(s) of the Vault server (default $VAULT_CACERT)")
+	fs.StringVar(&o.roleID, "approle-role-id", "", "Log in with AppRole using this role ID instead of a token")
+	fs.StringVar(&o.secretID, "approle-secret-id", "", "Secret ID for AppRole login")
+	fs.StringVar(&o.approleMount, "approle-mount", "approle", "Mount path of the AppRole auth method")
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// login sets up the HTTP client and obtains a token via AppRole if a role
+// ID was given.
+func (o *vaultOptions) login() error {
+	tlsConfig := &tls.Config{}
+	if o.caCert != "" {
+		certs, err := loadCertificates(o.caCert)
+		if err != nil {
+			return fmt.Errorf("failed to load Vault CA certificate: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		for _, cert := range certs {
+			tlsConfig.RootCAs.AddCert(cert)
+		}
+	}
+	o.client = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}
+
+	if o.roleID == "" {
+		if o.token == "" {
+			o.token = os.Getenv("VAULT_TOKEN")
+		}
+		if o.token == "" {
+			return fmt.Errorf("no Vault token given, use -vault-token or -approle-role-id")
+		}
+		return nil
+	}
+
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role_id": o.roleID, "secret_id": o.secretID}
+	if err := o.request("POST", "auth/"+o.approleMount+"/login", body, &resp); err != nil {
+		return fmt.Errorf("AppRole login failed: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return fmt.Errorf("AppRole login returned no token")
+	}
+	o.token = resp.Auth.ClientToken
+	slog.Debug("Logged in to Vault with AppRole", "mount", o.approleMount)
+	return nil
+}
+
+// request sends a request to the Vault HTTP API at /v1/<path>, encoding
+// body as JSON if not nil and decoding the response into v if not nil.
+func (o *vaultOptions) request(method, path string, body, v any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	url := strings.TrimRight(o.addr, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return err
+	}
+	if o.token != "" {
+		req.Header.Set("X-Vault-Token", o.token)
+	}
+	if o.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", o.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.Join(vaultErr.Errors, "; "))
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if v == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode Vault response: %w", err)
+	}
+	return nil
+}
+
+// readKV reads a secret from a KV secrets engine. Both KV version 1 and
+// version 2 (where the path contains /data/) responses are understood.
+func (o *vaultOptions) readKV(path string) (map[string]any, error) {
+	var resp struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := o.request("GET", path, nil, &resp); err != nil {
+		return nil, err
+	}
+	if inner, ok := resp.Data["data"].(map[string]any); ok {
+		if _, ok := resp.Data["metadata"]; ok {
+			return inner, nil
+		}
+	}
+	return resp.Data, nil
+}
+
+func runVault(args []string) {
+	fs := flag.NewFlagSet("vault", flag.ContinueOnError)
+	var caOpts caOptions
+	caOpts.registerInput(fs)
+	pkiMount := fs.String("pki-mount", "pki", "Mount path of the PKI secrets engine")
+	kvPath := fs.String("kv-path", "", "Read the CA certificate and key from this KV secret (e.g. secret/data/ca) instead of local files")
+	kvCertField := fs.String("kv-cert-field", "certificate", "Field of the KV secret holding the CA certificate")
+	kvKeyField := fs.String("kv-key-field", "private_key", "Field of the KV secret holding the CA private key")
+	importCA := fs.Bool("import", false, "Import the regenerated CA into the PKI secrets engine via <pki-mount>/config/ca")
+	setDefault := fs.Bool("set-default", false, "Make the imported issuer the default issuer of the mount (Vault 1.11+)")
+	dryRun := fs.Bool("dry-run", false, "Only show what would be changed")
+	var vault vaultOptions
+	vault.register(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	// Importing into Vault needs the key itself, a KMS or hardware key
+	// cannot be used
+	if caOpts.externalKeys() > 0 || (*kvPath == "" && caOpts.keyFile == "" && !caOpts.valid()) {
+		usageError("go run *.go vault (-kv-path <path> | -ca <ca-bundle.pem> | -ca-cert <ca-cert.pem> -ca-key <ca-key.pem> | -ca-key <ca-key.pem>) [-pki-mount pki] [-import [-set-default]] [-dry-run] [-vault-addr addr] [-vault-token token | -approle-role-id id -approle-secret-id id]")
+	}
+
+	if err := vault.login(); err != nil {
+		exitWith(exitFailure, "Failed to connect to Vault", "error", err)
+	}
+
+	// The PKI engine never returns the issuer key, so the key comes from a
+	// KV secret or a local file. Without a local certificate the CA
+	// certificate is fetched from the PKI mount.
+	var certPEM, keyPEM []byte
+	var err error
+	switch {
+	case *kvPath != "":
+		var secret map[string]any
+		secret, err = vault.readKV(*kvPath)
+		if err != nil {
+			exitWith(exitFailure, "Failed to read CA from Vault", "path", *kvPath, "error", err)
+		}
+		cert, _ := secret[*kvCertField].(string)
+		key, _ := secret[*kvKeyField].(string)
+		if key == "" {
+			exitWith(exitInvalidCA, "KV secret has no private key", "path", *kvPath, "field", *kvKeyField)
+		}
+		certPEM, keyPEM = []byte(cert), []byte(key)
+		if cert == "" {
+			certPEM, err = vault.fetchPKICA(*pkiMount)
+		}
+	case caOpts.certFile == "" && caOpts.bundleFile == "":
+		keyPEM, err = readInput(caOpts.keyFile)
+		if err == nil {
+			certPEM, err = vault.fetchPKICA(*pkiMount)
+		}
+	default:
+		certFile, keyFile := caOpts.files()
+		certPEM, err = readInput(certFile)
+		if err == nil {
+			keyPEM, err = readInput(keyFile)
+		}
+	}
+	if err != nil {
+		exitWith(exitFailure, "Failed to read CA", "error", err)
+	}
+
+	originalCA, caKey, _, err := parseCA(certPEM, keyPEM)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA", "error", err)
+	}
+	slog.Info("Loaded original CA certificate and key", "subject", originalCA.Subject.String())
+
+	if err := checkOriginalCABasicConstraints(originalCA); err != nil {
+		exitWith(exitInvalidCA, "Original CA validation failed", "error", err)
+	}
+	newCA, err := caOpts.regenerate(originalCA, caKey)
+	if err != nil {
+		exitWith(exitRegenerationFailed, "Failed to generate new CA", "error", err)
+	}
+	slog.Info("Generated new CA with critical basic constraints")
+
+	if err := saveCAToFile(newCA, "new-ca.pem"); err != nil {
+		slog.Warn("Failed to save new CA to file", "error", err)
+	} else {
+		slog.Info("Saved new CA for inspection", "file", "new-ca.pem")
+	}
+
+	if !*importCA {
+		return
+	}
+	if *dryRun {
+		slog.Info("Dry run: would import regenerated CA", "mount", *pkiMount)
+		return
+	}
+
+	keyBlock := findPEMBlock(keyPEM, "PRIVATE KEY")
+	bundle := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newCA.Raw}), pem.EncodeToMemory(keyBlock)...)
+	var resp struct {
+		Data struct {
+			ImportedIssuers []string `json:"imported_issuers"`
+		} `json:"data"`
+	}
+	if err := vault.request("POST", *pkiMount+"/config/ca", map[string]string{"pem_bundle": string(bundle)}, &resp); err != nil {
+		exitWith(exitFailure, "Failed to import regenerated CA", "mount", *pkiMount, "error", err)
+	}
+	slog.Info("Imported regenerated CA", "mount", *pkiMount, "issuers", strings.Join(resp.Data.ImportedIssuers, ","))
+
+	if !*setDefault {
+		return
+	}
+	if len(resp.Data.ImportedIssuers) != 1 {
+		exitWith(exitFailure, "Cannot set default issuer, Vault did not report exactly one imported issuer", "issuers", len(resp.Data.ImportedIssuers))
+	}
+	issuer := resp.Data.ImportedIssuers[0]
+	if err := vault.request("POST", *pkiMount+"/config/issuers", map[string]string{"default": issuer}, nil); err != nil {
+		exitWith(exitFailure, "Failed to set default issuer", "issuer", issuer, "error", err)
+	}
+	slog.Info("Set default issuer", "mount", *pkiMount, "issuer", issuer)
+}
+
+// fetchPKICA returns the PEM encoded CA certificate of a PKI mount.
+func (o *vaultOptions) fetchPKICA(mount string) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Certificate string `json:"certificate"`
+		} `json:"data"`
+	}
+	if err := o.request("GET", mount+"/cert/ca", nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to fetch CA certificate from %s: %w", mount, err)
+	}
+	if resp.Data.Certificate == "" {
+		return nil, fmt.Errorf("PKI mount %s has no CA certificate", mount)
+	}
+	return []byte(resp.Data.Certificate), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log/slog"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	var caFiles, intermediateFiles stringList
+	fs.Var(&caFiles, "ca", "Path to PEM encoded CA certificate(s) to trust (repeatable)")
+	certFile := fs.String("cert", "", "Path to PEM encoded certificate to verify")
+	fs.Var(&intermediateFiles, "intermediate", "Path to PEM encoded intermediate certificate(s) (repeatable)")
+	hostname := fs.String("hostname", "", "Hostname (or IP address) the certificate must be valid for")
+	registerAIAFetch(fs)
+	registerClock(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if len(caFiles) == 0 || *certFile == "" {
+		usageError("go run *.go verify -ca <ca.pem> -cert <leaf.pem> [-intermediate <int.pem>]... [-hostname <name>] [-aia-fetch]")
+	}
+
+	roots := x509.NewCertPool()
+	var rootCerts []*x509.Certificate
+	for _, file := range caFiles {
+		certs, err := loadCertificates(file)
+		if err != nil {
+			exitWith(exitFailure, "Failed to load CA certificates", "file", file, "error", err)
+		}
+		for _, cert := range certs {
+			roots.AddCert(cert)
+		}
+		rootCerts = append(rootCerts, certs...)
+	}
+
+	intermediates := x509.NewCertPool()
+	var intermediateCerts []*x509.Certificate
+	for _, file := range intermediateFiles {
+		certs, err := loadCertificates(file)
+		if err != nil {
+			exitWith(exitFailure, "Failed to load intermediate certificates", "file", file, "error", err)
+		}
+		for _, cert := range certs {
+			intermediates.AddCert(cert)
+		}
+		intermediateCerts = append(intermediateCerts, certs...)
+	}
+
+	certs, err := loadCertificates(*certFile)
+	if err != nil {
+		exitWith(exitFailure, "Failed to load certificate", "file", *certFile, "error", err)
+	}
+	// Any additional certificates in the leaf file are treated as the
+	// chain sent along with it, like a TLS server would do.
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       *hostname,
+		CurrentTime:   now.Now(),
+	}
+	var chains [][]*x509.Certificate
+	var fetched []*x509.Certificate
+	if aiaFetch {
+		chains, fetched, err = verifyWithAIA(certs, opts)
+	} else {
+		chains, err = certs[0].Verify(opts)
+	}
+	if err != nil {
+		logChainProblems(append(certs, intermediateCerts...), rootCerts, *hostname)
+		exitWith(exitVerifyFailed, "Verification failed: "+x509util.ExplainVerifyError(err), "error", err)
+	}
+
+	if len(fetched) > 0 {
+		warnAIAOnly(fetched, "subject", certs[0].Subject.String())
+	}
+	slog.Info("Certificate verified", "subject", certs[0].Subject.String(), "chains", len(chains))
+	for i, chain := range chains {
+		fmt.Printf("Chain %d:\n", i+1)
+		for depth, cert := range chain {
+			fmt.Printf("  %d: %s\n", depth, cert.Subject)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// runWatch re-runs the regeneration and the client tests whenever one of
+// the CA files changes, e.g. when a secret sync process updates them. Every
+// run is a child process of the tool with the same arguments, so a failing
+// run, which exits like a single run would, does not end the watch. A
+// change is only acted upon once the files are unchanged for one interval,
+// as the certificate and key are usually not written at once.
+func runWatch(files []string, interval time.Duration) {
+	executable, err := os.Executable()
+	if err != nil {
+		fatal("Failed to find executable", "error", err)
+	}
+	// The last occurrence of a flag wins, so the child runs only once
+	args := append(os.Args[1:len(os.Args):len(os.Args)], "-watch=false")
+
+	last := fingerprintFiles(files)
+	for {
+		cmd := exec.Command(executable, args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		switch {
+		case err == nil:
+			slog.Info("Run succeeded, watching for changes", "files", files)
+		case errors.As(err, &exitErr):
+			slog.Error("Run failed, watching for changes", "files", files, "exit_code", exitErr.ExitCode())
+		default:
+			fatal("Failed to run", "error", err)
+		}
+
+		changed := false
+		for {
+			time.Sleep(interval)
+			current := fingerprintFiles(files)
+			if current != last {
+				slog.Debug("CA files changed, waiting for them to settle", "files", files)
+				last, changed = current, true
+			} else if changed {
+				break
+			}
+		}
+		slog.Info("CA files changed, running again", "files", files)
+	}
+}
+
+// fingerprintFiles returns a hash of the content of files. Files which
+// cannot be read contribute their error, so they are retried.
+func fingerprintFiles(files []string) [sha256.Size]byte {
+	h := sha256.New()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			h.Write([]byte(err.Error()))
+		} else {
+			data := sha256.Sum256(data)
+			h.Write(data[:])
+		}
+	}
+	return [sha256.Size]byte(h.Sum(nil))
+}
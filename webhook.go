@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/databus23/ca-regen/internal/x509util"
+)
+
+// webhookURL receives a JSON event for every regenerated, issued and
+// re-signed certificate and every completed compatibility run, if
+// -webhook-url is given.
+var webhookURL string
+
+// webhookEvent is the body POSTed to the webhook.
+type webhookEvent struct {
+	// Operation is regenerate, issue, resign or compatibility-test.
+	Operation string `json:"operation"`
+	Time      string `json:"time"`
+	// Result is success or failure.
+	Result  string `json:"result"`
+	Error   string `json:"error,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Serial  string `json:"serial,omitempty"`
+	// Fingerprints are the SHA-256 fingerprints of the certificates
+	// involved, by role: certificate for issued ones, original_ca, new_ca
+	// and server_certificate for compatibility runs.
+	Fingerprints map[string]string `json:"fingerprints,omitempty"`
+	Tests        []webhookTest     `json:"tests,omitempty"`
+}
+
+// webhookTest is the outcome of a client test of a compatibility run.
+type webhookTest struct {
+	CA     string `json:"ca"`
+	Client string `json:"client"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// registerWebhook registers the -webhook-url flag.
+func registerWebhook(fs *flag.FlagSet) {
+	fs.StringVar(&webhookURL, "webhook-url", "", "POST a JSON event to this URL for every regenerated, issued and re-signed certificate and every completed compatibility run, e.g. for chatops or ticketing")
+}
+
+// notifyCertificate notifies the webhook of a certificate just signed.
+func notifyCertificate(event string, cert *x509.Certificate) {
+	notifyWebhook(webhookEvent{
+		Operation:    event,
+		Result:       "success",
+		Subject:      cert.Subject.String(),
+		Serial:       x509util.FormatHex(cert.SerialNumber.Bytes()),
+		Fingerprints: map[string]string{"certificate": sha256Hex(cert)},
+	})
+}
+
+// notifyCompatibilityRun notifies the webhook of the results of a
+// compatibility run. It fails if any client test failed.
+func notifyCompatibilityRun(setup *caSetup, results []compatResult) {
+	event := webhookEvent{
+		Operation: "compatibility-test",
+		Result:    "success",
+		Subject:   setup.newCA.Subject.String(),
+		Fingerprints: map[string]string{
+			"original_ca":        sha256Hex(setup.originalCA),
+			"new_ca":             sha256Hex(setup.newCA),
+			"server_certificate": sha256Hex(setup.serverCert),
+		},
+	}
+	failed := 0
+	for _, r := range results {
+		test := webhookTest{CA: r.CA, Client: r.Client, Result: "success"}
+		if r.Err != nil {
+			test.Result, test.Error = "failure", r.Err.Error()
+			failed++
+		}
+		event.Tests = append(event.Tests, test)
+	}
+	if failed > 0 {
+		event.Result = "failure"
+		event.Error = fmt.Sprintf("%d of %d client tests failed", failed, len(results))
+	}
+	notifyWebhook(event)
+}
+
+// notifyWebhook POSTs event to the webhook. A failing webhook is logged
+// but does not fail the operation, which already happened.
+func notifyWebhook(event webhookEvent) {
+	if webhookURL == "" {
+		return
+	}
+	event.Time = now.Now().UTC().Format(time.RFC3339)
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Warn("Failed to encode webhook event", "error", err)
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Failed to notify webhook", "operation", event.Operation, "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		slog.Warn("Webhook rejected event", "operation", event.Operation, "status", resp.Status, "response", strings.TrimSpace(string(data)))
+		return
+	}
+	slog.Debug("Notified webhook", "operation", event.Operation, "result", event.Result)
+}
+
+func sha256Hex(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
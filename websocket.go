@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Minimal RFC 6455 WebSocket support: just enough to perform the opening
+// handshake over TLS and exchange a single text message, which is all the
+// compatibility test needs.
+
+const (
+	webSocketPath = "/ws"
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	webSocketOpText  = 0x1
+	webSocketOpClose = 0x8
+)
+
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// handleWebSocket upgrades the connection and echoes text messages back
+// to the client until the connection is closed.
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, "expected WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket requires HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", webSocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	for {
+		opcode, payload, err := readWebSocketFrame(rw.Reader)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case webSocketOpText:
+			writeWebSocketFrame(conn, webSocketOpText, payload, false)
+		case webSocketOpClose:
+			writeWebSocketFrame(conn, webSocketOpClose, nil, false)
+			return
+		}
+	}
+}
+
+func testWebSocketCompatibility(ca *x509.Certificate) error {
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca)
+
+	network := testNetworks()[0]
+	rawConn, err := dialTest(context.Background(), &net.Dialer{Timeout: 10 * time.Second}, network)
+	if err != nil {
+		return fmt.Errorf("WebSocket connection failed: %w", err)
+	}
+	conn := tls.Client(rawConn, &tls.Config{
+		RootCAs:    caPool,
+		ServerName: testHostname(network),
+		Time:       now.Now,
+		NextProtos: []string{"http/1.1"},
+	})
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return fmt.Errorf("WebSocket TLS handshake failed: %w", err)
+	}
+	defer conn.Close()
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate WebSocket key: %w", err)
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", webSocketPath, testAddr(network), key)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read WebSocket handshake response: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("WebSocket upgrade rejected: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return fmt.Errorf("invalid Sec-WebSocket-Accept header")
+	}
+
+	const message = "Hello from the regenerated CA WebSocket client!"
+	if err := writeWebSocketFrame(conn, webSocketOpText, []byte(message), true); err != nil {
+		return fmt.Errorf("failed to send WebSocket message: %w", err)
+	}
+
+	opcode, payload, err := readWebSocketFrame(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read WebSocket message: %w", err)
+	}
+	if opcode != webSocketOpText || string(payload) != message {
+		return fmt.Errorf("unexpected WebSocket reply (opcode %d): %q", opcode, payload)
+	}
+
+	writeWebSocketFrame(conn, webSocketOpClose, nil, true)
+
+	slog.Info("WebSocket echo received", "reply", string(payload))
+
+	return nil
+}
+
+// readWebSocketFrame reads a single, unfragmented frame and unmasks its
+// payload if necessary.
+func readWebSocketFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[0]&0x80 == 0 {
+		return 0, nil, fmt.Errorf("fragmented WebSocket frames are not supported")
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > 1<<20 {
+		return 0, nil, fmt.Errorf("WebSocket frame too large (%d bytes)", length)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return opcode, payload, nil
+}
+
+// writeWebSocketFrame writes a single final frame. Clients must mask the
+// frames they send, servers must not.
+func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte, mask bool) error {
+	frame := []byte{0x80 | opcode}
+
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if mask {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		frame = append(frame, key[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^key[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := w.Write(frame)
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Reads a CA identity from a Windows certificate store and publishes the
+// regenerated CA to the Root store (self-signed CAs) or the Intermediate
+// store (CAs issued by another CA) of the local machine, e.g. for the CA
+// of an AD CS hierarchy. Like the keychain mode it shells out, to certutil
+// for the store and to openssl for the exported PFX, which Go cannot parse.
+func runWindowsStore(args []string) {
+	fs := flag.NewFlagSet("windows-store", flag.ContinueOnError)
+	identity := fs.String("identity", "", "Certificate in the store: common name, serial number or SHA-1 thumbprint, as understood by certutil")
+	store := fs.String("store", "My", "Store holding the CA identity with its private key")
+	user := fs.Bool("user", false, "Use the stores of the current user instead of the local machine")
+	publish := fs.Bool("publish", false, "Add the regenerated CA to the Root or Intermediate store")
+	replace := fs.Bool("replace", false, "Delete the original CA certificate from the store it is published to")
+	dryRun := fs.Bool("dry-run", false, "Only show what would be changed")
+	var caOpts caOptions
+	registerAudit(fs)
+	registerWebhook(fs)
+	registerCertDB(fs)
+	registerSerials(fs)
+	var logOpts logOptions
+	logOpts.register(fs)
+	parseFlags(fs, args)
+	logOpts.setup()
+
+	if *identity == "" || (*replace && !*publish) {
+		usageError("go run *.go windows-store -identity <name|serial|thumbprint> [-store My] [-user] [-publish [-replace]] [-dry-run]")
+	}
+	if runtime.GOOS != "windows" {
+		exitWith(exitFailure, "Windows certificate stores are only available on Windows", "os", runtime.GOOS)
+	}
+	var scope []string
+	if *user {
+		scope = []string{"-user"}
+	}
+
+	identityPEM, err := exportWindowsIdentity(scope, *store, *identity)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to read CA from certificate store", "store", *store, "identity", *identity, "error", err)
+	}
+	originalCA, caKey, _, err := parseCA(identityPEM, identityPEM)
+	if err != nil {
+		exitWith(exitInvalidCA, "Failed to load CA", "error", err)
+	}
+	slog.Info("Loaded original CA certificate and key from certificate store", "store", *store, "subject", originalCA.Subject.String())
+
+	if err := checkOriginalCABasicConstraints(originalCA); err != nil {
+		exitWith(exitInvalidCA, "Original CA validation failed", "error", err)
+	}
+	newCA, err := caOpts.regenerate(originalCA, caKey)
+	if err != nil {
+		exitWith(exitRegenerationFailed, "Failed to generate new CA", "error", err)
+	}
+	slog.Info("Generated new CA with critical basic constraints")
+
+	if err := saveCAToFile(newCA, "new-ca.pem"); err != nil {
+		exitWith(exitFailure, "Failed to save new CA to file", "error", err)
+	}
+	slog.Info("Saved new CA for inspection", "file", "new-ca.pem")
+
+	if !*publish {
+		return
+	}
+	// certutil calls the Intermediate Certification Authorities store CA
+	target := "Root"
+	if !isSelfSigned(newCA) {
+		target = "CA"
+	}
+	if *dryRun {
+		slog.Info("Dry run: would publish regenerated CA", "store", target, "user", *user, "delete_original", *replace)
+		return
+	}
+
+	if _, err := runCertutil(append(scope, "-addstore", "-f", target, "new-ca.pem")...); err != nil {
+		exitWith(exitFailure, "Failed to publish regenerated CA", "store", target, "error", err)
+	}
+	slog.Info("Published regenerated CA", "store", target, "user", *user)
+
+	if *replace {
+		// The thumbprint only matches the original, the serial would match
+		// the regenerated CA as well
+		thumbprint := sha1Thumbprint(originalCA)
+		if _, err := runCertutil(append(scope, "-delstore", target, thumbprint)...); err != nil {
+			exitWith(exitFailure, "Failed to delete original CA", "store", target, "error", err)
+		}
+		slog.Info("Deleted original CA certificate", "store", target, "sha1", thumbprint)
+	}
+}
+
+// exportWindowsIdentity exports the identity with its private key as PFX
+// protected by a random password and returns it as PEM. The key must have
+// been marked exportable when it was imported or created.
+func exportWindowsIdentity(scope []string, store, identity string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "ca-regen-certstore")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	password := make([]byte, 16)
+	if _, err := rand.Read(password); err != nil {
+		return nil, err
+	}
+	pfxFile := filepath.Join(dir, "identity.pfx")
+	args := append(scope, "-exportPFX", "-p", hex.EncodeToString(password), store, identity, pfxFile)
+	if _, err := runCertutil(args...); err != nil {
+		return nil, err
+	}
+	return pkcs12ToPEM(pfxFile, hex.EncodeToString(password))
+}
+
+// runCertutil runs certutil and returns its output. certutil reports
+// errors on stdout, so the error includes all of its output.
+func runCertutil(args ...string) ([]byte, error) {
+	slog.Debug("Running certutil", "args", strings.Join(args, " "))
+	var out bytes.Buffer
+	cmd := exec.Command("certutil", args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("certutil failed: %w: %s", err, strings.TrimSpace(out.String()))
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/databus23/ca-regen/caregen"
+)
+
+// yubiKeyPIVSlots maps the PIV slots to the CKA_ID of their keys in
+// Yubico's PKCS#11 module (ykcs11).
+var yubiKeyPIVSlots = map[string]string{
+	"9a": "01", // Authentication
+	"9c": "02", // Digital Signature
+	"9d": "03", // Key Management
+	"9e": "04", // Card Authentication
+}
+
+// yubiKeyModules are the usual install locations of ykcs11.
+var yubiKeyModules = []string{
+	"/usr/lib/x86_64-linux-gnu/libykcs11.so",
+	"/usr/lib/aarch64-linux-gnu/libykcs11.so",
+	"/usr/lib64/libykcs11.so",
+	"/usr/lib/libykcs11.so",
+	"/usr/local/lib/libykcs11.so",
+	"/usr/local/lib/libykcs11.dylib",
+	"/opt/homebrew/lib/libykcs11.dylib",
+}
+
+func init() {
+	caregen.RegisterSignerBackend(func() caregen.SignerBackend { return &yubiKeyOptions{} })
+}
+
+// yubiKeyOptions selects a CA key stored in a PIV slot of a YubiKey.
+type yubiKeyOptions struct {
+	slot   string
+	pin    string
+	module string
+	touch  bool
+	// flags is used to look up -pkcs11-tool of the PKCS#11 backend.
+	flags *flag.FlagSet
+}
+
+func (o *yubiKeyOptions) Register(fs *flag.FlagSet) {
+	o.flags = fs
+	fs.StringVar(&o.slot, "yubikey-slot", "", "Sign with the key in this YubiKey PIV slot (usually 9c) instead of a CA key file")
+	fs.StringVar(&o.pin, "yubikey-pin", "", "PIV PIN of the YubiKey (default: prompt)")
+	fs.StringVar(&o.module, "yubikey-module", "", "Path to Yubico's PKCS#11 module libykcs11 (default: search the usual locations)")
+	fs.BoolVar(&o.touch, "yubikey-touch", false, "The key has a touch policy, prompt to touch the YubiKey before each signature")
+}
+
+func (o *yubiKeyOptions) Selected() bool {
+	return o.slot != ""
+}
+
+// Signer returns a signer for the key in the configured slot. YubiKeys
+// are accessed through ykcs11 with the PKCS#11 backend. A PIN policy of
+// "always" is handled by pkcs11-tool, which logs in for each signature.
+func (o *yubiKeyOptions) Signer() (crypto.Signer, error) {
+	id, ok := yubiKeyPIVSlots[strings.ToLower(o.slot)]
+	if !ok {
+		return nil, fmt.Errorf("unknown PIV slot %q, use 9a, 9c, 9d or 9e", o.slot)
+	}
+
+	module := o.module
+	if module == "" {
+		for _, candidate := range yubiKeyModules {
+			if _, err := os.Stat(candidate); err == nil {
+				module = candidate
+				break
+			}
+		}
+		if module == "" {
+			return nil, fmt.Errorf("libykcs11 not found, install yubico-piv-tool or use -yubikey-module")
+		}
+	}
+
+	tool := "pkcs11-tool"
+	if f := o.flags.Lookup("pkcs11-tool"); f != nil {
+		tool = f.Value.String()
+	}
+	pkcs11 := pkcs11Options{module: module, pin: o.pin, keyID: id, tool: tool}
+	signer, err := pkcs11.open()
+	if err != nil {
+		return nil, err
+	}
+	if o.touch {
+		signer.beforeSign = func() {
+			slog.Warn("Touch the YubiKey to confirm the signature", "slot", o.slot)
+		}
+	}
+	return signer, nil
+}